@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Aviso es un mensaje para un cliente ya redactado
+type Aviso struct {
+	Destino string `json:"destino"` // email o teléfono, según el canal
+	Asunto  string `json:"asunto"`
+	Cuerpo  string `json:"cuerpo"`
+}
+
+// Notificador envía avisos a los clientes por un canal
+type Notificador interface {
+	Canal() string // "email" o "sms": decide qué dato del cliente es el destino
+	Enviar(a Aviso) error
+}
+
+// NotificadorSMTP envía los avisos por correo a través de un servidor SMTP
+type NotificadorSMTP struct {
+	Servidor  string // host:puerto
+	Remitente string
+	Usuario   string // "" = sin autenticación
+	Clave     string
+}
+
+func (n *NotificadorSMTP) Canal() string { return "email" }
+
+// Enviar manda el aviso como un correo de texto en UTF-8
+func (n *NotificadorSMTP) Enviar(a Aviso) error {
+	var auth smtp.Auth
+	if n.Usuario != "" {
+		host, _, _ := net.SplitHostPort(n.Servidor)
+		auth = smtp.PlainAuth("", n.Usuario, n.Clave, host)
+	}
+	var correo bytes.Buffer
+	fmt.Fprintf(&correo, "From: %s\r\n", n.Remitente)
+	fmt.Fprintf(&correo, "To: %s\r\n", a.Destino)
+	fmt.Fprintf(&correo, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", a.Asunto))
+	fmt.Fprintf(&correo, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	correo.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+	correo.WriteString(strings.ReplaceAll(a.Cuerpo, "\n", "\r\n"))
+	correo.WriteString("\r\n")
+	return smtp.SendMail(n.Servidor, auth, n.Remitente, []string{a.Destino}, correo.Bytes())
+}
+
+// NotificadorSMS hace de pasarela de SMS: deja cada mensaje en un fichero
+// del directorio de salida, de donde lo recogería el proveedor
+type NotificadorSMS struct {
+	Directorio string
+
+	mu sync.Mutex
+	n  int
+}
+
+func (n *NotificadorSMS) Canal() string { return "sms" }
+
+// Enviar escribe el mensaje en un fichero nuevo del directorio de salida
+func (n *NotificadorSMS) Enviar(a Aviso) error {
+	if err := os.MkdirAll(n.Directorio, 0755); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	n.n++
+	nombre := fmt.Sprintf("sms-%s-%04d.txt", time.Now().UTC().Format("20060102T150405.000"), n.n)
+	n.mu.Unlock()
+	texto := fmt.Sprintf("Para: %s\n\n%s\n", a.Destino, a.Cuerpo)
+	return escribirAtomico(filepath.Join(n.Directorio, nombre), []byte(texto))
+}
+
+// PlantillaAviso es el texto de un aviso; Asunto y Cuerpo son plantillas de
+// text/template que reciben un DatosAviso
+type PlantillaAviso struct {
+	Asunto string
+	Cuerpo string
+}
+
+// DatosAviso son los datos con los que se rellenan las plantillas
+type DatosAviso struct {
+	Nombre       string
+	Matricula    string
+	Marca        string
+	Modelo       string
+	IDIncidencia int
+	Tipo         string
+	Descripcion  string
+	Fecha        string
+}
+
+// PlantillasAvisos son los avisos que se envían, por estado de la incidencia
+// o "salida" cuando el vehículo sale del taller
+var PlantillasAvisos = map[string]PlantillaAviso{
+	"abierta": {
+		Asunto: "Hemos recibido su vehículo {{.Matricula}}",
+		Cuerpo: "Hola, {{.Nombre}}:\n\nHemos registrado la incidencia {{.IDIncidencia}} ({{.Tipo}}) de su {{.Marca}} {{.Modelo}} con matrícula {{.Matricula}}. " +
+			"Le avisaremos en cuanto empecemos a repararlo.\n\nTaller",
+	},
+	"en proceso": {
+		Asunto: "Estamos reparando su vehículo {{.Matricula}}",
+		Cuerpo: "Hola, {{.Nombre}}:\n\nUn mecánico ya está trabajando en su {{.Marca}} {{.Modelo}} ({{.Matricula}}). " +
+			"Le avisaremos cuando esté listo.\n\nTaller",
+	},
+	"cerrada": {
+		Asunto: "Su vehículo {{.Matricula}} está listo",
+		Cuerpo: "Hola, {{.Nombre}}:\n\nHemos terminado la reparación de su {{.Marca}} {{.Modelo}} ({{.Matricula}}). " +
+			"Ya puede pasar a recogerlo.\n\nTaller",
+	},
+	"salida": {
+		Asunto: "Su vehículo {{.Matricula}} ha salido del taller",
+		Cuerpo: "Hola, {{.Nombre}}:\n\nSu vehículo con matrícula {{.Matricula}} ha salido del taller el {{.Fecha}}. " +
+			"Gracias por su confianza.\n\nTaller",
+	},
+}
+
+// redactarAviso rellena la plantilla indicada
+func redactarAviso(plantilla string, d DatosAviso) (asunto, cuerpo string, err error) {
+	p, ok := PlantillasAvisos[plantilla]
+	if !ok {
+		return "", "", fmt.Errorf("no hay plantilla para %q", plantilla)
+	}
+	rellenar := func(texto string) (string, error) {
+		t, err := template.New(plantilla).Parse(texto)
+		if err != nil {
+			return "", err
+		}
+		var b strings.Builder
+		if err := t.Execute(&b, d); err != nil {
+			return "", err
+		}
+		return b.String(), nil
+	}
+	if asunto, err = rellenar(p.Asunto); err != nil {
+		return
+	}
+	cuerpo, err = rellenar(p.Cuerpo)
+	return
+}
+
+// EntregaAviso es una línea del registro de entregas: un intento de enviar
+// un aviso y su resultado
+type EntregaAviso struct {
+	Fecha   string `json:"fecha"`
+	Canal   string `json:"canal"`
+	Destino string `json:"destino"`
+	Asunto  string `json:"asunto"`
+	Intento int    `json:"intento"`
+	Estado  string `json:"estado"` // "enviado", "reintento" o "fallido"
+	Error   string `json:"error,omitempty"`
+}
+
+// Avisos envía a los clientes un aviso cuando su incidencia cambia de estado
+// y cuando su vehículo sale del taller. Con cada evento del bus redacta el
+// aviso con los datos del taller en ese momento (aunque el vehículo se
+// elimine justo después) y lo pasa a cada notificador para el que el cliente
+// tiene destino. Cada canal tiene su cola, así que los avisos de
+// un canal llegan en orden. Un envío que falla se reintenta hasta Intentos
+// veces, doblando la espera cada vez, salvo que el error sea permanente (un
+// 5xx de SMTP). Cada intento queda en el registro de entregas.
+type Avisos struct {
+	Intentos int
+	Espera   time.Duration // espera antes del primer reintento
+	// Reloj del que se toma la hora del registro (nil = hora del sistema)
+	Reloj *RelojFisico
+
+	taller        *Taller
+	bus           *BusEventos
+	notificadores []Notificador
+	ruta          string // registro de entregas en JSON por líneas ("" = solo en memoria)
+
+	mu        sync.Mutex
+	recientes []EntregaAviso
+	enviados  int
+	fallidos  int
+	colas     map[string]chan Aviso
+	baja      func()
+	parar     chan struct{}
+	wg        sync.WaitGroup
+}
+
+// NuevoAvisos crea el servicio de avisos del taller, que escuchará los
+// eventos de bus y enviará por los notificadores indicados
+func NuevoAvisos(t *Taller, bus *BusEventos, ruta string, notificadores ...Notificador) *Avisos {
+	return &Avisos{
+		Intentos:      5,
+		Espera:        time.Second,
+		taller:        t,
+		bus:           bus,
+		notificadores: notificadores,
+		ruta:          ruta,
+		colas:         map[string]chan Aviso{},
+		parar:         make(chan struct{}),
+	}
+}
+
+// Iniciar empieza a escuchar los eventos y a enviar avisos
+func (a *Avisos) Iniciar() {
+	for _, n := range a.notificadores {
+		cola := make(chan Aviso, 100)
+		a.colas[n.Canal()] = cola
+		a.wg.Add(1)
+		go a.repartir(n, cola)
+	}
+	a.baja = a.bus.AlPublicar(a.preparar)
+}
+
+// Detener deja de escuchar eventos y abandona los avisos pendientes
+func (a *Avisos) Detener() {
+	a.baja()
+	close(a.parar)
+	a.wg.Wait()
+}
+
+// Registro devuelve las últimas entregas, de la más antigua a la más reciente
+func (a *Avisos) Registro() []EntregaAviso {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]EntregaAviso(nil), a.recientes...)
+}
+
+// Estado resume los avisos para mostrarlos por consola
+func (a *Avisos) Estado() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var canales []string
+	for canal := range a.colas {
+		canales = append(canales, canal)
+	}
+	sort.Strings(canales)
+	return fmt.Sprintf("Avisos | Canales:%s | Enviados:%d | Fallidos:%d", strings.Join(canales, ","), a.enviados, a.fallidos)
+}
+
+// preparar redacta y encola los avisos de un evento; se llama al publicarlo,
+// con el cerrojo del taller tomado
+func (a *Avisos) preparar(e Evento) {
+	plantilla := e.Estado
+	switch e.Tema {
+	case TemaSalidaVehiculo:
+		plantilla = "salida"
+	case TemaEstadoIncidencia:
+	default:
+		return
+	}
+	if _, ok := PlantillasAvisos[plantilla]; !ok {
+		return
+	}
+	cliente, datos, ok := a.datosDe(e)
+	if !ok {
+		return
+	}
+	asunto, cuerpo, err := redactarAviso(plantilla, datos)
+	if err != nil {
+		fmt.Println("Aviso: no se pudo redactar el aviso:", err)
+		return
+	}
+	for canal, cola := range a.colas {
+		destino := cliente.Email
+		if canal == "sms" {
+			destino = cliente.Telefono
+		}
+		if destino == "" {
+			continue
+		}
+		aviso := Aviso{Destino: destino, Asunto: asunto, Cuerpo: cuerpo}
+		select {
+		case cola <- aviso:
+		default:
+			a.anotar(canal, aviso, 0, "fallido", errors.New("cola de envío llena"))
+		}
+	}
+}
+
+// datosDe busca en el taller el cliente y los datos del aviso de un evento;
+// se llama con el cerrojo del taller tomado
+func (a *Avisos) datosDe(e Evento) (Cliente, DatosAviso, bool) {
+	d := DatosAviso{Fecha: e.Fecha, Matricula: e.Matricula}
+	if e.Tema == TemaSalidaVehiculo {
+		c, _ := a.taller.BuscarCliente(e.IDCliente)
+		if c == nil {
+			return Cliente{}, d, false
+		}
+		d.Nombre = c.Nombre
+		return *c, d, true
+	}
+	for _, c := range a.taller.ClientesTaller {
+		for _, v := range c.Vehiculos {
+			if inc := v.GetIncidencia(); inc != nil && inc.IDIncidencia == e.IDIncidencia {
+				d.Nombre, d.Matricula, d.Marca, d.Modelo = c.Nombre, v.Matricula, v.Marca, v.Modelo
+				d.IDIncidencia, d.Tipo, d.Descripcion = inc.IDIncidencia, inc.Tipo, inc.Descripcion
+				return *c, d, true
+			}
+		}
+	}
+	return Cliente{}, d, false
+}
+
+// repartir envía los avisos de un canal por orden, con reintentos
+func (a *Avisos) repartir(n Notificador, cola chan Aviso) {
+	defer a.wg.Done()
+	for {
+		var aviso Aviso
+		select {
+		case aviso = <-cola:
+		case <-a.parar:
+			return
+		}
+		espera := a.Espera
+		for intento := 1; ; intento++ {
+			err := n.Enviar(aviso)
+			if err == nil {
+				a.anotar(n.Canal(), aviso, intento, "enviado", nil)
+				break
+			}
+			if intento >= a.Intentos || errorPermanente(err) {
+				a.anotar(n.Canal(), aviso, intento, "fallido", err)
+				break
+			}
+			a.anotar(n.Canal(), aviso, intento, "reintento", err)
+			select {
+			case <-time.After(espera):
+			case <-a.parar:
+				return
+			}
+			espera *= 2
+		}
+	}
+}
+
+// errorPermanente indica si reintentar no servirá de nada (el servidor SMTP
+// ha rechazado el mensaje o el destinatario)
+func errorPermanente(err error) bool {
+	var e *textproto.Error
+	return errors.As(err, &e) && e.Code >= 500
+}
+
+// anotar guarda un intento de entrega en el registro
+func (a *Avisos) anotar(canal string, aviso Aviso, intento int, estado string, err error) {
+	entrega := EntregaAviso{Fecha: a.Reloj.Fecha(), Canal: canal, Destino: aviso.Destino,
+		Asunto: aviso.Asunto, Intento: intento, Estado: estado}
+	if err != nil {
+		entrega.Error = err.Error()
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch estado {
+	case "enviado":
+		a.enviados++
+	case "fallido":
+		a.fallidos++
+	}
+	a.recientes = append(a.recientes, entrega)
+	if len(a.recientes) > 100 {
+		a.recientes = a.recientes[1:]
+	}
+	if a.ruta == "" {
+		return
+	}
+	f, errF := os.OpenFile(a.ruta, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if errF != nil {
+		fmt.Println("Aviso: no se pudo abrir el registro de avisos:", errF)
+		return
+	}
+	defer f.Close()
+	json.NewEncoder(f).Encode(entrega)
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"mime"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// notificadorPrueba apunta los asuntos de los avisos que recibe
+type notificadorPrueba struct {
+	mu      sync.Mutex
+	asuntos []string
+}
+
+func (n *notificadorPrueba) Canal() string { return "email" }
+
+func (n *notificadorPrueba) Enviar(a Aviso) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.asuntos = append(n.asuntos, a.Asunto)
+	return nil
+}
+
+func (n *notificadorPrueba) recibidos() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]string(nil), n.asuntos...)
+}
+
+// TestAvisosSoloAlEjecutar comprueba que solo avisa la operación que este
+// nodo ejecuta con éxito: no la que le llega aplicada desde otra réplica, ni
+// las que repite al reabrir su registro, ni una que falla
+func TestAvisosSoloAlEjecutar(t *testing.T) {
+	anteriorApp, anteriorBus, anteriorReloj := app, bus, relojFisico
+	defer func() { app, bus, relojFisico = anteriorApp, anteriorBus, anteriorReloj }()
+	app, bus, relojFisico = Taller{}, NuevoBusEventos(), NuevoRelojFisico(0)
+
+	buzon := &notificadorPrueba{}
+	av := NuevoAvisos(&app, bus, "", buzon)
+	av.Iniciar()
+	defer av.Detener()
+
+	alta := []Operacion{
+		{Tipo: OpCrearMecanico, IDMecanico: 1, Nombre: "Laura", Especialidad: "mecánica"},
+		{Tipo: OpCrearCliente, IDCliente: 1, Nombre: "Ana", Email: "ana@ejemplo.es"},
+		{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "1234ABC"},
+		{Tipo: OpCrearIncidencia, Matricula: "1234ABC", IDIncidencia: 7, TipoIncidencia: "mecánica"},
+	}
+	for _, op := range alta {
+		if err := ejecutar(op); err != nil {
+			t.Fatalf("%s: %v", op.Tipo, err)
+		}
+	}
+
+	// Como un seguidor de Raft o un respaldo: la operación llega ya
+	// ejecutada en otro nodo
+	replicadas := []Operacion{
+		{Tipo: OpPresupuestar, Matricula: "1234ABC", Presupuesto: presupuestoDePrueba()},
+		{Tipo: OpResponderPresupuesto, Matricula: "1234ABC", Estado: PresupuestoAceptado},
+		{Tipo: OpEstadoIncidencia, Matricula: "1234ABC", Estado: "en proceso"},
+	}
+	mutexTaller.Lock()
+	for _, op := range replicadas {
+		if err := aplicarLocal(op); err != nil {
+			t.Fatalf("%s: %v", op.Tipo, err)
+		}
+	}
+	mutexTaller.Unlock()
+
+	// Al reabrir un registro se repiten todas sus operaciones
+	dir := t.TempDir()
+	var origen, repetido Taller
+	r, err := AbrirRegistro(dir, &origen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range append(append(append([]Operacion(nil), alta...), replicadas...),
+		Operacion{Tipo: OpEstadoIncidencia, Matricula: "1234ABC", Estado: "cerrada"}) {
+		if err := r.Ejecutar(&origen, op); err != nil {
+			t.Fatalf("%s: %v", op.Tipo, err)
+		}
+	}
+	r.f.Close()
+	if r, err = AbrirRegistro(dir, &repetido); err != nil {
+		t.Fatal(err)
+	}
+	r.f.Close()
+
+	if err := ejecutar(Operacion{Tipo: OpEstadoIncidencia, Matricula: "9999ZZZ", Estado: "cerrada"}); err == nil {
+		t.Fatal("cierra la incidencia de un vehículo que no existe")
+	}
+	if err := ejecutar(Operacion{Tipo: OpEstadoIncidencia, Matricula: "1234ABC", Estado: "cerrada"}); err != nil {
+		t.Fatal(err)
+	}
+
+	esperados := []string{"Hemos recibido su vehículo 1234ABC", "Su vehículo 1234ABC está listo"}
+	esperar(t, 5*time.Second, "llegan los avisos de las operaciones ejecutadas", func() bool {
+		return len(buzon.recibidos()) >= len(esperados)
+	})
+	time.Sleep(100 * time.Millisecond)
+	if got := buzon.recibidos(); strings.Join(got, "|") != strings.Join(esperados, "|") {
+		t.Fatalf("se envía %q en lugar de %q", got, esperados)
+	}
+}
+
+// servidorSMTPPrueba es un servidor SMTP mínimo que guarda los asuntos de
+// los correos recibidos. Responde 451 a los primeros fallos mensajes y
+// rechaza con 550 los destinatarios que empiezan por "rechazo".
+type servidorSMTPPrueba struct {
+	mu      sync.Mutex
+	fallos  int
+	asuntos []string
+	oyente  net.Listener
+}
+
+func (s *servidorSMTPPrueba) escuchar(direccion string) error {
+	oyente, err := net.Listen("tcp", direccion)
+	if err != nil {
+		return err
+	}
+	s.oyente = oyente
+	go func() {
+		for {
+			conn, err := oyente.Accept()
+			if err != nil {
+				return
+			}
+			go s.atender(conn)
+		}
+	}()
+	return nil
+}
+
+func (s *servidorSMTPPrueba) atender(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 taller-prueba ESMTP")
+	for {
+		linea, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		orden := strings.ToUpper(strings.Fields(linea + " ")[0])
+		switch orden {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250 taller-prueba")
+		case "MAIL", "NOOP", "RSET":
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			if strings.Contains(strings.ToLower(linea), "<rechazo") {
+				tp.PrintfLine("550 buzón inexistente")
+			} else {
+				tp.PrintfLine("250 OK")
+			}
+		case "DATA":
+			tp.PrintfLine("354 adelante")
+			datos, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			fallar := s.fallos > 0
+			if fallar {
+				s.fallos--
+			} else {
+				s.asuntos = append(s.asuntos, asuntoDe(datos))
+			}
+			s.mu.Unlock()
+			if fallar {
+				tp.PrintfLine("451 inténtelo más tarde")
+			} else {
+				tp.PrintfLine("250 recibido")
+			}
+		case "QUIT":
+			tp.PrintfLine("221 adiós")
+			return
+		default:
+			tp.PrintfLine("502 orden no admitida")
+		}
+	}
+}
+
+func (s *servidorSMTPPrueba) recibidos() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.asuntos...)
+}
+
+// asuntoDe saca y descodifica la cabecera Subject de un correo
+func asuntoDe(correo []byte) string {
+	lector := textproto.NewReader(bufio.NewReader(bytes.NewReader(correo)))
+	cabeceras, _ := lector.ReadMIMEHeader()
+	asunto, err := new(mime.WordDecoder).DecodeHeader(cabeceras.Get("Subject"))
+	if err != nil {
+		return cabeceras.Get("Subject")
+	}
+	return asunto
+}
+
+// TestAvisosSMTP recorre la reparación de un vehículo con un servidor SMTP
+// local que falla las dos primeras entregas y una salida de SMS a un
+// directorio, y comprueba que el cliente recibe los cuatro avisos por cada
+// canal y en orden, que los fallos se reintentan y que un destinatario
+// rechazado no se reintenta
+func TestAvisosSMTP(t *testing.T) {
+	anterior := bus
+	bus = NuevoBusEventos()
+	defer func() { bus = anterior }()
+	dir := t.TempDir()
+
+	smtpPrueba := &servidorSMTPPrueba{fallos: 2}
+	direccion := "localhost:9681"
+	if err := smtpPrueba.escuchar(direccion); err != nil {
+		t.Fatal(err)
+	}
+	defer smtpPrueba.oyente.Close()
+
+	var tl Taller
+	var cerrojo sync.Mutex
+	aplicar := func(op Operacion) {
+		cerrojo.Lock()
+		defer cerrojo.Unlock()
+		if err := tl.Aplicar(op); err != nil {
+			t.Fatalf("%s: %v", op.Tipo, err)
+		}
+		publicarEventos(bus, op.Fecha, tl.Eventos())
+	}
+	spool := filepath.Join(dir, "sms")
+	avisos := NuevoAvisos(&tl, bus, filepath.Join(dir, "avisos.log"),
+		&NotificadorSMTP{Servidor: direccion, Remitente: "taller@ejemplo.es"},
+		&NotificadorSMS{Directorio: spool})
+	avisos.Espera = 50 * time.Millisecond
+	avisos.Iniciar()
+	defer avisos.Detener()
+
+	ops := []Operacion{
+		{Tipo: OpCrearMecanico, IDMecanico: 1, Nombre: "Laura", Especialidad: "mecánica"},
+		{Tipo: OpCrearCliente, IDCliente: 1, Nombre: "Ana", Telefono: "600000001", Email: "ana@ejemplo.es"},
+		{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "1234ABC", Marca: "Seat", Modelo: "Ibiza"},
+		{Tipo: OpCrearIncidencia, Matricula: "1234ABC", IDIncidencia: 7, TipoIncidencia: "mecánica", Prioridad: "alta"},
+		{Tipo: OpPresupuestar, Matricula: "1234ABC", Presupuesto: presupuestoDePrueba()},
+		{Tipo: OpResponderPresupuesto, Matricula: "1234ABC", Estado: PresupuestoAceptado},
+		{Tipo: OpEstadoIncidencia, Matricula: "1234ABC", Estado: "en proceso"},
+		{Tipo: OpEstadoIncidencia, Matricula: "1234ABC", Estado: "cerrada", Fecha: "2026-01-01T10:00:00.000Z"},
+		{Tipo: OpEliminarVehiculo, Matricula: "1234ABC", Fecha: "2026-01-01T12:00:00.000Z"},
+		// Un cliente sin teléfono cuyo buzón no existe
+		{Tipo: OpCrearCliente, IDCliente: 2, Nombre: "Luis", Email: "rechazo@ejemplo.es"},
+		{Tipo: OpCrearVehiculo, IDCliente: 2, Matricula: "5678DEF"},
+		{Tipo: OpCrearIncidencia, Matricula: "5678DEF", IDIncidencia: 8, TipoIncidencia: "eléctrica", Prioridad: "baja"},
+	}
+	for _, op := range ops {
+		aplicar(op)
+	}
+	esperados := []string{
+		"Hemos recibido su vehículo 1234ABC",
+		"Estamos reparando su vehículo 1234ABC",
+		"Su vehículo 1234ABC está listo",
+		"Su vehículo 1234ABC ha salido del taller",
+	}
+	limite := time.Now().Add(10 * time.Second)
+	for len(smtpPrueba.recibidos()) < len(esperados) {
+		if time.Now().After(limite) {
+			t.Fatalf("el servidor SMTP solo ha recibido %q", smtpPrueba.recibidos())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if got := smtpPrueba.recibidos(); strings.Join(got, "|") != strings.Join(esperados, "|") {
+		t.Fatalf("el servidor SMTP ha recibido %q en lugar de %q", got, esperados)
+	}
+
+	var sms []os.DirEntry
+	for {
+		sms, _ = os.ReadDir(spool)
+		if len(sms) == len(esperados) {
+			break
+		}
+		if time.Now().After(limite) {
+			t.Fatalf("hay %d SMS en la salida en lugar de %d", len(sms), len(esperados))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	ultimo, err := os.ReadFile(filepath.Join(spool, sms[len(sms)-1].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(ultimo), "Para: 600000001") || !strings.Contains(string(ultimo), "2026-01-01T12:00:00.000Z") {
+		t.Fatalf("SMS inesperado:\n%s", ultimo)
+	}
+
+	var reintentos, rechazados int
+	for time.Now().Before(limite) {
+		reintentos, rechazados = 0, 0
+		for _, e := range avisos.Registro() {
+			if e.Estado == "reintento" {
+				reintentos++
+			}
+			if e.Estado == "fallido" && e.Destino == "rechazo@ejemplo.es" {
+				rechazados++
+				if e.Intento != 1 {
+					t.Fatalf("un destinatario rechazado se ha intentado %d veces", e.Intento)
+				}
+			}
+		}
+		if rechazados > 0 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if reintentos != 2 || rechazados != 1 {
+		t.Fatalf("se esperaban 2 reintentos y 1 rechazo en el registro; hay %d y %d", reintentos, rechazados)
+	}
+	// El registro en disco recoge al menos lo que ya se ve en memoria
+	enMemoria := len(avisos.Registro())
+	registro, err := os.ReadFile(filepath.Join(dir, "avisos.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lineas := strings.Count(string(registro), "\n"); lineas < enMemoria {
+		t.Errorf("el registro de entregas tiene %d líneas y en memoria hay %d", lineas, enMemoria)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Estados de una cita
+const (
+	CitaPendiente = "pendiente"
+	CitaAtendida  = "atendida" // el vehículo llegó y ocupa una plaza
+	CitaCancelada = "cancelada"
+)
+
+// HorasCita son las franjas del día en las que se puede pedir cita. Cada
+// cita ocupa una plaza durante su franja.
+var HorasCita = []string{"09:00", "10:00", "11:00", "12:00", "13:00", "16:00", "17:00", "18:00"}
+
+// Cita es la reserva de una plaza para un vehículo en un día y una franja.
+// Especialidad es la del trabajo que necesita.
+type Cita struct {
+	IDCita       int    `json:"idCita"`
+	IDCliente    int    `json:"idCliente"`
+	Matricula    string `json:"matricula"`
+	Dia          string `json:"dia"`  // AAAA-MM-DD
+	Hora         string `json:"hora"` // una de HorasCita
+	Especialidad string `json:"especialidad"`
+	Motivo       string `json:"motivo,omitempty"`
+	Estado       string `json:"estado"`
+	IDPlaza      int    `json:"idPlaza,omitempty"` // la que ocupó al llegar
+}
+
+// BuscarCita devuelve la cita con ese ID (nil si no existe)
+func (t *Taller) BuscarCita(id int) *Cita {
+	for _, c := range t.Citas {
+		if c.IDCita == id {
+			return c
+		}
+	}
+	return nil
+}
+
+// CapacidadFranja devuelve cuántos vehículos más caben en una franja: en
+// total, lo que aún pueden atender los mecánicos activos y de turno (2
+// plazas por mecánico, menos las que ya ocupan o tienen reservadas) sin
+// pasar de las plazas libres del taller, y de una especialidad, lo mismo
+// contando solo a sus mecánicos. Los vehículos que están ahora en el
+// taller siguen en él mientras no salgan, así que cuentan en cualquier
+// franja.
+func (t *Taller) CapacidadFranja(dia, hora, especialidad string) (total, deEspecialidad int) {
+	libres := 0
+	enUso := map[*Mecanico]int{}
+	for _, p := range t.PlazasTaller {
+		if p.EstaLibre() {
+			libres++
+		} else if p.GetMecanico() != nil {
+			enUso[p.GetMecanico()]++
+		}
+	}
+	for _, m := range t.MecanicosTaller {
+		if !m.Activo || !m.TrabajaEl(dia, hora) {
+			continue
+		}
+		quedan := max(2-enUso[m], 0)
+		total += quedan
+		if m.Especialidad == especialidad {
+			deEspecialidad += quedan
+		}
+	}
+	return min(total, libres), min(deEspecialidad, libres)
+}
+
+// HuecosFranja devuelve cuántas citas más admite la franja para esa
+// especialidad. Las citas atendidas no se restan: su vehículo ya ocupa una
+// plaza y CapacidadFranja lo tiene en cuenta.
+func (t *Taller) HuecosFranja(dia, hora, especialidad string) int {
+	total, deEsp := t.CapacidadFranja(dia, hora, especialidad)
+	for _, c := range t.CitasDelDia(dia) {
+		if c.Hora != hora || c.Estado != CitaPendiente {
+			continue
+		}
+		total--
+		if c.Especialidad == especialidad {
+			deEsp--
+		}
+	}
+	return max(min(total, deEsp), 0)
+}
+
+// CitasPendientesEn cuenta las citas pendientes de la franja en la que cae
+// un momento (FormatoFecha), salvo las del vehículo indicado: son las plazas
+// libres que no puede ocupar un vehículo que llega sin cita
+func (t *Taller) CitasPendientesEn(fecha, matricula string) int {
+	momento, err := time.Parse(FormatoFecha, fecha)
+	if err != nil {
+		return 0
+	}
+	momento = momento.In(ZonaTaller)
+	dia, hora := momento.Format("2006-01-02"), momento.Format("15")+":00"
+	n := 0
+	for _, c := range t.CitasDelDia(dia) {
+		if c.Hora == hora && c.Estado == CitaPendiente && c.Matricula != matricula {
+			n++
+		}
+	}
+	return n
+}
+
+// CitasDelDia devuelve las citas de un día ordenadas por franja
+func (t *Taller) CitasDelDia(dia string) []*Cita {
+	var out []*Cita
+	for _, c := range t.Citas {
+		if c.Dia == dia {
+			out = append(out, c)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Hora < out[j].Hora })
+	return out
+}
+
+// ProximasCitas devuelve las citas pendientes desde el día indicado durante
+// n días, agrupadas por día
+func (t *Taller) ProximasCitas(desde string, n int) map[string][]*Cita {
+	inicio, err := time.Parse("2006-01-02", desde)
+	if err != nil {
+		return nil
+	}
+	out := map[string][]*Cita{}
+	for i := 0; i < n; i++ {
+		dia := inicio.AddDate(0, 0, i).Format("2006-01-02")
+		for _, c := range t.CitasDelDia(dia) {
+			if c.Estado == CitaPendiente {
+				out[dia] = append(out[dia], c)
+			}
+		}
+	}
+	return out
+}
+
+// anularCitas cancela las citas pendientes de un vehículo que deja el taller
+func (t *Taller) anularCitas(matricula string) {
+	for _, c := range t.Citas {
+		if c.Matricula == matricula && c.Estado == CitaPendiente {
+			c.Estado = CitaCancelada
+		}
+	}
+}
+
+// pedirCita aplica OpPedirCita: reserva una plaza en la franja si caben más
+// vehículos en ella, en total y de esa especialidad
+func (t *Taller) pedirCita(op Operacion) error {
+	if op.Cita == nil {
+		return errors.New("falta la cita")
+	}
+	c := *op.Cita
+	if t.BuscarCita(c.IDCita) != nil {
+		return errors.New("ya existe una cita con ese ID")
+	}
+	if _, err := time.Parse("2006-01-02", c.Dia); err != nil {
+		return fmt.Errorf("día no válido: %q", c.Dia)
+	}
+	franja := false
+	for _, h := range HorasCita {
+		franja = franja || h == c.Hora
+	}
+	if !franja {
+		return fmt.Errorf("no hay citas a las %s", c.Hora)
+	}
+	cli, v := t.BuscarVehiculo(c.Matricula)
+	if v == nil {
+		return errors.New("vehículo no encontrado")
+	}
+	for _, otra := range t.Citas {
+		if otra.Matricula == c.Matricula && otra.Estado == CitaPendiente {
+			return fmt.Errorf("el vehículo ya tiene cita el %s a las %s", otra.Dia, otra.Hora)
+		}
+	}
+	if t.HuecosFranja(c.Dia, c.Hora, c.Especialidad) == 0 {
+		return fmt.Errorf("no quedan plazas de %s el %s a las %s", c.Especialidad, c.Dia, c.Hora)
+	}
+	c.IDCliente, c.Estado, c.IDPlaza = cli.IDCliente, CitaPendiente, 0
+	t.Citas = append(t.Citas, &c)
+	return nil
+}
+
+// llegadaCita aplica OpLlegadaCita: el vehículo llega a su cita, se le abre
+// la incidencia si no tiene (con op.IDIncidencia) y ocupa una plaza libre
+// con un mecánico de la especialidad: op.IDMecanico, que debe ser de ella y
+// estar de turno, o si no se indica el primero que lo esté
+func (t *Taller) llegadaCita(op Operacion) error {
+	c := t.BuscarCita(op.IDCita)
+	if c == nil {
+		return errors.New("cita no encontrada")
+	}
+	if c.Estado != CitaPendiente {
+		return fmt.Errorf("la cita está %s", c.Estado)
+	}
+	_, v := t.BuscarVehiculo(c.Matricula)
+	if v == nil {
+		return errors.New("el vehículo de la cita ya no está registrado")
+	}
+	var mec *Mecanico
+	if op.IDMecanico != 0 {
+		mec, _ = t.BuscarMecanico(op.IDMecanico)
+		if mec == nil {
+			return errors.New("no existe ese mecánico")
+		}
+		if mec.Especialidad != c.Especialidad {
+			return fmt.Errorf("%s no es de %s", mec.Nombre, c.Especialidad)
+		}
+		if !mec.DisponibleEn(op.Fecha) {
+			return fmt.Errorf("%s no está disponible ni de turno", mec.Nombre)
+		}
+	} else {
+		for _, m := range t.MecanicosTaller {
+			if m.DisponibleEn(op.Fecha) && m.Especialidad == c.Especialidad {
+				mec = m
+				break
+			}
+		}
+		if mec == nil {
+			return fmt.Errorf("no hay mecánicos de %s disponibles", c.Especialidad)
+		}
+	}
+	var plaza *Plaza
+	for _, p := range t.PlazasTaller {
+		if p.EstaLibre() {
+			plaza = p
+			break
+		}
+	}
+	if plaza == nil {
+		return errors.New("no hay plazas libres")
+	}
+	if v.GetIncidencia() == nil && op.IDIncidencia != 0 {
+		alta := Operacion{Tipo: OpCrearIncidencia, Matricula: c.Matricula, IDIncidencia: op.IDIncidencia,
+			TipoIncidencia: c.Especialidad, Prioridad: "media", Descripcion: c.Motivo, Fecha: op.Fecha}
+		if err := t.aplicar(alta); err != nil {
+			return err
+		}
+	}
+	asignar := Operacion{Tipo: OpAsignarPlaza, Matricula: c.Matricula, IDMecanico: mec.IDMecanico,
+		IDPlaza: plaza.IDPlaza, Fecha: op.Fecha}
+	if err := t.aplicar(asignar); err != nil {
+		return err
+	}
+	c.Estado, c.IDPlaza = CitaAtendida, plaza.IDPlaza
+	return nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestCitasPlazasOcupadas comprueba que los huecos de una franja descuentan
+// las plazas que ya ocupan o tienen reservadas los mecánicos, y que a la
+// llegada no se acepta un mecánico de otra especialidad o fuera de turno
+func TestCitasPlazasOcupadas(t *testing.T) {
+	var tl Taller
+	for _, op := range []Operacion{
+		{Tipo: OpCrearMecanico, IDMecanico: 1, Nombre: "M1", Especialidad: "mecánica"},
+		{Tipo: OpCrearMecanico, IDMecanico: 2, Nombre: "M2", Especialidad: "eléctrica"},
+		{Tipo: OpCrearCliente, IDCliente: 1, Nombre: "Ana"},
+		{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "0001AAA"},
+		{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "0002AAA"},
+		{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "0003AAA"},
+	} {
+		if err := tl.Aplicar(op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tl.InicializarPlazas()
+	dia := "2026-07-01"
+	if h := tl.HuecosFranja(dia, "09:00", "mecánica"); h != 2 {
+		t.Fatalf("con el taller vacío quedan %d huecos de mecánica", h)
+	}
+	if err := tl.Aplicar(Operacion{Tipo: OpAsignarPlaza, Matricula: "0001AAA", IDMecanico: 1, IDPlaza: 1}); err != nil {
+		t.Fatal(err)
+	}
+	tl.BuscarPlaza(2).Reservar("tx1", tl.MecanicosTaller[0])
+	if h := tl.HuecosFranja(dia, "09:00", "mecánica"); h != 0 {
+		t.Fatalf("con las dos plazas del mecánico en uso quedan %d huecos", h)
+	}
+	if err := tl.Aplicar(Operacion{Tipo: OpPedirCita, Cita: &Cita{IDCita: 1, Matricula: "0002AAA", Dia: dia, Hora: "09:00", Especialidad: "mecánica"}}); err == nil {
+		t.Fatal("se ha dado cita sin plazas del mecánico")
+	}
+	if h := tl.HuecosFranja(dia, "09:00", "eléctrica"); h != 2 {
+		t.Fatalf("quedan %d huecos de eléctrica", h)
+	}
+
+	cita := &Cita{IDCita: 2, Matricula: "0003AAA", Dia: dia, Hora: "09:00", Especialidad: "eléctrica"}
+	if err := tl.Aplicar(Operacion{Tipo: OpPedirCita, Cita: cita}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tl.Aplicar(Operacion{Tipo: OpLlegadaCita, IDCita: 2, IDMecanico: 1}); err == nil {
+		t.Fatal("se ha atendido una cita de eléctrica con un mecánico de mecánica")
+	}
+	tl.MecanicosTaller[1].Turnos = []Turno{{Dia: time.Monday, Inicio: "15:00", Fin: "20:00"}}
+	// 2026-07-01 es miércoles: el mecánico de eléctrica solo trabaja los lunes
+	if err := tl.Aplicar(Operacion{Tipo: OpLlegadaCita, IDCita: 2, IDMecanico: 2, Fecha: "2026-07-01T07:05:00.000Z"}); err == nil {
+		t.Fatal("se ha atendido una cita con un mecánico fuera de turno")
+	}
+	if tl.BuscarCita(2).Estado != CitaPendiente {
+		t.Fatal("una llegada rechazada ha cambiado la cita")
+	}
+	tl.MecanicosTaller[1].Turnos = nil
+	if err := tl.Aplicar(Operacion{Tipo: OpLlegadaCita, IDCita: 2, IDMecanico: 2, Fecha: "2026-07-01T07:05:00.000Z"}); err != nil {
+		t.Fatal(err)
+	}
+	if h := tl.HuecosFranja(dia, "09:00", "eléctrica"); h != 1 {
+		t.Fatalf("tras la llegada quedan %d huecos de eléctrica", h)
+	}
+}
+
+// TestCitas llena franjas con citas de dos especialidades y comprueba que
+// no se admiten más de las que caben, que dar de baja a un mecánico reduce
+// los huecos, que cancelar los libera y que al llegar el vehículo ocupa
+// una plaza con un mecánico de la especialidad de su cita
+func TestCitas(t *testing.T) {
+	var tl Taller
+	for i, esp := range []string{"mecánica", "mecánica", "eléctrica"} {
+		tl.Aplicar(Operacion{Tipo: OpCrearMecanico, IDMecanico: i + 1, Nombre: fmt.Sprint("M", i+1), Especialidad: esp})
+	}
+	tl.Aplicar(Operacion{Tipo: OpCrearCliente, IDCliente: 1, Nombre: "Ana"})
+	pedir := func(id int, dia, hora, esp string) error {
+		mat := fmt.Sprintf("%04dAAA", id)
+		if _, v := tl.BuscarVehiculo(mat); v == nil {
+			tl.Aplicar(Operacion{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: mat})
+		}
+		return tl.Aplicar(Operacion{Tipo: OpPedirCita, Cita: &Cita{IDCita: id, Matricula: mat, Dia: dia, Hora: hora,
+			Especialidad: esp, Motivo: "revisión"}})
+	}
+	dia := "2026-07-01"
+	for id := 1; id <= 4; id++ {
+		if err := pedir(id, dia, "09:00", "mecánica"); err != nil {
+			t.Fatalf("cita %d: %v", id, err)
+		}
+	}
+	if err := pedir(5, dia, "09:00", "mecánica"); err == nil {
+		t.Fatal("se ha admitido una quinta cita de mecánica con dos mecánicos")
+	}
+	if err := pedir(5, dia, "09:00", "eléctrica"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pedir(6, dia, "09:00", "eléctrica"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pedir(7, dia, "09:00", "eléctrica"); err == nil {
+		t.Fatal("se ha admitido una cita con el taller lleno")
+	}
+	if err := pedir(8, dia, "09:30", "mecánica"); err == nil {
+		t.Fatal("se ha admitido una cita fuera de las franjas")
+	}
+	if err := pedir(1, "2026-07-02", "10:00", "mecánica"); err == nil {
+		t.Fatal("un vehículo tiene dos citas pendientes")
+	}
+
+	// Con un mecánico de mecánica de baja, a las 10:00 solo caben 2
+	tl.Aplicar(Operacion{Tipo: OpEstadoMecanico, IDMecanico: 2, Activo: false})
+	if h := tl.HuecosFranja(dia, "10:00", "mecánica"); h != 2 {
+		t.Fatalf("con un mecánico de baja quedan %d huecos", h)
+	}
+	tl.Aplicar(Operacion{Tipo: OpEstadoMecanico, IDMecanico: 2, Activo: true})
+	if err := tl.Aplicar(Operacion{Tipo: OpCancelarCita, IDCita: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pedir(7, dia, "09:00", "mecánica"); err != nil {
+		t.Fatalf("tras cancelar una cita: %v", err)
+	}
+
+	if err := tl.Aplicar(Operacion{Tipo: OpLlegadaCita, IDCita: 5, IDIncidencia: 50, Fecha: "2026-07-01T07:05:00.000Z"}); err != nil {
+		t.Fatal(err)
+	}
+	c := tl.BuscarCita(5)
+	p := tl.BuscarPlaza(c.IDPlaza)
+	_, v := tl.BuscarVehiculo(c.Matricula)
+	if c.Estado != CitaAtendida || p == nil || p.GetMecanico().Especialidad != "eléctrica" ||
+		v.GetIncidencia() == nil || v.GetIncidencia().IDIncidencia != 50 || v.GetIncidencia().GetMecanicos()[0].IDMecanico != 3 {
+		t.Fatalf("la llegada no ha asignado la plaza: %+v", *c)
+	}
+	if err := tl.Aplicar(Operacion{Tipo: OpLlegadaCita, IDCita: 5}); err == nil {
+		t.Fatal("se ha atendido dos veces la misma cita")
+	}
+
+	proximas := tl.ProximasCitas("2026-06-30", 3)
+	if len(proximas["2026-06-30"]) != 0 || len(proximas[dia]) != 5 {
+		t.Fatalf("próximas citas inesperadas: %v", proximas)
+	}
+	if len(tl.CitasDelDia(dia)) != 7 || tl.HuecosFranja(dia, "09:00", "mecánica") != 0 {
+		t.Fatalf("quedan %d huecos de mecánica a las 9:00", tl.HuecosFranja(dia, "09:00", "mecánica"))
+	}
+}
+
+// TestSinCitaFranjaReservada hace llegar vehículos sin cita durante una
+// franja con citas pendientes: solo ocupan las plazas que les sobran a las
+// citas, y las citas llegan después y encuentran su plaza
+func TestSinCitaFranjaReservada(t *testing.T) {
+	var tl Taller
+	ops := []Operacion{
+		{Tipo: OpCrearMecanico, IDMecanico: 1, Nombre: "Laura", Especialidad: "mecánica"},
+		{Tipo: OpCrearMecanico, IDMecanico: 2, Nombre: "Pedro", Especialidad: "mecánica"},
+		{Tipo: OpCrearCliente, IDCliente: 1, Nombre: "Ana"},
+	}
+	for i := 1; i <= 6; i++ {
+		ops = append(ops, Operacion{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: fmt.Sprintf("%04dAAA", i)})
+	}
+	ops = append(ops, Operacion{Tipo: OpCrearCliente, IDCliente: 2, Nombre: "Luis"},
+		Operacion{Tipo: OpCrearVehiculo, IDCliente: 2, Matricula: "0007AAA"})
+	for id := 1; id <= 3; id++ {
+		ops = append(ops, Operacion{Tipo: OpPedirCita, Cita: &Cita{IDCita: id, Matricula: fmt.Sprintf("%04dAAA", id),
+			Dia: "2026-07-01", Hora: "09:00", Especialidad: "mecánica"}})
+	}
+	for _, op := range ops {
+		if err := tl.Aplicar(op); err != nil {
+			t.Fatalf("%s: %v", op.Tipo, err)
+		}
+	}
+	sinCita := func(mat string, plaza int, fecha string) error {
+		return tl.Aplicar(Operacion{Tipo: OpAsignarPlaza, Matricula: mat, IDMecanico: 1 + plaza%2, IDPlaza: plaza, Fecha: fecha})
+	}
+	// Antes de la franja no hay nada reservado
+	if err := sinCita("0007AAA", 1, "2026-07-01T06:30:00.000Z"); err != nil {
+		t.Fatal(err)
+	}
+	// A las 9:10 quedan 3 plazas libres para 3 citas
+	if err := sinCita("0005AAA", 2, "2026-07-01T07:10:00.000Z"); err == nil {
+		t.Fatal("un vehículo sin cita ha ocupado una plaza reservada para las citas")
+	}
+	for id := 1; id <= 3; id++ {
+		if err := tl.Aplicar(Operacion{Tipo: OpLlegadaCita, IDCita: id, Fecha: "2026-07-01T07:20:00.000Z"}); err != nil {
+			t.Fatalf("cita %d: %v", id, err)
+		}
+	}
+	if _, libres := tl.EstadoTaller(); libres != 0 {
+		t.Fatalf("quedan %d plazas libres", libres)
+	}
+	// Al irse Luis queda una plaza, reservada para la cita de las 10:00
+	// hasta que se cancela
+	if err := tl.Aplicar(Operacion{Tipo: OpEliminarCliente, IDCliente: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tl.Aplicar(Operacion{Tipo: OpPedirCita, Cita: &Cita{IDCita: 4, Matricula: "0006AAA",
+		Dia: "2026-07-01", Hora: "10:00", Especialidad: "mecánica"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sinCita("0005AAA", 1, "2026-07-01T08:10:00.000Z"); err == nil {
+		t.Fatal("un vehículo sin cita ha ocupado la plaza de la cita de las 10:00")
+	}
+	tl.Aplicar(Operacion{Tipo: OpCancelarCita, IDCita: 4})
+	if err := sinCita("0005AAA", 1, "2026-07-01T08:10:00.000Z"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Una transferencia de vehículo entre sedes es una transacción en dos fases.
+// La sede de origen coordina y participa a la vez (marca el vehículo como
+// saliente); la de destino participa reservando una plaza libre. Si alguna
+// no puede prepararse se aborta en las dos; si ambas votan sí, se confirma:
+// el origen elimina el vehículo y el destino lo da de alta en la plaza.
+//
+// Cada sede anota en su registro de transacciones las decisiones del
+// coordinador y el estado de sus participaciones antes de comunicarlas, de
+// modo que tras una caída puede terminar lo pendiente. Un participante en
+// duda (preparado pero sin decisión) pregunta al coordinador; una transacción
+// que el coordinador no llegó a decidir se considera abortada.
+
+// Roles en el registro de transacciones
+const (
+	txCoordinador  = "coordinador"
+	txParticipante = "participante"
+)
+
+// Estados de una transacción en el registro
+const (
+	txIniciada   = "iniciada"   // coordinador: se ha empezado a preparar
+	txPreparada  = "preparada"  // participante: ha votado sí y espera la decisión
+	txConfirmada = "confirmada" // decisión (coordinador) o decisión aplicada (participante)
+	txAbortada   = "abortada"
+	txTerminada  = "terminada" // coordinador: todos los participantes conocen la decisión
+)
+
+// Lados de una participación
+const (
+	ladoOrigen  = "origen"
+	ladoDestino = "destino"
+)
+
+// Fases de una transferencia en las que se puede simular una caída con
+// RedSedes.SimularCaida. Las cinco primeras afectan al coordinador (origen)
+// y las dos últimas al destino.
+const (
+	FalloIniciada         = "iniciada"         // registrada la transacción, nada preparado
+	FalloPreparadoOrigen  = "preparadoOrigen"  // vehículo marcado como saliente
+	FalloPreparadoDestino = "preparadoDestino" // votos recibidos, sin decisión
+	FalloDecision         = "decision"         // decisión registrada, sin comunicar
+	FalloConfirmadoOrigen = "confirmadoOrigen" // decisión aplicada en el origen
+	FalloDestinoPreparar  = "destinoPreparar"  // plaza reservada, sin votar
+	FalloDestinoDecision  = "destinoDecision"  // decisión recibida, sin aplicar
+)
+
+// FasesFallo enumera todas las fases en las que se puede simular una caída
+var FasesFallo = []string{FalloIniciada, FalloPreparadoOrigen, FalloPreparadoDestino,
+	FalloDecision, FalloConfirmadoOrigen, FalloDestinoPreparar, FalloDestinoDecision}
+
+// ErrCaidaSimulada indica que la sede se ha "caído" en la fase indicada con SimularCaida
+var ErrCaidaSimulada = errors.New("caída simulada")
+
+// registroTx es una línea del registro de transacciones
+type registroTx struct {
+	Tx        string     `json:"tx"`
+	Rol       string     `json:"rol"`
+	Estado    string     `json:"estado"`
+	Lado      string     `json:"lado,omitempty"`    // participante: origen o destino
+	Origen    string     `json:"origen,omitempty"`  // sede coordinadora
+	Destino   string     `json:"destino,omitempty"` // coordinador: sede de destino
+	Matricula string     `json:"matricula,omitempty"`
+	Recepcion *Operacion `json:"recepcion,omitempty"` // vehículo que se transfiere
+	Terminada bool       `json:"-"`
+}
+
+// RegistroTransacciones es un fichero de solo añadir, una línea JSON por
+// cambio de estado, sincronizado en disco tras cada escritura
+type RegistroTransacciones struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// AbrirRegistroTransacciones abre (o crea) dir/transacciones.log y devuelve
+// sus entradas. Una última línea cortada por una caída se ignora.
+func AbrirRegistroTransacciones(dir string) (*RegistroTransacciones, []registroTx, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "transacciones.log"), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	var regs []registroTx
+	lector := bufio.NewScanner(f)
+	lector.Buffer(make([]byte, 64*1024), 1<<20)
+	for lector.Scan() {
+		var reg registroTx
+		if json.Unmarshal(lector.Bytes(), &reg) == nil {
+			regs = append(regs, reg)
+		}
+	}
+	return &RegistroTransacciones{f: f}, regs, nil
+}
+
+// Anotar añade una entrada y la sincroniza en disco
+func (rt *RegistroTransacciones) Anotar(reg registroTx) error {
+	datos, err := json.Marshal(reg)
+	if err != nil {
+		return err
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if _, err := rt.f.Write(append(datos, '\n')); err != nil {
+		return err
+	}
+	return rt.f.Sync()
+}
+
+// Cerrar cierra el fichero del registro
+func (rt *RegistroTransacciones) Cerrar() error {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.f.Close()
+}
+
+// abrirTransacciones abre el registro y reconstruye el estado de cada transacción
+func (r *RedSedes) abrirTransacciones(dir string) error {
+	rt, regs, err := AbrirRegistroTransacciones(dir)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.transacciones != nil {
+		r.transacciones.Cerrar()
+	}
+	r.transacciones = rt
+	r.coordinadas = map[string]*registroTx{}
+	r.participaciones = map[string]*registroTx{}
+	for _, reg := range regs {
+		r.recordar(reg)
+	}
+	return nil
+}
+
+// recordar incorpora una entrada al estado en memoria; se llama con r.mu tomado
+func (r *RedSedes) recordar(reg registroTx) {
+	mapa := r.participaciones
+	if reg.Rol == txCoordinador {
+		mapa = r.coordinadas
+	}
+	if reg.Estado == txTerminada {
+		if anterior := mapa[reg.Tx]; anterior != nil {
+			anterior.Terminada = true
+		}
+		return
+	}
+	copia := reg
+	if anterior := mapa[reg.Tx]; anterior != nil {
+		// Las entradas posteriores solo cambian el estado
+		copia = *anterior
+		copia.Estado = reg.Estado
+	}
+	mapa[reg.Tx] = &copia
+}
+
+// anotar escribe la entrada en disco y después la incorpora en memoria
+func (r *RedSedes) anotar(reg registroTx) error {
+	if err := r.transacciones.Anotar(reg); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.recordar(reg)
+	r.mu.Unlock()
+	return nil
+}
+
+// SimularCaida hace que la sede se "caiga" al llegar a la fase indicada de
+// una transferencia (vacío = no simular caídas). Una sede caída no atiende a
+// las demás hasta que se llama a Recuperar.
+func (r *RedSedes) SimularCaida(fase string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fallarEn = fase
+}
+
+// fallar simula la caída de la sede si es la fase indicada con SimularCaida
+func (r *RedSedes) fallar(fase string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if fase == "" || r.fallarEn != fase {
+		return false
+	}
+	r.caida = true
+	return true
+}
+
+// Caida indica si la sede está en una caída simulada
+func (r *RedSedes) Caida() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.caida
+}
+
+// COORDINADOR
+
+// Transferir mueve un vehículo (con su cliente y su incidencia) a la sede
+// destino mediante una transacción en dos fases coordinada por esta sede
+func (r *RedSedes) Transferir(matricula, destino string) error {
+	sede := r.buscarSede(destino)
+	if sede == nil {
+		return fmt.Errorf("sede desconocida: %s", destino)
+	}
+	if r.Caida() {
+		return ErrCaidaSimulada
+	}
+	r.cerrojo.Lock()
+	op, err := operacionRecepcion(r.taller, matricula)
+	r.cerrojo.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tx := fmt.Sprintf("%s-%d", r.Propia.Nombre, time.Now().UnixNano())
+	err = r.anotar(registroTx{Tx: tx, Rol: txCoordinador, Estado: txIniciada,
+		Origen: r.Propia.Nombre, Destino: destino, Matricula: matricula, Recepcion: &op})
+	if err != nil {
+		return err
+	}
+	if r.fallar(FalloIniciada) {
+		return ErrCaidaSimulada
+	}
+
+	// Fase 1: preparar el origen y pedir el voto al destino
+	motivo := ""
+	votoOrigen, err := r.prepararOrigen(tx, matricula)
+	if err != nil {
+		motivo = err.Error()
+	}
+	if r.fallar(FalloPreparadoOrigen) {
+		return ErrCaidaSimulada
+	}
+	votoDestino := false
+	if votoOrigen {
+		resp, err := r.llamar(sede.Direccion, PeticionSede{Tipo: prepararTx, Tx: tx,
+			Origen: r.Propia.Nombre, Recepcion: &op})
+		switch {
+		case err != nil:
+			motivo = fmt.Sprintf("la sede %s no responde", destino)
+		case !resp.Voto:
+			motivo = fmt.Sprintf("la sede %s no puede recibirlo: %s", destino, resp.Error)
+		default:
+			votoDestino = true
+		}
+	}
+	if r.fallar(FalloPreparadoDestino) {
+		return ErrCaidaSimulada
+	}
+
+	// La decisión se registra antes de comunicarla: a partir de aquí la
+	// transacción terminará igual aunque haya caídas
+	decision := txAbortada
+	if votoOrigen && votoDestino {
+		decision = txConfirmada
+	}
+	if err := r.anotar(registroTx{Tx: tx, Rol: txCoordinador, Estado: decision}); err != nil {
+		return err
+	}
+	if r.fallar(FalloDecision) {
+		return ErrCaidaSimulada
+	}
+
+	// Fase 2: aplicar la decisión en el origen y comunicarla al destino
+	if err := r.aplicarDecision(tx, decision); err != nil {
+		return err
+	}
+	if r.fallar(FalloConfirmadoOrigen) {
+		return ErrCaidaSimulada
+	}
+	if !r.comunicarDecision(tx) {
+		// El destino la recibirá en un reintento o la preguntará al volver
+		r.iniciarResolucion()
+	}
+	if decision == txAbortada {
+		return fmt.Errorf("transferencia abortada: %s", motivo)
+	}
+	return nil
+}
+
+// prepararOrigen marca el vehículo como saliente y anota la participación
+func (r *RedSedes) prepararOrigen(tx, matricula string) (bool, error) {
+	reg := registroTx{Tx: tx, Rol: txParticipante, Lado: ladoOrigen,
+		Origen: r.Propia.Nombre, Matricula: matricula}
+	if err := r.ejecutar(Operacion{Tipo: OpPrepararSalida, Matricula: matricula, Transaccion: tx}); err != nil {
+		reg.Estado = txAbortada
+		r.anotar(reg)
+		return false, err
+	}
+	reg.Estado = txPreparada
+	if err := r.anotar(reg); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// comunicarDecision envía la decisión al destino y, si la recibe, da la
+// transacción por terminada
+func (r *RedSedes) comunicarDecision(tx string) bool {
+	r.mu.Lock()
+	coord := r.coordinadas[tx]
+	r.mu.Unlock()
+	if coord == nil {
+		return true
+	}
+	sede := r.buscarSede(coord.Destino)
+	if sede == nil {
+		return false
+	}
+	resp, err := r.llamar(sede.Direccion, PeticionSede{Tipo: decidirTx, Tx: tx, Decision: coord.Estado})
+	if err != nil || resp.Error != "" {
+		return false
+	}
+	r.anotar(registroTx{Tx: tx, Rol: txCoordinador, Estado: txTerminada})
+	return true
+}
+
+// decisionDe responde a un participante en duda. Sin decisión registrada la
+// transacción se considera abortada; si sigue en curso aún no hay respuesta.
+func (r *RedSedes) decisionDe(tx string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	coord := r.coordinadas[tx]
+	if coord == nil {
+		return txAbortada
+	}
+	if coord.Estado == txIniciada {
+		return ""
+	}
+	return coord.Estado
+}
+
+// PARTICIPANTES
+
+// prepararDestino reserva una plaza para el vehículo que llega y vota
+func (r *RedSedes) prepararDestino(pet PeticionSede) RespuestaSede {
+	if pet.Recepcion == nil {
+		return RespuestaSede{Error: "petición sin vehículo"}
+	}
+	r.mu.Lock()
+	previa := r.participaciones[pet.Tx]
+	r.mu.Unlock()
+	if previa != nil {
+		return RespuestaSede{Voto: previa.Estado != txAbortada}
+	}
+
+	reg := registroTx{Tx: pet.Tx, Rol: txParticipante, Lado: ladoDestino, Origen: pet.Origen,
+		Matricula: pet.Recepcion.Matricula, Recepcion: pet.Recepcion}
+	err := r.ejecutar(Operacion{Tipo: OpReservarPlaza, Matricula: pet.Recepcion.Matricula, Transaccion: pet.Tx})
+	if err != nil {
+		reg.Estado = txAbortada
+		r.anotar(reg)
+		return RespuestaSede{Error: err.Error()}
+	}
+	reg.Estado = txPreparada
+	if err := r.anotar(reg); err != nil {
+		return RespuestaSede{Error: err.Error()}
+	}
+	r.fallar(FalloDestinoPreparar)
+	return RespuestaSede{Voto: true}
+}
+
+// aplicarDecision aplica la decisión del coordinador en esta sede (origen o
+// destino) y la anota. Las operaciones son idempotentes, así que se puede
+// repetir sin riesgo tras una caída entre aplicar y anotar.
+func (r *RedSedes) aplicarDecision(tx, decision string) error {
+	r.mu.Lock()
+	reg := r.participaciones[tx]
+	r.mu.Unlock()
+	if reg == nil || reg.Estado != txPreparada {
+		return nil // nunca se preparó aquí o ya estaba resuelta
+	}
+	if reg.Lado == ladoDestino && r.fallar(FalloDestinoDecision) {
+		return ErrCaidaSimulada
+	}
+	if err := r.ejecutar(r.operacionDecision(reg, decision)); err != nil {
+		return err
+	}
+	return r.anotar(registroTx{Tx: tx, Rol: txParticipante, Estado: decision})
+}
+
+// operacionDecision traduce la decisión a la operación del lado del participante
+func (r *RedSedes) operacionDecision(reg *registroTx, decision string) Operacion {
+	switch {
+	case reg.Lado == ladoOrigen && decision == txConfirmada:
+		return Operacion{Tipo: OpConfirmarSalida, Matricula: reg.Matricula, Transaccion: reg.Tx}
+	case reg.Lado == ladoOrigen:
+		return Operacion{Tipo: OpAbortarSalida, Matricula: reg.Matricula, Transaccion: reg.Tx}
+	case decision == txConfirmada:
+		op := *reg.Recepcion
+		op.Tipo = OpConfirmarEntrada
+		op.Transaccion = reg.Tx
+		if op.IDIncidencia != 0 && EsIDAntiguo(op.IDIncidencia) && generadorIDs != nil {
+			// Los IDs del antiguo contador de cada sede pueden repetirse en
+			// esta; los del generador son únicos y la incidencia los conserva
+			if id, err := generadorIDs.Siguiente(); err == nil {
+				op.IDIncidencia = id
+			}
+		}
+		return op
+	default:
+		return Operacion{Tipo: OpCancelarReserva, Transaccion: reg.Tx}
+	}
+}
+
+// RECUPERACIÓN
+
+// Recuperar vuelve a leer el registro de transacciones (como tras reiniciar
+// el proceso), deshace las reservas de transacciones que nunca llegaron a
+// prepararse y resuelve en segundo plano las transacciones en duda
+func (r *RedSedes) Recuperar(dir string) error {
+	if err := r.abrirTransacciones(dir); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.caida = false
+	// Lo que el coordinador no llegó a decidir se aborta
+	var sinDecidir []string
+	for tx, coord := range r.coordinadas {
+		if coord.Estado == txIniciada {
+			sinDecidir = append(sinDecidir, tx)
+		}
+	}
+	r.mu.Unlock()
+	for _, tx := range sinDecidir {
+		if err := r.anotar(registroTx{Tx: tx, Rol: txCoordinador, Estado: txAbortada}); err != nil {
+			return err
+		}
+	}
+
+	// Vehículos marcados y plazas reservadas por transacciones sin
+	// participación preparada: la caída fue antes de votar
+	r.cerrojo.Lock()
+	var retenidas []Operacion
+	for _, c := range r.taller.ClientesTaller {
+		for _, v := range c.Vehiculos {
+			if tx := v.GetSaliendo(); tx != "" {
+				retenidas = append(retenidas, Operacion{Tipo: OpAbortarSalida, Matricula: v.Matricula, Transaccion: tx})
+			}
+		}
+	}
+	for _, p := range r.taller.PlazasTaller {
+		if tx := p.GetReserva(); tx != "" {
+			retenidas = append(retenidas, Operacion{Tipo: OpCancelarReserva, Transaccion: tx})
+		}
+	}
+	r.cerrojo.Unlock()
+	for _, op := range retenidas {
+		r.mu.Lock()
+		reg := r.participaciones[op.Transaccion]
+		r.mu.Unlock()
+		if reg == nil || reg.Estado == txAbortada {
+			r.ejecutar(op)
+		}
+	}
+
+	r.iniciarResolucion()
+	return nil
+}
+
+// Pendientes devuelve cuántas transacciones siguen sin resolver en esta sede
+func (r *RedSedes) Pendientes() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, coord := range r.coordinadas {
+		if !coord.Terminada {
+			n++
+		}
+	}
+	for _, reg := range r.participaciones {
+		if reg.Estado == txPreparada {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *RedSedes) iniciarResolucion() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.resolviendo {
+		r.resolviendo = true
+		go r.resolverPendientes()
+	}
+}
+
+// resolverPendientes reintenta hasta que no quede nada pendiente: el
+// coordinador aplica y comunica sus decisiones y los participantes en duda
+// preguntan por ellas
+func (r *RedSedes) resolverPendientes() {
+	for {
+		if r.Caida() || r.resolverUnaVez() == 0 {
+			r.mu.Lock()
+			r.resolviendo = false
+			r.mu.Unlock()
+			return
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+func (r *RedSedes) resolverUnaVez() int {
+	r.mu.Lock()
+	var decididas, enDuda []registroTx
+	for _, coord := range r.coordinadas {
+		if !coord.Terminada && coord.Estado != txIniciada {
+			decididas = append(decididas, *coord)
+		}
+	}
+	for _, reg := range r.participaciones {
+		if reg.Estado == txPreparada && reg.Origen != r.Propia.Nombre {
+			enDuda = append(enDuda, *reg)
+		}
+	}
+	r.mu.Unlock()
+
+	pendientes := 0
+	for _, coord := range decididas {
+		r.aplicarDecision(coord.Tx, coord.Estado)
+		if !r.comunicarDecision(coord.Tx) {
+			pendientes++
+		}
+	}
+	for _, reg := range enDuda {
+		coordinador := r.buscarSede(reg.Origen)
+		if coordinador == nil {
+			pendientes++
+			continue
+		}
+		resp, err := r.llamar(coordinador.Direccion, PeticionSede{Tipo: consultarDecision, Tx: reg.Tx})
+		if err != nil || resp.Decision == "" {
+			pendientes++
+			continue
+		}
+		if err := r.aplicarDecision(reg.Tx, resp.Decision); err != nil {
+			pendientes++
+		}
+	}
+	return pendientes
+}
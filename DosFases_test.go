@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sedesPrueba arranca en el mismo proceso las sedes Origen y Destino, con
+// sus registros de transacciones en dirs, y devuelve sus talleres, cerrojos
+// y redes
+func sedesPrueba(t *testing.T, puerto int, dirs [2]string) (*[2]Taller, *[2]sync.Mutex, [2]*RedSedes) {
+	t.Helper()
+	sedes := []Sede{
+		{Nombre: "Origen", Direccion: fmt.Sprintf("localhost:%d", puerto)},
+		{Nombre: "Destino", Direccion: fmt.Sprintf("localhost:%d", puerto+1), X: 5},
+	}
+	talleres, cerrojos := &[2]Taller{}, &[2]sync.Mutex{}
+	var redes [2]*RedSedes
+	for i := range sedes {
+		tl, m := &talleres[i], &cerrojos[i]
+		ejecutarLocal := func(op Operacion) error {
+			m.Lock()
+			defer m.Unlock()
+			return tl.Aplicar(op)
+		}
+		rs, err := NuevaRedSedes(sedes, sedes[i].Nombre, dirs[i], tl, m, ejecutarLocal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rs.Escuchar(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(rs.Detener)
+		redes[i] = rs
+	}
+	return talleres, cerrojos, redes
+}
+
+// TestTransferenciaConCaidas transfiere un vehículo entre dos sedes
+// simulando una caída en cada fase, recupera ambas y comprueba la decisión
+// del coordinador, en qué sede acaba el vehículo (con su cliente y su
+// incidencia) y que no quedan reservas, marcas ni transacciones pendientes
+func TestTransferenciaConCaidas(t *testing.T) {
+	casos := []struct {
+		fase     string
+		decision string
+		queda    string
+	}{
+		{"", txConfirmada, "Destino"},
+		// Antes de votar: nadie ha preparado nada y se aborta al recuperar
+		{FalloIniciada, txAbortada, "Origen"},
+		{FalloPreparadoOrigen, txAbortada, "Origen"},
+		{FalloDestinoPreparar, txAbortada, "Origen"},
+		// Tras preparar las dos sedes pero sin decisión registrada
+		{FalloPreparadoDestino, txAbortada, "Origen"},
+		// Tras la decisión: se termina igual aunque nadie la conozca aún
+		{FalloDecision, txConfirmada, "Destino"},
+		{FalloConfirmadoOrigen, txConfirmada, "Destino"},
+		{FalloDestinoDecision, txConfirmada, "Destino"},
+	}
+	if len(casos) != len(FasesFallo)+1 {
+		t.Fatalf("la tabla cubre %d fases de %d", len(casos)-1, len(FasesFallo))
+	}
+	for k, c := range casos {
+		nombre := c.fase
+		if nombre == "" {
+			nombre = "sin fallos"
+		}
+		t.Run(nombre, func(t *testing.T) {
+			base := t.TempDir()
+			dirs := [2]string{filepath.Join(base, "Origen"), filepath.Join(base, "Destino")}
+			talleres, cerrojos, redes := sedesPrueba(t, 9501+2*k, dirs)
+			origen, destino := redes[0], redes[1]
+			talleres[1].Aplicar(Operacion{Tipo: OpCrearMecanico, IDMecanico: 1, Nombre: "Laura", Especialidad: "mecánica"})
+			talleres[0].Aplicar(Operacion{Tipo: OpCrearCliente, IDCliente: 1, Nombre: "Ana"})
+			talleres[0].Aplicar(Operacion{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "1234ABC"})
+			talleres[0].Aplicar(Operacion{Tipo: OpCrearIncidencia, Matricula: "1234ABC", IDIncidencia: 7, TipoIncidencia: "mecánica"})
+
+			origen.SimularCaida(c.fase)
+			destino.SimularCaida(c.fase)
+			err := origen.Transferir("1234ABC", "Destino")
+			if c.fase == "" && err != nil {
+				t.Fatal(err)
+			}
+			if c.fase != "" && !origen.Caida() && !destino.Caida() {
+				t.Fatalf("ninguna sede se cae en %s", c.fase)
+			}
+
+			// "Reiniciar" las dos sedes y esperar a que resuelvan lo pendiente
+			origen.SimularCaida("")
+			destino.SimularCaida("")
+			for i, rs := range redes {
+				if err := rs.Recuperar(dirs[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			esperar(t, 10*time.Second, "se resuelven las transacciones", func() bool {
+				return origen.Pendientes()+destino.Pendientes() == 0
+			})
+
+			origen.mu.Lock()
+			if len(origen.coordinadas) != 1 {
+				t.Fatalf("el origen coordina %d transacciones", len(origen.coordinadas))
+			}
+			for tx, coord := range origen.coordinadas {
+				if coord.Estado != c.decision || !coord.Terminada {
+					t.Errorf("%s: decisión %q terminada=%v, se esperaba %q terminada", tx, coord.Estado, coord.Terminada, c.decision)
+				}
+			}
+			origen.mu.Unlock()
+
+			sedes := []string{"Origen", "Destino"}
+			for i := range talleres {
+				cerrojos[i].Lock()
+				cli, v := talleres[i].BuscarVehiculo("1234ABC")
+				for _, p := range talleres[i].PlazasTaller {
+					if p.GetReserva() != "" {
+						t.Errorf("%s: la plaza %d sigue reservada para %s", sedes[i], p.IDPlaza, p.GetReserva())
+					}
+				}
+				if v != nil && v.GetSaliendo() != "" {
+					t.Errorf("%s: el vehículo sigue marcado como saliente", sedes[i])
+				}
+				switch {
+				case sedes[i] != c.queda && v != nil:
+					t.Errorf("el vehículo sigue en %s", sedes[i])
+				case sedes[i] == c.queda && v == nil:
+					t.Errorf("el vehículo no está en %s", sedes[i])
+				case sedes[i] == c.queda && (cli.Nombre != "Ana" || v.GetIncidencia() == nil || v.GetIncidencia().IDIncidencia != 7):
+					t.Errorf("%s: el vehículo queda sin su cliente o su incidencia", sedes[i])
+				}
+				if err := talleres[i].ComprobarConsistencia(); err != nil {
+					t.Errorf("%s: %v", sedes[i], err)
+				}
+				cerrojos[i].Unlock()
+			}
+		})
+	}
+}
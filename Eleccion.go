@@ -0,0 +1,445 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Algoritmos de elección de coordinador
+const (
+	AlgBully          = "bully"  // gana el nodo vivo de mayor id, que se impone a los menores
+	AlgAnilloEleccion = "anillo" // un mensaje recorre el anillo recogiendo los nodos vivos
+)
+
+// Tipos de mensaje de elección
+const (
+	elLatido      = "latido"      // ¿sigues vivo? (lleva el coordinador si lo es quien lo envía)
+	elOK          = "ok"          // respuesta a cualquier mensaje
+	elEleccion    = "eleccion"    // convocatoria (bully) o ronda de candidatos (anillo)
+	elCoordinador = "coordinador" // anuncio del nuevo coordinador
+)
+
+// MensajeEleccion es lo que un nodo envía a otro; cada mensaje va en su propia
+// conexión y se responde con elOK
+type MensajeEleccion struct {
+	Tipo        string `json:"tipo"`
+	Origen      int    `json:"origen"`
+	Coordinador int    `json:"coordinador,omitempty"`
+	Candidatos  []int  `json:"candidatos,omitempty"` // nodos por los que ha pasado (anillo)
+	Sello
+}
+
+// MiembroEleccion es un nodo del grupo tal como lo ve este nodo
+type MiembroEleccion struct {
+	ID        int
+	Direccion string
+	Vivo      bool
+}
+
+// NodoEleccion elige con los demás nodos de pares un coordinador común. Cada
+// Latido comprueba qué nodos responden; si el coordinador deja de responder
+// durante Expiracion (o no hay ninguno) convoca una elección. El coordinador
+// se anuncia también en cada latido, así que un anuncio perdido o una
+// elección que se cruza con otra se corrigen en el siguiente.
+type NodoEleccion struct {
+	Latido     time.Duration
+	Expiracion time.Duration
+	// AlCambiarCoordinador se llama (si no es nil) al conocer un nuevo coordinador
+	AlCambiarCoordinador func(coordinador int)
+	// Relojes lógicos con los que se marcan los mensajes (nil = sin marcas)
+	Relojes *Relojes
+
+	algoritmo string
+	id        int
+	pares     []string
+	oyente    net.Listener
+	parar     chan struct{}
+
+	mu             sync.Mutex
+	coordinador    int // -1 = desconocido
+	vistos         map[int]time.Time
+	eligiendo      bool // hay una elección bully en curso en este nodo
+	ultimaEleccion time.Time
+}
+
+// NuevoNodoEleccion crea el nodo id del grupo formado por pares
+func NuevoNodoEleccion(algoritmo string, id int, pares []string) (*NodoEleccion, error) {
+	if algoritmo != AlgBully && algoritmo != AlgAnilloEleccion {
+		return nil, fmt.Errorf("algoritmo de elección desconocido: %q", algoritmo)
+	}
+	if id < 0 || id >= len(pares) {
+		return nil, fmt.Errorf("el nodo %d no está entre los %d pares", id, len(pares))
+	}
+	return &NodoEleccion{
+		Latido:      200 * time.Millisecond,
+		Expiracion:  time.Second,
+		algoritmo:   algoritmo,
+		id:          id,
+		pares:       pares,
+		parar:       make(chan struct{}),
+		coordinador: -1,
+		vistos:      map[int]time.Time{},
+	}, nil
+}
+
+// Iniciar atiende los mensajes de los demás nodos y arranca la vigilancia
+func (n *NodoEleccion) Iniciar() error {
+	oyente, err := net.Listen("tcp", n.pares[n.id])
+	if err != nil {
+		return err
+	}
+	n.oyente = oyente
+	go func() {
+		for {
+			conn, err := oyente.Accept()
+			if err != nil {
+				return
+			}
+			go n.atender(conn)
+		}
+	}()
+	go n.vigilar()
+	return nil
+}
+
+// Detener deja de atender mensajes, como si el nodo se cayera
+func (n *NodoEleccion) Detener() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	select {
+	case <-n.parar:
+		return
+	default:
+	}
+	close(n.parar)
+	if n.oyente != nil {
+		n.oyente.Close()
+	}
+}
+
+// Coordinador devuelve el coordinador actual (-1 si no se conoce)
+func (n *NodoEleccion) Coordinador() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.coordinador
+}
+
+// Miembros devuelve los nodos del grupo y si han respondido hace menos de
+// Expiracion (este nodo siempre está vivo)
+func (n *NodoEleccion) Miembros() []MiembroEleccion {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	miembros := make([]MiembroEleccion, len(n.pares))
+	for i, dir := range n.pares {
+		miembros[i] = MiembroEleccion{ID: i, Direccion: dir, Vivo: i == n.id || n.vivo(i)}
+	}
+	return miembros
+}
+
+// Estado resume el coordinador y los miembros para mostrarlo por consola
+func (n *NodoEleccion) Estado() string {
+	coord := "desconocido"
+	if c := n.Coordinador(); c != -1 {
+		coord = fmt.Sprint(c)
+	}
+	var partes []string
+	for _, m := range n.Miembros() {
+		estado := "caído"
+		if m.Vivo {
+			estado = "vivo"
+		}
+		partes = append(partes, fmt.Sprintf("%d %s (%s)", m.ID, m.Direccion, estado))
+	}
+	return fmt.Sprintf("Elección %s | Nodo:%d | Coordinador:%s | Miembros: %s",
+		n.algoritmo, n.id, coord, strings.Join(partes, ", "))
+}
+
+// vivo indica si p ha respondido hace menos de Expiracion; se llama con n.mu tomado
+func (n *NodoEleccion) vivo(p int) bool {
+	visto, ok := n.vistos[p]
+	return ok && time.Since(visto) <= n.Expiracion
+}
+
+// DETECCIÓN DE FALLOS
+
+func (n *NodoEleccion) vigilar() {
+	tick := time.NewTicker(n.Latido)
+	defer tick.Stop()
+	for {
+		latido := MensajeEleccion{Tipo: elLatido, Coordinador: -1}
+		if n.Coordinador() == n.id {
+			latido.Coordinador = n.id
+		}
+		for p := range n.pares {
+			if p != n.id {
+				go n.llamar(p, latido)
+			}
+		}
+
+		n.mu.Lock()
+		coord := n.coordinador
+		if coord != -1 && coord != n.id && !n.vivo(coord) {
+			coord = -1
+			n.coordinador = -1
+		}
+		convocar := coord == -1 && time.Since(n.ultimaEleccion) > n.Expiracion
+		if convocar {
+			n.ultimaEleccion = time.Now()
+		}
+		n.mu.Unlock()
+		if convocar {
+			go n.convocar()
+		}
+
+		select {
+		case <-n.parar:
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// llamar envía un mensaje a p y espera su respuesta; cualquier respuesta
+// cuenta como señal de vida
+func (n *NodoEleccion) llamar(p int, m MensajeEleccion) error {
+	select {
+	case <-n.parar:
+		return errNodoCaido
+	default:
+	}
+	m.Origen = n.id
+	m.Sellar(n.Relojes)
+	conn, err := net.DialTimeout("tcp", n.pares[p], n.Expiracion/2)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(n.Expiracion))
+	if err := json.NewEncoder(conn).Encode(m); err != nil {
+		return err
+	}
+	var resp MensajeEleccion
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return err
+	}
+	resp.Recibido(n.Relojes)
+	if resp.Tipo != elOK {
+		return errors.New("respuesta inesperada")
+	}
+	n.mu.Lock()
+	n.vistos[p] = time.Now()
+	n.mu.Unlock()
+	return nil
+}
+
+func (n *NodoEleccion) atender(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(n.Expiracion))
+	var m MensajeEleccion
+	if err := json.NewDecoder(conn).Decode(&m); err != nil {
+		return
+	}
+	m.Recibido(n.Relojes)
+	n.mu.Lock()
+	n.vistos[m.Origen] = time.Now()
+	n.mu.Unlock()
+	resp := MensajeEleccion{Tipo: elOK, Origen: n.id}
+	resp.Sellar(n.Relojes)
+	if json.NewEncoder(conn).Encode(resp) != nil {
+		return
+	}
+	// Se responde antes de actuar para no encadenar esperas entre nodos
+	switch {
+	case m.Tipo == elLatido && m.Coordinador == m.Origen:
+		n.reclamado(m.Origen)
+	case m.Tipo == elEleccion && n.algoritmo == AlgBully:
+		// Un nodo menor convoca: este lo para y convoca por su cuenta
+		go n.eleccionBully()
+	case m.Tipo == elEleccion:
+		n.rondaAnillo(m)
+	case m.Tipo == elCoordinador:
+		n.recibirCoordinador(m)
+	}
+}
+
+// convocar empieza una elección con el algoritmo del nodo
+func (n *NodoEleccion) convocar() {
+	if n.algoritmo == AlgBully {
+		n.eleccionBully()
+		return
+	}
+	n.rondaAnillo(MensajeEleccion{Tipo: elEleccion})
+}
+
+// reclamado atiende el latido de un nodo que se tiene por coordinador. Si es
+// mayor que el coordinador conocido (o este ya no responde) se acepta; si es
+// menor que este nodo, no le corresponde coordinar y se vuelve a elegir.
+func (n *NodoEleccion) reclamado(c int) {
+	if c < n.id {
+		n.impugnar()
+		return
+	}
+	n.mu.Lock()
+	actual := n.coordinador
+	acepta := actual == -1 || c > actual || (actual != n.id && !n.vivo(actual))
+	n.mu.Unlock()
+	if acepta {
+		n.fijarCoordinador(c)
+	}
+}
+
+// impugnar convoca una elección porque un nodo menor que este se ha
+// proclamado coordinador. En bully no hace nada si ya hay una en curso; en
+// anillo se espera Expiracion entre rondas. Como el coordinador se anuncia
+// en cada latido, si ahora no se convoca se hará en el siguiente.
+func (n *NodoEleccion) impugnar() {
+	if n.algoritmo == AlgBully {
+		go n.eleccionBully()
+		return
+	}
+	n.mu.Lock()
+	convocar := time.Since(n.ultimaEleccion) > n.Expiracion
+	if convocar {
+		n.ultimaEleccion = time.Now()
+	}
+	n.mu.Unlock()
+	if convocar {
+		go n.convocar()
+	}
+}
+
+// fijarCoordinador anota el coordinador y avisa si ha cambiado
+func (n *NodoEleccion) fijarCoordinador(c int) {
+	n.mu.Lock()
+	cambia := n.coordinador != c
+	n.coordinador = c
+	alCambiar := n.AlCambiarCoordinador
+	n.mu.Unlock()
+	if cambia && alCambiar != nil {
+		alCambiar(c)
+	}
+}
+
+// BULLY
+
+// eleccionBully convoca a los nodos de mayor id. Si ninguno responde, este
+// nodo se proclama coordinador; si alguno responde, espera su anuncio y
+// vuelve a convocar si no llega.
+func (n *NodoEleccion) eleccionBully() {
+	n.mu.Lock()
+	if n.eligiendo {
+		n.mu.Unlock()
+		return
+	}
+	n.eligiendo = true
+	n.ultimaEleccion = time.Now()
+	n.mu.Unlock()
+	defer func() {
+		n.mu.Lock()
+		n.eligiendo = false
+		n.mu.Unlock()
+	}()
+
+	for {
+		respondio := false
+		for p := n.id + 1; p < len(n.pares); p++ {
+			if n.llamar(p, MensajeEleccion{Tipo: elEleccion}) == nil {
+				respondio = true
+			}
+		}
+		if !respondio {
+			n.proclamarse()
+			return
+		}
+		limite := time.Now().Add(2 * n.Expiracion)
+		for time.Now().Before(limite) {
+			if c := n.Coordinador(); c > n.id {
+				return
+			}
+			select {
+			case <-n.parar:
+				return
+			case <-time.After(n.Latido / 4):
+			}
+		}
+	}
+}
+
+// proclamarse anuncia a todos que este nodo es el coordinador (bully). Si
+// algún anuncio se pierde, el nodo lo recibe con el siguiente latido.
+func (n *NodoEleccion) proclamarse() {
+	n.fijarCoordinador(n.id)
+	for p := range n.pares {
+		if p != n.id {
+			go n.llamar(p, MensajeEleccion{Tipo: elCoordinador, Coordinador: n.id})
+		}
+	}
+}
+
+func (n *NodoEleccion) recibirCoordinador(m MensajeEleccion) {
+	if n.algoritmo == AlgBully {
+		if m.Coordinador < n.id {
+			// Un nodo menor no puede coordinar mientras este siga vivo
+			n.impugnar()
+			return
+		}
+		n.fijarCoordinador(m.Coordinador)
+		return
+	}
+	// Anillo: el anuncio da la vuelta completa y se detiene al volver
+	if contieneID(m.Candidatos, n.id) {
+		return
+	}
+	n.fijarCoordinador(m.Coordinador)
+	m.Candidatos = append(m.Candidatos, n.id)
+	n.reenviarAnillo(m)
+}
+
+// ANILLO
+
+// rondaAnillo añade este nodo a los candidatos y pasa el mensaje al siguiente
+// nodo vivo. Cuando el mensaje vuelve a un nodo que ya está en la lista, la
+// ronda ha dado la vuelta: el candidato de mayor id es el coordinador.
+func (n *NodoEleccion) rondaAnillo(m MensajeEleccion) {
+	if contieneID(m.Candidatos, n.id) {
+		coord := n.id
+		for _, c := range m.Candidatos {
+			if c > coord {
+				coord = c
+			}
+		}
+		n.fijarCoordinador(coord)
+		n.reenviarAnillo(MensajeEleccion{Tipo: elCoordinador, Coordinador: coord, Candidatos: []int{n.id}})
+		return
+	}
+	m.Candidatos = append(append([]int(nil), m.Candidatos...), n.id)
+	if !n.reenviarAnillo(m) {
+		// Nadie más responde: este nodo es el único vivo
+		n.fijarCoordinador(n.id)
+	}
+}
+
+// reenviarAnillo pasa el mensaje al siguiente nodo del anillo que responda
+func (n *NodoEleccion) reenviarAnillo(m MensajeEleccion) bool {
+	for k := 1; k < len(n.pares); k++ {
+		sig := (n.id + k) % len(n.pares)
+		if n.llamar(sig, m) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func contieneID(ids []int, id int) bool {
+	for _, x := range ids {
+		if x == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestEleccion levanta un grupo local de nodos con cada algoritmo y
+// comprueba que eligen al de mayor id, que al caer el coordinador eligen otro
+// y que al volver el caído recupera el puesto
+func TestEleccion(t *testing.T) {
+	const total = 5
+	for k, alg := range []string{AlgBully, AlgAnilloEleccion} {
+		t.Run(alg, func(t *testing.T) {
+			var pares []string
+			for i := 0; i < total; i++ {
+				pares = append(pares, fmt.Sprintf("localhost:%d", 9821+k*total+i))
+			}
+			nodos := make([]*NodoEleccion, total)
+			arrancar := func(i int) {
+				nodo, err := NuevoNodoEleccion(alg, i, pares)
+				if err != nil {
+					t.Fatal(err)
+				}
+				nodos[i] = nodo
+				if err := nodo.Iniciar(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := range nodos {
+				arrancar(i)
+				defer func(i int) { nodos[i].Detener() }(i)
+			}
+
+			vivos := []int{0, 1, 2, 3, 4}
+			if err := esperarCoordinador(nodos, vivos, 4); err != nil {
+				t.Fatal(err)
+			}
+			nodos[4].Detener()
+			vivos = vivos[:4]
+			if err := esperarCoordinador(nodos, vivos, 3); err != nil {
+				t.Fatalf("tras caer el 4: %v", err)
+			}
+			arrancar(4)
+			vivos = append(vivos, 4)
+			if err := esperarCoordinador(nodos, vivos, 4); err != nil {
+				t.Fatalf("tras volver el 4: %v", err)
+			}
+		})
+	}
+}
+
+// TestEleccionCoordinadorMenor hace que nodos menores que el coordinador se
+// tengan por coordinadores, como tras una elección cruzada cuyo anuncio se
+// perdió: con el coordinador en los latidos, todos vuelven al mayor
+func TestEleccionCoordinadorMenor(t *testing.T) {
+	const total = 4
+	for k, alg := range []string{AlgBully, AlgAnilloEleccion} {
+		t.Run(alg, func(t *testing.T) {
+			var pares []string
+			for i := 0; i < total; i++ {
+				pares = append(pares, fmt.Sprintf("localhost:%d", 9841+k*total+i))
+			}
+			nodos := make([]*NodoEleccion, total)
+			for i := range nodos {
+				nodo, err := NuevoNodoEleccion(alg, i, pares)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := nodo.Iniciar(); err != nil {
+					t.Fatal(err)
+				}
+				defer nodo.Detener()
+				nodos[i] = nodo
+			}
+			vivos := []int{0, 1, 2, 3}
+			if err := esperarCoordinador(nodos, vivos, 3); err != nil {
+				t.Fatal(err)
+			}
+			nodos[0].fijarCoordinador(0)
+			nodos[2].fijarCoordinador(2)
+			nodos[1].fijarCoordinador(2)
+			if err := esperarCoordinador(nodos, vivos, 3); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// esperarCoordinador espera a que todos los nodos vivos indicados reconozcan
+// al mismo coordinador esperado
+func esperarCoordinador(nodos []*NodoEleccion, vivos []int, esperado int) error {
+	limite := time.Now().Add(10 * time.Second)
+	for time.Now().Before(limite) {
+		todos := true
+		for _, i := range vivos {
+			if nodos[i].Coordinador() != esperado {
+				todos = false
+				break
+			}
+		}
+		if todos {
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	var vistos []string
+	for _, i := range vivos {
+		vistos = append(vistos, fmt.Sprintf("%d→%d", i, nodos[i].Coordinador()))
+	}
+	sort.Strings(vistos)
+	return fmt.Errorf("no reconocen al nodo %d como coordinador (%s)", esperado, strings.Join(vistos, " "))
+}
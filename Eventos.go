@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Temas de los eventos del taller
+const (
+	TemaEstadoIncidencia  = "incidencia.estado"  // cualquier cambio de estado de una incidencia
+	TemaIncidenciaCerrada = "incidencia.cerrada" // una incidencia pasa a "cerrada"
+	TemaPlazaOcupada      = "plaza.ocupada"
+	TemaPlazaLibre        = "plaza.libre" // una plaza ocupada o reservada queda libre
+	TemaSalidaVehiculo    = "vehiculo.salida"
+)
+
+// Evento es un cambio del taller publicado en el bus. Solo se rellenan los
+// campos que tienen sentido para su Tema.
+type Evento struct {
+	Tema         string `json:"tema"`
+	Seq          uint64 `json:"seq"`   // orden de publicación en este nodo
+	Fecha        string `json:"fecha"` // hora sincronizada del cambio
+	IDIncidencia int    `json:"idIncidencia,omitempty"`
+	Estado       string `json:"estado,omitempty"`
+	IDPlaza      int    `json:"idPlaza,omitempty"`
+	IDCliente    int    `json:"idCliente,omitempty"`
+	IDMecanico   int    `json:"idMecanico,omitempty"`
+	Matricula    string `json:"matricula,omitempty"`
+}
+
+// Suscripcion recibe por C los eventos de sus temas. Si el suscriptor no da
+// abasto, los eventos que no caben en C se pierden y se cuentan en Perdidos.
+type Suscripcion struct {
+	C <-chan Evento
+
+	c        chan Evento
+	temas    []string
+	perdidos uint64
+	bus      *BusEventos
+}
+
+// BusEventos reparte los eventos del taller entre sus suscriptores dentro del
+// proceso. Publicar nunca bloquea: se llama con el cerrojo del taller tomado,
+// justo después de ejecutar la operación que produjo los eventos.
+type BusEventos struct {
+	// Reloj del que se toma la fecha de los eventos (nil = hora del sistema)
+	Reloj *RelojFisico
+	// Capacidad es el número de eventos que cada suscripción puede tener
+	// pendientes y el de eventos recientes que se guardan para repetirlos
+	Capacidad int
+
+	mu           sync.Mutex
+	seq          uint64
+	suscriptores map[*Suscripcion]bool
+	recientes    []Evento
+	ganchos      map[int]func(Evento)
+	nGanchos     int
+}
+
+// NuevoBusEventos crea un bus sin suscriptores
+func NuevoBusEventos() *BusEventos {
+	return &BusEventos{Capacidad: 256, suscriptores: map[*Suscripcion]bool{}, ganchos: map[int]func(Evento){}}
+}
+
+// Publicar reparte un evento entre las suscripciones de su tema. Un bus nil
+// no hace nada, para que se pueda publicar sin comprobarlo.
+func (b *BusEventos) Publicar(e Evento) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.seq++
+	e.Seq = b.seq
+	if e.Fecha == "" {
+		e.Fecha = b.Reloj.Fecha()
+	}
+	ganchos := make([]func(Evento), 0, len(b.ganchos))
+	for _, f := range b.ganchos {
+		ganchos = append(ganchos, f)
+	}
+	b.recientes = append(b.recientes, e)
+	if len(b.recientes) > b.Capacidad {
+		b.recientes = b.recientes[len(b.recientes)-b.Capacidad:]
+	}
+	for s := range b.suscriptores {
+		if !s.quiere(e.Tema) {
+			continue
+		}
+		select {
+		case s.c <- e:
+		default:
+			s.perdidos++
+		}
+	}
+	b.mu.Unlock()
+	for _, f := range ganchos {
+		f(e)
+	}
+}
+
+// publicarEventos publica los eventos de una operación ejecutada en este
+// nodo (ver Taller.Eventos) con la hora de la operación
+func publicarEventos(b *BusEventos, fecha string, eventos []Evento) {
+	for _, e := range eventos {
+		e.Fecha = fecha
+		b.Publicar(e)
+	}
+}
+
+// AlPublicar registra una función que se llama en el mismo momento en que
+// se publica cada evento, con el cerrojo del taller aún tomado: puede leer el
+// taller tal como queda tras el cambio, pero debe ser rápida y no puede tomar
+// el cerrojo ni publicar. Devuelve la función que la da de baja.
+func (b *BusEventos) AlPublicar(f func(Evento)) (baja func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.nGanchos++
+	id := b.nGanchos
+	b.ganchos[id] = f
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.ganchos, id)
+	}
+}
+
+// Suscribir da una suscripción a los temas indicados. Un tema que termina
+// en ".*" abarca todos los que empiezan igual; sin temas, se reciben todos.
+func (b *BusEventos) Suscribir(temas ...string) *Suscripcion {
+	return b.SuscribirDesde(0, temas...)
+}
+
+// SuscribirDesde es como Suscribir, pero primero entrega los eventos
+// recientes posteriores a seq que aún se guardan
+func (b *BusEventos) SuscribirDesde(seq uint64, temas ...string) *Suscripcion {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := make(chan Evento, b.Capacidad)
+	s := &Suscripcion{C: c, c: c, temas: temas, bus: b}
+	if seq > 0 {
+		for _, e := range b.recientes {
+			if e.Seq > seq && s.quiere(e.Tema) {
+				c <- e
+			}
+		}
+	}
+	b.suscriptores[s] = true
+	return s
+}
+
+// Cancelar da de baja la suscripción y cierra su canal
+func (s *Suscripcion) Cancelar() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	if s.bus.suscriptores[s] {
+		delete(s.bus.suscriptores, s)
+		close(s.c)
+	}
+}
+
+// Perdidos devuelve cuántos eventos no cupieron en la suscripción
+func (s *Suscripcion) Perdidos() uint64 {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	return s.perdidos
+}
+
+func (s *Suscripcion) quiere(tema string) bool {
+	if len(s.temas) == 0 {
+		return true
+	}
+	for _, t := range s.temas {
+		if t == tema || strings.HasSuffix(t, ".*") && strings.HasPrefix(tema, strings.TrimSuffix(t, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Estado resume el bus para mostrarlo por consola
+func (b *BusEventos) Estado() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return fmt.Sprintf("Eventos | Publicados:%d | Suscripciones:%d", b.seq, len(b.suscriptores))
+}
+
+// SERVER-SENT EVENTS
+
+// ServidorEventos emite los eventos del bus a clientes HTTP con
+// Server-Sent Events en GET /eventos. El parámetro tema (repetible o
+// separado por comas) filtra los temas y la cabecera Last-Event-ID permite a
+// un cliente que se reconecta recibir los eventos que se perdió.
+type ServidorEventos struct {
+	// Latido es cada cuánto se envía un comentario para mantener viva la
+	// conexión cuando no hay eventos
+	Latido time.Duration
+
+	bus      *BusEventos
+	servidor *http.Server
+}
+
+// NuevoServidorEventos crea el servidor de los eventos de bus en direccion
+func NuevoServidorEventos(direccion string, bus *BusEventos) *ServidorEventos {
+	s := &ServidorEventos{Latido: 15 * time.Second, bus: bus}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/eventos", s.emitir)
+	s.servidor = &http.Server{Addr: direccion, Handler: mux}
+	return s
+}
+
+// Escuchar empieza a atender a los clientes
+func (s *ServidorEventos) Escuchar() error {
+	oyente, err := net.Listen("tcp", s.servidor.Addr)
+	if err != nil {
+		return err
+	}
+	go s.servidor.Serve(oyente)
+	return nil
+}
+
+// Detener cierra el servidor y las conexiones abiertas
+func (s *ServidorEventos) Detener() {
+	s.servidor.Close()
+}
+
+func (s *ServidorEventos) emitir(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "solo se admite GET", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "la conexión no admite envíos parciales", http.StatusInternalServerError)
+		return
+	}
+	var temas []string
+	for _, t := range r.URL.Query()["tema"] {
+		for _, x := range strings.Split(t, ",") {
+			if x != "" {
+				temas = append(temas, x)
+			}
+		}
+	}
+	desde, _ := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+	sus := s.bus.SuscribirDesde(desde, temas...)
+	defer sus.Cancelar()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": eventos del taller\n\n")
+	flusher.Flush()
+
+	latido := time.NewTicker(s.Latido)
+	defer latido.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-latido.C:
+			fmt.Fprint(w, ": latido\n\n")
+		case e, ok := <-sus.C:
+			if !ok {
+				return
+			}
+			datos, _ := json.Marshal(e)
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Tema, datos)
+		}
+		flusher.Flush()
+	}
+}
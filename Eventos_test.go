@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestAplicarNoPublica comprueba que Aplicar deja los eventos en Eventos
+// sin publicarlos, que una operación fallida no deja ninguno y que recalcular
+// las plazas avisa de las que estaban ocupadas
+func TestAplicarNoPublica(t *testing.T) {
+	anterior := bus
+	bus = NuevoBusEventos()
+	defer func() { bus = anterior }()
+	todos := bus.Suscribir()
+	defer todos.Cancelar()
+
+	var taller Taller
+	for _, op := range []Operacion{
+		{Tipo: OpCrearMecanico, IDMecanico: 1, Nombre: "Laura", Especialidad: "mecánica"},
+		{Tipo: OpCrearCliente, IDCliente: 1, Nombre: "Ana"},
+		{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "1234ABC"},
+		{Tipo: OpCrearIncidencia, Matricula: "1234ABC", IDIncidencia: 7, TipoIncidencia: "mecánica"},
+		{Tipo: OpAsignarPlaza, Matricula: "1234ABC", IDMecanico: 1, IDPlaza: 2},
+	} {
+		if err := taller.Aplicar(op); err != nil {
+			t.Fatalf("%s: %v", op.Tipo, err)
+		}
+	}
+	if ev := taller.Eventos(); len(ev) != 1 || ev[0].Tema != TemaPlazaOcupada || ev[0].IDPlaza != 2 {
+		t.Fatalf("eventos de la asignación: %+v", ev)
+	}
+	if err := taller.Aplicar(Operacion{Tipo: OpAsignarPlaza, Matricula: "1234ABC", IDMecanico: 1, IDPlaza: 2}); err == nil {
+		t.Fatal("asigna una plaza ocupada")
+	}
+	if ev := taller.Eventos(); len(ev) != 0 {
+		t.Fatalf("una operación fallida deja eventos: %+v", ev)
+	}
+	if err := taller.Aplicar(Operacion{Tipo: OpCrearMecanico, IDMecanico: 2, Nombre: "Pedro", Especialidad: "eléctrica"}); err != nil {
+		t.Fatal(err)
+	}
+	if ev := taller.Eventos(); len(ev) != 1 || ev[0].Tema != TemaPlazaLibre || ev[0].IDPlaza != 2 || ev[0].IDCliente != 1 {
+		t.Fatalf("al recalcular las plazas: %+v", ev)
+	}
+	select {
+	case e := <-todos.C:
+		t.Fatalf("Aplicar publica %+v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	publicarEventos(bus, "2026-01-01T10:00:00.000Z", taller.Eventos())
+	if e := <-todos.C; e.Tema != TemaPlazaLibre || e.Fecha != "2026-01-01T10:00:00.000Z" {
+		t.Fatalf("se publica %+v", e)
+	}
+}
+
+// leerEventosSSE lee eventos de un flujo SSE hasta que se cierra o llegan n
+func leerEventosSSE(lector *bufio.Reader, n int) ([]Evento, error) {
+	var out []Evento
+	for len(out) < n {
+		linea, err := lector.ReadString('\n')
+		if err != nil {
+			return out, err
+		}
+		if datos, ok := strings.CutPrefix(strings.TrimRight(linea, "\n"), "data: "); ok {
+			var e Evento
+			if err := json.Unmarshal([]byte(datos), &e); err != nil {
+				return out, err
+			}
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
+
+// TestEventosSSE suscribe un cliente SSE a los cierres de incidencias y a las
+// plazas que se liberan, recorre el ciclo de una reparación y comprueba que
+// recibe justo esos eventos y en orden, y que al reconectarse con
+// Last-Event-ID recibe los que se perdió
+func TestEventosSSE(t *testing.T) {
+	anterior := bus
+	bus = NuevoBusEventos()
+	defer func() { bus = anterior }()
+	direccion := "localhost:9671"
+	servidor := NuevoServidorEventos(direccion, bus)
+	if err := servidor.Escuchar(); err != nil {
+		t.Fatal(err)
+	}
+	defer servidor.Detener()
+
+	var tl Taller
+	var cerrojo sync.Mutex
+	aplicar := func(op Operacion) {
+		cerrojo.Lock()
+		defer cerrojo.Unlock()
+		if err := tl.Aplicar(op); err != nil {
+			t.Fatalf("%s: %v", op.Tipo, err)
+		}
+		publicarEventos(bus, op.Fecha, tl.Eventos())
+	}
+	// Un suscriptor del propio proceso que lo recibe todo
+	todos := bus.Suscribir()
+	defer todos.Cancelar()
+
+	url := "http://" + direccion + "/eventos?tema=" + TemaIncidenciaCerrada + "," + TemaPlazaLibre
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if tipo := resp.Header.Get("Content-Type"); tipo != "text/event-stream" {
+		t.Fatalf("el servidor responde %q en lugar de text/event-stream", tipo)
+	}
+	lector := bufio.NewReader(resp.Body)
+
+	for _, op := range []Operacion{
+		{Tipo: OpCrearMecanico, IDMecanico: 1, Nombre: "Laura", Especialidad: "mecánica"},
+		{Tipo: OpCrearCliente, IDCliente: 1, Nombre: "Ana"},
+		{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "1234ABC"},
+		{Tipo: OpCrearIncidencia, Matricula: "1234ABC", IDIncidencia: 7, TipoIncidencia: "mecánica", Prioridad: "alta"},
+		{Tipo: OpAsignarPlaza, Matricula: "1234ABC", IDMecanico: 1, IDPlaza: 1},
+		{Tipo: OpPresupuestar, Matricula: "1234ABC", Presupuesto: presupuestoDePrueba()},
+		{Tipo: OpResponderPresupuesto, Matricula: "1234ABC", Estado: PresupuestoAceptado},
+		{Tipo: OpEstadoIncidencia, Matricula: "1234ABC", Estado: "en proceso"},
+		{Tipo: OpEstadoIncidencia, Matricula: "1234ABC", Estado: "cerrada"},
+		{Tipo: OpEliminarCliente, IDCliente: 1},
+	} {
+		aplicar(op)
+	}
+	recibidos, err := leerEventosSSE(lector, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recibidos[0].Tema != TemaIncidenciaCerrada || recibidos[0].IDIncidencia != 7 ||
+		recibidos[1].Tema != TemaPlazaLibre || recibidos[1].IDPlaza != 1 || recibidos[1].IDCliente != 1 {
+		t.Fatalf("eventos SSE inesperados: %+v", recibidos)
+	}
+
+	var temas []string
+	for len(temas) < 6 {
+		select {
+		case e := <-todos.C:
+			temas = append(temas, e.Tema)
+		case <-time.After(time.Second):
+			t.Fatalf("el suscriptor interno solo ha recibido %v", temas)
+		}
+	}
+	esperados := []string{TemaEstadoIncidencia, TemaPlazaOcupada, TemaEstadoIncidencia, TemaEstadoIncidencia, TemaIncidenciaCerrada, TemaPlazaLibre}
+	if strings.Join(temas, " ") != strings.Join(esperados, " ") {
+		t.Fatalf("el suscriptor interno recibe %v en lugar de %v", temas, esperados)
+	}
+
+	// El cliente se desconecta, se liberan más plazas y vuelve con Last-Event-ID
+	resp.Body.Close()
+	ultimo := recibidos[1].Seq
+	for _, op := range []Operacion{
+		{Tipo: OpCrearCliente, IDCliente: 2, Nombre: "Luis"},
+		{Tipo: OpCrearVehiculo, IDCliente: 2, Matricula: "5678DEF"},
+		{Tipo: OpAsignarPlaza, Matricula: "5678DEF", IDMecanico: 1, IDPlaza: 2},
+		{Tipo: OpEliminarVehiculo, Matricula: "5678DEF"},
+		{Tipo: OpEliminarCliente, IDCliente: 2},
+	} {
+		aplicar(op)
+	}
+	pet, _ := http.NewRequest(http.MethodGet, url, nil)
+	pet.Header.Set("Last-Event-ID", strconv.FormatUint(ultimo, 10))
+	resp, err = http.DefaultClient.Do(pet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	recibidos, err = leerEventosSSE(bufio.NewReader(resp.Body), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recibidos[0].Tema != TemaPlazaLibre || recibidos[0].IDPlaza != 2 {
+		t.Fatalf("tras reconectarse se esperaba la plaza 2 libre y llega %+v", recibidos[0])
+	}
+	if todos.Perdidos() != 0 {
+		t.Error("el suscriptor interno ha perdido eventos")
+	}
+}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Algoritmos de exclusión mutua distribuida
+const (
+	AlgCentralizado   = "centralizado"    // un coordinador (el nodo 0) concede el acceso por turnos
+	AlgRicartAgrawala = "ricart-agrawala" // se entra con el permiso de todos los demás nodos
+	AlgAnillo         = "anillo"          // un testigo circula por el anillo de nodos
+)
+
+// tiempoEsperaEntrar es lo máximo que Entrar espera el acceso
+const tiempoEsperaEntrar = 10 * time.Second
+
+// Tipos de mensaje de exclusión mutua
+const (
+	exPedir    = "pedir"    // solicitud de acceso (al coordinador o a todos)
+	exConceder = "conceder" // permiso de acceso
+	exLiberar  = "liberar"  // el titular sale (centralizado)
+	exTestigo  = "testigo"  // paso del testigo (anillo)
+)
+
+// ExclusionMutua es un cerrojo compartido por varios procesos. Entrar
+// bloquea hasta que este proceso tiene acceso exclusivo y Salir lo cede.
+//
+// Los procesos leen cada uno su réplica del taller, que puede ir por detrás
+// de la del último titular. Por eso el acceso viaja con una versión: la
+// posición del estado replicado (índice de Raft o secuencia de la réplica)
+// en la que el titular dejó su operación. Salir la recibe y Entrar devuelve
+// la más alta conocida; antes de leer hay que esperar a tenerla aplicada.
+type ExclusionMutua interface {
+	Entrar() (version uint64, err error)
+	Salir(version uint64) error
+	Metricas() MetricasExclusion
+	Detener()
+}
+
+// MetricasExclusion cuenta los accesos a la sección crítica de un nodo y los
+// mensajes que ha enviado para conseguirlos
+type MetricasExclusion struct {
+	Algoritmo string
+	Entradas  int
+	Mensajes  int
+}
+
+// MensajesPorEntrada es la media de mensajes enviados por cada acceso
+func (m MetricasExclusion) MensajesPorEntrada() float64 {
+	if m.Entradas == 0 {
+		return 0
+	}
+	return float64(m.Mensajes) / float64(m.Entradas)
+}
+
+// String resume las métricas para mostrarlas por consola
+func (m MetricasExclusion) String() string {
+	return fmt.Sprintf("Exclusión %s | Entradas:%d | Mensajes:%d | Mensajes/entrada:%.1f",
+		m.Algoritmo, m.Entradas, m.Mensajes, m.MensajesPorEntrada())
+}
+
+// MensajeExclusion es lo que un nodo envía a otro (uno por conexión)
+type MensajeExclusion struct {
+	Tipo     string `json:"tipo"`
+	Origen   int    `json:"origen"`
+	Peticion uint64 `json:"peticion,omitempty"` // marca de Lamport de la solicitud (Ricart–Agrawala)
+	Version  uint64 `json:"version,omitempty"`  // versión del taller que dejó el último titular
+	Sello
+}
+
+// NuevaExclusion crea el nodo id del algoritmo indicado entre los procesos
+// que escuchan en pares y empieza a atender sus mensajes
+func NuevaExclusion(algoritmo string, id int, pares []string, relojes *Relojes) (ExclusionMutua, error) {
+	if id < 0 || id >= len(pares) {
+		return nil, fmt.Errorf("el nodo %d no está entre los %d pares", id, len(pares))
+	}
+	t := &transporteExclusion{algoritmo: algoritmo, id: id, pares: pares, relojes: relojes, parar: make(chan struct{})}
+	var e interface {
+		ExclusionMutua
+		recibir(m MensajeExclusion)
+	}
+	switch algoritmo {
+	case AlgCentralizado:
+		e = &ExclusionCentralizada{transporteExclusion: t}
+	case AlgRicartAgrawala:
+		e = &ExclusionRicartAgrawala{transporteExclusion: t}
+	case AlgAnillo:
+		e = &ExclusionAnillo{transporteExclusion: t, Pausa: 50 * time.Millisecond}
+	default:
+		return nil, fmt.Errorf("algoritmo de exclusión desconocido: %q", algoritmo)
+	}
+	t.recibir = e.recibir
+	if err := t.escuchar(); err != nil {
+		return nil, err
+	}
+	if anillo, ok := e.(*ExclusionAnillo); ok && id == 0 {
+		// El nodo 0 crea el testigo
+		go anillo.recibir(MensajeExclusion{Tipo: exTestigo, Origen: id})
+	}
+	return e, nil
+}
+
+// TRANSPORTE
+
+// transporteExclusion envía y recibe los mensajes de un nodo. Cada mensaje va
+// en su propia conexión y las conexiones se atienden de una en una, así que
+// los mensajes de un mismo nodo llegan en el orden en que se enviaron.
+type transporteExclusion struct {
+	algoritmo string
+	id        int
+	pares     []string
+	relojes   *Relojes
+	recibir   func(m MensajeExclusion)
+	oyente    net.Listener
+	parar     chan struct{}
+
+	cuentas  sync.Mutex // protege entradas, mensajes, version y parar
+	entradas int
+	mensajes int
+	version  uint64 // versión más alta que ha dejado un titular, que sepa este nodo
+}
+
+// conocer anota una versión recibida o dejada al salir y devuelve la más
+// alta conocida
+func (t *transporteExclusion) conocer(v uint64) uint64 {
+	t.cuentas.Lock()
+	defer t.cuentas.Unlock()
+	if v > t.version {
+		t.version = v
+	}
+	return t.version
+}
+
+func (t *transporteExclusion) escuchar() error {
+	oyente, err := net.Listen("tcp", t.pares[t.id])
+	if err != nil {
+		return err
+	}
+	t.oyente = oyente
+	go func() {
+		for {
+			conn, err := oyente.Accept()
+			if err != nil {
+				return
+			}
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+			var m MensajeExclusion
+			err = json.NewDecoder(conn).Decode(&m)
+			conn.Close()
+			if err == nil {
+				m.Recibido(t.relojes)
+				t.recibir(m)
+			}
+		}
+	}()
+	return nil
+}
+
+// enviar manda un mensaje al nodo p; los mensajes a uno mismo se entregan
+// directamente y no cuentan. No se debe llamar con el cerrojo del algoritmo
+// tomado.
+func (t *transporteExclusion) enviar(p int, m MensajeExclusion) error {
+	m.Origen = t.id
+	if p == t.id {
+		t.recibir(m)
+		return nil
+	}
+	t.cuentas.Lock()
+	t.mensajes++
+	t.cuentas.Unlock()
+	m.Sellar(t.relojes)
+	conn, err := net.DialTimeout("tcp", t.pares[p], 2*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	return json.NewEncoder(conn).Encode(m)
+}
+
+// esperar bloquea hasta que se cierre listo, se agote el tiempo o se detenga
+// el nodo
+func (t *transporteExclusion) esperar(listo chan struct{}) error {
+	select {
+	case <-listo:
+		t.cuentas.Lock()
+		t.entradas++
+		t.cuentas.Unlock()
+		return nil
+	case <-time.After(tiempoEsperaEntrar):
+		return errors.New("tiempo de espera agotado para entrar en la sección crítica")
+	case <-t.parar:
+		return errors.New("exclusión mutua detenida")
+	}
+}
+
+// EsperarVersion espera a que la réplica local, cuya posición devuelve
+// aplicada, alcance la versión v que dejó el último titular
+func EsperarVersion(aplicada func() uint64, v uint64) error {
+	limite := time.Now().Add(tiempoEsperaEntrar)
+	for aplicada() < v {
+		if time.Now().After(limite) {
+			return fmt.Errorf("el taller no alcanza a tiempo la versión %d del último titular", v)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+// Metricas devuelve los accesos y mensajes de este nodo
+func (t *transporteExclusion) Metricas() MetricasExclusion {
+	t.cuentas.Lock()
+	defer t.cuentas.Unlock()
+	return MetricasExclusion{Algoritmo: t.algoritmo, Entradas: t.entradas, Mensajes: t.mensajes}
+}
+
+// Detener deja de atender mensajes
+func (t *transporteExclusion) Detener() {
+	t.cuentas.Lock()
+	defer t.cuentas.Unlock()
+	select {
+	case <-t.parar:
+		return
+	default:
+	}
+	close(t.parar)
+	t.oyente.Close()
+}
+
+// cerrado indica si el canal ya está cerrado
+func cerrado(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// CENTRALIZADO
+
+// ExclusionCentralizada pide el acceso a un coordinador (el nodo 0), que lo
+// concede por orden de llegada. Cuesta tres mensajes por entrada: pedir,
+// conceder y liberar.
+type ExclusionCentralizada struct {
+	*transporteExclusion
+
+	mu        sync.Mutex
+	esperando bool
+	concedido chan struct{}
+
+	// Solo en el coordinador
+	ocupada bool
+	titular int
+	cola    []int
+}
+
+const coordinadorExclusion = 0
+
+// Entrar pide el acceso al coordinador y espera a que lo conceda
+func (e *ExclusionCentralizada) Entrar() (uint64, error) {
+	e.mu.Lock()
+	e.esperando = true
+	e.concedido = make(chan struct{})
+	concedido := e.concedido
+	e.mu.Unlock()
+
+	err := e.enviar(coordinadorExclusion, MensajeExclusion{Tipo: exPedir})
+	if err == nil {
+		err = e.esperar(concedido)
+	}
+	if err != nil {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if !cerrado(concedido) {
+			// Si el permiso llega más tarde se devuelve sin usarlo
+			e.esperando = false
+			return 0, err
+		}
+		// Concedido justo al rendirse: se aprovecha
+	}
+	return e.conocer(0), nil
+}
+
+// Salir devuelve el acceso al coordinador con la versión en que queda el
+// taller
+func (e *ExclusionCentralizada) Salir(version uint64) error {
+	return e.enviar(coordinadorExclusion, MensajeExclusion{Tipo: exLiberar, Version: e.conocer(version)})
+}
+
+func (e *ExclusionCentralizada) recibir(m MensajeExclusion) {
+	switch m.Tipo {
+	case exPedir:
+		e.mu.Lock()
+		if e.ocupada {
+			e.cola = append(e.cola, m.Origen)
+			e.mu.Unlock()
+			return
+		}
+		e.ocupada, e.titular = true, m.Origen
+		e.mu.Unlock()
+		e.conceder(m.Origen)
+	case exLiberar:
+		e.conocer(m.Version)
+		e.mu.Lock()
+		if !e.ocupada || e.titular != m.Origen {
+			e.mu.Unlock()
+			return
+		}
+		e.ocupada = false
+		if len(e.cola) == 0 {
+			e.mu.Unlock()
+			return
+		}
+		sig := e.cola[0]
+		e.cola = e.cola[1:]
+		e.ocupada, e.titular = true, sig
+		e.mu.Unlock()
+		e.conceder(sig)
+	case exConceder:
+		e.conocer(m.Version)
+		e.mu.Lock()
+		if !e.esperando {
+			e.mu.Unlock()
+			e.Salir(0)
+			return
+		}
+		e.esperando = false
+		close(e.concedido)
+		e.mu.Unlock()
+	}
+}
+
+// conceder da el acceso a p; si p no responde se da por liberado y pasa al
+// siguiente de la cola
+func (e *ExclusionCentralizada) conceder(p int) {
+	if err := e.enviar(p, MensajeExclusion{Tipo: exConceder, Version: e.conocer(0)}); err != nil {
+		e.recibir(MensajeExclusion{Tipo: exLiberar, Origen: p})
+	}
+}
+
+// RICART–AGRAWALA
+
+// ExclusionRicartAgrawala pide permiso a todos los demás nodos con una marca
+// de Lamport; cada uno lo concede salvo que esté dentro o tenga una petición
+// anterior, en cuyo caso lo aplaza hasta salir. Cuesta 2(N-1) mensajes por
+// entrada y no tiene coordinador, pero necesita que respondan todos los nodos.
+type ExclusionRicartAgrawala struct {
+	*transporteExclusion
+
+	mu         sync.Mutex
+	reloj      uint64
+	pidiendo   bool
+	dentro     bool
+	peticion   uint64 // marca de la petición en curso
+	respuestas map[int]bool
+	aplazadas  []MensajeExclusion
+	listo      chan struct{}
+}
+
+// Entrar pide permiso a todos los nodos y espera a tenerlo de todos
+func (e *ExclusionRicartAgrawala) Entrar() (uint64, error) {
+	e.mu.Lock()
+	e.reloj++
+	e.peticion = e.reloj
+	e.pidiendo = true
+	e.respuestas = map[int]bool{}
+	e.listo = make(chan struct{})
+	listo, peticion := e.listo, e.peticion
+	if len(e.pares) == 1 {
+		e.dentro = true
+		close(e.listo)
+	}
+	e.mu.Unlock()
+
+	var err error
+	for p := range e.pares {
+		if p == e.id {
+			continue
+		}
+		if err = e.enviar(p, MensajeExclusion{Tipo: exPedir, Peticion: peticion}); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = e.esperar(listo)
+	}
+	if err != nil {
+		e.mu.Lock()
+		if !cerrado(listo) {
+			e.mu.Unlock()
+			// Se retira la petición y se responde a los que esperaban
+			e.Salir(0)
+			return 0, err
+		}
+		e.mu.Unlock()
+	}
+	return e.conocer(0), nil
+}
+
+// Salir responde a las peticiones aplazadas con la versión en que queda el
+// taller
+func (e *ExclusionRicartAgrawala) Salir(version uint64) error {
+	version = e.conocer(version)
+	e.mu.Lock()
+	e.pidiendo, e.dentro = false, false
+	aplazadas := e.aplazadas
+	e.aplazadas = nil
+	e.mu.Unlock()
+	var err error
+	for _, m := range aplazadas {
+		if errEnvio := e.enviar(m.Origen, MensajeExclusion{Tipo: exConceder, Peticion: m.Peticion, Version: version}); errEnvio != nil {
+			err = errEnvio
+		}
+	}
+	return err
+}
+
+func (e *ExclusionRicartAgrawala) recibir(m MensajeExclusion) {
+	e.mu.Lock()
+	switch m.Tipo {
+	case exPedir:
+		if m.Peticion > e.reloj {
+			e.reloj = m.Peticion
+		}
+		e.reloj++
+		// Tiene preferencia la petición con menor marca y, a igualdad, el
+		// nodo con menor id
+		propiaAntes := e.peticion < m.Peticion || (e.peticion == m.Peticion && e.id < m.Origen)
+		if e.dentro || (e.pidiendo && propiaAntes) {
+			e.aplazadas = append(e.aplazadas, m)
+			e.mu.Unlock()
+			return
+		}
+		e.mu.Unlock()
+		e.enviar(m.Origen, MensajeExclusion{Tipo: exConceder, Peticion: m.Peticion, Version: e.conocer(0)})
+	case exConceder:
+		e.conocer(m.Version)
+		// Las respuestas a peticiones ya retiradas se ignoran
+		if e.pidiendo && !e.dentro && m.Peticion == e.peticion {
+			e.respuestas[m.Origen] = true
+			if len(e.respuestas) == len(e.pares)-1 {
+				e.dentro = true
+				close(e.listo)
+			}
+		}
+		e.mu.Unlock()
+	default:
+		e.mu.Unlock()
+	}
+}
+
+// ANILLO
+
+// ExclusionAnillo hace circular un testigo por los nodos en orden de id; solo
+// entra quien lo tiene. Los nodos que no lo necesitan lo retienen Pausa antes
+// de pasarlo, así que el anillo gasta mensajes aunque nadie quiera entrar. Si
+// cae el nodo que tiene el testigo, este se pierde.
+type ExclusionAnillo struct {
+	*transporteExclusion
+	Pausa time.Duration
+
+	mu      sync.Mutex
+	testigo bool
+	vuelta  int // cuántas veces ha llegado el testigo a este nodo
+	quiero  bool
+	dentro  bool
+	listo   chan struct{}
+}
+
+// Entrar espera a que llegue el testigo (o lo usa si ya lo tiene)
+func (e *ExclusionAnillo) Entrar() (uint64, error) {
+	e.mu.Lock()
+	e.quiero = true
+	e.listo = make(chan struct{})
+	listo := e.listo
+	if e.testigo && !e.dentro {
+		e.dentro = true
+		close(e.listo)
+	}
+	e.mu.Unlock()
+
+	err := e.esperar(listo)
+	if err != nil {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if !cerrado(listo) {
+			e.quiero = false
+			return 0, err
+		}
+	}
+	return e.conocer(0), nil
+}
+
+// Salir pasa el testigo al siguiente nodo con la versión en que queda el
+// taller
+func (e *ExclusionAnillo) Salir(version uint64) error {
+	e.conocer(version)
+	e.mu.Lock()
+	e.dentro, e.quiero = false, false
+	e.mu.Unlock()
+	e.pasar()
+	return nil
+}
+
+func (e *ExclusionAnillo) recibir(m MensajeExclusion) {
+	if m.Tipo != exTestigo {
+		return
+	}
+	e.conocer(m.Version)
+	e.mu.Lock()
+	e.testigo = true
+	e.vuelta++
+	if e.quiero && !e.dentro {
+		e.dentro = true
+		close(e.listo)
+		e.mu.Unlock()
+		return
+	}
+	vuelta := e.vuelta
+	e.mu.Unlock()
+	go e.retener(vuelta)
+}
+
+// retener guarda el testigo durante Pausa por si se pide entrar y luego lo
+// pasa. Si entretanto se entró y se salió, el testigo ya se pasó al salir
+// (vuelta ha cambiado o ya no está aquí) y no hay que pasarlo otra vez.
+func (e *ExclusionAnillo) retener(vuelta int) {
+	select {
+	case <-e.parar:
+		return
+	case <-time.After(e.Pausa):
+	}
+	e.mu.Lock()
+	if e.dentro || !e.testigo || e.vuelta != vuelta {
+		e.mu.Unlock()
+		return // se entró durante la pausa; Salir lo pasa
+	}
+	if e.quiero {
+		e.dentro = true
+		close(e.listo)
+		e.mu.Unlock()
+		return
+	}
+	e.mu.Unlock()
+	e.pasar()
+}
+
+// pasar envía el testigo al siguiente nodo que responda. Con un solo nodo
+// (o si no responde ninguno) se queda aquí.
+func (e *ExclusionAnillo) pasar() {
+	select {
+	case <-e.parar:
+		return
+	default:
+	}
+	e.mu.Lock()
+	e.testigo = false
+	e.mu.Unlock()
+	for k := 1; k < len(e.pares); k++ {
+		sig := (e.id + k) % len(e.pares)
+		if e.enviar(sig, MensajeExclusion{Tipo: exTestigo, Version: e.conocer(0)}) == nil {
+			return
+		}
+	}
+	e.mu.Lock()
+	e.testigo = true
+	e.vuelta++
+	vuelta := e.vuelta
+	e.mu.Unlock()
+	if len(e.pares) > 1 {
+		go e.retener(vuelta)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestExclusionTalleresReplicados pone a tres procesos, cada uno con su
+// réplica Raft del taller, a asignar plazas a la vez. Cada uno consulta la
+// plaza libre en su propia réplica, que puede ir por detrás del líder; con
+// la versión que viaja con el acceso, ninguno debe elegir una plaza que el
+// titular anterior ya ocupó.
+func TestExclusionTalleresReplicados(t *testing.T) {
+	const nodos, porNodo = 3, 4
+	for k, alg := range []string{AlgCentralizado, AlgRicartAgrawala, AlgAnillo} {
+		t.Run(alg, func(t *testing.T) {
+			c, err := NuevoClusterRaft(nodos, 9340+k*nodos)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Detener()
+			var pares []string
+			for i := 0; i < nodos; i++ {
+				pares = append(pares, fmt.Sprintf("localhost:%d", 9360+k*nodos+i))
+			}
+			excl := make([]ExclusionMutua, nodos)
+			for i := range excl {
+				e, err := NuevaExclusion(alg, i, pares, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer e.Detener()
+				excl[i] = e
+			}
+
+			plazas := nodos * porNodo / 2
+			ops := []Operacion{{Tipo: OpCrearCliente, IDCliente: 1, Nombre: "Ana"}}
+			for m := 1; m <= plazas/2; m++ {
+				ops = append(ops, Operacion{Tipo: OpCrearMecanico, IDMecanico: m, Nombre: fmt.Sprint("mecánico", m), Especialidad: "mecánica"})
+			}
+			for n := 0; n < nodos; n++ {
+				for v := 0; v < porNodo; v++ {
+					ops = append(ops, Operacion{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: fmt.Sprintf("N%dV%d", n, v)})
+				}
+			}
+			for _, op := range ops {
+				if err := c.Proponer(op); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := c.EsperarConvergencia(5 * time.Second); err != nil {
+				t.Fatal(err)
+			}
+
+			// aplicada es la versión de la réplica de un nodo; al salir se
+			// deja la más alta, que ya incluye la asignación recién confirmada
+			aplicada := func(i int) uint64 {
+				_, _, a := c.nodos[i].Indices()
+				return uint64(a)
+			}
+			var mu sync.Mutex
+			asignadas, dobles := 0, 0
+			var wg sync.WaitGroup
+			for n := range excl {
+				wg.Add(1)
+				go func(n int) {
+					defer wg.Done()
+					for v := 0; v < porNodo; v++ {
+						version, err := excl[n].Entrar()
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						if err := EsperarVersion(func() uint64 { return aplicada(n) }, version); err != nil {
+							t.Error(err)
+						}
+						c.cerrojos[n].Lock()
+						libre := 0
+						for _, p := range c.Taller(n).PlazasTaller {
+							if p.EstaLibre() {
+								libre = p.IDPlaza
+								break
+							}
+						}
+						c.cerrojos[n].Unlock()
+						if libre != 0 {
+							err := c.Proponer(Operacion{Tipo: OpAsignarPlaza, Matricula: fmt.Sprintf("N%dV%d", n, v), IDMecanico: 1, IDPlaza: libre})
+							mu.Lock()
+							if err != nil {
+								dobles++
+							} else {
+								asignadas++
+							}
+							mu.Unlock()
+						}
+						var salida uint64
+						for i := range excl {
+							salida = max(salida, aplicada(i))
+						}
+						excl[n].Salir(salida)
+					}
+				}(n)
+			}
+			wg.Wait()
+			if dobles > 0 || asignadas != plazas {
+				t.Fatalf("%d plazas asignadas de %d y %d elegidas ya ocupadas", asignadas, plazas, dobles)
+			}
+		})
+	}
+}
+
+// sinExclusion no protege nada; sirve para comprobar que sin
+// exclusión mutua sí hay dobles reservas
+type sinExclusion struct{}
+
+func (sinExclusion) Entrar() (uint64, error)     { return 0, nil }
+func (sinExclusion) Salir(uint64) error          { return nil }
+func (sinExclusion) Metricas() MetricasExclusion { return MetricasExclusion{Algoritmo: "ninguno"} }
+func (sinExclusion) Detener()                    {}
+
+// TestExclusionPlazas enfrenta a varios nodos que reservan plazas de un
+// mismo taller con cada algoritmo y comprueba que nunca hay dos dentro de la
+// sección crítica ni una plaza reservada dos veces. Sin exclusión mutua la
+// misma contienda sí provoca solapes, lo que prueba que es real.
+func TestExclusionPlazas(t *testing.T) {
+	const nodos, porNodo = 4, 6
+	for k, alg := range []string{"", AlgCentralizado, AlgRicartAgrawala, AlgAnillo} {
+		nombre := alg
+		if nombre == "" {
+			nombre = "sin exclusión"
+		}
+		t.Run(nombre, func(t *testing.T) {
+			var pares []string
+			for i := 0; i < nodos; i++ {
+				pares = append(pares, fmt.Sprintf("localhost:%d", 9701+k*nodos+i))
+			}
+			excl := make([]ExclusionMutua, nodos)
+			for i := range excl {
+				if alg == "" {
+					excl[i] = sinExclusion{}
+					continue
+				}
+				e, err := NuevaExclusion(alg, i, pares, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer e.Detener()
+				excl[i] = e
+			}
+			asignadas, dobles, solapes, err := contiendaPlazas(excl, porNodo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if alg == "" {
+				if solapes == 0 {
+					t.Fatal("sin exclusión mutua ningún nodo coincide con otro: la contienda no prueba nada")
+				}
+				return
+			}
+			if dobles > 0 || solapes > 0 {
+				t.Fatalf("%d dobles reservas y %d solapes en la sección crítica", dobles, solapes)
+			}
+			if plazas := nodos * porNodo / 2; asignadas != plazas {
+				t.Errorf("se han asignado %d plazas de %d", asignadas, plazas)
+			}
+			entradas := 0
+			for _, e := range excl {
+				entradas += e.Metricas().Entradas
+			}
+			if entradas != nodos*porNodo {
+				t.Errorf("las métricas cuentan %d entradas en vez de %d", entradas, nodos*porNodo)
+			}
+		})
+	}
+}
+
+// contiendaPlazas pone a cada nodo a asignar porNodo vehículos a la vez sobre
+// un taller con menos plazas que vehículos. Entre consultar la plaza libre y
+// ocuparla pasa un momento, como ocurre cuando la asignación viaja por red.
+func contiendaPlazas(excl []ExclusionMutua, porNodo int) (asignadas, dobles, solapes int, err error) {
+	var t Taller
+	var cerrojo sync.Mutex
+	plazas := len(excl) * porNodo / 2
+	for m := 1; m <= plazas/2; m++ {
+		t.Aplicar(Operacion{Tipo: OpCrearMecanico, IDMecanico: m, Nombre: fmt.Sprint("mecánico", m), Especialidad: "mecánica"})
+	}
+	t.Aplicar(Operacion{Tipo: OpCrearCliente, IDCliente: 1, Nombre: "Ana"})
+	for n := range excl {
+		for v := 0; v < porNodo; v++ {
+			t.Aplicar(Operacion{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: fmt.Sprintf("N%dV%d", n, v)})
+		}
+	}
+
+	var mu sync.Mutex // protege los contadores
+	dentro := 0
+	var wg sync.WaitGroup
+	var errs []error
+	for n, e := range excl {
+		wg.Add(1)
+		go func(n int, e ExclusionMutua) {
+			defer wg.Done()
+			for v := 0; v < porNodo; v++ {
+				if _, err := e.Entrar(); err != nil {
+					mu.Lock()
+					errs = append(errs, err)
+					mu.Unlock()
+					return
+				}
+				mu.Lock()
+				dentro++
+				if dentro > 1 {
+					solapes++
+				}
+				mu.Unlock()
+
+				cerrojo.Lock()
+				libre := 0
+				for _, p := range t.PlazasTaller {
+					if p.EstaLibre() {
+						libre = p.IDPlaza
+						break
+					}
+				}
+				cerrojo.Unlock()
+				if libre != 0 {
+					time.Sleep(2 * time.Millisecond)
+					cerrojo.Lock()
+					op := Operacion{Tipo: OpAsignarPlaza, Matricula: fmt.Sprintf("N%dV%d", n, v), IDMecanico: 1, IDPlaza: libre}
+					errAsignar := t.Aplicar(op)
+					cerrojo.Unlock()
+					mu.Lock()
+					if errAsignar != nil {
+						dobles++
+					} else {
+						asignadas++
+					}
+					mu.Unlock()
+				}
+
+				mu.Lock()
+				dentro--
+				mu.Unlock()
+				e.Salir(0)
+			}
+		}(n, e)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return 0, 0, 0, errs[0]
+	}
+	return asignadas, dobles, solapes, nil
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	htmlTemplate "html/template"
+	"math"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// IVA general que se aplica a las facturas, en tanto por ciento
+const IVAGeneral = 21
+
+// Tipos de línea de factura
+const (
+	LineaManoObra = "mano de obra"
+	LineaPieza    = "pieza"
+)
+
+// TarifasHora es el precio por hora de mano de obra según la especialidad
+// del mecánico, en céntimos
+var TarifasHora = map[string]int64{"mecánica": 4500, "eléctrica": 5000, "carrocería": 4000}
+
+// EmisorFacturas son los datos del taller que figuran en las facturas
+var EmisorFacturas = struct {
+	Nombre    string
+	NIF       string
+	Direccion string
+}{"Taller Mecánico", "B00000000", "Calle Mayor 1, 28001 Madrid"}
+
+// LineaFactura es un concepto facturado: horas de un mecánico o piezas.
+// Los importes van en céntimos.
+type LineaFactura struct {
+	Tipo       string  `json:"tipo"` // LineaManoObra o LineaPieza
+	Concepto   string  `json:"concepto"`
+	IDMecanico int     `json:"idMecanico,omitempty"`
+	Cantidad   float64 `json:"cantidad"`             // horas o unidades
+	Precio     int64   `json:"precio"`               // por hora o por unidad
+	Descuento  float64 `json:"descuento,omitempty"`  // en tanto por ciento
+	Importe    int64   `json:"importe"`              // lo calcula Calcular
+	IDRepuesto string  `json:"idRepuesto,omitempty"` // referencia de la pieza, si la tiene
+}
+
+// Factura es la factura de una incidencia cerrada. Una vez emitida no
+// cambia: guarda los datos del cliente y del vehículo de ese momento.
+type Factura struct {
+	Numero       string         `json:"numero"` // "2026-0001": año y orden dentro del año
+	Anio         int            `json:"anio"`
+	Secuencia    int            `json:"secuencia"`
+	Fecha        string         `json:"fecha"`
+	IDCliente    int            `json:"idCliente"`
+	Cliente      string         `json:"cliente"`
+	Email        string         `json:"email,omitempty"`
+	Telefono     string         `json:"telefono,omitempty"`
+	Matricula    string         `json:"matricula"`
+	Vehiculo     string         `json:"vehiculo,omitempty"` // marca y modelo
+	IDIncidencia int            `json:"idIncidencia"`
+	Lineas       []LineaFactura `json:"lineas"`
+	Descuento    float64        `json:"descuento,omitempty"` // sobre el total de las líneas, en tanto por ciento
+	// Importes en céntimos; los calcula Calcular
+	Subtotal      int64 `json:"subtotal"`
+	ImporteDto    int64 `json:"importeDescuento"`
+	BaseImponible int64 `json:"baseImponible"`
+	IVA           int64 `json:"iva"`
+	Total         int64 `json:"total"`
+}
+
+// Calcular rellena los importes de las líneas y los totales: descuento de
+// cada línea, descuento general sobre la suma, base imponible, IVA y total.
+// Cada importe se redondea al céntimo.
+func (f *Factura) Calcular() {
+	f.Subtotal = 0
+	for i := range f.Lineas {
+		l := &f.Lineas[i]
+		l.Importe = redondear(l.Cantidad * float64(l.Precio) * (1 - l.Descuento/100))
+		f.Subtotal += l.Importe
+	}
+	f.ImporteDto = redondear(float64(f.Subtotal) * f.Descuento / 100)
+	f.BaseImponible = f.Subtotal - f.ImporteDto
+	f.IVA = redondear(float64(f.BaseImponible) * IVAGeneral / 100)
+	f.Total = f.BaseImponible + f.IVA
+}
+
+// Comprobar valida las líneas y los descuentos de una factura
+func (f *Factura) Comprobar() error {
+	if len(f.Lineas) == 0 {
+		return errors.New("la factura no tiene líneas")
+	}
+	if f.Descuento < 0 || f.Descuento > 100 {
+		return errors.New("el descuento debe estar entre 0 y 100")
+	}
+	for _, l := range f.Lineas {
+		switch {
+		case l.Tipo != LineaManoObra && l.Tipo != LineaPieza:
+			return fmt.Errorf("tipo de línea desconocido: %q", l.Tipo)
+		case l.Cantidad <= 0 || l.Precio < 0:
+			return fmt.Errorf("cantidad o precio no válidos en %q", l.Concepto)
+		case l.Descuento < 0 || l.Descuento > 100:
+			return fmt.Errorf("descuento no válido en %q", l.Concepto)
+		}
+	}
+	return nil
+}
+
+func redondear(x float64) int64 { return int64(math.Round(x)) }
+
+// emitirFactura aplica OpEmitirFactura: factura la incidencia cerrada del
+// vehículo y le da el siguiente número del año de la operación
+func (t *Taller) emitirFactura(op Operacion) error {
+	if op.Factura == nil {
+		return errors.New("falta la factura")
+	}
+	if len(op.Fecha) < 4 {
+		return errors.New("falta la fecha de la factura")
+	}
+	anio, err := strconv.Atoi(op.Fecha[:4])
+	if err != nil {
+		return fmt.Errorf("fecha no válida: %q", op.Fecha)
+	}
+	c, v := t.BuscarVehiculo(op.Matricula)
+	if v == nil || v.GetIncidencia() == nil {
+		return errors.New("vehículo no encontrado o sin incidencia")
+	}
+	inc := v.GetIncidencia()
+	if inc.Estado != "cerrada" {
+		return errors.New("solo se facturan incidencias cerradas")
+	}
+	if t.FacturaDeIncidencia(inc.IDIncidencia) != nil {
+		return errors.New("la incidencia ya está facturada")
+	}
+	f := *op.Factura
+	f.Lineas = append([]LineaFactura(nil), op.Factura.Lineas...)
+	if err := f.Comprobar(); err != nil {
+		return err
+	}
+	for _, l := range f.Lineas {
+		if l.Tipo == LineaManoObra {
+			if m, _ := t.BuscarMecanico(l.IDMecanico); m == nil {
+				return fmt.Errorf("no existe el mecánico %d", l.IDMecanico)
+			}
+		}
+	}
+	f.Anio, f.Secuencia = anio, 1
+	for _, x := range t.Facturas {
+		if x.Anio == anio && x.Secuencia >= f.Secuencia {
+			f.Secuencia = x.Secuencia + 1
+		}
+	}
+	f.Numero = fmt.Sprintf("%d-%04d", anio, f.Secuencia)
+	f.Fecha = op.Fecha
+	f.IDCliente, f.Cliente, f.Email, f.Telefono = c.IDCliente, c.Nombre, c.Email, c.Telefono
+	f.Matricula, f.Vehiculo = v.Matricula, strings.TrimSpace(v.Marca+" "+v.Modelo)
+	f.IDIncidencia = inc.IDIncidencia
+	f.Calcular()
+	t.Facturas = append(t.Facturas, &f)
+	return nil
+}
+
+// FacturaDeIncidencia devuelve la factura de una incidencia (nil si no tiene)
+func (t *Taller) FacturaDeIncidencia(id int) *Factura {
+	for _, f := range t.Facturas {
+		if f.IDIncidencia == id {
+			return f
+		}
+	}
+	return nil
+}
+
+// BuscarFactura devuelve la factura con ese número (nil si no existe)
+func (t *Taller) BuscarFactura(numero string) *Factura {
+	for _, f := range t.Facturas {
+		if f.Numero == numero {
+			return f
+		}
+	}
+	return nil
+}
+
+// FacturasDeCliente devuelve las facturas de un cliente en orden de emisión
+func (t *Taller) FacturasDeCliente(id int) []*Factura {
+	var out []*Factura
+	for _, f := range t.Facturas {
+		if f.IDCliente == id {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// mecanicosIncidencia devuelve los mecánicos asignados a la incidencia
+// seguidos de los que fichan en ella aunque ya no estén asignados (por
+// ejemplo, porque su terminal dejó de responder). Uno que ya no está en el
+// taller se cobra con la especialidad de la incidencia.
+func (t *Taller) mecanicosIncidencia(inc *Incidencia) []*Mecanico {
+	out := append([]*Mecanico(nil), inc.GetMecanicos()...)
+	vistos := map[int]bool{}
+	for _, m := range out {
+		vistos[m.IDMecanico] = true
+	}
+	for _, s := range inc.Sesiones {
+		if vistos[s.IDMecanico] {
+			continue
+		}
+		vistos[s.IDMecanico] = true
+		m, _ := t.BuscarMecanico(s.IDMecanico)
+		if m == nil {
+			m = &Mecanico{IDMecanico: s.IDMecanico, Nombre: fmt.Sprintf("mecánico %d", s.IDMecanico), Especialidad: inc.Tipo}
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+// lineasManoObra prepara las líneas de mano de obra de una incidencia: una
+// por mecánico con horas, a la tarifa de su especialidad
+func (t *Taller) lineasManoObra(inc *Incidencia, horas map[int]float64) []LineaFactura {
+	var lineas []LineaFactura
+	for _, m := range t.mecanicosIncidencia(inc) {
+		if horas[m.IDMecanico] <= 0 {
+			continue
+		}
+		lineas = append(lineas, LineaFactura{Tipo: LineaManoObra, IDMecanico: m.IDMecanico,
+			Concepto: fmt.Sprintf("Mano de obra %s (%s)", m.Especialidad, m.Nombre),
+			Cantidad: horas[m.IDMecanico], Precio: TarifasHora[m.Especialidad]})
+	}
+	return lineas
+}
+
+// FORMATO
+
+// Euros da formato español a un importe en céntimos: 1.234,56 €
+func Euros(centimos int64) string {
+	signo := ""
+	if centimos < 0 {
+		signo, centimos = "-", -centimos
+	}
+	entero := strconv.FormatInt(centimos/100, 10)
+	var grupos []string
+	for len(entero) > 3 {
+		grupos = append([]string{entero[len(entero)-3:]}, grupos...)
+		entero = entero[:len(entero)-3]
+	}
+	grupos = append([]string{entero}, grupos...)
+	return fmt.Sprintf("%s%s,%02d €", signo, strings.Join(grupos, "."), centimos%100)
+}
+
+func cantidadTexto(x float64) string {
+	return strings.Replace(strconv.FormatFloat(x, 'f', -1, 64), ".", ",", 1)
+}
+
+// ajustar rellena s con espacios hasta n caracteres (no bytes) por la
+// izquierda o por la derecha; si no cabe lo corta
+func ajustar(s string, n int, derecha bool) string {
+	r := []rune(s)
+	if len(r) >= n {
+		return string(r[:n])
+	}
+	relleno := strings.Repeat(" ", n-len(r))
+	if derecha {
+		return relleno + s
+	}
+	return s + relleno
+}
+
+var funcionesFactura = map[string]interface{}{
+	"euros":    Euros,
+	"cantidad": cantidadTexto,
+	"iva":      func() int { return IVAGeneral },
+	"emisor":   func() interface{} { return EmisorFacturas },
+	"neg":      func(x int64) int64 { return -x },
+	"izq":      func(n int, s string) string { return ajustar(s, n, false) },
+	"der":      func(n int, s string) string { return ajustar(s, n, true) },
+	"fecha": func(f string) string {
+		if len(f) >= 10 {
+			return f[8:10] + "/" + f[5:7] + "/" + f[:4]
+		}
+		return f
+	},
+}
+
+// importesTexto son las líneas y los totales en texto plano, iguales en la
+// factura y en el presupuesto (los dos tienen los mismos campos de importes)
+const importesTexto = `{{define "importes"}}--------------------------------------------------------------------------------
+{{izq 40 "Concepto"}}{{der 7 "Cant."}}{{der 12 "Precio"}}{{der 6 "Dto."}}{{der 15 "Importe"}}
+{{range .Lineas}}{{izq 40 .Concepto}}{{der 7 (cantidad .Cantidad)}}{{der 12 (euros .Precio)}}{{der 6 (printf "%s%%" (cantidad .Descuento))}}{{der 15 (euros .Importe)}}
+{{end}}--------------------------------------------------------------------------------
+{{der 65 "Suma"}}{{der 15 (euros .Subtotal)}}
+{{if .ImporteDto}}{{der 65 (printf "Descuento %s%%" (cantidad .Descuento))}}{{der 15 (euros (neg .ImporteDto))}}
+{{end}}{{der 65 "Base imponible"}}{{der 15 (euros .BaseImponible)}}
+{{der 65 (printf "IVA %d%%" iva)}}{{der 15 (euros .IVA)}}
+{{der 65 "TOTAL"}}{{der 15 (euros .Total)}}
+{{end}}`
+
+var plantillaFacturaTexto = template.Must(template.New("factura").Funcs(funcionesFactura).Parse(`{{with emisor}}{{.Nombre}} · NIF {{.NIF}} · {{.Direccion}}{{end}}
+FACTURA {{.Numero}}{{der 63 (printf "Fecha: %s" (fecha .Fecha))}}
+Cliente: {{.Cliente}} (n.º {{.IDCliente}}){{if .Email}} · {{.Email}}{{end}}{{if .Telefono}} · {{.Telefono}}{{end}}
+Vehículo: {{.Matricula}}{{if .Vehiculo}} {{.Vehiculo}}{{end}} · Incidencia {{.IDIncidencia}}
+{{template "importes" .}}` + importesTexto))
+
+var plantillaPresupuestoTexto = template.Must(template.New("presupuesto").Funcs(funcionesFactura).Parse(`PRESUPUESTO versión {{.Version}} ({{.Estado}})
+{{if .Motivo}}Revisión: {{.Motivo}}
+{{end}}{{template "importes" .}}{{if .Comentario}}Respuesta del cliente: {{.Comentario}}
+{{end}}` + importesTexto))
+
+var plantillaFacturaHTML = htmlTemplate.Must(htmlTemplate.New("factura").Funcs(htmlTemplate.FuncMap(funcionesFactura)).Parse(`<!DOCTYPE html>
+<html lang="es">
+<head>
+<meta charset="utf-8">
+<title>Factura {{.Numero}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; width: 100%; }
+th, td { padding: .3em .6em; border-bottom: 1px solid #ccc; }
+td.n, th.n { text-align: right; }
+tfoot td { border: none; }
+.total td { font-weight: bold; font-size: 1.2em; }
+@media print { body { margin: 0; } }
+</style>
+</head>
+<body>
+{{with emisor}}<p><strong>{{.Nombre}}</strong><br>NIF {{.NIF}}<br>{{.Direccion}}</p>{{end}}
+<h1>Factura {{.Numero}}</h1>
+<p>Fecha: {{fecha .Fecha}}</p>
+<p><strong>Cliente:</strong> {{.Cliente}} (n.º {{.IDCliente}}){{if .Email}}<br>{{.Email}}{{end}}{{if .Telefono}}<br>{{.Telefono}}{{end}}</p>
+<p><strong>Vehículo:</strong> {{.Matricula}}{{if .Vehiculo}} {{.Vehiculo}}{{end}} · Incidencia {{.IDIncidencia}}</p>
+<table>
+<thead><tr><th>Concepto</th><th class="n">Cantidad</th><th class="n">Precio</th><th class="n">Dto.</th><th class="n">Importe</th></tr></thead>
+<tbody>
+{{range .Lineas}}<tr><td>{{.Concepto}}</td><td class="n">{{cantidad .Cantidad}}</td><td class="n">{{euros .Precio}}</td><td class="n">{{cantidad .Descuento}} %</td><td class="n">{{euros .Importe}}</td></tr>
+{{end}}</tbody>
+<tfoot>
+<tr><td colspan="4" class="n">Suma</td><td class="n">{{euros .Subtotal}}</td></tr>
+{{if .ImporteDto}}<tr><td colspan="4" class="n">Descuento {{cantidad .Descuento}} %</td><td class="n">{{euros (neg .ImporteDto)}}</td></tr>
+{{end}}<tr><td colspan="4" class="n">Base imponible</td><td class="n">{{euros .BaseImponible}}</td></tr>
+<tr><td colspan="4" class="n">IVA {{iva}} %</td><td class="n">{{euros .IVA}}</td></tr>
+<tr class="total"><td colspan="4" class="n">Total</td><td class="n">{{euros .Total}}</td></tr>
+</tfoot>
+</table>
+</body>
+</html>
+`))
+
+// Texto devuelve la factura en texto plano, lista para imprimir
+func (f *Factura) Texto() string {
+	var b strings.Builder
+	if err := plantillaFacturaTexto.Execute(&b, f); err != nil {
+		return "error al preparar la factura: " + err.Error()
+	}
+	return b.String()
+}
+
+// HTML devuelve la factura como una página HTML imprimible
+func (f *Factura) HTML() string {
+	var b strings.Builder
+	if err := plantillaFacturaHTML.Execute(&b, f); err != nil {
+		return "error al preparar la factura: " + err.Error()
+	}
+	return b.String()
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestFacturas emite facturas de incidencias cerradas con horas de dos
+// mecánicos, piezas y descuentos, y comprueba los importes, la numeración
+// por año, que no se factura dos veces ni una incidencia abierta y cómo se
+// imprimen
+func TestFacturas(t *testing.T) {
+	var tl Taller
+	ops := []Operacion{
+		{Tipo: OpCrearMecanico, IDMecanico: 1, Nombre: "Laura", Especialidad: "mecánica", Activo: true},
+		{Tipo: OpCrearMecanico, IDMecanico: 2, Nombre: "Pedro", Especialidad: "eléctrica", Activo: true},
+		{Tipo: OpCrearCliente, IDCliente: 1, Nombre: "Ana <b>López</b>", Email: "ana@ejemplo.es"},
+		{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "1234ABC", Marca: "Seat", Modelo: "Ibiza"},
+		{Tipo: OpCrearIncidencia, Matricula: "1234ABC", IDIncidencia: 7, TipoIncidencia: "mecánica", Prioridad: "alta"},
+		{Tipo: OpAsignarPlaza, Matricula: "1234ABC", IDMecanico: 1, IDPlaza: 1},
+		{Tipo: OpAsignarPlaza, Matricula: "1234ABC", IDMecanico: 2, IDPlaza: 3},
+		{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "5678DEF"},
+		{Tipo: OpCrearIncidencia, Matricula: "5678DEF", IDIncidencia: 8, TipoIncidencia: "eléctrica", Prioridad: "baja"},
+	}
+	for _, op := range ops {
+		if err := tl.Aplicar(op); err != nil {
+			t.Fatalf("%s: %v", op.Tipo, err)
+		}
+	}
+	_, v := tl.BuscarVehiculo("1234ABC")
+	lineas := tl.lineasManoObra(v.GetIncidencia(), map[int]float64{1: 2.5, 2: 1})
+	lineas = append(lineas,
+		LineaFactura{Tipo: LineaPieza, Concepto: "Pastillas de freno", Cantidad: 2, Precio: 3995, Descuento: 10},
+		LineaFactura{Tipo: LineaPieza, Concepto: "Líquido de frenos", Cantidad: 1, Precio: 1250})
+	emitir := func(mat, fecha string, lineas []LineaFactura, dto float64) error {
+		return tl.Aplicar(Operacion{Tipo: OpEmitirFactura, Matricula: mat, Fecha: fecha,
+			Factura: &Factura{Lineas: lineas, Descuento: dto}})
+	}
+	if err := emitir("1234ABC", "2026-03-01T10:00:00.000Z", lineas, 0); err == nil {
+		t.Fatal("se ha facturado una incidencia abierta")
+	}
+	for _, op := range append(repararPrueba("1234ABC"), repararPrueba("5678DEF")...) {
+		if err := tl.Aplicar(op); err != nil {
+			t.Fatalf("%s: %v", op.Tipo, err)
+		}
+	}
+	if err := emitir("1234ABC", "2026-12-31T18:00:00.000Z", lineas, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := emitir("1234ABC", "2026-12-31T18:05:00.000Z", lineas, 0); err == nil {
+		t.Fatal("se ha facturado dos veces la misma incidencia")
+	}
+	f := tl.FacturaDeIncidencia(7)
+	// 2,5 h × 45 € + 1 h × 50 € + 2 × 39,95 € − 10 % + 12,50 € = 112,50 + 50 + 71,91 + 12,50
+	if f.Subtotal != 24691 || f.ImporteDto != 1235 || f.BaseImponible != 23456 || f.IVA != 4926 || f.Total != 28382 {
+		t.Fatalf("importes inesperados: suma %d, descuento %d, base %d, IVA %d, total %d",
+			f.Subtotal, f.ImporteDto, f.BaseImponible, f.IVA, f.Total)
+	}
+
+	pieza := []LineaFactura{{Tipo: LineaPieza, Concepto: "Fusible", Cantidad: 1, Precio: 300}}
+	if err := emitir("5678DEF", "2027-01-02T09:00:00.000Z", pieza, 0); err != nil {
+		t.Fatal(err)
+	}
+	// Otra incidencia del primer vehículo, ya en 2027
+	tl.Aplicar(Operacion{Tipo: OpEliminarIncidencia, Matricula: "1234ABC"})
+	tl.Aplicar(Operacion{Tipo: OpCrearIncidencia, Matricula: "1234ABC", IDIncidencia: 9, TipoIncidencia: "carrocería"})
+	for _, op := range repararPrueba("1234ABC") {
+		if err := tl.Aplicar(op); err != nil {
+			t.Fatalf("%s: %v", op.Tipo, err)
+		}
+	}
+	if err := emitir("1234ABC", "2027-01-03T09:00:00.000Z", pieza, 0); err != nil {
+		t.Fatal(err)
+	}
+	var numeros []string
+	for _, f := range tl.FacturasDeCliente(1) {
+		numeros = append(numeros, f.Numero)
+	}
+	if strings.Join(numeros, " ") != "2026-0001 2027-0001 2027-0002" {
+		t.Fatalf("numeración inesperada: %v", numeros)
+	}
+
+	html := f.HTML()
+	if strings.Contains(html, "<b>López</b>") || !strings.Contains(html, "&lt;b&gt;López&lt;/b&gt;") {
+		t.Fatal("el HTML de la factura no escapa el nombre del cliente")
+	}
+	if !strings.Contains(html, "283,82 €") {
+		t.Fatal("el HTML de la factura no muestra el total")
+	}
+	if !strings.Contains(f.Texto(), "2026-0001") {
+		t.Fatalf("la factura en texto no lleva su número:\n%s", f.Texto())
+	}
+}
+
+// TestManoObraMecanicoRetirado ficha a dos mecánicos en una incidencia y
+// retira a una de ellas cuando su terminal deja de responder: sus horas se
+// siguen facturando, también después de darla de baja en el taller
+func TestManoObraMecanicoRetirado(t *testing.T) {
+	var tl Taller
+	ops := []Operacion{
+		{Tipo: OpCrearMecanico, IDMecanico: 1, Nombre: "Laura", Especialidad: "mecánica", Activo: true},
+		{Tipo: OpCrearMecanico, IDMecanico: 2, Nombre: "Pedro", Especialidad: "eléctrica", Activo: true},
+		{Tipo: OpCrearCliente, IDCliente: 1, Nombre: "Ana"},
+		{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "1234ABC"},
+		{Tipo: OpCrearIncidencia, Matricula: "1234ABC", IDIncidencia: 7, TipoIncidencia: "mecánica"},
+		{Tipo: OpAsignarPlaza, Matricula: "1234ABC", IDMecanico: 1, IDPlaza: 1},
+		{Tipo: OpAsignarPlaza, Matricula: "1234ABC", IDMecanico: 2, IDPlaza: 3},
+		{Tipo: OpPresupuestar, Matricula: "1234ABC", Presupuesto: presupuestoDePrueba()},
+		{Tipo: OpResponderPresupuesto, Matricula: "1234ABC", Estado: PresupuestoAceptado},
+		{Tipo: OpEstadoIncidencia, Matricula: "1234ABC", Estado: "en proceso"},
+		{Tipo: OpIniciarTrabajo, Matricula: "1234ABC", IDMecanico: 2, Fecha: "2026-06-01T07:00:00.000Z"},
+		{Tipo: OpTerminarTrabajo, IDMecanico: 2, Fecha: "2026-06-01T08:00:00.000Z"},
+		{Tipo: OpIniciarTrabajo, Matricula: "1234ABC", IDMecanico: 1, Fecha: "2026-06-01T07:00:00.000Z"},
+		// El terminal de Laura deja de responder: sale de la incidencia
+		{Tipo: OpMecanicoInaccesible, IDMecanico: 1, Fecha: "2026-06-01T09:00:00.000Z"},
+		{Tipo: OpEstadoIncidencia, Matricula: "1234ABC", Estado: "en proceso"},
+		{Tipo: OpEstadoIncidencia, Matricula: "1234ABC", Estado: "cerrada"},
+	}
+	for _, op := range ops {
+		if err := tl.Aplicar(op); err != nil {
+			t.Fatalf("%s: %v", op.Tipo, err)
+		}
+	}
+	_, v := tl.BuscarVehiculo("1234ABC")
+	inc := v.GetIncidencia()
+	for _, m := range inc.GetMecanicos() {
+		if m.IDMecanico == 1 {
+			t.Fatal("Laura sigue asignada a la incidencia")
+		}
+	}
+	manoObra := func() string {
+		horas := map[int]float64{}
+		for id, h := range HorasIncidencia(inc, time.Now()) {
+			horas[id] = horasFacturables(h)
+		}
+		var lineas []string
+		for _, l := range tl.lineasManoObra(inc, horas) {
+			lineas = append(lineas, fmt.Sprintf("%s %s %s", l.Concepto, cantidadTexto(l.Cantidad), Euros(l.Precio)))
+		}
+		return strings.Join(lineas, "|")
+	}
+	esperado := "Mano de obra eléctrica (Pedro) 1 50,00 €|Mano de obra mecánica (Laura) 2 45,00 €"
+	if got := manoObra(); got != esperado {
+		t.Fatalf("mano de obra %q en vez de %q", got, esperado)
+	}
+
+	// Dada de baja, sus horas se cobran con la especialidad de la incidencia
+	if err := tl.Aplicar(Operacion{Tipo: OpEliminarMecanico, IDMecanico: 1}); err != nil {
+		t.Fatal(err)
+	}
+	esperado = "Mano de obra eléctrica (Pedro) 1 50,00 €|Mano de obra mecánica (mecánico 1) 2 45,00 €"
+	if got := manoObra(); got != esperado {
+		t.Fatalf("tras la baja, mano de obra %q en vez de %q", got, esperado)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SesionTrabajo es un rato que un mecánico ha trabajado en una incidencia.
+// Las horas son las sincronizadas de las operaciones; Fin vacío = sigue.
+// Cada sesión está en su incidencia, que la cobra en la factura, y en el
+// registro del taller (Taller.Sesiones), que sigue contando para los
+// informes cuando el vehículo sale o la incidencia se borra.
+type SesionTrabajo struct {
+	IDMecanico   int    `json:"idMecanico"`
+	IDIncidencia int    `json:"idIncidencia,omitempty"` // solo en el registro del taller
+	Inicio       string `json:"inicio"`
+	Fin          string `json:"fin,omitempty"`
+}
+
+// Abierta indica si el mecánico sigue trabajando en esta sesión
+func (s SesionTrabajo) Abierta() bool { return s.Fin == "" }
+
+// Tramo devuelve el inicio y el fin de la sesión; si sigue abierta, acaba
+// en ahora
+func (s SesionTrabajo) Tramo(ahora time.Time) (inicio, fin time.Time, err error) {
+	if inicio, err = time.Parse(FormatoFecha, s.Inicio); err != nil {
+		return
+	}
+	fin = ahora
+	if !s.Abierta() {
+		fin, err = time.Parse(FormatoFecha, s.Fin)
+	}
+	return
+}
+
+// Duracion devuelve lo que ha durado la sesión (hasta ahora si sigue abierta)
+func (s SesionTrabajo) Duracion(ahora time.Time) time.Duration {
+	inicio, fin, err := s.Tramo(ahora)
+	if err != nil || fin.Before(inicio) {
+		return 0
+	}
+	return fin.Sub(inicio)
+}
+
+// SesionAbierta devuelve la sesión del registro del taller en la que está
+// trabajando el mecánico (nil si no está fichado en ninguna)
+func (t *Taller) SesionAbierta(idMecanico int) *SesionTrabajo {
+	for k := range t.Sesiones {
+		if s := &t.Sesiones[k]; s.IDMecanico == idMecanico && s.Abierta() {
+			return s
+		}
+	}
+	return nil
+}
+
+// iniciarTrabajo aplica OpIniciarTrabajo: el mecánico empieza a trabajar en
+// la incidencia del vehículo. No puede estar fichado en otra a la vez.
+func (t *Taller) iniciarTrabajo(op Operacion) error {
+	if op.Fecha == "" {
+		return errors.New("falta la hora de inicio")
+	}
+	_, v := t.BuscarVehiculo(op.Matricula)
+	if v == nil || v.GetIncidencia() == nil {
+		return errors.New("vehículo no encontrado o sin incidencia")
+	}
+	inc := v.GetIncidencia()
+	if inc.Estado == "cerrada" {
+		return errors.New("la incidencia ya está cerrada")
+	}
+	m, _ := t.BuscarMecanico(op.IDMecanico)
+	if m == nil || !m.Disponible() {
+		return errors.New("mecánico inexistente, no activo o inaccesible")
+	}
+	asignado := false
+	for _, x := range inc.GetMecanicos() {
+		asignado = asignado || x == m
+	}
+	if !asignado {
+		return errors.New("el mecánico no está asignado a esta incidencia")
+	}
+	if otra := t.SesionAbierta(m.IDMecanico); otra != nil {
+		return fmt.Errorf("el mecánico ya está trabajando en la incidencia %d", otra.IDIncidencia)
+	}
+	inc.Sesiones = append(inc.Sesiones, SesionTrabajo{IDMecanico: m.IDMecanico, Inicio: op.Fecha})
+	t.Sesiones = append(t.Sesiones, SesionTrabajo{IDMecanico: m.IDMecanico, IDIncidencia: inc.IDIncidencia, Inicio: op.Fecha})
+	return nil
+}
+
+// terminarTrabajo aplica OpTerminarTrabajo: cierra la sesión abierta del
+// mecánico, esté en la incidencia que esté
+func (t *Taller) terminarTrabajo(op Operacion) error {
+	if op.Fecha == "" {
+		return errors.New("falta la hora de fin")
+	}
+	s := t.SesionAbierta(op.IDMecanico)
+	if s == nil {
+		return errors.New("el mecánico no está trabajando en ninguna incidencia")
+	}
+	if op.Fecha < s.Inicio {
+		return errors.New("la sesión no puede terminar antes de empezar")
+	}
+	t.cerrarSesion(s, op.Fecha)
+	return nil
+}
+
+// cerrarSesion termina una sesión del registro del taller y la misma sesión
+// en su incidencia, si sigue en el taller
+func (t *Taller) cerrarSesion(s *SesionTrabajo, fecha string) {
+	s.Fin = fecha
+	t.incidencias(func(_ *Vehiculo, inc *Incidencia) {
+		if inc.IDIncidencia != s.IDIncidencia {
+			return
+		}
+		for k := range inc.Sesiones {
+			if inc.Sesiones[k].IDMecanico == s.IDMecanico && inc.Sesiones[k].Abierta() {
+				inc.Sesiones[k].Fin = fecha
+			}
+		}
+	})
+}
+
+// terminarSesiones cierra todas las sesiones abiertas de la incidencia; se
+// llama al cerrarla y al traerla de otra sede
+func (inc *Incidencia) terminarSesiones(fecha string) {
+	for k := range inc.Sesiones {
+		if inc.Sesiones[k].Abierta() && fecha != "" {
+			inc.Sesiones[k].Fin = fecha
+		}
+	}
+}
+
+// terminarSesionesIncidencia cierra las sesiones abiertas en la incidencia,
+// en ella y en el registro del taller; se llama al cerrarla y antes de que
+// deje el taller (se borra, el vehículo sale o se va a otra sede). Sin
+// fecha, la sesión se cierra en su inicio: el mecánico no puede quedar
+// fichado en una incidencia que ya no está.
+func (t *Taller) terminarSesionesIncidencia(inc *Incidencia, fecha string) {
+	for k := range t.Sesiones {
+		if s := &t.Sesiones[k]; s.IDIncidencia == inc.IDIncidencia && s.Abierta() {
+			s.Fin = max(fecha, s.Inicio)
+		}
+	}
+	for k := range inc.Sesiones {
+		if s := &inc.Sesiones[k]; s.Abierta() {
+			s.Fin = max(fecha, s.Inicio)
+		}
+	}
+}
+
+// terminarSesionesDe cierra la sesión abierta de un mecánico que deja de
+// poder trabajar (se elimina o se vuelve inaccesible)
+func (t *Taller) terminarSesionesDe(idMecanico int, fecha string) {
+	if s := t.SesionAbierta(idMecanico); s != nil && fecha != "" {
+		t.cerrarSesion(s, fecha)
+	}
+}
+
+// HorasIncidencia devuelve las horas trabajadas en la incidencia por cada
+// mecánico, contando las sesiones abiertas hasta ahora
+func HorasIncidencia(inc *Incidencia, ahora time.Time) map[int]float64 {
+	horas := map[int]float64{}
+	for _, s := range inc.Sesiones {
+		horas[s.IDMecanico] += s.Duracion(ahora).Hours()
+	}
+	return horas
+}
+
+// horasFacturables redondea las horas al cuarto de hora superior, como se
+// cobran en la factura
+func horasFacturables(h float64) float64 {
+	cuartos := int(h * 4)
+	if float64(cuartos) < h*4-1e-9 {
+		cuartos++
+	}
+	return float64(cuartos) / 4
+}
+
+// INFORMES
+
+// JornadaMecanico son las horas que trabajó un mecánico un día
+type JornadaMecanico struct {
+	IDMecanico  int
+	Nombre      string
+	Dia         string // AAAA-MM-DD en la zona del taller
+	Horas       float64
+	Incidencias []int
+}
+
+// Jornadas devuelve las horas de cada mecánico por día, entre desde y hasta
+// (AAAA-MM-DD, vacío = sin límite), según el registro de sesiones del
+// taller. Una sesión que pasa de medianoche se reparte entre los dos días.
+func (t *Taller) Jornadas(desde, hasta string, ahora time.Time) []JornadaMecanico {
+	dias := map[[2]string]*JornadaMecanico{}
+	for _, s := range t.Sesiones {
+		inicio, fin, err := s.Tramo(ahora)
+		if err != nil {
+			continue
+		}
+		inicio, fin = inicio.In(ZonaTaller), fin.In(ZonaTaller)
+		for inicio.Before(fin) {
+			y, mes, d := inicio.Date()
+			medianoche := time.Date(y, mes, d+1, 0, 0, 0, 0, ZonaTaller)
+			tramo := fin
+			if medianoche.Before(fin) {
+				tramo = medianoche
+			}
+			dia := inicio.Format("2006-01-02")
+			if (desde == "" || dia >= desde) && (hasta == "" || dia <= hasta) {
+				clave := [2]string{fmt.Sprint(s.IDMecanico), dia}
+				j := dias[clave]
+				if j == nil {
+					j = &JornadaMecanico{IDMecanico: s.IDMecanico, Dia: dia}
+					if m, _ := t.BuscarMecanico(s.IDMecanico); m != nil {
+						j.Nombre = m.Nombre
+					}
+					dias[clave] = j
+				}
+				j.Horas += tramo.Sub(inicio).Hours()
+				if !contieneID(j.Incidencias, s.IDIncidencia) {
+					j.Incidencias = append(j.Incidencias, s.IDIncidencia)
+				}
+			}
+			inicio = tramo
+		}
+	}
+	var out []JornadaMecanico
+	for _, j := range dias {
+		out = append(out, *j)
+	}
+	sort.Slice(out, func(a, b int) bool {
+		if out[a].IDMecanico != out[b].IDMecanico {
+			return out[a].IDMecanico < out[b].IDMecanico
+		}
+		return out[a].Dia < out[b].Dia
+	})
+	return out
+}
+
+// ProductividadMecanico resume lo trabajado y lo facturado por un mecánico
+type ProductividadMecanico struct {
+	IDMecanico  int
+	Nombre      string
+	Fichadas    float64 // horas en sesiones de trabajo
+	Facturadas  float64 // horas de mano de obra en facturas
+	Incidencias int     // incidencias en las que ha trabajado
+}
+
+// Rendimiento devuelve las horas facturadas por cada hora fichada
+func (p ProductividadMecanico) Rendimiento() float64 {
+	if p.Fichadas == 0 {
+		return 0
+	}
+	return p.Facturadas / p.Fichadas
+}
+
+// Productividad compara, para cada mecánico, las horas que ha fichado (en
+// el registro de sesiones del taller) con las que se han facturado de su
+// trabajo
+func (t *Taller) Productividad(ahora time.Time) []ProductividadMecanico {
+	var out []ProductividadMecanico
+	for _, m := range t.MecanicosTaller {
+		p := ProductividadMecanico{IDMecanico: m.IDMecanico, Nombre: m.Nombre}
+		var incidencias []int
+		for _, s := range t.Sesiones {
+			if s.IDMecanico == m.IDMecanico {
+				p.Fichadas += s.Duracion(ahora).Hours()
+				if !contieneID(incidencias, s.IDIncidencia) {
+					incidencias = append(incidencias, s.IDIncidencia)
+				}
+			}
+		}
+		p.Incidencias = len(incidencias)
+		for _, f := range t.Facturas {
+			for _, l := range f.Lineas {
+				if l.Tipo == LineaManoObra && l.IDMecanico == m.IDMecanico {
+					p.Facturadas += l.Cantidad
+				}
+			}
+		}
+		out = append(out, p)
+	}
+	return out
+}
+
+// formatoHoras escribe unas horas como "2 h 30 min"
+func formatoHoras(h float64) string {
+	minutos := int(h*60 + 0.5)
+	if minutos < 60 {
+		return fmt.Sprintf("%d min", minutos)
+	}
+	return strings.TrimSuffix(fmt.Sprintf("%d h %d min", minutos/60, minutos%60), " 0 min")
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSesionesTrasSalida comprueba que las horas fichadas siguen en los
+// informes cuando el vehículo sale del taller o se borra su incidencia, y
+// que una sesión abierta se cierra al irse la incidencia
+func TestSesionesTrasSalida(t *testing.T) {
+	var taller Taller
+	for _, op := range []Operacion{
+		{Tipo: OpCrearMecanico, IDMecanico: 1, Nombre: "Laura", Especialidad: "mecánica"},
+		{Tipo: OpCrearCliente, IDCliente: 1, Nombre: "Ana"},
+		{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "1111AAA"},
+		{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "2222BBB"},
+		{Tipo: OpCrearIncidencia, Matricula: "1111AAA", IDIncidencia: 1},
+		{Tipo: OpCrearIncidencia, Matricula: "2222BBB", IDIncidencia: 2},
+		{Tipo: OpAsignarPlaza, Matricula: "1111AAA", IDMecanico: 1, IDPlaza: 1},
+		{Tipo: OpAsignarPlaza, Matricula: "2222BBB", IDMecanico: 1, IDPlaza: 2},
+		{Tipo: OpIniciarTrabajo, Matricula: "1111AAA", IDMecanico: 1, Fecha: "2026-06-01T09:00:00.000Z"},
+		{Tipo: OpTerminarTrabajo, IDMecanico: 1, Fecha: "2026-06-01T11:00:00.000Z"},
+		{Tipo: OpIniciarTrabajo, Matricula: "2222BBB", IDMecanico: 1, Fecha: "2026-06-01T12:00:00.000Z"},
+		// Se borra la incidencia con Laura trabajando en ella y sale el otro vehículo
+		{Tipo: OpEliminarIncidencia, Matricula: "2222BBB", Fecha: "2026-06-01T13:00:00.000Z"},
+		{Tipo: OpEliminarVehiculo, Matricula: "1111AAA", Fecha: "2026-06-01T14:00:00.000Z"},
+	} {
+		if err := taller.Aplicar(op); err != nil {
+			t.Fatalf("%s: %v", op.Tipo, err)
+		}
+	}
+	if taller.SesionAbierta(1) != nil {
+		t.Fatal("Laura sigue fichada en una incidencia que ya no existe")
+	}
+	ahora := time.Now()
+	prod := taller.Productividad(ahora)
+	if len(prod) != 1 || prod[0].Fichadas != 3 || prod[0].Incidencias != 2 {
+		t.Fatalf("productividad %+v", prod)
+	}
+	horas := 0.0
+	for _, j := range taller.Jornadas("", "", ahora) {
+		horas += j.Horas
+	}
+	if horas != 3 {
+		t.Fatalf("las jornadas suman %v h", horas)
+	}
+
+	// Una instantánea anterior al registro lo rehace con las incidencias
+	ins := taller.Exportar()
+	ins.Sesiones = nil
+	ins.Clientes = []ClienteDatos{{IDCliente: 1, Nombre: "Ana", Vehiculos: []VehiculoDatos{{Matricula: "3333CCC",
+		Incidencia: &IncidenciaDatos{IDIncidencia: 3, Estado: "abierta",
+			Sesiones: []SesionTrabajo{{IDMecanico: 1, Inicio: "2026-06-02T09:00:00.000Z", Fin: "2026-06-02T10:30:00.000Z"}}}}}}}
+	var antigua Taller
+	antigua.Importar(ins)
+	if len(antigua.Sesiones) != 1 || antigua.Sesiones[0].IDIncidencia != 3 {
+		t.Fatalf("registro rehecho: %+v", antigua.Sesiones)
+	}
+}
+
+// TestFichajes ficha a dos mecánicos en dos incidencias y comprueba que
+// nadie trabaja en dos a la vez, las horas por incidencia y por día (con
+// una sesión que pasa de medianoche), que cerrar la incidencia cierra sus
+// sesiones y que las horas fichadas llegan a la factura
+func TestFichajes(t *testing.T) {
+	var tl Taller
+	tl.Aplicar(Operacion{Tipo: OpCrearMecanico, IDMecanico: 1, Nombre: "Laura", Especialidad: "mecánica"})
+	tl.Aplicar(Operacion{Tipo: OpCrearMecanico, IDMecanico: 2, Nombre: "Pedro", Especialidad: "eléctrica"})
+	hora := func(h string) string {
+		f, _ := time.ParseInLocation("2006-01-02 15:04", h, ZonaTaller)
+		return f.UTC().Format(FormatoFecha)
+	}
+	ops := []Operacion{
+		{Tipo: OpCrearCliente, IDCliente: 1, Nombre: "Ana"},
+		{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "1111AAA"},
+		{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "2222BBB"},
+		{Tipo: OpCrearIncidencia, Matricula: "1111AAA", IDIncidencia: 1},
+		{Tipo: OpCrearIncidencia, Matricula: "2222BBB", IDIncidencia: 2},
+		{Tipo: OpAsignarPlaza, Matricula: "1111AAA", IDMecanico: 1, IDPlaza: 1},
+		{Tipo: OpAsignarPlaza, Matricula: "1111AAA", IDMecanico: 2, IDPlaza: 3},
+		{Tipo: OpAsignarPlaza, Matricula: "2222BBB", IDMecanico: 1, IDPlaza: 2},
+		{Tipo: OpPresupuestar, Matricula: "1111AAA", Presupuesto: presupuestoDePrueba()},
+		{Tipo: OpResponderPresupuesto, Matricula: "1111AAA", Estado: PresupuestoAceptado},
+		{Tipo: OpEstadoIncidencia, Matricula: "1111AAA", Estado: "en proceso"},
+		{Tipo: OpIniciarTrabajo, Matricula: "1111AAA", IDMecanico: 1, Fecha: hora("2026-06-01 09:00")},
+		{Tipo: OpIniciarTrabajo, Matricula: "1111AAA", IDMecanico: 2, Fecha: hora("2026-06-01 09:30")},
+		{Tipo: OpTerminarTrabajo, IDMecanico: 1, Fecha: hora("2026-06-01 11:00")},
+		{Tipo: OpIniciarTrabajo, Matricula: "2222BBB", IDMecanico: 1, Fecha: hora("2026-06-01 11:15")},
+		{Tipo: OpTerminarTrabajo, IDMecanico: 1, Fecha: hora("2026-06-01 12:45")},
+		{Tipo: OpTerminarTrabajo, IDMecanico: 2, Fecha: hora("2026-06-01 10:10")},
+		{Tipo: OpIniciarTrabajo, Matricula: "1111AAA", IDMecanico: 1, Fecha: hora("2026-06-01 23:00")},
+	}
+	for _, op := range ops {
+		if err := tl.Aplicar(op); err != nil {
+			t.Fatalf("%s %d: %v", op.Tipo, op.IDMecanico, err)
+		}
+	}
+	if err := tl.Aplicar(Operacion{Tipo: OpIniciarTrabajo, Matricula: "2222BBB", IDMecanico: 1, Fecha: hora("2026-06-01 23:30")}); err == nil {
+		t.Fatal("un mecánico ha fichado en dos incidencias a la vez")
+	}
+	if err := tl.Aplicar(Operacion{Tipo: OpIniciarTrabajo, Matricula: "2222BBB", IDMecanico: 2, Fecha: hora("2026-06-01 23:30")}); err == nil {
+		t.Fatal("ha fichado un mecánico que no está asignado a la incidencia")
+	}
+	// Al cerrar la incidencia 1 se cierra la sesión nocturna de Laura
+	if err := tl.Aplicar(Operacion{Tipo: OpEstadoIncidencia, Matricula: "1111AAA", Estado: "cerrada", Fecha: hora("2026-06-02 01:30")}); err != nil {
+		t.Fatal(err)
+	}
+	if tl.SesionAbierta(1) != nil {
+		t.Fatal("cerrar la incidencia no ha cerrado la sesión")
+	}
+	ahora := time.Now()
+	_, v := tl.BuscarVehiculo("1111AAA")
+	horas := HorasIncidencia(v.GetIncidencia(), ahora)
+	if horas[1] != 4.5 || fmt.Sprintf("%.4f", horas[2]) != "0.6667" {
+		t.Fatalf("horas inesperadas en la incidencia 1: %v", horas)
+	}
+
+	var dias []string
+	for _, j := range tl.Jornadas("", "", ahora) {
+		dias = append(dias, fmt.Sprintf("%d %s %s %v", j.IDMecanico, j.Dia, formatoHoras(j.Horas), j.Incidencias))
+	}
+	esperado := "1 2026-06-01 4 h 30 min [1 2]|1 2026-06-02 1 h 30 min [1]|2 2026-06-01 40 min [1]"
+	if strings.Join(dias, "|") != esperado {
+		t.Fatalf("jornadas inesperadas: %q", strings.Join(dias, "|"))
+	}
+	if len(tl.Jornadas("2026-06-02", "2026-06-02", ahora)) != 1 {
+		t.Fatal("el filtro de días no funciona")
+	}
+
+	lineas := tl.lineasManoObra(v.GetIncidencia(), map[int]float64{1: horasFacturables(horas[1]), 2: horasFacturables(horas[2])})
+	if err := tl.Aplicar(Operacion{Tipo: OpEmitirFactura, Matricula: "1111AAA", Fecha: hora("2026-06-02 09:00"),
+		Factura: &Factura{Lineas: lineas}}); err != nil {
+		t.Fatal(err)
+	}
+	f := tl.FacturaDeIncidencia(1)
+	if f.Lineas[0].Cantidad != 4.5 || f.Lineas[1].Cantidad != 0.75 || f.Subtotal != 4.5*4500+0.75*5000 {
+		t.Fatalf("factura inesperada: %+v", f.Lineas)
+	}
+	prod := tl.Productividad(ahora)
+	if prod[0].Fichadas != 6 || prod[0].Facturadas != 4.5 || prod[0].Incidencias != 2 || prod[1].Facturadas != 0.75 {
+		t.Fatalf("productividad inesperada: %+v", prod)
+	}
+
+}
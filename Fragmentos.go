@@ -0,0 +1,503 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ANILLO DE HASH CONSISTENTE
+
+// AnilloHash reparte claves entre nodos con hash consistente: cada nodo ocupa
+// Virtuales puntos del anillo y una clave pertenece al primer punto que
+// encuentra avanzando desde su hash. Al entrar o salir un nodo solo cambian
+// de dueño las claves de los tramos que gana o pierde.
+type AnilloHash struct {
+	virtuales int
+	puntos    []uint64 // ordenados
+	duenos    map[uint64]string
+	nodos     map[string]bool
+}
+
+// NuevoAnilloHash crea un anillo vacío con virtuales puntos por nodo
+func NuevoAnilloHash(virtuales int) *AnilloHash {
+	if virtuales < 1 {
+		virtuales = 1
+	}
+	return &AnilloHash{virtuales: virtuales, duenos: map[uint64]string{}, nodos: map[string]bool{}}
+}
+
+// Agregar incorpora un nodo al anillo
+func (a *AnilloHash) Agregar(nodo string) {
+	if a.nodos[nodo] {
+		return
+	}
+	a.nodos[nodo] = true
+	for i := 0; i < a.virtuales; i++ {
+		p := hashClave(nodo + "#" + strconv.Itoa(i))
+		if _, ocupado := a.duenos[p]; ocupado {
+			continue // colisión improbable: el punto se queda con su dueño
+		}
+		a.duenos[p] = nodo
+		a.puntos = append(a.puntos, p)
+	}
+	sort.Slice(a.puntos, func(i, j int) bool { return a.puntos[i] < a.puntos[j] })
+}
+
+// Quitar saca un nodo del anillo
+func (a *AnilloHash) Quitar(nodo string) {
+	if !a.nodos[nodo] {
+		return
+	}
+	delete(a.nodos, nodo)
+	quedan := a.puntos[:0]
+	for _, p := range a.puntos {
+		if a.duenos[p] == nodo {
+			delete(a.duenos, p)
+		} else {
+			quedan = append(quedan, p)
+		}
+	}
+	a.puntos = quedan
+}
+
+// Nodo devuelve el nodo al que pertenece la clave ("" si no hay nodos)
+func (a *AnilloHash) Nodo(clave string) string {
+	if len(a.puntos) == 0 {
+		return ""
+	}
+	h := hashClave(clave)
+	i := sort.Search(len(a.puntos), func(i int) bool { return a.puntos[i] >= h })
+	if i == len(a.puntos) {
+		i = 0
+	}
+	return a.duenos[a.puntos[i]]
+}
+
+// Nodos devuelve los nodos del anillo ordenados
+func (a *AnilloHash) Nodos() []string {
+	var nodos []string
+	for n := range a.nodos {
+		nodos = append(nodos, n)
+	}
+	sort.Strings(nodos)
+	return nodos
+}
+
+// hashClave es FNV-1a con una mezcla final, para que claves parecidas ("17",
+// "18") caigan lejos en el anillo
+func hashClave(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// FRAGMENTOS
+
+// Tipos de petición a un fragmento
+const (
+	fragAplicar  = "aplicar"  // aplica una operación sobre sus clientes
+	fragCliente  = "cliente"  // devuelve un cliente por su ID
+	fragClientes = "clientes" // devuelve todos sus clientes
+)
+
+// PeticionFragmento es lo que el enrutador envía a un fragmento
+type PeticionFragmento struct {
+	Tipo      string     `json:"tipo"`
+	Op        *Operacion `json:"op,omitempty"`
+	IDCliente int        `json:"idCliente,omitempty"`
+	Sello
+}
+
+// RespuestaFragmento es la respuesta de un fragmento
+type RespuestaFragmento struct {
+	Error    string         `json:"error,omitempty"`
+	Clientes []ClienteDatos `json:"clientes,omitempty"`
+	Sello
+}
+
+// ServidorFragmento guarda una parte de los clientes del taller (con sus
+// vehículos e incidencias) y atiende las peticiones del enrutador
+type ServidorFragmento struct {
+	// Relojes lógicos con los que se marcan los mensajes (nil = sin marcas)
+	Relojes *Relojes
+
+	direccion string
+	taller    *Taller
+	cerrojo   *sync.Mutex
+	ejecutar  func(op Operacion) error
+	oyente    net.Listener
+}
+
+// NuevoServidorFragmento crea el fragmento que atiende en direccion sobre el
+// taller t (protegido por cerrojo); las operaciones se aplican con ejecutar
+func NuevoServidorFragmento(direccion string, t *Taller, cerrojo *sync.Mutex, ejecutar func(op Operacion) error) *ServidorFragmento {
+	return &ServidorFragmento{direccion: direccion, taller: t, cerrojo: cerrojo, ejecutar: ejecutar}
+}
+
+// Escuchar atiende las peticiones del enrutador
+func (s *ServidorFragmento) Escuchar() error {
+	oyente, err := net.Listen("tcp", s.direccion)
+	if err != nil {
+		return err
+	}
+	s.oyente = oyente
+	go func() {
+		for {
+			conn, err := oyente.Accept()
+			if err != nil {
+				return
+			}
+			go s.atender(conn)
+		}
+	}()
+	return nil
+}
+
+// Detener deja de atender peticiones
+func (s *ServidorFragmento) Detener() {
+	if s.oyente != nil {
+		s.oyente.Close()
+	}
+}
+
+func (s *ServidorFragmento) atender(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	var pet PeticionFragmento
+	if err := json.NewDecoder(conn).Decode(&pet); err != nil {
+		return
+	}
+	pet.Recibido(s.Relojes)
+	var resp RespuestaFragmento
+	switch pet.Tipo {
+	case fragAplicar:
+		if pet.Op == nil {
+			resp.Error = "falta la operación"
+		} else if err := s.ejecutar(*pet.Op); err != nil {
+			resp.Error = err.Error()
+		}
+	case fragCliente:
+		s.cerrojo.Lock()
+		if c, _ := s.taller.BuscarCliente(pet.IDCliente); c != nil {
+			resp.Clientes = []ClienteDatos{datosCliente(c)}
+		}
+		s.cerrojo.Unlock()
+	case fragClientes:
+		s.cerrojo.Lock()
+		for _, c := range s.taller.ClientesTaller {
+			resp.Clientes = append(resp.Clientes, datosCliente(c))
+		}
+		s.cerrojo.Unlock()
+	default:
+		resp.Error = "petición desconocida"
+	}
+	resp.Sellar(s.Relojes)
+	json.NewEncoder(conn).Encode(resp)
+}
+
+// ENRUTADOR
+
+// EnrutadorFragmentos reparte los clientes entre fragmentos con hash
+// consistente sobre IDCliente y lleva las consultas y operaciones de cada
+// cliente a su fragmento. Las operaciones que solo traen la matrícula se
+// enrutan con un índice secundario matrícula → fragmento, que se reconstruye
+// preguntando a los fragmentos al iniciar y al reequilibrar.
+type EnrutadorFragmentos struct {
+	// Relojes lógicos con los que se marcan los mensajes (nil = sin marcas)
+	Relojes *Relojes
+
+	mu     sync.Mutex
+	anillo *AnilloHash
+	indice map[string]string
+}
+
+// NuevoEnrutadorFragmentos crea el enrutador de los fragmentos indicados
+func NuevoEnrutadorFragmentos(nodos []string, virtuales int) *EnrutadorFragmentos {
+	e := &EnrutadorFragmentos{anillo: NuevoAnilloHash(virtuales), indice: map[string]string{}}
+	for _, n := range nodos {
+		e.anillo.Agregar(n)
+	}
+	return e
+}
+
+// Iniciar construye el índice de matrículas y lleva a su fragmento los
+// clientes que estén en otro (por ejemplo, si cambió la lista de nodos)
+func (e *EnrutadorFragmentos) Iniciar() (movidos int, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.reequilibrar(e.anillo.Nodos())
+}
+
+// Nodos devuelve los fragmentos actuales
+func (e *EnrutadorFragmentos) Nodos() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.anillo.Nodos()
+}
+
+// NodoDe devuelve el fragmento al que pertenece un cliente
+func (e *EnrutadorFragmentos) NodoDe(idCliente int) string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.anillo.Nodo(strconv.Itoa(idCliente))
+}
+
+// NodoDeMatricula devuelve el fragmento de un vehículo según el índice
+func (e *EnrutadorFragmentos) NodoDeMatricula(matricula string) string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.indice[matricula]
+}
+
+// BuscarCliente devuelve el cliente con sus vehículos (nil si no existe)
+func (e *EnrutadorFragmentos) BuscarCliente(id int) (*ClienteDatos, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.cliente(e.anillo.Nodo(strconv.Itoa(id)), id)
+}
+
+// BuscarVehiculo devuelve el cliente dueño de la matrícula (nil si no existe)
+func (e *EnrutadorFragmentos) BuscarVehiculo(matricula string) (*ClienteDatos, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	nodo := e.indice[matricula]
+	if nodo == "" {
+		return nil, nil
+	}
+	clientes, err := e.clientesDe(nodo)
+	if err != nil {
+		return nil, err
+	}
+	for i, c := range clientes {
+		for _, v := range c.Vehiculos {
+			if v.Matricula == matricula {
+				return &clientes[i], nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// Clientes devuelve los clientes de todos los fragmentos, ordenados por ID
+func (e *EnrutadorFragmentos) Clientes() ([]ClienteDatos, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var todos []ClienteDatos
+	for _, nodo := range e.anillo.Nodos() {
+		clientes, err := e.clientesDe(nodo)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", nodo, err)
+		}
+		todos = append(todos, clientes...)
+	}
+	sort.Slice(todos, func(i, j int) bool { return todos[i].IDCliente < todos[j].IDCliente })
+	return todos, nil
+}
+
+// Reparto devuelve cuántos clientes guarda cada fragmento
+func (e *EnrutadorFragmentos) Reparto() (map[string]int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	reparto := map[string]int{}
+	for _, nodo := range e.anillo.Nodos() {
+		clientes, err := e.clientesDe(nodo)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", nodo, err)
+		}
+		reparto[nodo] = len(clientes)
+	}
+	return reparto, nil
+}
+
+// Reparte indica si la operación afecta a los clientes y por tanto la
+// aplica un fragmento; el resto (mecánicos, plazas, sedes) es local
+func (e *EnrutadorFragmentos) Reparte(op Operacion) bool {
+	switch op.Tipo {
+	case OpCrearCliente, OpModificarCliente, OpEliminarCliente,
+		OpCrearVehiculo, OpModificarVehiculo, OpEliminarVehiculo,
+		OpCrearIncidencia, OpModificarIncidencia, OpEliminarIncidencia, OpEstadoIncidencia:
+		return true
+	}
+	return false
+}
+
+// Ejecutar lleva la operación al fragmento que corresponde y mantiene el
+// índice de matrículas
+func (e *EnrutadorFragmentos) Ejecutar(op Operacion) error {
+	if !e.Reparte(op) {
+		return fmt.Errorf("la operación %q no se reparte entre fragmentos", op.Tipo)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var nodo string
+	switch op.Tipo {
+	case OpCrearCliente, OpModificarCliente, OpEliminarCliente, OpCrearVehiculo:
+		nodo = e.anillo.Nodo(strconv.Itoa(op.IDCliente))
+	default:
+		nodo = e.indice[op.Matricula]
+		if nodo == "" {
+			return errors.New("vehículo no encontrado")
+		}
+	}
+	if nodo == "" {
+		return errors.New("no hay fragmentos")
+	}
+
+	var matriculas []string // las que dejan de existir
+	switch op.Tipo {
+	case OpCrearVehiculo:
+		// El fragmento solo ve sus vehículos; la unicidad la asegura el índice
+		if e.indice[op.Matricula] != "" {
+			return errors.New("ya existe un vehículo con esa matrícula")
+		}
+	case OpEliminarCliente:
+		c, err := e.cliente(nodo, op.IDCliente)
+		if err != nil {
+			return err
+		}
+		if c != nil {
+			for _, v := range c.Vehiculos {
+				matriculas = append(matriculas, v.Matricula)
+			}
+		}
+	case OpEliminarVehiculo:
+		matriculas = []string{op.Matricula}
+	}
+
+	if err := e.aplicar(nodo, op); err != nil {
+		return err
+	}
+	if op.Tipo == OpCrearVehiculo {
+		e.indice[op.Matricula] = nodo
+	}
+	for _, m := range matriculas {
+		delete(e.indice, m)
+	}
+	return nil
+}
+
+// AgregarNodo incorpora un fragmento y le pasa los clientes que ahora le
+// corresponden; devuelve cuántos se han movido
+func (e *EnrutadorFragmentos) AgregarNodo(nodo string) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.anillo.Agregar(nodo)
+	return e.reequilibrar(e.anillo.Nodos())
+}
+
+// QuitarNodo saca un fragmento y reparte sus clientes entre los demás; el
+// fragmento debe seguir respondiendo mientras tanto. Devuelve cuántos
+// clientes se han movido.
+func (e *EnrutadorFragmentos) QuitarNodo(nodo string) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.anillo.Nodos()) == 1 && e.anillo.Nodos()[0] == nodo {
+		return 0, errors.New("no se puede quitar el último fragmento")
+	}
+	e.anillo.Quitar(nodo)
+	return e.reequilibrar(append(e.anillo.Nodos(), nodo))
+}
+
+// reequilibrar recorre los clientes de los nodos indicados, mueve al suyo
+// los que están en otro y rehace el índice de matrículas. Cada cliente se da
+// de alta en el destino antes de borrarlo del origen: si algo falla a medias,
+// el siguiente reequilibrado lo encuentra en los dos y termina de moverlo.
+// Se llama con e.mu tomado.
+func (e *EnrutadorFragmentos) reequilibrar(nodos []string) (int, error) {
+	indice := map[string]string{}
+	movidos := 0
+	for _, origen := range nodos {
+		clientes, err := e.clientesDe(origen)
+		if err != nil {
+			return movidos, fmt.Errorf("%s: %v", origen, err)
+		}
+		for i := range clientes {
+			c := &clientes[i]
+			destino := e.anillo.Nodo(strconv.Itoa(c.IDCliente))
+			if destino != origen {
+				existente, err := e.cliente(destino, c.IDCliente)
+				if err != nil {
+					return movidos, fmt.Errorf("%s: %v", destino, err)
+				}
+				if existente == nil {
+					if err := e.aplicar(destino, Operacion{Tipo: OpImportarCliente, Cliente: c}); err != nil {
+						return movidos, fmt.Errorf("%s: %v", destino, err)
+					}
+				}
+				if err := e.aplicar(origen, Operacion{Tipo: OpEliminarCliente, IDCliente: c.IDCliente}); err != nil {
+					return movidos, fmt.Errorf("%s: %v", origen, err)
+				}
+				movidos++
+			}
+			for _, v := range c.Vehiculos {
+				indice[v.Matricula] = destino
+			}
+		}
+	}
+	e.indice = indice
+	return movidos, nil
+}
+
+func (e *EnrutadorFragmentos) aplicar(nodo string, op Operacion) error {
+	resp, err := e.llamar(nodo, PeticionFragmento{Tipo: fragAplicar, Op: &op})
+	if err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	return nil
+}
+
+func (e *EnrutadorFragmentos) cliente(nodo string, id int) (*ClienteDatos, error) {
+	resp, err := e.llamar(nodo, PeticionFragmento{Tipo: fragCliente, IDCliente: id})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Clientes) == 0 {
+		return nil, nil
+	}
+	return &resp.Clientes[0], nil
+}
+
+func (e *EnrutadorFragmentos) clientesDe(nodo string) ([]ClienteDatos, error) {
+	resp, err := e.llamar(nodo, PeticionFragmento{Tipo: fragClientes})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Clientes, nil
+}
+
+// llamar envía una petición al fragmento que atiende en direccion y espera
+// su respuesta
+func (e *EnrutadorFragmentos) llamar(direccion string, pet PeticionFragmento) (RespuestaFragmento, error) {
+	var resp RespuestaFragmento
+	pet.Sellar(e.Relojes)
+	conn, err := net.DialTimeout("tcp", direccion, 2*time.Second)
+	if err != nil {
+		return resp, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := json.NewEncoder(conn).Encode(pet); err != nil {
+		return resp, err
+	}
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return resp, err
+	}
+	resp.Recibido(e.Relojes)
+	return resp, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// TestFragmentos reparte 300 clientes entre tres fragmentos locales,
+// añade un cuarto y quita uno, y comprueba tras cada paso que todos los
+// clientes y vehículos se encuentran, que ninguno está repetido y que solo se
+// mueven los clientes que cambian de dueño
+func TestFragmentos(t *testing.T) {
+	const clientes = 300
+	var nodos []string
+	talleres := map[string]*Taller{}
+	cerrojos := map[string]*sync.Mutex{}
+	// clientesEn devuelve los IDs de los clientes que guarda un fragmento
+	clientesEn := func(dir string) []int {
+		cerrojos[dir].Lock()
+		defer cerrojos[dir].Unlock()
+		var ids []int
+		for _, c := range talleres[dir].ClientesTaller {
+			ids = append(ids, c.IDCliente)
+		}
+		return ids
+	}
+	arrancar := func(i int) (string, error) {
+		dir := fmt.Sprintf("localhost:%d", 9611+i)
+		tl, cerrojo := &Taller{}, &sync.Mutex{}
+		s := NuevoServidorFragmento(dir, tl, cerrojo, func(op Operacion) error {
+			cerrojo.Lock()
+			defer cerrojo.Unlock()
+			return tl.Aplicar(op)
+		})
+		if err := s.Escuchar(); err != nil {
+			return "", err
+		}
+		t.Cleanup(s.Detener)
+		talleres[dir], cerrojos[dir] = tl, cerrojo
+		return dir, nil
+	}
+	for i := 0; i < 3; i++ {
+		dir, err := arrancar(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodos = append(nodos, dir)
+	}
+	e := NuevoEnrutadorFragmentos(nodos, 64)
+	if _, err := e.Iniciar(); err != nil {
+		t.Fatal(err)
+	}
+
+	for id := 1; id <= clientes; id++ {
+		ops := []Operacion{
+			{Tipo: OpCrearCliente, IDCliente: id, Nombre: fmt.Sprintf("Cliente%d", id)},
+			{Tipo: OpCrearVehiculo, IDCliente: id, Matricula: fmt.Sprintf("%04dAAA", id)},
+		}
+		if id%2 == 0 {
+			ops = append(ops,
+				Operacion{Tipo: OpCrearVehiculo, IDCliente: id, Matricula: fmt.Sprintf("%04dBBB", id)},
+				Operacion{Tipo: OpCrearIncidencia, Matricula: fmt.Sprintf("%04dBBB", id), IDIncidencia: id, TipoIncidencia: "mecánica"})
+		}
+		for _, op := range ops {
+			if err := e.Ejecutar(op); err != nil {
+				t.Fatalf("%s del cliente %d: %v", op.Tipo, id, err)
+			}
+		}
+	}
+	if err := e.Ejecutar(Operacion{Tipo: OpCrearVehiculo, IDCliente: 2, Matricula: "0001AAA"}); err == nil {
+		t.Fatal("se ha admitido una matrícula repetida en otro fragmento")
+	}
+
+	// comprobar recorre los talleres de los fragmentos vivos y mira que cada
+	// cliente esté una sola vez y en su nodo, y que el enrutador lo encuentre
+	comprobar := func(paso string) error {
+		donde := map[int]string{}
+		for _, dir := range e.Nodos() {
+			ids := clientesEn(dir)
+			for _, id := range ids {
+				if otro, ok := donde[id]; ok {
+					return fmt.Errorf("%s: el cliente %d está en %s y en %s", paso, id, otro, dir)
+				}
+				if dueno := e.NodoDe(id); dueno != dir {
+					return fmt.Errorf("%s: el cliente %d está en %s pero pertenece a %s", paso, id, dir, dueno)
+				}
+				donde[id] = dir
+			}
+		}
+		if len(donde) != clientes {
+			return fmt.Errorf("%s: hay %d clientes en vez de %d", paso, len(donde), clientes)
+		}
+		for id := 1; id <= clientes; id++ {
+			c, err := e.BuscarCliente(id)
+			if err != nil || c == nil {
+				return fmt.Errorf("%s: no se encuentra el cliente %d (%v)", paso, id, err)
+			}
+			matricula := fmt.Sprintf("%04dAAA", id)
+			if id%2 == 0 {
+				matricula = fmt.Sprintf("%04dBBB", id)
+			}
+			c, err = e.BuscarVehiculo(matricula)
+			if err != nil || c == nil || c.IDCliente != id {
+				return fmt.Errorf("%s: la matrícula %s no lleva al cliente %d (%v)", paso, matricula, id, err)
+			}
+		}
+		return nil
+	}
+	if err := comprobar("reparto entre 3 fragmentos"); err != nil {
+		t.Fatal(err)
+	}
+
+	nuevo, err := arrancar(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	movidos, err := e.AgregarNodo(nuevo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := comprobar(fmt.Sprintf("entra %s y se le pasan %d clientes", nuevo, movidos)); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(clientesEn(nuevo)); movidos != n {
+		t.Fatalf("se han movido %d clientes pero el nuevo fragmento tiene %d", movidos, n)
+	}
+
+	sale := nodos[0]
+	tenia := len(clientesEn(sale))
+	movidos, err = e.QuitarNodo(sale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if movidos != tenia || len(clientesEn(sale)) != 0 {
+		t.Fatalf("al salir %s se han movido %d de sus %d clientes", sale, movidos, tenia)
+	}
+	if err := comprobar(fmt.Sprintf("sale %s y reparte sus %d clientes", sale, movidos)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Las operaciones por matrícula siguen llegando a su fragmento
+	if err := e.Ejecutar(Operacion{Tipo: OpModificarIncidencia, Matricula: "0100BBB", Descripcion: "revisada"}); err != nil {
+		t.Fatal(err)
+	}
+	c, _ := e.BuscarVehiculo("0100BBB")
+	for _, v := range c.Vehiculos {
+		if v.Matricula == "0100BBB" && (v.Incidencia == nil || v.Incidencia.Descripcion != "revisada") {
+			t.Fatal("el cambio no ha llegado a la incidencia movida")
+		}
+	}
+}
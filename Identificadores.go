@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reparto de los 63 bits de un identificador: milisegundos desde epocaIDs,
+// nodo que lo generó y secuencia dentro del mismo milisegundo
+const (
+	bitsNodo      = 10
+	bitsSecuencia = 12
+	MaxNodoID     = 1<<bitsNodo - 1
+	maxSecuencia  = 1<<bitsSecuencia - 1
+)
+
+// epocaIDs es el instante cero de los identificadores (da para 69 años)
+var epocaIDs = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// GeneradorIDs da identificadores únicos sin contador compartido, al estilo
+// "snowflake": cada uno lleva la hora, el nodo y una secuencia. Son
+// crecientes en cada nodo y no se repiten entre nodos con distinto número.
+// La hora del último identificador se guarda antes de entregarlo, así que
+// tras un reinicio (o si el reloj retrocede, por ejemplo al sincronizarlo) se
+// sigue desde ella en lugar de repetir.
+type GeneradorIDs struct {
+	// Reloj del que se toma la hora (nil = hora del sistema)
+	Reloj *RelojFisico
+
+	mu        sync.Mutex
+	nodo      int64
+	fijo      bool   // el número de nodo se indicó al arrancar (o en un arranque anterior)
+	ruta      string // fichero con la hora del último identificador ("" = no se guarda)
+	ultimo    int64  // milisegundos desde epocaIDs del último identificador
+	secuencia int64
+}
+
+// estadoGenerador es lo que el generador guarda en disco
+type estadoGenerador struct {
+	Nodo   int   `json:"nodo"`
+	Fijo   bool  `json:"fijo,omitempty"`
+	Ultimo int64 `json:"ultimo"`
+}
+
+// NuevoGeneradorIDs crea el generador del nodo indicado y recupera de ruta
+// (si existe) la hora del último identificador que dio. El número de nodo
+// queda guardado en ruta; con nodo -1 se usa el que se fijó en un arranque
+// anterior o, si no se fijó ninguno, el 0 (que sirve a un taller aislado,
+// pero no se da por fijado: ver Fijo).
+func NuevoGeneradorIDs(nodo int, ruta string) (*GeneradorIDs, error) {
+	if nodo < -1 || nodo > MaxNodoID {
+		return nil, fmt.Errorf("el número de nodo de los identificadores debe estar entre 0 y %d", MaxNodoID)
+	}
+	g := &GeneradorIDs{nodo: int64(max(nodo, 0)), fijo: nodo >= 0, ruta: ruta}
+	if ruta == "" {
+		return g, nil
+	}
+	datos, err := os.ReadFile(ruta)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var e estadoGenerador
+		if err := json.Unmarshal(datos, &e); err != nil {
+			return nil, fmt.Errorf("%s: %v", ruta, err)
+		}
+		// El milisegundo guardado puede tener ya identificadores: se da por lleno
+		g.ultimo, g.secuencia = e.Ultimo, maxSecuencia
+		if nodo == -1 && e.Fijo {
+			g.nodo, g.fijo = int64(e.Nodo), true
+		}
+	}
+	if err := g.guardar(g.ultimo); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Nodo devuelve el número de nodo de los identificadores
+func (g *GeneradorIDs) Nodo() int { return int(g.nodo) }
+
+// Fijo indica si el número de nodo se indicó al crear el generador (ahora o
+// en un arranque anterior con la misma ruta). En una red de talleres debe
+// estarlo: cada nodo necesita uno distinto y no se puede deducir solo.
+func (g *GeneradorIDs) Fijo() bool { return g.fijo }
+
+// guardar escribe en ruta el número de nodo y la hora del último
+// identificador
+func (g *GeneradorIDs) guardar(ultimo int64) error {
+	if g.ruta == "" {
+		return nil
+	}
+	datos, _ := json.Marshal(estadoGenerador{Nodo: int(g.nodo), Fijo: g.fijo, Ultimo: ultimo})
+	return escribirAtomico(g.ruta, datos)
+}
+
+// Siguiente devuelve un identificador nuevo
+func (g *GeneradorIDs) Siguiente() (int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ahora := g.Reloj.Ahora().Sub(epocaIDs).Milliseconds()
+	if ahora < g.ultimo {
+		ahora = g.ultimo // el reloj ha retrocedido
+	}
+	secuencia := int64(0)
+	if ahora == g.ultimo {
+		secuencia = g.secuencia + 1
+		if secuencia > maxSecuencia {
+			// Milisegundo agotado: se toma prestado el siguiente
+			ahora, secuencia = ahora+1, 0
+		}
+	}
+	if ahora != g.ultimo {
+		if err := g.guardar(ahora); err != nil {
+			return 0, err
+		}
+	}
+	g.ultimo, g.secuencia = ahora, secuencia
+	return int(ahora<<(bitsNodo+bitsSecuencia) | g.nodo<<bitsSecuencia | secuencia), nil
+}
+
+// DescomponerID devuelve la hora, el nodo y la secuencia de un identificador
+func DescomponerID(id int) (fecha time.Time, nodo, secuencia int) {
+	ms := int64(id) >> (bitsNodo + bitsSecuencia)
+	return epocaIDs.Add(time.Duration(ms) * time.Millisecond),
+		id >> bitsSecuencia & MaxNodoID, id & maxSecuencia
+}
+
+// EsIDAntiguo indica si id viene del contador por proceso que se usaba antes
+// del generador (sus valores caben en los bits de nodo y secuencia)
+func EsIDAntiguo(id int) bool { return id < 1<<(bitsNodo+bitsSecuencia) }
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestGeneradorNodoFijo comprueba que el número de nodo indicado se recuerda
+// en los siguientes arranques y que el 0 por omisión no se da por fijado
+func TestGeneradorNodoFijo(t *testing.T) {
+	ruta := filepath.Join(t.TempDir(), "ids.json")
+	g, err := NuevoGeneradorIDs(-1, ruta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Fijo() || g.Nodo() != 0 {
+		t.Fatalf("sin -id-nodo: nodo %d, fijo %v", g.Nodo(), g.Fijo())
+	}
+	if _, err := g.Siguiente(); err != nil {
+		t.Fatal(err)
+	}
+	if g, err = NuevoGeneradorIDs(-1, ruta); err != nil || g.Fijo() {
+		t.Fatal("el 0 por omisión queda fijado en el siguiente arranque", err)
+	}
+
+	g, err = NuevoGeneradorIDs(7, ruta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := g.Siguiente()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err = NuevoGeneradorIDs(-1, ruta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !g.Fijo() || g.Nodo() != 7 {
+		t.Fatalf("tras fijar el 7: nodo %d, fijo %v", g.Nodo(), g.Fijo())
+	}
+	if otro, err := g.Siguiente(); err != nil || otro <= id {
+		t.Fatalf("tras reiniciar da %d después de %d (%v)", otro, id, err)
+	}
+
+	if _, err := NuevoGeneradorIDs(MaxNodoID+1, ruta); err == nil {
+		t.Fatal("acepta un número de nodo fuera de rango")
+	}
+}
+
+// TestIdentificadoresUnicos genera identificadores a la vez desde varios nodos y
+// comprueba que no se repiten, que crecen en cada nodo aunque su reloj
+// retroceda y que un nodo que se reinicia no repite los que ya dio
+func TestIdentificadoresUnicos(t *testing.T) {
+	dir := t.TempDir()
+
+	const nodos, porNodo = 4, 20000
+	generadores := make([]*GeneradorIDs, nodos)
+	for i := range generadores {
+		g, err := NuevoGeneradorIDs(i+1, filepath.Join(dir, fmt.Sprintf("ids-%d.json", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		g.Reloj = NuevoRelojFisico(0)
+		generadores[i] = g
+	}
+	ids := make([][]int, nodos)
+	errores := make([]error, nodos)
+	var wg sync.WaitGroup
+	for i, g := range generadores {
+		wg.Add(1)
+		go func(i int, g *GeneradorIDs) {
+			defer wg.Done()
+			for k := 0; k < porNodo; k++ {
+				if k == porNodo/2 && i == 0 {
+					// A mitad de la prueba el reloj del primer nodo retrocede una hora
+					g.Reloj.Ajustar(-time.Hour)
+				}
+				id, err := g.Siguiente()
+				if err != nil {
+					errores[i] = err
+					return
+				}
+				ids[i] = append(ids[i], id)
+			}
+		}(i, g)
+	}
+	wg.Wait()
+	for _, err := range errores {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, lista := range ids {
+		for k := 1; k < len(lista); k++ {
+			if lista[k] <= lista[k-1] {
+				t.Fatalf("el nodo %d dio %d después de %d", i+1, lista[k], lista[k-1])
+			}
+		}
+	}
+
+	// El primer nodo se reinicia con el reloj una hora atrasado
+	reiniciado, err := NuevoGeneradorIDs(1, filepath.Join(dir, "ids-0.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reiniciado.Reloj = NuevoRelojFisico(-time.Hour)
+	ultimo := ids[0][len(ids[0])-1]
+	for k := 0; k < 100; k++ {
+		id, err := reiniciado.Siguiente()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id <= ultimo {
+			t.Fatalf("tras reiniciar, el nodo 1 dio %d, que no es posterior a %d", id, ultimo)
+		}
+		ids[0] = append(ids[0], id)
+		ultimo = id
+	}
+
+	var todos []int
+	for _, lista := range ids {
+		todos = append(todos, lista...)
+	}
+	sort.Ints(todos)
+	for k := 1; k < len(todos); k++ {
+		if todos[k] == todos[k-1] {
+			fecha, nodo, sec := DescomponerID(todos[k])
+			t.Fatalf("identificador repetido %d (nodo %d, %s, secuencia %d)", todos[k], nodo, fecha.Format(FormatoFecha), sec)
+		}
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Instantánea global de Chandy–Lamport. Los nodos se comunican por canales
+// FIFO (una conexión TCP por sentido entre cada par) por los que viajan las
+// operaciones que un nodo remite a otro y los marcadores. Quien inicia la
+// instantánea guarda su estado y envía un marcador por todos sus canales de
+// salida; cada nodo, al recibir el primer marcador, hace lo mismo y graba lo
+// que le llega por los demás canales de entrada hasta recibir su marcador.
+// Cada nodo envía al iniciador su estado y las operaciones grabadas, y este
+// las combina en una InstantaneaGlobal.
+
+// Tipos de mensaje por los canales
+const (
+	clHola     = "hola"     // primer mensaje de un canal: identifica al origen
+	clOp       = "op"       // operación remitida que el destino debe aplicar
+	clMarcador = "marcador" // marcador de una instantánea
+	clParte    = "parte"    // estado y canales grabados de un nodo, para el iniciador
+)
+
+// MensajeCanal es lo que viaja por un canal, un JSON por línea
+type MensajeCanal struct {
+	Tipo        string            `json:"tipo"`
+	Origen      string            `json:"origen"`
+	Op          *Operacion        `json:"op,omitempty"`
+	Instantanea string            `json:"instantanea,omitempty"` // id de la instantánea
+	Iniciador   string            `json:"iniciador,omitempty"`
+	Parte       *ParteInstantanea `json:"parte,omitempty"`
+	Sello
+}
+
+// MensajeEnTransito es una operación que estaba en un canal al tomar la instantánea
+type MensajeEnTransito struct {
+	Origen  string    `json:"origen"`
+	Destino string    `json:"destino"`
+	Op      Operacion `json:"op"`
+}
+
+// ParteInstantanea es lo que cada nodo aporta a una instantánea global
+type ParteInstantanea struct {
+	Nodo       string              `json:"nodo"`
+	Estado     Instantanea         `json:"estado"`
+	EnTransito []MensajeEnTransito `json:"enTransito"`
+}
+
+// InstantaneaGlobal es un estado consistente de todos los nodos: el taller de
+// cada uno y las operaciones que viajaban entre ellos
+type InstantaneaGlobal struct {
+	ID         string                 `json:"id"`
+	Fecha      string                 `json:"fecha"`
+	Nodos      map[string]Instantanea `json:"nodos"`
+	EnTransito []MensajeEnTransito    `json:"enTransito"`
+}
+
+// NodoCL es un nodo con canales FIFO hacia los demás que puede tomar
+// instantáneas globales y participar en las de otros
+type NodoCL struct {
+	Nombre string
+	// Cómo actúa el nodo sobre su taller; se llaman con el cerrojo tomado
+	Aplicar  func(op Operacion) error
+	Exportar func() Instantanea
+	// Relojes lógicos con los que se marcan los mensajes (nil = sin marcas)
+	Relojes *Relojes
+
+	cerrojo *sync.Mutex // cerrojo del taller
+	pares   map[string]string
+	oyente  net.Listener
+
+	mu           sync.Mutex
+	salida       map[string]*json.Encoder
+	conexiones   []net.Conn
+	instantaneas map[string]*grabacionCL
+	detenido     bool
+}
+
+// grabacionCL es el progreso de una instantánea en un nodo
+type grabacionCL struct {
+	iniciador  string
+	estado     Instantanea
+	grabando   map[string]bool // canales de entrada que aún se graban
+	enTransito []MensajeEnTransito
+	// Solo en el iniciador
+	partes map[string]ParteInstantanea
+	lista  chan InstantaneaGlobal
+}
+
+// NuevoNodoCL crea el nodo nombre sobre el taller t protegido por cerrojo;
+// pares asocia el nombre de cada nodo (incluido este) con su dirección
+func NuevoNodoCL(nombre string, pares map[string]string, t *Taller, cerrojo *sync.Mutex) (*NodoCL, error) {
+	if _, ok := pares[nombre]; !ok {
+		return nil, fmt.Errorf("el nodo %q no está entre los pares", nombre)
+	}
+	return &NodoCL{
+		Nombre:       nombre,
+		Aplicar:      t.Aplicar,
+		Exportar:     t.Exportar,
+		cerrojo:      cerrojo,
+		pares:        pares,
+		salida:       map[string]*json.Encoder{},
+		instantaneas: map[string]*grabacionCL{},
+	}, nil
+}
+
+// Escuchar acepta los canales de entrada de los demás nodos
+func (n *NodoCL) Escuchar() error {
+	oyente, err := net.Listen("tcp", n.pares[n.Nombre])
+	if err != nil {
+		return err
+	}
+	n.oyente = oyente
+	go func() {
+		for {
+			conn, err := oyente.Accept()
+			if err != nil {
+				return
+			}
+			n.mu.Lock()
+			n.conexiones = append(n.conexiones, conn)
+			n.mu.Unlock()
+			go n.leerCanal(conn)
+		}
+	}()
+	return nil
+}
+
+// Detener cierra el oyente y todos los canales
+func (n *NodoCL) Detener() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.detenido = true
+	if n.oyente != nil {
+		n.oyente.Close()
+	}
+	for _, c := range n.conexiones {
+		c.Close()
+	}
+}
+
+// Remitir envía una operación al nodo destino para que la aplique. Si local no
+// es nil se ejecuta antes con el cerrojo del taller tomado, de modo que el
+// cambio local y el envío no pueden quedar a distinto lado de una instantánea
+// (por ejemplo, eliminar aquí un vehículo y darlo de alta allí). Si el envío
+// falla, el cambio local ya está hecho.
+func (n *NodoCL) Remitir(destino string, op Operacion, local func() error) error {
+	n.cerrojo.Lock()
+	defer n.cerrojo.Unlock()
+	if local != nil {
+		if err := local(); err != nil {
+			return err
+		}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.enviar(destino, MensajeCanal{Tipo: clOp, Op: &op})
+}
+
+// TomarInstantanea inicia una instantánea global y espera a tener las partes
+// de todos los nodos
+func (n *NodoCL) TomarInstantanea(espera time.Duration) (InstantaneaGlobal, error) {
+	id := fmt.Sprintf("%s-%d", n.Nombre, time.Now().UnixNano())
+	n.cerrojo.Lock()
+	n.mu.Lock()
+	g, err := n.grabar(id, n.Nombre, "")
+	var lista chan InstantaneaGlobal
+	if g != nil {
+		lista = g.lista
+		n.terminarSiCompleta(id, g)
+	}
+	n.mu.Unlock()
+	n.cerrojo.Unlock()
+	if err != nil {
+		return InstantaneaGlobal{}, err
+	}
+	select {
+	case ig := <-lista:
+		return ig, nil
+	case <-time.After(espera):
+		n.mu.Lock()
+		delete(n.instantaneas, id)
+		n.mu.Unlock()
+		return InstantaneaGlobal{}, errors.New("no respondieron todos los nodos a tiempo")
+	}
+}
+
+// grabar guarda el estado local para la instantánea id y envía un marcador por
+// cada canal de salida. desde es el canal por el que llegó el primer marcador
+// (vacío en el iniciador), que queda vacío. Se llama con el cerrojo del taller
+// y n.mu tomados.
+func (n *NodoCL) grabar(id, iniciador, desde string) (*grabacionCL, error) {
+	g := &grabacionCL{iniciador: iniciador, estado: n.Exportar(), grabando: map[string]bool{}}
+	if iniciador == n.Nombre {
+		g.partes = map[string]ParteInstantanea{}
+		g.lista = make(chan InstantaneaGlobal, 1)
+	}
+	for p := range n.pares {
+		if p != n.Nombre && p != desde {
+			g.grabando[p] = true
+		}
+	}
+	n.instantaneas[id] = g
+	for p := range n.pares {
+		if p == n.Nombre {
+			continue
+		}
+		if err := n.enviar(p, MensajeCanal{Tipo: clMarcador, Instantanea: id, Iniciador: iniciador}); err != nil {
+			delete(n.instantaneas, id)
+			return nil, fmt.Errorf("no se pudo enviar el marcador a %s: %v", p, err)
+		}
+	}
+	return g, nil
+}
+
+// terminarSiCompleta envía la parte de este nodo al iniciador cuando ya no
+// queda ningún canal por grabar; se llama con n.mu tomado
+func (n *NodoCL) terminarSiCompleta(id string, g *grabacionCL) {
+	if len(g.grabando) > 0 {
+		return
+	}
+	parte := ParteInstantanea{Nodo: n.Nombre, Estado: g.estado, EnTransito: g.enTransito}
+	if g.iniciador == n.Nombre {
+		n.recibirParte(id, parte)
+		return
+	}
+	delete(n.instantaneas, id)
+	n.enviar(g.iniciador, MensajeCanal{Tipo: clParte, Instantanea: id, Parte: &parte})
+}
+
+// recibirParte guarda la parte de un nodo en el iniciador y, si ya están
+// todas, entrega la instantánea global; se llama con n.mu tomado
+func (n *NodoCL) recibirParte(id string, parte ParteInstantanea) {
+	g := n.instantaneas[id]
+	if g == nil || g.partes == nil {
+		return
+	}
+	g.partes[parte.Nodo] = parte
+	if len(g.partes) < len(n.pares) {
+		return
+	}
+	ig := InstantaneaGlobal{ID: id, Fecha: time.Now().Format(time.RFC3339), Nodos: map[string]Instantanea{}}
+	nombres := make([]string, 0, len(g.partes))
+	for nombre := range g.partes {
+		nombres = append(nombres, nombre)
+	}
+	sort.Strings(nombres)
+	for _, nombre := range nombres {
+		ig.Nodos[nombre] = g.partes[nombre].Estado
+		ig.EnTransito = append(ig.EnTransito, g.partes[nombre].EnTransito...)
+	}
+	delete(n.instantaneas, id)
+	g.lista <- ig
+}
+
+// enviar escribe un mensaje en el canal hacia p, abriéndolo si hace falta; se
+// llama con n.mu tomado para que los mensajes de un canal no se mezclen
+func (n *NodoCL) enviar(p string, m MensajeCanal) error {
+	if n.detenido {
+		return errNodoCaido
+	}
+	codif := n.salida[p]
+	if codif == nil {
+		conn, err := net.DialTimeout("tcp", n.pares[p], 2*time.Second)
+		if err != nil {
+			return err
+		}
+		n.conexiones = append(n.conexiones, conn)
+		codif = json.NewEncoder(conn)
+		if err := codif.Encode(MensajeCanal{Tipo: clHola, Origen: n.Nombre}); err != nil {
+			conn.Close()
+			return err
+		}
+		n.salida[p] = codif
+	}
+	m.Origen = n.Nombre
+	m.Sellar(n.Relojes)
+	if err := codif.Encode(m); err != nil {
+		delete(n.salida, p)
+		return err
+	}
+	return nil
+}
+
+// leerCanal procesa en orden los mensajes de un canal de entrada
+func (n *NodoCL) leerCanal(conn net.Conn) {
+	defer conn.Close()
+	decod := json.NewDecoder(conn)
+	var hola MensajeCanal
+	if err := decod.Decode(&hola); err != nil || hola.Tipo != clHola {
+		return
+	}
+	origen := hola.Origen
+	for {
+		var m MensajeCanal
+		if err := decod.Decode(&m); err != nil {
+			return
+		}
+		m.Recibido(n.Relojes)
+		switch m.Tipo {
+		case clOp:
+			n.cerrojo.Lock()
+			n.Aplicar(*m.Op)
+			n.mu.Lock()
+			for _, g := range n.instantaneas {
+				if g.grabando[origen] {
+					g.enTransito = append(g.enTransito, MensajeEnTransito{Origen: origen, Destino: n.Nombre, Op: *m.Op})
+				}
+			}
+			n.mu.Unlock()
+			n.cerrojo.Unlock()
+		case clMarcador:
+			n.cerrojo.Lock()
+			n.mu.Lock()
+			g := n.instantaneas[m.Instantanea]
+			if g == nil {
+				// Primer marcador: el canal por el que llega queda vacío
+				g, _ = n.grabar(m.Instantanea, m.Iniciador, origen)
+			} else {
+				delete(g.grabando, origen)
+			}
+			if g != nil {
+				n.terminarSiCompleta(m.Instantanea, g)
+			}
+			n.mu.Unlock()
+			n.cerrojo.Unlock()
+		case clParte:
+			n.mu.Lock()
+			n.recibirParte(m.Instantanea, *m.Parte)
+			n.mu.Unlock()
+		}
+	}
+}
+
+// FICHERO
+
+// GuardarInstantaneaGlobal escribe la instantánea en ruta
+func GuardarInstantaneaGlobal(ruta string, ig InstantaneaGlobal) error {
+	datos, err := json.MarshalIndent(ig, "", "  ")
+	if err != nil {
+		return err
+	}
+	return escribirAtomico(ruta, datos)
+}
+
+// CargarInstantaneaGlobal lee una instantánea escrita con GuardarInstantaneaGlobal
+func CargarInstantaneaGlobal(ruta string) (InstantaneaGlobal, error) {
+	var ig InstantaneaGlobal
+	datos, err := os.ReadFile(ruta)
+	if err != nil {
+		return ig, err
+	}
+	err = json.Unmarshal(datos, &ig)
+	return ig, err
+}
+
+// Restaurar devuelve el nodo indicado al estado de la instantánea: importa su
+// taller y aplica las operaciones que iban hacia él
+func (ig InstantaneaGlobal) Restaurar(nodo string, importar func(Instantanea), aplicar func(Operacion) error) error {
+	estado, ok := ig.Nodos[nodo]
+	if !ok {
+		return fmt.Errorf("la instantánea no incluye el nodo %q", nodo)
+	}
+	importar(estado)
+	for _, m := range ig.EnTransito {
+		if m.Destino == nodo {
+			if err := aplicar(m.Op); err != nil {
+				return fmt.Errorf("operación en tránsito desde %s: %v", m.Origen, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Resumen cuenta los clientes y vehículos de cada nodo y los mensajes en tránsito
+func (ig InstantaneaGlobal) Resumen() string {
+	nombres := make([]string, 0, len(ig.Nodos))
+	for nombre := range ig.Nodos {
+		nombres = append(nombres, nombre)
+	}
+	sort.Strings(nombres)
+	s := fmt.Sprintf("Instantánea %s (%s)", ig.ID, ig.Fecha)
+	for _, nombre := range nombres {
+		ins := ig.Nodos[nombre]
+		vehiculos := 0
+		for _, c := range ins.Clientes {
+			vehiculos += len(c.Vehiculos)
+		}
+		s += fmt.Sprintf("\n - %s: %d clientes, %d vehículos, %d plazas", nombre, len(ins.Clientes), vehiculos, len(ins.Plazas))
+	}
+	s += fmt.Sprintf("\n - En tránsito: %d operaciones", len(ig.EnTransito))
+	return s
+}
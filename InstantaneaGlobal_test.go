@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestInstantaneaGlobal mueve vehículos sin parar entre tres nodos mientras
+// cada uno toma una instantánea, y comprueba que en todas cada vehículo está
+// exactamente una vez (en un taller o en tránsito), también tras guardarla,
+// cargarla y restaurar los nodos a partir de ella
+func TestInstantaneaGlobal(t *testing.T) {
+	nombres := []string{"A", "B", "C"}
+	pares := map[string]string{}
+	for i, nombre := range nombres {
+		pares[nombre] = fmt.Sprintf("localhost:%d", 9901+i)
+	}
+	const vehiculos = 30
+	talleres := make([]*Taller, len(nombres))
+	cerrojos := make([]*sync.Mutex, len(nombres))
+	nodos := make([]*NodoCL, len(nombres))
+	for i, nombre := range nombres {
+		talleres[i], cerrojos[i] = &Taller{}, &sync.Mutex{}
+		nodo, err := NuevoNodoCL(nombre, pares, talleres[i], cerrojos[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := nodo.Escuchar(); err != nil {
+			t.Fatal(err)
+		}
+		defer nodo.Detener()
+		nodos[i] = nodo
+	}
+	talleres[0].Aplicar(Operacion{Tipo: OpCrearCliente, IDCliente: 1, Nombre: "Ana"})
+	for v := 0; v < vehiculos; v++ {
+		talleres[0].Aplicar(Operacion{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: fmt.Sprintf("%04dABC", v)})
+	}
+
+	// Cada nodo envía sus vehículos a los otros sin parar
+	parar := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range nodos {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			azar := rand.New(rand.NewSource(int64(i)))
+			for {
+				select {
+				case <-parar:
+					return
+				default:
+				}
+				cerrojos[i].Lock()
+				var matricula string
+				for _, c := range talleres[i].ClientesTaller {
+					if len(c.Vehiculos) > 0 {
+						matricula = c.Vehiculos[azar.Intn(len(c.Vehiculos))].Matricula
+						break
+					}
+				}
+				var op Operacion
+				if matricula != "" {
+					op, _ = operacionRecepcion(talleres[i], matricula)
+				}
+				cerrojos[i].Unlock()
+				if matricula == "" {
+					time.Sleep(time.Millisecond)
+					continue
+				}
+				destino := nombres[(i+1+azar.Intn(len(nombres)-1))%len(nombres)]
+				nodos[i].Remitir(destino, op, func() error {
+					return talleres[i].Aplicar(Operacion{Tipo: OpEliminarVehiculo, Matricula: matricula})
+				})
+			}
+		}(i)
+	}
+	defer func() {
+		close(parar)
+		wg.Wait()
+	}()
+
+	dir := t.TempDir()
+	for i, nodo := range nodos {
+		time.Sleep(50 * time.Millisecond)
+		ig, err := nodo.TomarInstantanea(5 * time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := comprobarVehiculos(ig, vehiculos); err != nil {
+			t.Fatalf("instantánea de %s: %v", nodo.Nombre, err)
+		}
+		ruta := filepath.Join(dir, fmt.Sprintf("instantanea-%d.json", i))
+		if err := GuardarInstantaneaGlobal(ruta, ig); err != nil {
+			t.Fatal(err)
+		}
+		cargada, err := CargarInstantaneaGlobal(ruta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total := 0
+		for _, nombre := range nombres {
+			var tl Taller
+			if err := cargada.Restaurar(nombre, tl.Importar, tl.Aplicar); err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range tl.ClientesTaller {
+				total += len(c.Vehiculos)
+			}
+		}
+		if total != vehiculos {
+			t.Fatalf("instantánea de %s: al restaurar hay %d vehículos en lugar de %d", nodo.Nombre, total, vehiculos)
+		}
+	}
+}
+
+// comprobarVehiculos comprueba que cada vehículo aparece una sola vez entre
+// los talleres y las operaciones en tránsito de la instantánea
+func comprobarVehiculos(ig InstantaneaGlobal, esperados int) error {
+	vistos := map[string]int{}
+	for _, ins := range ig.Nodos {
+		for _, c := range ins.Clientes {
+			for _, v := range c.Vehiculos {
+				vistos[v.Matricula]++
+			}
+		}
+	}
+	for _, m := range ig.EnTransito {
+		if m.Op.Tipo == OpRecibirVehiculo {
+			vistos[m.Op.Matricula]++
+		}
+	}
+	if len(vistos) != esperados {
+		return fmt.Errorf("hay %d vehículos distintos en lugar de %d", len(vistos), esperados)
+	}
+	for matricula, veces := range vistos {
+		if veces != 1 {
+			return fmt.Errorf("el vehículo %s aparece %d veces", matricula, veces)
+		}
+	}
+	return nil
+}
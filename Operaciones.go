@@ -0,0 +1,963 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Tipos de operación que modifican el estado del Taller
+const (
+	OpCrearCliente        = "crearCliente"
+	OpModificarCliente    = "modificarCliente"
+	OpEliminarCliente     = "eliminarCliente"
+	OpCrearVehiculo       = "crearVehiculo"
+	OpModificarVehiculo   = "modificarVehiculo"
+	OpEliminarVehiculo    = "eliminarVehiculo"
+	OpCrearIncidencia     = "crearIncidencia"
+	OpModificarIncidencia = "modificarIncidencia"
+	OpEliminarIncidencia  = "eliminarIncidencia"
+	OpEstadoIncidencia    = "estadoIncidencia"
+	OpCrearMecanico       = "crearMecanico"
+	OpModificarMecanico   = "modificarMecanico"
+	OpEliminarMecanico    = "eliminarMecanico"
+	OpEstadoMecanico      = "estadoMecanico"
+	OpAsignarPlaza        = "asignarPlaza"
+	OpRecibirVehiculo     = "recibirVehiculo"
+
+	// Terminales de los mecánicos (detector de fallos)
+	OpMecanicoInaccesible = "mecanicoInaccesible"
+	OpMecanicoAccesible   = "mecanicoAccesible"
+
+	// Reparto de clientes entre fragmentos
+	OpImportarCliente = "importarCliente"
+
+	// Transferencias entre sedes con confirmación en dos fases
+	OpPrepararSalida   = "prepararSalida"
+	OpConfirmarSalida  = "confirmarSalida"
+	OpAbortarSalida    = "abortarSalida"
+	OpReservarPlaza    = "reservarPlaza"
+	OpConfirmarEntrada = "confirmarEntrada"
+	OpCancelarReserva  = "cancelarReserva"
+
+	// Facturación de incidencias cerradas
+	OpEmitirFactura = "emitirFactura"
+
+	// Inventario de repuestos
+	OpCrearRepuesto     = "crearRepuesto"
+	OpModificarRepuesto = "modificarRepuesto"
+	OpEliminarRepuesto  = "eliminarRepuesto"
+	OpEntradaRepuesto   = "entradaRepuesto"
+	OpReservarRepuesto  = "reservarRepuesto"
+	OpLiberarRepuesto   = "liberarRepuesto"
+
+	// Proveedores y pedidos de repuestos
+	OpCrearProveedor     = "crearProveedor"
+	OpModificarProveedor = "modificarProveedor"
+	OpEliminarProveedor  = "eliminarProveedor"
+	OpEnviarPedido       = "enviarPedido"
+	OpRecibirPedido      = "recibirPedido"
+	OpCancelarPedido     = "cancelarPedido"
+
+	// Sesiones de trabajo de los mecánicos en las incidencias
+	OpIniciarTrabajo  = "iniciarTrabajo"
+	OpTerminarTrabajo = "terminarTrabajo"
+
+	// Citas con reserva de plaza
+	OpPedirCita    = "pedirCita"
+	OpCancelarCita = "cancelarCita"
+	OpLlegadaCita  = "llegadaCita"
+
+	// Turnos y ausencias de los mecánicos
+	OpHorarioMecanico  = "horarioMecanico"
+	OpAusenciaMecanico = "ausenciaMecanico"
+	OpQuitarAusencia   = "quitarAusencia"
+
+	// Presupuestos de las incidencias
+	OpPresupuestar         = "presupuestar"
+	OpEnviarPresupuesto    = "enviarPresupuesto"
+	OpResponderPresupuesto = "responderPresupuesto"
+
+	// Cobros y devoluciones de las facturas
+	OpRegistrarPago = "registrarPago"
+)
+
+// Operacion describe un único cambio sobre el Taller. Solo se rellenan los
+// campos que necesita su Tipo; así puede guardarse en el log y reaplicarse.
+type Operacion struct {
+	Tipo             string `json:"tipo"`
+	IDCliente        int    `json:"idCliente,omitempty"`
+	Nombre           string `json:"nombre,omitempty"`
+	Telefono         string `json:"telefono,omitempty"`
+	Email            string `json:"email,omitempty"`
+	Matricula        string `json:"matricula,omitempty"`
+	Marca            string `json:"marca,omitempty"`
+	Modelo           string `json:"modelo,omitempty"`
+	FechaEntrada     string `json:"fechaEntrada,omitempty"`
+	FechaSalida      string `json:"fechaSalida,omitempty"`
+	IDIncidencia     int    `json:"idIncidencia,omitempty"`
+	TipoIncidencia   string `json:"tipoIncidencia,omitempty"`
+	Prioridad        string `json:"prioridad,omitempty"`
+	Descripcion      string `json:"descripcion,omitempty"`
+	Estado           string `json:"estado,omitempty"`
+	IDMecanico       int    `json:"idMecanico,omitempty"`
+	Especialidad     string `json:"especialidad,omitempty"`
+	AniosExperiencia int    `json:"aniosExperiencia,omitempty"`
+	Activo           bool   `json:"activo,omitempty"`
+	IDPlaza          int    `json:"idPlaza,omitempty"`
+	Transaccion      string `json:"transaccion,omitempty"`
+	// Cliente completo, con sus vehículos e incidencias (OpImportarCliente),
+	// o con solo el vehículo que llega de otra sede (OpRecibirVehiculo)
+	Cliente *ClienteDatos `json:"cliente,omitempty"`
+	// Líneas y descuento de la factura; el número y los totales los pone Aplicar (OpEmitirFactura)
+	Factura *Factura `json:"factura,omitempty"`
+	// Pieza del catálogo (OpCrearRepuesto, OpModificarRepuesto) o referencia y
+	// unidades con las que se opera
+	Repuesto   *Repuesto `json:"repuesto,omitempty"`
+	Referencia string    `json:"referencia,omitempty"`
+	Cantidad   int       `json:"cantidad,omitempty"`
+	// Proveedor completo (OpCrearProveedor, OpModificarProveedor) o los IDs
+	// del proveedor y del pedido con los que se opera
+	Proveedor   *Proveedor `json:"proveedor,omitempty"`
+	IDProveedor int        `json:"idProveedor,omitempty"`
+	IDPedido    int        `json:"idPedido,omitempty"`
+	// Cita que se pide (OpPedirCita) o ID de la cita con la que se opera
+	Cita   *Cita `json:"cita,omitempty"`
+	IDCita int   `json:"idCita,omitempty"`
+	// Jornada semanal completa del mecánico (OpHorarioMecanico) o ausencia
+	// que se le añade o se le quita (se identifica por su tipo y su inicio)
+	Turnos   []Turno   `json:"turnos,omitempty"`
+	Ausencia *Ausencia `json:"ausencia,omitempty"`
+	// Líneas, descuento y motivo del presupuesto de la incidencia; la
+	// versión, el estado y los importes los pone Aplicar (OpPresupuestar)
+	Presupuesto *Presupuesto `json:"presupuesto,omitempty"`
+	// Cobro o devolución de una factura; el cliente lo pone Aplicar (OpRegistrarPago)
+	Pago *Pago `json:"pago,omitempty"`
+	// Fecha es la hora sincronizada a la que se ejecutó la operación; la pone
+	// ejecutar para que todas las réplicas apunten la misma
+	Fecha string `json:"fecha,omitempty"`
+}
+
+// Aplicar ejecuta la operación sobre el taller. Todas las comprobaciones se
+// hacen antes de modificar nada, de modo que una operación que falla deja el
+// estado intacto y reaplicar la misma secuencia produce siempre el mismo estado.
+// Aplicar no publica nada: los eventos del cambio quedan en Eventos para que
+// los publique el nodo que ejecutó la operación, no cada réplica que la aplica.
+func (t *Taller) Aplicar(op Operacion) error {
+	t.eventos = nil
+	if err := t.aplicar(op); err != nil {
+		t.eventos = nil
+		return err
+	}
+	return nil
+}
+
+// Eventos devuelve los eventos de la última operación aplicada con éxito
+func (t *Taller) Eventos() []Evento { return t.eventos }
+
+func (t *Taller) anotar(e Evento) { t.eventos = append(t.eventos, e) }
+
+func (t *Taller) aplicar(op Operacion) error {
+	switch op.Tipo {
+	case OpCrearCliente:
+		if c, _ := t.BuscarCliente(op.IDCliente); c != nil {
+			return errors.New("ya existe un cliente con ese ID")
+		}
+		c := &Cliente{IDCliente: op.IDCliente, Nombre: op.Nombre, Telefono: op.Telefono, Email: op.Email}
+		t.ClientesTaller = append(t.ClientesTaller, c)
+
+	case OpModificarCliente:
+		c, _ := t.BuscarCliente(op.IDCliente)
+		if c == nil {
+			return errors.New("cliente no encontrado")
+		}
+		c.Nombre, c.Telefono, c.Email = op.Nombre, op.Telefono, op.Email
+
+	case OpEliminarCliente:
+		c, idx := t.BuscarCliente(op.IDCliente)
+		if c == nil {
+			return errors.New("cliente no encontrado")
+		}
+		for _, v := range c.Vehiculos {
+			if v.GetSaliendo() != "" {
+				return errors.New("el cliente tiene un vehículo transfiriéndose a otra sede")
+			}
+		}
+		t.LiberarPlazasDeCliente(c)
+		for _, v := range c.Vehiculos {
+			if inc := v.GetIncidencia(); inc != nil {
+				t.terminarSesionesIncidencia(inc, op.Fecha)
+			}
+		}
+		t.ClientesTaller = append(t.ClientesTaller[:idx], t.ClientesTaller[idx+1:]...)
+		t.repartirRepuestos()
+		for _, v := range c.Vehiculos {
+			t.anularCitas(v.Matricula)
+		}
+
+	case OpCrearVehiculo:
+		c, _ := t.BuscarCliente(op.IDCliente)
+		if c == nil {
+			return errors.New("cliente no encontrado")
+		}
+		if _, v := t.BuscarVehiculo(op.Matricula); v != nil {
+			return errors.New("ya existe un vehículo con esa matrícula")
+		}
+		v := &Vehiculo{Matricula: op.Matricula, Marca: op.Marca, Modelo: op.Modelo,
+			FechaEntrada: op.FechaEntrada, FechaSalida: op.FechaSalida}
+		if v.FechaEntrada == "" {
+			v.FechaEntrada = op.Fecha
+		}
+		c.Vehiculos = append(c.Vehiculos, v)
+
+	case OpModificarVehiculo:
+		_, v := t.BuscarVehiculo(op.Matricula)
+		if v == nil {
+			return errors.New("vehículo no encontrado")
+		}
+		v.Marca, v.Modelo, v.FechaEntrada, v.FechaSalida = op.Marca, op.Modelo, op.FechaEntrada, op.FechaSalida
+
+	case OpEliminarVehiculo:
+		c, v := t.BuscarVehiculo(op.Matricula)
+		if v == nil {
+			return errors.New("vehículo no encontrado")
+		}
+		if v.GetSaliendo() != "" {
+			return errors.New("el vehículo se está transfiriendo a otra sede")
+		}
+		if inc := v.GetIncidencia(); inc != nil {
+			t.terminarSesionesIncidencia(inc, op.Fecha)
+		}
+		v.SetIncidencia(nil)
+		for i, vv := range c.Vehiculos {
+			if vv == v {
+				c.Vehiculos = append(c.Vehiculos[:i], c.Vehiculos[i+1:]...)
+				break
+			}
+		}
+		t.repartirRepuestos()
+		t.anularCitas(v.Matricula)
+		t.anotar(Evento{Tema: TemaSalidaVehiculo, Matricula: v.Matricula, IDCliente: c.IDCliente})
+
+	case OpCrearIncidencia:
+		_, v := t.BuscarVehiculo(op.Matricula)
+		if v == nil {
+			return errors.New("vehículo no encontrado")
+		}
+		if v.GetIncidencia() != nil {
+			return errors.New("el vehículo ya tiene una incidencia")
+		}
+		inc := &Incidencia{
+			IDIncidencia: op.IDIncidencia,
+			Tipo:         op.TipoIncidencia,
+			Prioridad:    op.Prioridad,
+			Descripcion:  op.Descripcion,
+		}
+		v.SetIncidencia(inc)
+		t.CambiarEstadoIncidencia(inc, "abierta", op.Fecha)
+
+	case OpModificarIncidencia:
+		_, v := t.BuscarVehiculo(op.Matricula)
+		if v == nil || v.GetIncidencia() == nil {
+			return errors.New("vehículo no encontrado o sin incidencia")
+		}
+		inc := v.GetIncidencia()
+		inc.Tipo, inc.Prioridad, inc.Descripcion = op.TipoIncidencia, op.Prioridad, op.Descripcion
+
+	case OpEliminarIncidencia:
+		_, v := t.BuscarVehiculo(op.Matricula)
+		if v == nil || v.GetIncidencia() == nil {
+			return errors.New("vehículo no encontrado o sin incidencia")
+		}
+		t.terminarSesionesIncidencia(v.GetIncidencia(), op.Fecha)
+		v.SetIncidencia(nil)
+		t.repartirRepuestos()
+
+	case OpEstadoIncidencia:
+		_, v := t.BuscarVehiculo(op.Matricula)
+		if v == nil || v.GetIncidencia() == nil {
+			return errors.New("vehículo no encontrado o sin incidencia")
+		}
+		inc := v.GetIncidencia()
+		if !contiene(EstadosIncidencia, op.Estado) {
+			return fmt.Errorf("estado de incidencia desconocido: %q", op.Estado)
+		}
+		if !contiene(siguientesEstados[inc.Estado], op.Estado) {
+			return fmt.Errorf("una incidencia %s no puede pasar a %s", inc.Estado, op.Estado)
+		}
+		if op.Estado == "en proceso" || op.Estado == "cerrada" {
+			// No se empieza ni se termina sin las piezas reservadas ni con
+			// el presupuesto sin aceptar
+			if faltan := PiezasQueFaltan(inc); len(faltan) > 0 {
+				return errorFaltan(faltan)
+			}
+			if err := comprobarPresupuesto(inc, op.Estado); err != nil {
+				return err
+			}
+		}
+		if op.Estado == "cerrada" {
+			t.consumirPiezas(inc)
+			t.terminarSesionesIncidencia(inc, op.Fecha)
+		}
+		t.CambiarEstadoIncidencia(inc, op.Estado, op.Fecha)
+		if op.Estado == "cerrada" && op.Fecha != "" {
+			// Terminada la reparación, la salida real sustituye a la estimada
+			v.FechaSalida = op.Fecha
+		}
+
+	case OpCrearMecanico:
+		if m, _ := t.BuscarMecanico(op.IDMecanico); m != nil {
+			return errors.New("ya existe un mecánico con ese ID")
+		}
+		m := &Mecanico{IDMecanico: op.IDMecanico, Nombre: op.Nombre, Especialidad: op.Especialidad,
+			AniosExperiencia: op.AniosExperiencia, Activo: true}
+		t.MecanicosTaller = append(t.MecanicosTaller, m)
+		t.InicializarPlazas()
+
+	case OpModificarMecanico:
+		m, _ := t.BuscarMecanico(op.IDMecanico)
+		if m == nil {
+			return errors.New("no existe ese mecánico")
+		}
+		m.Nombre, m.Especialidad, m.AniosExperiencia = op.Nombre, op.Especialidad, op.AniosExperiencia
+
+	case OpEliminarMecanico:
+		m, idx := t.BuscarMecanico(op.IDMecanico)
+		if m == nil {
+			return errors.New("no existe ese mecánico")
+		}
+		t.LiberarPlazasDeMecanico(m)
+		t.terminarSesionesDe(m.IDMecanico, op.Fecha)
+		t.MecanicosTaller = append(t.MecanicosTaller[:idx], t.MecanicosTaller[idx+1:]...)
+		t.InicializarPlazas()
+
+	case OpEstadoMecanico:
+		m, _ := t.BuscarMecanico(op.IDMecanico)
+		if m == nil {
+			return errors.New("no existe ese mecánico")
+		}
+		m.CambiarEstado(op.Activo)
+		t.InicializarPlazas()
+
+	case OpAsignarPlaza:
+		cli, veh := t.BuscarVehiculo(op.Matricula)
+		if veh == nil {
+			return errors.New("vehículo no encontrado")
+		}
+		mec, _ := t.BuscarMecanico(op.IDMecanico)
+		if mec == nil || !mec.DisponibleEn(op.Fecha) {
+			return errors.New("mecánico inexistente, no activo, inaccesible o fuera de turno")
+		}
+		p := t.BuscarPlaza(op.IDPlaza)
+		if p == nil || !p.EstaLibre() {
+			return errors.New("la plaza no existe o ya está ocupada")
+		}
+		// Las plazas libres de la franja en curso son antes de sus citas
+		if citas := t.CitasPendientesEn(op.Fecha, op.Matricula); citas > 0 {
+			if _, libres := t.EstadoTaller(); libres <= citas {
+				return fmt.Errorf("las %d plazas libres están reservadas para citas de esta hora", libres)
+			}
+		}
+		t.OcuparPlaza(p, cli, mec)
+		if inc := veh.GetIncidencia(); inc != nil {
+			inc.QuitarMecanico(mec)
+			inc.AsignarMecanico(mec)
+		}
+
+	case OpMecanicoInaccesible:
+		m, _ := t.BuscarMecanico(op.IDMecanico)
+		if m == nil {
+			return errors.New("no existe ese mecánico")
+		}
+		m.Inaccesible = true
+		t.RetirarMecanicoInaccesible(m, op.Fecha)
+		t.terminarSesionesDe(m.IDMecanico, op.Fecha)
+
+	case OpMecanicoAccesible:
+		m, _ := t.BuscarMecanico(op.IDMecanico)
+		if m == nil {
+			return errors.New("no existe ese mecánico")
+		}
+		m.Inaccesible = false
+
+	case OpImportarCliente:
+		// Cliente que llega entero de otro fragmento al reequilibrar
+		if op.Cliente == nil {
+			return errors.New("falta el cliente")
+		}
+		if c, _ := t.BuscarCliente(op.Cliente.IDCliente); c != nil {
+			return errors.New("ya existe un cliente con ese ID")
+		}
+		for _, vd := range op.Cliente.Vehiculos {
+			if _, v := t.BuscarVehiculo(vd.Matricula); v != nil {
+				return errors.New("ya existe un vehículo con esa matrícula")
+			}
+		}
+		t.ClientesTaller = append(t.ClientesTaller, t.clienteDeDatos(*op.Cliente))
+
+	case OpRecibirVehiculo:
+		// Vehículo que llega de otra sede con su cliente y su incidencia
+		// completa en op.Cliente (ver operacionRecepcion); el cliente se crea
+		// si no existía. Sin op.Cliente, como en las transferencias anotadas
+		// antes de llevarlo, la incidencia se rehace con los campos sueltos.
+		if _, v := t.BuscarVehiculo(op.Matricula); v != nil {
+			return errors.New("ya existe un vehículo con esa matrícula")
+		}
+		if op.Cliente != nil && (len(op.Cliente.Vehiculos) != 1 || op.Cliente.Vehiculos[0].Matricula != op.Matricula) {
+			return errors.New("la recepción debe traer solo el vehículo que llega")
+		}
+		c, _ := t.BuscarCliente(op.IDCliente)
+		if c == nil {
+			c = &Cliente{IDCliente: op.IDCliente, Nombre: op.Nombre, Telefono: op.Telefono, Email: op.Email}
+			t.ClientesTaller = append(t.ClientesTaller, c)
+		}
+		if op.Cliente != nil {
+			v := t.vehiculoDeDatos(op.Cliente.Vehiculos[0])
+			if inc := v.GetIncidencia(); inc != nil {
+				// El ID puede ser uno nuevo que le dio esta sede; las horas
+				// en marcha se cortan al salir del otro taller y las piezas
+				// se apartan de nuevo de este almacén
+				inc.IDIncidencia = op.IDIncidencia
+				inc.terminarSesiones(op.Fecha)
+				for i := range inc.Piezas {
+					if !inc.Piezas[i].Consumida {
+						inc.Piezas[i].Apartadas = 0
+					}
+				}
+			}
+			c.Vehiculos = append(c.Vehiculos, v)
+			t.repartirRepuestos()
+			break
+		}
+		v := &Vehiculo{Matricula: op.Matricula, Marca: op.Marca, Modelo: op.Modelo,
+			FechaEntrada: op.FechaEntrada, FechaSalida: op.FechaSalida}
+		if op.IDIncidencia != 0 {
+			estado := op.Estado
+			if estado == "" {
+				estado = "abierta"
+			}
+			v.SetIncidencia(&Incidencia{IDIncidencia: op.IDIncidencia, Tipo: op.TipoIncidencia,
+				Prioridad: op.Prioridad, Descripcion: op.Descripcion, Estado: estado,
+				Cambios: []CambioEstado{{Estado: estado, Fecha: op.Fecha}}})
+		}
+		c.Vehiculos = append(c.Vehiculos, v)
+
+	case OpPrepararSalida:
+		_, v := t.BuscarVehiculo(op.Matricula)
+		if v == nil {
+			return errors.New("vehículo no encontrado")
+		}
+		if v.GetSaliendo() != "" {
+			return errors.New("el vehículo ya se está transfiriendo")
+		}
+		v.SetSaliendo(op.Transaccion)
+
+	case OpConfirmarSalida:
+		// Idempotente: si ya se eliminó no hay nada que hacer
+		c, v := t.BuscarVehiculo(op.Matricula)
+		if v != nil && v.GetSaliendo() == op.Transaccion {
+			if inc := v.GetIncidencia(); inc != nil {
+				t.terminarSesionesIncidencia(inc, op.Fecha)
+			}
+			for i, vv := range c.Vehiculos {
+				if vv == v {
+					c.Vehiculos = append(c.Vehiculos[:i], c.Vehiculos[i+1:]...)
+					break
+				}
+			}
+			t.repartirRepuestos()
+			t.anularCitas(v.Matricula)
+		}
+
+	case OpAbortarSalida:
+		if _, v := t.BuscarVehiculo(op.Matricula); v != nil && v.GetSaliendo() == op.Transaccion {
+			v.SetSaliendo("")
+		}
+
+	case OpReservarPlaza:
+		if _, v := t.BuscarVehiculo(op.Matricula); v != nil {
+			return errors.New("ya existe un vehículo con esa matrícula")
+		}
+		disponibles := t.ListarMecanicosDisponibles(op.Fecha)
+		if len(disponibles) == 0 {
+			return errors.New("no hay mecánicos activos")
+		}
+		for _, p := range t.PlazasTaller {
+			if p.EstaLibre() {
+				p.Reservar(op.Transaccion, disponibles[0])
+				return nil
+			}
+		}
+		return errors.New("no hay plazas libres")
+
+	case OpConfirmarEntrada:
+		// Da de alta el vehículo y ocupa la plaza reservada (si sigue
+		// reservada: recalcular las plazas borra las reservas). Idempotente.
+		var plaza *Plaza
+		for _, p := range t.PlazasTaller {
+			if p.GetReserva() == op.Transaccion {
+				plaza = p
+			}
+		}
+		if _, v := t.BuscarVehiculo(op.Matricula); v == nil {
+			recepcion := op
+			recepcion.Tipo = OpRecibirVehiculo
+			if err := t.aplicar(recepcion); err != nil {
+				return err
+			}
+		}
+		if plaza != nil {
+			c, _ := t.BuscarCliente(op.IDCliente)
+			if m := plaza.GetMecanico(); m != nil && m.Disponible() {
+				t.OcuparPlaza(plaza, c, m)
+			} else {
+				t.LiberarPlaza(plaza)
+			}
+		}
+
+	case OpCancelarReserva:
+		for _, p := range t.PlazasTaller {
+			if p.GetReserva() == op.Transaccion {
+				t.LiberarPlaza(p)
+			}
+		}
+
+	case OpEmitirFactura:
+		return t.emitirFactura(op)
+
+	case OpCrearRepuesto, OpModificarRepuesto:
+		if op.Repuesto == nil || op.Repuesto.Referencia == "" {
+			return errors.New("falta el repuesto o su referencia")
+		}
+		if op.Repuesto.Coste < 0 || op.Repuesto.Precio < 0 || op.Repuesto.Stock < 0 {
+			return errors.New("coste, precio o existencias no válidos")
+		}
+		r, _ := t.BuscarRepuesto(op.Repuesto.Referencia)
+		nuevo := *op.Repuesto
+		nuevo.Compatibles = append([]Compatible(nil), op.Repuesto.Compatibles...)
+		switch {
+		case op.Tipo == OpCrearRepuesto && r != nil:
+			return errors.New("ya existe un repuesto con esa referencia")
+		case op.Tipo == OpCrearRepuesto:
+			t.Repuestos = append(t.Repuestos, &nuevo)
+		case r == nil:
+			return errors.New("repuesto no encontrado")
+		default:
+			// Las existencias solo cambian con entradas y consumos
+			nuevo.Stock = r.Stock
+			*r = nuevo
+		}
+		t.revisarPedidos(op.Fecha)
+
+	case OpEliminarRepuesto:
+		r, idx := t.BuscarRepuesto(op.Referencia)
+		if r == nil {
+			return errors.New("repuesto no encontrado")
+		}
+		reservado := false
+		t.incidencias(func(_ *Vehiculo, inc *Incidencia) {
+			for _, p := range inc.Piezas {
+				reservado = reservado || (p.Referencia == r.Referencia && !p.Consumida)
+			}
+		})
+		if reservado {
+			return errors.New("el repuesto está reservado para alguna incidencia")
+		}
+		t.Repuestos = append(t.Repuestos[:idx], t.Repuestos[idx+1:]...)
+
+	case OpEntradaRepuesto:
+		r, _ := t.BuscarRepuesto(op.Referencia)
+		if r == nil {
+			return errors.New("repuesto no encontrado")
+		}
+		if op.Cantidad <= 0 {
+			return errors.New("la cantidad debe ser positiva")
+		}
+		r.Stock += op.Cantidad
+		t.repartirRepuestos()
+		t.revisarPedidos(op.Fecha)
+
+	case OpReservarRepuesto:
+		return t.reservarRepuesto(op)
+
+	case OpLiberarRepuesto:
+		return t.liberarRepuesto(op)
+
+	case OpCrearProveedor, OpModificarProveedor:
+		if op.Proveedor == nil {
+			return errors.New("falta el proveedor")
+		}
+		pr, _ := t.BuscarProveedor(op.Proveedor.IDProveedor)
+		switch {
+		case op.Tipo == OpCrearProveedor && pr != nil:
+			return errors.New("ya existe un proveedor con ese ID")
+		case op.Tipo == OpCrearProveedor:
+			nuevo := *op.Proveedor
+			t.Proveedores = append(t.Proveedores, &nuevo)
+		case pr == nil:
+			return errors.New("proveedor no encontrado")
+		default:
+			*pr = *op.Proveedor
+		}
+
+	case OpEliminarProveedor:
+		pr, idx := t.BuscarProveedor(op.IDProveedor)
+		if pr == nil {
+			return errors.New("proveedor no encontrado")
+		}
+		for _, p := range t.Pedidos {
+			if p.IDProveedor == pr.IDProveedor && p.Abierto() {
+				return errors.New("el proveedor tiene pedidos abiertos")
+			}
+		}
+		t.Proveedores = append(t.Proveedores[:idx], t.Proveedores[idx+1:]...)
+
+	case OpEnviarPedido, OpCancelarPedido:
+		p := t.BuscarPedido(op.IDPedido)
+		if p == nil {
+			return errors.New("pedido no encontrado")
+		}
+		switch {
+		case op.Tipo == OpEnviarPedido && p.Estado != PedidoBorrador:
+			return errors.New("solo se envían pedidos en borrador")
+		case op.Tipo == OpEnviarPedido:
+			p.Estado = PedidoEnviado
+		case !p.Abierto():
+			return fmt.Errorf("el pedido está %s", p.Estado)
+		default:
+			// Lo que faltaba se volverá a pedir en la próxima revisión
+			p.Estado = PedidoCancelado
+		}
+
+	case OpRecibirPedido:
+		return t.recibirPedido(op)
+
+	case OpIniciarTrabajo:
+		return t.iniciarTrabajo(op)
+
+	case OpTerminarTrabajo:
+		return t.terminarTrabajo(op)
+
+	case OpPedirCita:
+		return t.pedirCita(op)
+
+	case OpCancelarCita:
+		c := t.BuscarCita(op.IDCita)
+		if c == nil {
+			return errors.New("cita no encontrada")
+		}
+		if c.Estado != CitaPendiente {
+			return fmt.Errorf("la cita está %s", c.Estado)
+		}
+		c.Estado = CitaCancelada
+
+	case OpLlegadaCita:
+		return t.llegadaCita(op)
+
+	case OpHorarioMecanico:
+		return t.horarioMecanico(op)
+
+	case OpAusenciaMecanico:
+		return t.ausenciaMecanico(op)
+
+	case OpQuitarAusencia:
+		return t.quitarAusencia(op)
+
+	case OpPresupuestar:
+		return t.presupuestar(op)
+
+	case OpEnviarPresupuesto:
+		return t.enviarPresupuesto(op)
+
+	case OpResponderPresupuesto:
+		return t.responderPresupuesto(op)
+
+	case OpRegistrarPago:
+		return t.registrarPago(op)
+
+	default:
+		return fmt.Errorf("operación desconocida: %q", op.Tipo)
+	}
+	return nil
+}
+
+// ComprobarConsistencia verifica los invariantes del taller: identificadores y
+// matrículas únicos y plazas ocupadas que apuntan a clientes y mecánicos existentes.
+func (t *Taller) ComprobarConsistencia() error {
+	clientes := map[*Cliente]bool{}
+	ids := map[int]bool{}
+	matriculas := map[string]bool{}
+	for _, c := range t.ClientesTaller {
+		if ids[c.IDCliente] {
+			return fmt.Errorf("ID de cliente duplicado: %d", c.IDCliente)
+		}
+		ids[c.IDCliente] = true
+		clientes[c] = true
+		for _, v := range c.Vehiculos {
+			if matriculas[v.Matricula] {
+				return fmt.Errorf("matrícula duplicada: %s", v.Matricula)
+			}
+			matriculas[v.Matricula] = true
+		}
+	}
+	mecanicos := map[*Mecanico]bool{}
+	for _, m := range t.MecanicosTaller {
+		mecanicos[m] = true
+	}
+	for _, p := range t.PlazasTaller {
+		if !p.ocupada {
+			continue
+		}
+		if !clientes[p.cliente] {
+			return fmt.Errorf("plaza #%d ocupada por un cliente inexistente", p.IDPlaza)
+		}
+		if !mecanicos[p.mecanico] {
+			return fmt.Errorf("plaza #%d atendida por un mecánico inexistente", p.IDPlaza)
+		}
+	}
+	for _, r := range t.Repuestos {
+		if apartadas := t.Apartadas(r.Referencia); apartadas > r.Stock {
+			return fmt.Errorf("repuesto %s con %d unidades apartadas y %d en almacén", r.Referencia, apartadas, r.Stock)
+		}
+	}
+	return nil
+}
+
+// INSTANTÁNEAS
+
+// Instantanea es una copia serializable del estado completo del taller
+type Instantanea struct {
+	Clientes    []ClienteDatos `json:"clientes"`
+	Mecanicos   []Mecanico     `json:"mecanicos"`
+	Plazas      []PlazaDatos   `json:"plazas"`
+	Facturas    []Factura      `json:"facturas,omitempty"`
+	Repuestos   []Repuesto     `json:"repuestos,omitempty"`
+	Proveedores []Proveedor    `json:"proveedores,omitempty"`
+	Pedidos     []Pedido       `json:"pedidos,omitempty"`
+	Citas       []Cita         `json:"citas,omitempty"`
+	Pagos       []Pago         `json:"pagos,omitempty"`
+	// Registro de sesiones de trabajo del taller; nunca es nil al exportar.
+	// Las instantáneas anteriores a él no lo traen y se rehace con las
+	// sesiones de las incidencias.
+	Sesiones []SesionTrabajo `json:"sesiones"`
+}
+
+// ClienteDatos es la forma serializable de un Cliente y sus vehículos
+type ClienteDatos struct {
+	IDCliente int             `json:"idCliente"`
+	Nombre    string          `json:"nombre"`
+	Telefono  string          `json:"telefono"`
+	Email     string          `json:"email"`
+	Vehiculos []VehiculoDatos `json:"vehiculos"`
+}
+
+// VehiculoDatos es la forma serializable de un Vehiculo y su incidencia
+type VehiculoDatos struct {
+	Matricula    string           `json:"matricula"`
+	Marca        string           `json:"marca"`
+	Modelo       string           `json:"modelo"`
+	FechaEntrada string           `json:"fechaEntrada"`
+	FechaSalida  string           `json:"fechaSalida"`
+	Incidencia   *IncidenciaDatos `json:"incidencia,omitempty"`
+	Saliendo     string           `json:"saliendo,omitempty"`
+}
+
+// IncidenciaDatos guarda los mecánicos de la incidencia por su ID
+type IncidenciaDatos struct {
+	IDIncidencia int               `json:"idIncidencia"`
+	Mecanicos    []int             `json:"mecanicos,omitempty"`
+	Tipo         string            `json:"tipo"`
+	Prioridad    string            `json:"prioridad"`
+	Descripcion  string            `json:"descripcion"`
+	Estado       string            `json:"estado"`
+	Cambios      []CambioEstado    `json:"cambios,omitempty"`
+	Piezas       []PiezaIncidencia `json:"piezas,omitempty"`
+	Sesiones     []SesionTrabajo   `json:"sesiones,omitempty"`
+	Presupuestos []Presupuesto     `json:"presupuestos,omitempty"`
+}
+
+// PlazaDatos guarda el cliente y el mecánico de la plaza por su ID
+type PlazaDatos struct {
+	IDPlaza    int    `json:"idPlaza"`
+	Ocupada    bool   `json:"ocupada"`
+	IDCliente  int    `json:"idCliente,omitempty"`
+	IDMecanico int    `json:"idMecanico,omitempty"`
+	Reserva    string `json:"reserva,omitempty"`
+}
+
+// Exportar devuelve una instantánea independiente del estado actual
+func (t *Taller) Exportar() Instantanea {
+	var ins Instantanea
+	for _, c := range t.ClientesTaller {
+		ins.Clientes = append(ins.Clientes, datosCliente(c))
+	}
+	for _, m := range t.MecanicosTaller {
+		ins.Mecanicos = append(ins.Mecanicos, *m)
+	}
+	for _, p := range t.PlazasTaller {
+		pd := PlazaDatos{IDPlaza: p.IDPlaza, Ocupada: p.ocupada, Reserva: p.reserva}
+		if p.cliente != nil {
+			pd.IDCliente = p.cliente.IDCliente
+		}
+		if p.mecanico != nil {
+			pd.IDMecanico = p.mecanico.IDMecanico
+		}
+		ins.Plazas = append(ins.Plazas, pd)
+	}
+	for _, f := range t.Facturas {
+		g := *f
+		g.Lineas = append([]LineaFactura(nil), f.Lineas...)
+		ins.Facturas = append(ins.Facturas, g)
+	}
+	for _, r := range t.Repuestos {
+		q := *r
+		q.Compatibles = append([]Compatible(nil), r.Compatibles...)
+		ins.Repuestos = append(ins.Repuestos, q)
+	}
+	for _, pr := range t.Proveedores {
+		ins.Proveedores = append(ins.Proveedores, *pr)
+	}
+	for _, p := range t.Pedidos {
+		q := *p
+		q.Lineas = append([]LineaPedido(nil), p.Lineas...)
+		q.Incidencias = append([]int(nil), p.Incidencias...)
+		ins.Pedidos = append(ins.Pedidos, q)
+	}
+	for _, c := range t.Citas {
+		ins.Citas = append(ins.Citas, *c)
+	}
+	for _, p := range t.Pagos {
+		ins.Pagos = append(ins.Pagos, *p)
+	}
+	ins.Sesiones = append([]SesionTrabajo{}, t.Sesiones...)
+	return ins
+}
+
+// datosCliente devuelve la forma serializable de un cliente
+func datosCliente(c *Cliente) ClienteDatos {
+	cd := ClienteDatos{IDCliente: c.IDCliente, Nombre: c.Nombre, Telefono: c.Telefono, Email: c.Email}
+	for _, v := range c.Vehiculos {
+		cd.Vehiculos = append(cd.Vehiculos, datosVehiculo(v))
+	}
+	return cd
+}
+
+// datosVehiculo devuelve la forma serializable de un vehículo y su incidencia
+func datosVehiculo(v *Vehiculo) VehiculoDatos {
+	vd := VehiculoDatos{Matricula: v.Matricula, Marca: v.Marca, Modelo: v.Modelo,
+		FechaEntrada: v.FechaEntrada, FechaSalida: v.FechaSalida, Saliendo: v.GetSaliendo()}
+	if inc := v.GetIncidencia(); inc != nil {
+		id := &IncidenciaDatos{IDIncidencia: inc.IDIncidencia, Tipo: inc.Tipo,
+			Prioridad: inc.Prioridad, Descripcion: inc.Descripcion, Estado: inc.Estado,
+			Cambios:      append([]CambioEstado(nil), inc.Cambios...),
+			Piezas:       append([]PiezaIncidencia(nil), inc.Piezas...),
+			Sesiones:     append([]SesionTrabajo(nil), inc.Sesiones...),
+			Presupuestos: append([]Presupuesto(nil), inc.Presupuestos...)}
+		for _, m := range inc.GetMecanicos() {
+			id.Mecanicos = append(id.Mecanicos, m.IDMecanico)
+		}
+		vd.Incidencia = id
+	}
+	return vd
+}
+
+// clienteDeDatos reconstruye un cliente serializado; los mecánicos de sus
+// incidencias se buscan en t
+func (t *Taller) clienteDeDatos(cd ClienteDatos) *Cliente {
+	c := &Cliente{IDCliente: cd.IDCliente, Nombre: cd.Nombre, Telefono: cd.Telefono, Email: cd.Email}
+	for _, vd := range cd.Vehiculos {
+		c.Vehiculos = append(c.Vehiculos, t.vehiculoDeDatos(vd))
+	}
+	return c
+}
+
+// vehiculoDeDatos reconstruye un vehículo serializado con su incidencia
+func (t *Taller) vehiculoDeDatos(vd VehiculoDatos) *Vehiculo {
+	v := &Vehiculo{Matricula: vd.Matricula, Marca: vd.Marca, Modelo: vd.Modelo,
+		FechaEntrada: vd.FechaEntrada, FechaSalida: vd.FechaSalida, saliendo: vd.Saliendo}
+	if id := vd.Incidencia; id != nil {
+		inc := &Incidencia{IDIncidencia: id.IDIncidencia, Tipo: id.Tipo,
+			Prioridad: id.Prioridad, Descripcion: id.Descripcion, Estado: id.Estado,
+			Cambios:      append([]CambioEstado(nil), id.Cambios...),
+			Piezas:       append([]PiezaIncidencia(nil), id.Piezas...),
+			Sesiones:     append([]SesionTrabajo(nil), id.Sesiones...),
+			Presupuestos: append([]Presupuesto(nil), id.Presupuestos...)}
+		for _, idm := range id.Mecanicos {
+			if m, _ := t.BuscarMecanico(idm); m != nil {
+				inc.AsignarMecanico(m)
+			}
+		}
+		v.SetIncidencia(inc)
+	}
+	return v
+}
+
+// Importar sustituye el estado del taller por el de la instantánea
+func (t *Taller) Importar(ins Instantanea) {
+	t.ClientesTaller = []*Cliente{}
+	t.MecanicosTaller = []*Mecanico{}
+	for i := range ins.Mecanicos {
+		m := ins.Mecanicos[i]
+		t.MecanicosTaller = append(t.MecanicosTaller, &m)
+	}
+	for _, cd := range ins.Clientes {
+		t.ClientesTaller = append(t.ClientesTaller, t.clienteDeDatos(cd))
+	}
+	t.MaxPlazas = len(ins.Plazas)
+	t.PlazasTaller = make([]*Plaza, len(ins.Plazas))
+	for i, pd := range ins.Plazas {
+		p := &Plaza{IDPlaza: pd.IDPlaza}
+		if pd.Ocupada {
+			// Sin pasar por Ocupar: restaurar el estado no es un evento
+			c, _ := t.BuscarCliente(pd.IDCliente)
+			m, _ := t.BuscarMecanico(pd.IDMecanico)
+			p.ocupada, p.cliente, p.mecanico = true, c, m
+		} else if pd.Reserva != "" {
+			m, _ := t.BuscarMecanico(pd.IDMecanico)
+			p.Reservar(pd.Reserva, m)
+		}
+		t.PlazasTaller[i] = p
+	}
+	t.Facturas = nil
+	for i := range ins.Facturas {
+		f := ins.Facturas[i]
+		f.Lineas = append([]LineaFactura(nil), f.Lineas...)
+		t.Facturas = append(t.Facturas, &f)
+	}
+	t.Repuestos = nil
+	for i := range ins.Repuestos {
+		r := ins.Repuestos[i]
+		r.Compatibles = append([]Compatible(nil), r.Compatibles...)
+		t.Repuestos = append(t.Repuestos, &r)
+	}
+	t.Proveedores = nil
+	for i := range ins.Proveedores {
+		pr := ins.Proveedores[i]
+		t.Proveedores = append(t.Proveedores, &pr)
+	}
+	t.Pedidos = nil
+	for i := range ins.Pedidos {
+		p := ins.Pedidos[i]
+		p.Lineas = append([]LineaPedido(nil), p.Lineas...)
+		p.Incidencias = append([]int(nil), p.Incidencias...)
+		t.Pedidos = append(t.Pedidos, &p)
+	}
+	t.Citas = nil
+	for i := range ins.Citas {
+		c := ins.Citas[i]
+		t.Citas = append(t.Citas, &c)
+	}
+	t.Pagos = nil
+	for i := range ins.Pagos {
+		p := ins.Pagos[i]
+		t.Pagos = append(t.Pagos, &p)
+	}
+	t.Sesiones = append([]SesionTrabajo(nil), ins.Sesiones...)
+	if ins.Sesiones == nil {
+		t.incidencias(func(_ *Vehiculo, inc *Incidencia) {
+			for _, s := range inc.Sesiones {
+				s.IDIncidencia = inc.IDIncidencia
+				t.Sesiones = append(t.Sesiones, s)
+			}
+		})
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// piezaPrueba es una línea de factura cualquiera para los casos que solo
+// necesitan que la factura exista
+var piezaPrueba = []LineaFactura{{Tipo: LineaPieza, Concepto: "Fusible", Cantidad: 1, Precio: 300}}
+
+// pasoInstantanea es una operación de despues y si debe fallar
+type pasoInstantanea struct {
+	falla bool
+	op    Operacion
+}
+
+// casosInstantanea dejan un taller con el estado de cada parte (preparar) y
+// siguen con operaciones que dependen de ese estado (despues): números que
+// continúan, duplicados que se rechazan. comprobar, si lo hay, mira al final
+// que los números siguen donde se quedaron.
+var casosInstantanea = []struct {
+	nombre    string
+	preparar  []Operacion
+	despues   []pasoInstantanea
+	comprobar func(t *Taller) string
+}{
+	{
+		nombre: "facturas",
+		preparar: []Operacion{
+			{Tipo: OpCrearMecanico, IDMecanico: 1, Nombre: "Laura", Especialidad: "mecánica"},
+			{Tipo: OpCrearCliente, IDCliente: 1, Nombre: "Ana"},
+			{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "1234ABC"},
+			{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "5678DEF"},
+			{Tipo: OpCrearIncidencia, Matricula: "1234ABC", IDIncidencia: 7},
+			{Tipo: OpCrearIncidencia, Matricula: "5678DEF", IDIncidencia: 8},
+			{Tipo: OpAsignarPlaza, Matricula: "1234ABC", IDMecanico: 1, IDPlaza: 1},
+			{Tipo: OpPresupuestar, Matricula: "1234ABC", Presupuesto: presupuestoDePrueba()},
+			{Tipo: OpResponderPresupuesto, Matricula: "1234ABC", Estado: PresupuestoAceptado},
+			{Tipo: OpEstadoIncidencia, Matricula: "1234ABC", Estado: "en proceso"},
+			{Tipo: OpEstadoIncidencia, Matricula: "1234ABC", Estado: "cerrada"},
+			{Tipo: OpPresupuestar, Matricula: "5678DEF", Presupuesto: presupuestoDePrueba()},
+			{Tipo: OpResponderPresupuesto, Matricula: "5678DEF", Estado: PresupuestoAceptado},
+			{Tipo: OpEstadoIncidencia, Matricula: "5678DEF", Estado: "en proceso"},
+			{Tipo: OpEstadoIncidencia, Matricula: "5678DEF", Estado: "cerrada"},
+			{Tipo: OpEmitirFactura, Matricula: "1234ABC", Fecha: "2026-12-31T18:00:00.000Z",
+				Factura: &Factura{Lineas: piezaPrueba, Descuento: 5}},
+		},
+		despues: []pasoInstantanea{
+			// Ya facturada: la copia también debe rechazarla
+			{true, Operacion{Tipo: OpEmitirFactura, Matricula: "1234ABC", Fecha: "2027-01-02T09:00:00.000Z", Factura: &Factura{Lineas: piezaPrueba}}},
+			{false, Operacion{Tipo: OpEmitirFactura, Matricula: "5678DEF", Fecha: "2026-12-31T19:00:00.000Z", Factura: &Factura{Lineas: piezaPrueba}}},
+		},
+		comprobar: func(t *Taller) string {
+			if len(t.Facturas) != 2 || t.Facturas[1].Numero != "2026-0002" {
+				return "la segunda factura no es la 2026-0002"
+			}
+			return ""
+		},
+	},
+	{
+		nombre: "repuestos",
+		preparar: []Operacion{
+			{Tipo: OpCrearRepuesto, Repuesto: &Repuesto{Referencia: "FR-01", Descripcion: "Pastillas de freno",
+				Compatibles: LeerCompatibles("Seat/Ibiza"), Coste: 2000, Precio: 3995, Stock: 3, Minimo: 2}},
+			{Tipo: OpCrearCliente, IDCliente: 1, Nombre: "Ana"},
+			{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "1111AAA", Marca: "Seat", Modelo: "Ibiza"},
+			{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "2222BBB", Marca: "Seat", Modelo: "Ibiza"},
+			{Tipo: OpCrearIncidencia, Matricula: "1111AAA", IDIncidencia: 1},
+			{Tipo: OpCrearIncidencia, Matricula: "2222BBB", IDIncidencia: 2},
+			{Tipo: OpPresupuestar, Matricula: "2222BBB", Presupuesto: presupuestoDePrueba()},
+			{Tipo: OpResponderPresupuesto, Matricula: "2222BBB", Estado: PresupuestoAceptado},
+			{Tipo: OpReservarRepuesto, Matricula: "1111AAA", Referencia: "FR-01", Cantidad: 2},
+			{Tipo: OpReservarRepuesto, Matricula: "2222BBB", Referencia: "FR-01", Cantidad: 2},
+		},
+		despues: []pasoInstantanea{
+			{true, Operacion{Tipo: OpCrearRepuesto, Repuesto: &Repuesto{Referencia: "FR-01", Descripcion: "Otra"}}},
+			{true, Operacion{Tipo: OpEliminarRepuesto, Referencia: "FR-01"}},
+			// A la incidencia 2 le falta una pieza hasta que llega otra
+			{true, Operacion{Tipo: OpEstadoIncidencia, Matricula: "2222BBB", Estado: "en proceso"}},
+			{false, Operacion{Tipo: OpEntradaRepuesto, Referencia: "FR-01", Cantidad: 1}},
+			{false, Operacion{Tipo: OpEstadoIncidencia, Matricula: "2222BBB", Estado: "en proceso"}},
+		},
+	},
+	{
+		nombre: "pedidos",
+		preparar: []Operacion{
+			{Tipo: OpCrearProveedor, Proveedor: &Proveedor{IDProveedor: 1, Nombre: "Recambios Sur", Email: "pedidos@sur.es"}},
+			{Tipo: OpCrearRepuesto, Repuesto: &Repuesto{Referencia: "FR-01", Descripcion: "Pastillas de freno",
+				Coste: 2000, Precio: 3995, Stock: 2, Minimo: 2, Lote: 6, IDProveedor: 1}},
+			{Tipo: OpCrearCliente, IDCliente: 1, Nombre: "Ana"},
+			{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "1111AAA"},
+			{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "2222BBB"},
+			{Tipo: OpCrearIncidencia, Matricula: "1111AAA", IDIncidencia: 1},
+			{Tipo: OpCrearIncidencia, Matricula: "2222BBB", IDIncidencia: 2},
+			{Tipo: OpReservarRepuesto, Matricula: "1111AAA", Referencia: "FR-01", Cantidad: 5, Fecha: "2026-05-04T09:00:00.000Z"},
+			{Tipo: OpEnviarPedido, IDPedido: 1, Fecha: "2026-05-04T09:00:00.000Z"},
+		},
+		despues: []pasoInstantanea{
+			{true, Operacion{Tipo: OpCrearProveedor, Proveedor: &Proveedor{IDProveedor: 1, Nombre: "Otro"}}},
+			{true, Operacion{Tipo: OpEliminarProveedor, IDProveedor: 1}},
+			// Una nueva falta abre el pedido 2, no otro 1
+			{false, Operacion{Tipo: OpReservarRepuesto, Matricula: "2222BBB", Referencia: "FR-01", Cantidad: 8, Fecha: "2026-05-05T09:00:00.000Z"}},
+			{false, Operacion{Tipo: OpRecibirPedido, IDPedido: 1, Fecha: "2026-05-06T12:00:00.000Z"}},
+			{true, Operacion{Tipo: OpRecibirPedido, IDPedido: 1, Fecha: "2026-05-06T12:00:00.000Z"}},
+		},
+		comprobar: func(t *Taller) string {
+			if len(t.Pedidos) != 2 || t.Pedidos[1].IDPedido != 2 {
+				return "la nueva falta no abre el pedido 2"
+			}
+			return ""
+		},
+	},
+	{
+		nombre: "fichajes",
+		preparar: []Operacion{
+			{Tipo: OpCrearMecanico, IDMecanico: 1, Nombre: "Laura", Especialidad: "mecánica"},
+			{Tipo: OpCrearCliente, IDCliente: 1, Nombre: "Ana"},
+			{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "1111AAA"},
+			{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "2222BBB"},
+			{Tipo: OpCrearIncidencia, Matricula: "1111AAA", IDIncidencia: 1},
+			{Tipo: OpCrearIncidencia, Matricula: "2222BBB", IDIncidencia: 2},
+			{Tipo: OpAsignarPlaza, Matricula: "1111AAA", IDMecanico: 1, IDPlaza: 1},
+			{Tipo: OpAsignarPlaza, Matricula: "2222BBB", IDMecanico: 1, IDPlaza: 2},
+			{Tipo: OpIniciarTrabajo, Matricula: "1111AAA", IDMecanico: 1, Fecha: "2026-06-01T07:00:00.000Z"},
+			{Tipo: OpTerminarTrabajo, IDMecanico: 1, Fecha: "2026-06-01T09:00:00.000Z"},
+			// Las horas de un vehículo que ya se fue siguen en el registro
+			{Tipo: OpEliminarVehiculo, Matricula: "1111AAA", Fecha: "2026-06-01T10:00:00.000Z"},
+			{Tipo: OpIniciarTrabajo, Matricula: "2222BBB", IDMecanico: 1, Fecha: "2026-06-01T10:00:00.000Z"},
+		},
+		despues: []pasoInstantanea{
+			// La sesión sigue abierta en la copia
+			{true, Operacion{Tipo: OpIniciarTrabajo, Matricula: "2222BBB", IDMecanico: 1, Fecha: "2026-06-01T10:30:00.000Z"}},
+			{false, Operacion{Tipo: OpTerminarTrabajo, IDMecanico: 1, Fecha: "2026-06-01T11:00:00.000Z"}},
+			{true, Operacion{Tipo: OpTerminarTrabajo, IDMecanico: 1, Fecha: "2026-06-01T11:30:00.000Z"}},
+		},
+	},
+	{
+		nombre: "citas",
+		preparar: []Operacion{
+			{Tipo: OpCrearMecanico, IDMecanico: 1, Nombre: "Laura", Especialidad: "mecánica"},
+			{Tipo: OpCrearCliente, IDCliente: 1, Nombre: "Ana"},
+			{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "1111AAA"},
+			{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "2222BBB"},
+			{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "3333CCC"},
+			{Tipo: OpPedirCita, Cita: &Cita{IDCita: 1, Matricula: "1111AAA", Dia: "2026-07-01", Hora: "09:00", Especialidad: "mecánica"}},
+			{Tipo: OpPedirCita, Cita: &Cita{IDCita: 2, Matricula: "2222BBB", Dia: "2026-07-01", Hora: "09:00", Especialidad: "mecánica"}},
+			{Tipo: OpCancelarCita, IDCita: 2},
+			{Tipo: OpLlegadaCita, IDCita: 1, IDIncidencia: 10, Fecha: "2026-07-01T07:05:00.000Z"},
+		},
+		despues: []pasoInstantanea{
+			{true, Operacion{Tipo: OpPedirCita, Cita: &Cita{IDCita: 1, Matricula: "3333CCC", Dia: "2026-07-02", Hora: "09:00", Especialidad: "mecánica"}}},
+			{true, Operacion{Tipo: OpLlegadaCita, IDCita: 1, Fecha: "2026-07-01T07:10:00.000Z"}},
+			// Queda un hueco: la plaza de Laura que no ocupa la cita atendida
+			{false, Operacion{Tipo: OpPedirCita, Cita: &Cita{IDCita: 3, Matricula: "2222BBB", Dia: "2026-07-01", Hora: "09:00", Especialidad: "mecánica"}}},
+			{true, Operacion{Tipo: OpPedirCita, Cita: &Cita{IDCita: 4, Matricula: "3333CCC", Dia: "2026-07-01", Hora: "09:00", Especialidad: "mecánica"}}},
+		},
+	},
+	{
+		nombre: "turnos",
+		preparar: []Operacion{
+			{Tipo: OpCrearMecanico, IDMecanico: 1, Nombre: "Laura", Especialidad: "mecánica"},
+			{Tipo: OpHorarioMecanico, IDMecanico: 1, Turnos: []Turno{{Dia: time.Monday, Inicio: "08:00", Fin: "15:00"},
+				{Dia: time.Tuesday, Inicio: "08:00", Fin: "15:00"}}},
+			{Tipo: OpAusenciaMecanico, IDMecanico: 1, Ausencia: &Ausencia{Tipo: AusenciaVacaciones, Desde: "2026-08-03", Hasta: "2026-08-09"}},
+			{Tipo: OpCrearCliente, IDCliente: 1, Nombre: "Ana"},
+			{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "1111AAA"},
+			{Tipo: OpCrearIncidencia, Matricula: "1111AAA", IDIncidencia: 1},
+		},
+		despues: []pasoInstantanea{
+			// De vacaciones el martes 4, sin turno los miércoles y de turno el
+			// martes 11 a las 10:00
+			{true, Operacion{Tipo: OpAsignarPlaza, Matricula: "1111AAA", IDMecanico: 1, IDPlaza: 1, Fecha: "2026-08-04T08:00:00.000Z"}},
+			{true, Operacion{Tipo: OpPedirCita, Cita: &Cita{IDCita: 1, Matricula: "1111AAA", Dia: "2026-08-12", Hora: "10:00", Especialidad: "mecánica"}}},
+			{false, Operacion{Tipo: OpAsignarPlaza, Matricula: "1111AAA", IDMecanico: 1, IDPlaza: 1, Fecha: "2026-08-11T08:00:00.000Z"}},
+		},
+	},
+	{
+		nombre: "presupuestos",
+		preparar: []Operacion{
+			{Tipo: OpCrearMecanico, IDMecanico: 1, Nombre: "Laura", Especialidad: "mecánica"},
+			{Tipo: OpCrearCliente, IDCliente: 1, Nombre: "Ana"},
+			{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "1111AAA"},
+			{Tipo: OpCrearIncidencia, Matricula: "1111AAA", IDIncidencia: 1},
+			{Tipo: OpPresupuestar, Matricula: "1111AAA", Presupuesto: presupuestoDePrueba(), Fecha: "2026-03-02T09:00:00.000Z"},
+			{Tipo: OpEnviarPresupuesto, Matricula: "1111AAA"},
+			{Tipo: OpResponderPresupuesto, Matricula: "1111AAA", Estado: PresupuestoRechazado, Descripcion: "muy caro"},
+			{Tipo: OpPresupuestar, Matricula: "1111AAA", Presupuesto: &Presupuesto{Lineas: piezaPrueba, Motivo: "otra pieza"},
+				Fecha: "2026-03-02T10:00:00.000Z"},
+			{Tipo: OpEnviarPresupuesto, Matricula: "1111AAA"},
+		},
+		despues: []pasoInstantanea{
+			// La versión 2 está enviada sin respuesta: no se empieza
+			{true, Operacion{Tipo: OpEstadoIncidencia, Matricula: "1111AAA", Estado: "en proceso"}},
+			{false, Operacion{Tipo: OpResponderPresupuesto, Matricula: "1111AAA", Estado: PresupuestoAceptado}},
+			{true, Operacion{Tipo: OpResponderPresupuesto, Matricula: "1111AAA", Estado: PresupuestoRechazado}},
+			{false, Operacion{Tipo: OpEstadoIncidencia, Matricula: "1111AAA", Estado: "en proceso"}},
+			// Una revisión después de aceptar es la versión 3
+			{false, Operacion{Tipo: OpPresupuestar, Matricula: "1111AAA", Presupuesto: presupuestoDePrueba(), Fecha: "2026-03-03T09:00:00.000Z"}},
+		},
+		comprobar: func(t *Taller) string {
+			_, v := t.BuscarVehiculo("1111AAA")
+			if p := v.GetIncidencia().Presupuestos; p[len(p)-1].Version != 3 {
+				return "la revisión tras aceptar no es la versión 3"
+			}
+			return ""
+		},
+	},
+	{
+		nombre: "pagos",
+		preparar: []Operacion{
+			{Tipo: OpCrearCliente, IDCliente: 1, Nombre: "Ana"},
+			{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "1111AAA"},
+			{Tipo: OpCrearIncidencia, Matricula: "1111AAA", IDIncidencia: 1},
+			{Tipo: OpPresupuestar, Matricula: "1111AAA", Presupuesto: presupuestoDePrueba()},
+			{Tipo: OpResponderPresupuesto, Matricula: "1111AAA", Estado: PresupuestoAceptado},
+			{Tipo: OpEstadoIncidencia, Matricula: "1111AAA", Estado: "en proceso"},
+			{Tipo: OpEstadoIncidencia, Matricula: "1111AAA", Estado: "cerrada"},
+			// 3 € más IVA: 3,63 €
+			{Tipo: OpEmitirFactura, Matricula: "1111AAA", Fecha: "2026-04-01T10:00:00.000Z", Factura: &Factura{Lineas: piezaPrueba}},
+			{Tipo: OpRegistrarPago, Fecha: "2026-04-01T10:05:00.000Z", Pago: &Pago{IDPago: 1, Factura: "2026-0001", Metodo: PagoTarjeta, Importe: 300}},
+		},
+		despues: []pasoInstantanea{
+			{true, Operacion{Tipo: OpRegistrarPago, Fecha: "2026-04-02T09:00:00.000Z", Pago: &Pago{IDPago: 1, Factura: "2026-0001", Metodo: PagoEfectivo, Importe: 10}}},
+			{true, Operacion{Tipo: OpRegistrarPago, Fecha: "2026-04-02T09:00:00.000Z", Pago: &Pago{IDPago: 2, Factura: "2026-0001", Metodo: PagoEfectivo, Importe: 100}}},
+			{false, Operacion{Tipo: OpRegistrarPago, Fecha: "2026-04-02T09:00:00.000Z", Pago: &Pago{IDPago: 2, Factura: "2026-0001", Metodo: PagoEfectivo, Importe: 63}}},
+			{true, Operacion{Tipo: OpRegistrarPago, Fecha: "2026-04-03T09:00:00.000Z", Pago: &Pago{IDPago: 3, Factura: "2026-0001", Metodo: PagoEfectivo, Importe: -400}}},
+		},
+	},
+}
+
+// TestInstantaneaIdaVuelta exporta el taller de cada caso, pasa la
+// instantánea por JSON y la importa en otro. La copia debe exportar lo
+// mismo, y al aplicar a los dos las operaciones de despues las dos deben
+// aceptar o rechazar cada una según lo esperado y acabar iguales.
+func TestInstantaneaIdaVuelta(t *testing.T) {
+	for _, c := range casosInstantanea {
+		t.Run(c.nombre, func(t *testing.T) {
+			var original, copia Taller
+			for _, op := range c.preparar {
+				if err := original.Aplicar(op); err != nil {
+					t.Fatalf("%s: %v", op.Tipo, err)
+				}
+			}
+			datos, err := json.Marshal(original.Exportar())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ins Instantanea
+			if err := json.Unmarshal(datos, &ins); err != nil {
+				t.Fatal(err)
+			}
+			copia.Importar(ins)
+			if a, b := estadoJSON(t, &original), estadoJSON(t, &copia); a != b {
+				t.Fatalf("la copia no exporta lo mismo:\n%s\n%s", a, b)
+			}
+			for i, paso := range c.despues {
+				for _, tl := range []*Taller{&original, &copia} {
+					err := tl.Aplicar(paso.op)
+					if paso.falla && err == nil {
+						t.Fatalf("%d %s: debería fallar y se acepta", i, paso.op.Tipo)
+					}
+					if !paso.falla && err != nil {
+						t.Fatalf("%d %s: %v", i, paso.op.Tipo, err)
+					}
+				}
+			}
+			if a, b := estadoJSON(t, &original), estadoJSON(t, &copia); a != b {
+				t.Fatalf("tras las mismas operaciones acaban distintos:\n%s\n%s", a, b)
+			}
+			if c.comprobar != nil {
+				if fallo := c.comprobar(&copia); fallo != "" {
+					t.Error(fallo)
+				}
+			}
+		})
+	}
+}
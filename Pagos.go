@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Formas de pago
+const (
+	PagoEfectivo      = "efectivo"
+	PagoTarjeta       = "tarjeta"
+	PagoTransferencia = "transferencia"
+)
+
+// Pago es un cobro de una factura o, con importe negativo, una devolución
+// de lo cobrado. Los importes van en céntimos.
+type Pago struct {
+	IDPago    int    `json:"idPago"`
+	Factura   string `json:"factura"` // número de la factura
+	IDCliente int    `json:"idCliente"`
+	Fecha     string `json:"fecha"`
+	Metodo    string `json:"metodo"`
+	Importe   int64  `json:"importe"`
+	Nota      string `json:"nota,omitempty"`
+}
+
+// Devolucion indica si el pago devuelve dinero al cliente
+func (p *Pago) Devolucion() bool { return p.Importe < 0 }
+
+// PagosDeFactura devuelve los pagos de una factura en el orden en que se
+// registraron
+func (t *Taller) PagosDeFactura(numero string) []*Pago {
+	var out []*Pago
+	for _, p := range t.Pagos {
+		if p.Factura == numero {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// Cobrado devuelve lo cobrado de una factura descontando las devoluciones
+func (t *Taller) Cobrado(numero string) int64 {
+	var total int64
+	for _, p := range t.PagosDeFactura(numero) {
+		total += p.Importe
+	}
+	return total
+}
+
+// Pendiente devuelve lo que falta por cobrar de una factura
+func (t *Taller) Pendiente(f *Factura) int64 {
+	return f.Total - t.Cobrado(f.Numero)
+}
+
+// SaldoCliente devuelve lo que debe un cliente: lo facturado menos lo
+// cobrado (negativo si el taller le debe dinero)
+func (t *Taller) SaldoCliente(id int) int64 {
+	var saldo int64
+	for _, f := range t.FacturasDeCliente(id) {
+		saldo += t.Pendiente(f)
+	}
+	return saldo
+}
+
+// FacturaPendienteDe devuelve la factura sin cobrar del todo de la
+// incidencia actual del vehículo (nil si no tiene o está pagada)
+func (t *Taller) FacturaPendienteDe(matricula string) *Factura {
+	_, v := t.BuscarVehiculo(matricula)
+	if v == nil || v.GetIncidencia() == nil {
+		return nil
+	}
+	if f := t.FacturaDeIncidencia(v.GetIncidencia().IDIncidencia); f != nil && t.Pendiente(f) > 0 {
+		return f
+	}
+	return nil
+}
+
+// registrarPago aplica OpRegistrarPago: un cobro no puede pasar de lo que
+// falta por pagar ni una devolución de lo cobrado
+func (t *Taller) registrarPago(op Operacion) error {
+	if op.Pago == nil {
+		return errors.New("falta el pago")
+	}
+	p := *op.Pago
+	for _, otro := range t.Pagos {
+		if otro.IDPago == p.IDPago {
+			return errors.New("ya existe un pago con ese ID")
+		}
+	}
+	f := t.BuscarFactura(p.Factura)
+	if f == nil {
+		return errors.New("factura no encontrada")
+	}
+	if p.Metodo != PagoEfectivo && p.Metodo != PagoTarjeta && p.Metodo != PagoTransferencia {
+		return fmt.Errorf("forma de pago no válida: %q", p.Metodo)
+	}
+	switch pendiente, cobrado := t.Pendiente(f), t.Cobrado(f.Numero); {
+	case p.Importe == 0:
+		return errors.New("el importe no puede ser cero")
+	case p.Importe > pendiente:
+		return fmt.Errorf("solo quedan %s por cobrar", Euros(pendiente))
+	case -p.Importe > cobrado:
+		return fmt.Errorf("solo se han cobrado %s", Euros(cobrado))
+	}
+	p.IDCliente, p.Fecha = f.IDCliente, op.Fecha
+	t.Pagos = append(t.Pagos, &p)
+	return nil
+}
+
+// MovimientoCuenta es una línea del extracto de un cliente: una factura
+// (cargo), un cobro (abono) o una devolución (cargo)
+type MovimientoCuenta struct {
+	Fecha    string
+	Concepto string
+	Cargo    int64
+	Abono    int64
+	Saldo    int64 // lo que debe el cliente tras el movimiento
+}
+
+// ExtractoCliente devuelve los movimientos de la cuenta de un cliente por
+// fecha, con el saldo tras cada uno
+func (t *Taller) ExtractoCliente(id int) []MovimientoCuenta {
+	var movs []MovimientoCuenta
+	for _, f := range t.FacturasDeCliente(id) {
+		movs = append(movs, MovimientoCuenta{Fecha: f.Fecha, Cargo: f.Total,
+			Concepto: fmt.Sprintf("Factura %s (%s)", f.Numero, f.Matricula)})
+	}
+	for _, p := range t.Pagos {
+		if p.IDCliente != id {
+			continue
+		}
+		m := MovimientoCuenta{Fecha: p.Fecha, Concepto: fmt.Sprintf("Pago %s (%s)", p.Factura, p.Metodo),
+			Abono: p.Importe}
+		if p.Devolucion() {
+			m.Concepto = fmt.Sprintf("Devolución %s (%s)", p.Factura, p.Metodo)
+			m.Abono, m.Cargo = 0, -p.Importe
+		}
+		movs = append(movs, m)
+	}
+	sort.SliceStable(movs, func(i, j int) bool { return movs[i].Fecha < movs[j].Fecha })
+	var saldo int64
+	for i := range movs {
+		saldo += movs[i].Cargo - movs[i].Abono
+		movs[i].Saldo = saldo
+	}
+	return movs
+}
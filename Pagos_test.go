@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+)
+
+// TestPagos factura dos reparaciones a un cliente y comprueba los pagos
+// parciales, que no se cobra de más ni se devuelve más de lo cobrado, el
+// extracto con su saldo y lo que queda pendiente de la factura de un
+// vehículo
+func TestPagos(t *testing.T) {
+	var tl Taller
+	ops := []Operacion{
+		{Tipo: OpCrearCliente, IDCliente: 1, Nombre: "Ana"},
+		{Tipo: OpCrearCliente, IDCliente: 2, Nombre: "Luis"},
+		{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "1111AAA"},
+		{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "2222BBB"},
+		{Tipo: OpCrearIncidencia, Matricula: "1111AAA", IDIncidencia: 1, TipoIncidencia: "mecánica"},
+		{Tipo: OpCrearIncidencia, Matricula: "2222BBB", IDIncidencia: 2, TipoIncidencia: "mecánica"},
+	}
+	ops = append(ops, repararPrueba("1111AAA")...)
+	ops = append(ops, repararPrueba("2222BBB")...)
+	ops = append(ops,
+		// 100 € y 50 € más IVA
+		Operacion{Tipo: OpEmitirFactura, Matricula: "1111AAA", Fecha: "2026-04-01T10:00:00.000Z", Factura: &Factura{
+			Lineas: []LineaFactura{{Tipo: LineaPieza, Concepto: "Batería", Cantidad: 1, Precio: 10000}}}},
+		Operacion{Tipo: OpEmitirFactura, Matricula: "2222BBB", Fecha: "2026-04-03T10:00:00.000Z", Factura: &Factura{
+			Lineas: []LineaFactura{{Tipo: LineaPieza, Concepto: "Escobillas", Cantidad: 2, Precio: 2500}}}})
+	for _, op := range ops {
+		if err := tl.Aplicar(op); err != nil {
+			t.Fatalf("%s: %v", op.Tipo, err)
+		}
+	}
+	pagar := func(id int, factura, metodo string, importe int64, fecha string) error {
+		return tl.Aplicar(Operacion{Tipo: OpRegistrarPago, Fecha: fecha,
+			Pago: &Pago{IDPago: id, Factura: factura, Metodo: metodo, Importe: importe}})
+	}
+	if tl.SaldoCliente(1) != 18150 || tl.FacturaPendienteDe("1111AAA") == nil {
+		t.Fatalf("saldo inicial inesperado: %s", Euros(tl.SaldoCliente(1)))
+	}
+	// La primera se paga en dos veces; la segunda se paga y se devuelve una parte
+	if err := pagar(1, "2026-0001", PagoTarjeta, 5000, "2026-04-01T10:05:00.000Z"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pagar(2, "2026-0001", PagoEfectivo, 8000, "2026-04-02T09:00:00.000Z"); err == nil {
+		t.Fatal("se han cobrado más de los 121 € de la factura")
+	}
+	if err := pagar(2, "2026-0001", "bizum", 1000, ""); err == nil {
+		t.Fatal("se ha aceptado una forma de pago desconocida")
+	}
+	if err := pagar(2, "2026-0001", PagoEfectivo, 7100, "2026-04-02T09:00:00.000Z"); err != nil {
+		t.Fatal(err)
+	}
+	if tl.FacturaPendienteDe("1111AAA") != nil {
+		t.Fatal("la factura 2026-0001 está pagada y sigue pendiente")
+	}
+	if err := pagar(3, "2026-0002", PagoTransferencia, 6050, "2026-04-04T08:00:00.000Z"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pagar(4, "2026-0002", PagoTransferencia, -7000, "2026-04-05T08:00:00.000Z"); err == nil {
+		t.Fatal("se ha devuelto más de lo cobrado")
+	}
+	if err := pagar(4, "2026-0002", PagoTransferencia, -1050, "2026-04-05T08:00:00.000Z"); err != nil {
+		t.Fatal(err)
+	}
+	if tl.SaldoCliente(1) != 1050 || tl.SaldoCliente(2) != 0 || tl.FacturaPendienteDe("2222BBB") == nil {
+		t.Fatalf("saldo final inesperado: %s", Euros(tl.SaldoCliente(1)))
+	}
+	extracto := tl.ExtractoCliente(1)
+	if len(extracto) != 6 || extracto[3].Concepto != "Factura 2026-0002 (2222BBB)" || extracto[5].Cargo != 1050 ||
+		extracto[5].Saldo != 1050 {
+		t.Fatalf("extracto inesperado: %+v", extracto)
+	}
+	if p := tl.Pendiente(tl.FacturaPendienteDe("2222BBB")); p != 1050 {
+		t.Fatalf("faltan %s de la factura 2026-0002", Euros(p))
+	}
+}
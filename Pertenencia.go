@@ -0,0 +1,544 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Estados de un miembro del clúster
+const (
+	MiembroVivo       = "vivo"
+	MiembroSospechoso = "sospechoso" // no responde; si no lo desmiente a tiempo se da por caído
+	MiembroCaido      = "caído"
+)
+
+// Tipos de mensaje del protocolo de pertenencia
+const (
+	gsPing       = "ping"
+	gsAck        = "ack"
+	gsPingOtro   = "ping-req" // sondea a Objetivo en mi nombre
+	maxNovedades = 8          // novedades que viajan en cada mensaje
+)
+
+// Miembro es un nodo del clúster tal como lo conocen los demás. Encarnacion
+// solo la aumenta el propio nodo (al desmentir una sospecha o cambiar sus
+// metadatos) y decide qué noticia sobre él es más reciente.
+type Miembro struct {
+	Nombre      string     `json:"nombre"`
+	Direccion   string     `json:"direccion"`
+	Estado      string     `json:"estado"`
+	Encarnacion uint64     `json:"encarnacion"`
+	Metadatos   EstadoSede `json:"metadatos"`
+}
+
+// MensajeGossip es un datagrama UDP del protocolo; todos llevan novedades
+// sobre miembros que se difunden así, de boca en boca
+type MensajeGossip struct {
+	Tipo      string    `json:"tipo"`
+	Seq       uint64    `json:"seq"`
+	Origen    string    `json:"origen"`             // dirección de quien envía
+	Objetivo  string    `json:"objetivo,omitempty"` // a quién sondear (ping-req)
+	Completa  bool      `json:"completa,omitempty"` // pide la lista completa en el ack
+	Novedades []Miembro `json:"novedades,omitempty"`
+	Sello
+}
+
+// NodoPertenencia mantiene la lista de miembros del clúster con un
+// protocolo al estilo SWIM. Cada Periodo sondea a un miembro con un ping; si
+// no responde en Espera, pide a Indirectos miembros que lo sondeen ellos, y
+// si tampoco, lo declara sospechoso. Un sospechoso que no lo desmiente en
+// Sospecha se da por caído. Los cambios viajan en los propios mensajes y se
+// reenvían unas Retransmisiones·log2(n) veces.
+type NodoPertenencia struct {
+	Periodo         time.Duration
+	Espera          time.Duration
+	Indirectos      int
+	Sospecha        time.Duration
+	Retransmisiones int
+	// SincronizarCada es cada cuántos periodos se pide la lista completa a
+	// las semillas, para recuperar a los miembros de los que no llegó noticia
+	SincronizarCada int
+	// Perdida es la proporción de datagramas recibidos que se descartan, para
+	// probar el protocolo con una red poco fiable
+	Perdida float64
+	// Metadatos devuelve (si no es nil) lo que este nodo anuncia de sí mismo;
+	// se consulta en cada periodo y los cambios se difunden
+	Metadatos func() EstadoSede
+	// AlCambiar se llama (si no es nil) cuando un miembro cambia de estado
+	AlCambiar func(m Miembro)
+	// Relojes lógicos con los que se marcan los mensajes (nil = sin marcas)
+	Relojes *Relojes
+
+	semillas []string
+	conn     *net.UDPConn
+	parar    chan struct{}
+
+	mu        sync.Mutex
+	propio    Miembro
+	miembros  map[string]*miembroLocal // por nombre, sin el propio
+	novedades map[string]*novedad      // por nombre
+	esperas   map[uint64]chan struct{} // pings propios sin respuesta
+	encargos  map[uint64]encargo       // pings hechos en nombre de otro
+	seq       uint64
+	vueltas   int      // periodos de sondeo transcurridos
+	ronda     []string // orden en que se sondea a los miembros
+	azar      *rand.Rand
+}
+
+type miembroLocal struct {
+	Miembro
+	desde time.Time // cuándo pasó a su estado actual
+}
+
+type novedad struct {
+	m      Miembro
+	envios int
+}
+
+type encargo struct {
+	origen string
+	seq    uint64
+	hasta  time.Time
+}
+
+// NuevoNodoPertenencia crea el miembro nombre, que atiende en la dirección
+// UDP indicada y entra en el clúster a través de semillas
+func NuevoNodoPertenencia(nombre, direccion string, semillas []string) (*NodoPertenencia, error) {
+	dir, err := net.ResolveUDPAddr("udp", direccion)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", dir)
+	if err != nil {
+		return nil, err
+	}
+	var otras []string
+	for _, s := range semillas {
+		if s != "" && s != direccion {
+			otras = append(otras, s)
+		}
+	}
+	n := &NodoPertenencia{
+		Periodo:         500 * time.Millisecond,
+		Espera:          150 * time.Millisecond,
+		Indirectos:      3,
+		Sospecha:        3 * time.Second,
+		Retransmisiones: 3,
+		SincronizarCada: 10,
+		semillas:        otras,
+		conn:            conn,
+		parar:           make(chan struct{}),
+		// Un nodo que vuelve tras caer debe tener una encarnación mayor que
+		// la que los demás recuerdan de él
+		propio:    Miembro{Nombre: nombre, Direccion: direccion, Estado: MiembroVivo, Encarnacion: uint64(time.Now().UnixMilli())},
+		miembros:  map[string]*miembroLocal{},
+		novedades: map[string]*novedad{},
+		esperas:   map[uint64]chan struct{}{},
+		encargos:  map[uint64]encargo{},
+		azar:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	return n, nil
+}
+
+// Iniciar se anuncia a las semillas y empieza a sondear y a atender mensajes
+func (n *NodoPertenencia) Iniciar() {
+	n.mu.Lock()
+	if n.Metadatos != nil {
+		n.propio.Metadatos = n.Metadatos()
+	}
+	n.difundir(n.propio)
+	n.mu.Unlock()
+	go n.recibir()
+	go n.sondear()
+}
+
+// Detener deja de sondear y de responder, como si el nodo se cayera
+func (n *NodoPertenencia) Detener() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	select {
+	case <-n.parar:
+		return
+	default:
+	}
+	close(n.parar)
+	n.conn.Close()
+}
+
+// Miembros devuelve los miembros conocidos, este incluido, por nombre
+func (n *NodoPertenencia) Miembros() []Miembro {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	lista := []Miembro{n.propio}
+	for _, m := range n.miembros {
+		lista = append(lista, m.Miembro)
+	}
+	sort.Slice(lista, func(i, j int) bool { return lista[i].Nombre < lista[j].Nombre })
+	return lista
+}
+
+// Vivos devuelve los miembros que no se han dado por caídos
+func (n *NodoPertenencia) Vivos() []Miembro {
+	var vivos []Miembro
+	for _, m := range n.Miembros() {
+		if m.Estado != MiembroCaido {
+			vivos = append(vivos, m)
+		}
+	}
+	return vivos
+}
+
+// Estado resume el clúster para mostrarlo por consola
+func (n *NodoPertenencia) Estado() string {
+	miembros := n.Miembros()
+	vivos := 0
+	for _, m := range miembros {
+		if m.Estado != MiembroCaido {
+			vivos++
+		}
+	}
+	return fmt.Sprintf("Clúster | %d miembros conocidos, %d vivos", len(miembros), vivos)
+}
+
+// SONDEO
+
+func (n *NodoPertenencia) sondear() {
+	tick := time.NewTicker(n.Periodo)
+	defer tick.Stop()
+	for {
+		select {
+		case <-n.parar:
+			return
+		case <-tick.C:
+		}
+		n.revisar()
+		n.vueltas++
+		objetivo, ok := n.siguienteObjetivo()
+		if !ok || n.SincronizarCada > 0 && n.vueltas%n.SincronizarCada == 0 {
+			// Aún no conoce a nadie, o toca sincronizar: pide la lista
+			// completa a las semillas
+			n.llamarSemillas()
+		}
+		if !ok {
+			continue
+		}
+		if n.sondearMiembro(objetivo) {
+			continue
+		}
+		n.mu.Lock()
+		if m := n.miembros[objetivo.Nombre]; m != nil && m.Estado == MiembroVivo && m.Encarnacion == objetivo.Encarnacion {
+			sospecha := m.Miembro
+			sospecha.Estado = MiembroSospechoso
+			n.incorporar(sospecha)
+		}
+		n.mu.Unlock()
+	}
+}
+
+// revisar anuncia los cambios de los metadatos propios, da por caídos a los
+// sospechosos que no se han desmentido y olvida los encargos vencidos
+func (n *NodoPertenencia) revisar() {
+	var metadatos EstadoSede
+	if n.Metadatos != nil {
+		metadatos = n.Metadatos()
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.Metadatos != nil && !mismosMetadatos(metadatos, n.propio.Metadatos) {
+		n.propio.Metadatos = metadatos
+		n.propio.Encarnacion++
+		n.difundir(n.propio)
+	}
+	ahora := time.Now()
+	for _, m := range n.miembros {
+		if m.Estado == MiembroSospechoso && ahora.Sub(m.desde) > n.Sospecha {
+			caido := m.Miembro
+			caido.Estado = MiembroCaido
+			n.incorporar(caido)
+		}
+	}
+	for seq, e := range n.encargos {
+		if ahora.After(e.hasta) {
+			delete(n.encargos, seq)
+		}
+	}
+}
+
+// siguienteObjetivo elige el siguiente miembro no caído en una ronda que se
+// baraja cada vez que se completa, para que todos se sondeen con frecuencia
+func (n *NodoPertenencia) siguienteObjetivo() (Miembro, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for intento := 0; intento < 2; intento++ {
+		for len(n.ronda) > 0 {
+			nombre := n.ronda[0]
+			n.ronda = n.ronda[1:]
+			if m := n.miembros[nombre]; m != nil && m.Estado != MiembroCaido {
+				return m.Miembro, true
+			}
+		}
+		for nombre, m := range n.miembros {
+			if m.Estado != MiembroCaido {
+				n.ronda = append(n.ronda, nombre)
+			}
+		}
+		n.azar.Shuffle(len(n.ronda), func(i, j int) { n.ronda[i], n.ronda[j] = n.ronda[j], n.ronda[i] })
+	}
+	return Miembro{}, false
+}
+
+// sondearMiembro hace un ping directo y, si no hay respuesta en Espera,
+// pide a otros miembros que lo sondeen; devuelve si alguien obtuvo respuesta
+// antes de terminar el periodo
+func (n *NodoPertenencia) sondearMiembro(objetivo Miembro) bool {
+	seq, respuesta := n.ping(objetivo.Direccion, false)
+	defer n.olvidar(seq)
+	select {
+	case <-respuesta:
+		return true
+	case <-time.After(n.Espera):
+	case <-n.parar:
+		return true
+	}
+
+	n.mu.Lock()
+	var otros []string
+	for _, m := range n.miembros {
+		if m.Estado == MiembroVivo && m.Nombre != objetivo.Nombre {
+			otros = append(otros, m.Direccion)
+		}
+	}
+	n.azar.Shuffle(len(otros), func(i, j int) { otros[i], otros[j] = otros[j], otros[i] })
+	n.mu.Unlock()
+	if len(otros) > n.Indirectos {
+		otros = otros[:n.Indirectos]
+	}
+	for _, dir := range otros {
+		n.enviar(dir, MensajeGossip{Tipo: gsPingOtro, Seq: seq, Objetivo: objetivo.Direccion})
+	}
+	select {
+	case <-respuesta:
+		return true
+	case <-time.After(n.Periodo - n.Espera):
+		return false
+	case <-n.parar:
+		return true
+	}
+}
+
+// ping envía un ping (pidiendo o no la lista completa) y devuelve su número
+// y el canal que se cierra al llegar la respuesta; quien llama debe olvidar
+// el número cuando deje de esperarla
+func (n *NodoPertenencia) ping(direccion string, completa bool) (uint64, chan struct{}) {
+	n.mu.Lock()
+	n.seq++
+	seq := n.seq
+	respuesta := make(chan struct{})
+	n.esperas[seq] = respuesta
+	n.mu.Unlock()
+	n.enviar(direccion, MensajeGossip{Tipo: gsPing, Seq: seq, Completa: completa})
+	return seq, respuesta
+}
+
+// llamarSemillas hace ping a las semillas pidiendo la lista completa y
+// espera sus respuestas hasta Espera
+func (n *NodoPertenencia) llamarSemillas() {
+	var seqs []uint64
+	for _, s := range n.semillas {
+		seq, _ := n.ping(s, true)
+		seqs = append(seqs, seq)
+	}
+	select {
+	case <-time.After(n.Espera):
+	case <-n.parar:
+	}
+	for _, seq := range seqs {
+		n.olvidar(seq)
+	}
+}
+
+func (n *NodoPertenencia) olvidar(seq uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.esperas, seq)
+}
+
+// RECEPCIÓN
+
+func (n *NodoPertenencia) recibir() {
+	buf := make([]byte, 64*1024)
+	for {
+		tam, _, err := n.conn.ReadFromUDP(buf)
+		if err != nil {
+			return // conexión cerrada: nodo detenido
+		}
+		var m MensajeGossip
+		if json.Unmarshal(buf[:tam], &m) != nil {
+			continue
+		}
+		n.mu.Lock()
+		perdido := n.Perdida > 0 && n.azar.Float64() < n.Perdida
+		n.mu.Unlock()
+		if perdido {
+			continue
+		}
+		m.Recibido(n.Relojes)
+		n.procesar(m)
+	}
+}
+
+func (n *NodoPertenencia) procesar(m MensajeGossip) {
+	n.mu.Lock()
+	antes, conocido := n.miembroEn(m.Origen)
+	for _, nov := range m.Novedades {
+		n.incorporar(nov)
+	}
+	despues, _ := n.miembroEn(m.Origen)
+	n.mu.Unlock()
+
+	switch m.Tipo {
+	case gsPing:
+		ack := MensajeGossip{Tipo: gsAck, Seq: m.Seq}
+		if m.Completa || !conocido || despues.Encarnacion != antes.Encarnacion {
+			// Quien entra por primera vez, vuelve tras caer o la pide
+			// recibe la lista completa: las novedades que se perdió ya no
+			// viajan
+			ack.Novedades = n.Miembros()
+		}
+		n.enviar(m.Origen, ack)
+	case gsAck:
+		n.mu.Lock()
+		if respuesta, ok := n.esperas[m.Seq]; ok {
+			close(respuesta)
+			delete(n.esperas, m.Seq)
+		}
+		e, encargado := n.encargos[m.Seq]
+		delete(n.encargos, m.Seq)
+		n.mu.Unlock()
+		if encargado {
+			n.enviar(e.origen, MensajeGossip{Tipo: gsAck, Seq: e.seq})
+		}
+	case gsPingOtro:
+		n.mu.Lock()
+		n.seq++
+		seq := n.seq
+		n.encargos[seq] = encargo{origen: m.Origen, seq: m.Seq, hasta: time.Now().Add(n.Periodo)}
+		n.mu.Unlock()
+		n.enviar(m.Objetivo, MensajeGossip{Tipo: gsPing, Seq: seq})
+	}
+}
+
+// miembroEn devuelve el miembro no caído con esa dirección; se llama con
+// n.mu tomado
+func (n *NodoPertenencia) miembroEn(direccion string) (Miembro, bool) {
+	for _, x := range n.miembros {
+		if x.Direccion == direccion && x.Estado != MiembroCaido {
+			return x.Miembro, true
+		}
+	}
+	return Miembro{}, false
+}
+
+// incorporar aplica una noticia sobre un miembro si es más reciente que lo
+// que se sabía, y en ese caso la difunde. Una noticia de sospecha o caída
+// sobre este nodo se desmiente con una encarnación mayor. Se llama con n.mu
+// tomado.
+func (n *NodoPertenencia) incorporar(m Miembro) {
+	if m.Nombre == n.propio.Nombre {
+		if m.Estado != MiembroVivo && m.Encarnacion >= n.propio.Encarnacion {
+			n.propio.Encarnacion = m.Encarnacion + 1
+			n.difundir(n.propio)
+		}
+		return
+	}
+	actual := n.miembros[m.Nombre]
+	if actual != nil {
+		var aplica bool
+		switch m.Estado {
+		case MiembroVivo:
+			aplica = m.Encarnacion > actual.Encarnacion
+		case MiembroSospechoso:
+			aplica = m.Encarnacion > actual.Encarnacion ||
+				m.Encarnacion == actual.Encarnacion && actual.Estado == MiembroVivo
+		case MiembroCaido:
+			aplica = m.Encarnacion >= actual.Encarnacion && actual.Estado != MiembroCaido
+		}
+		if !aplica {
+			return
+		}
+	}
+	cambia := actual == nil || actual.Estado != m.Estado
+	n.miembros[m.Nombre] = &miembroLocal{Miembro: m, desde: time.Now()}
+	n.difundir(m)
+	if cambia && n.AlCambiar != nil {
+		go n.AlCambiar(m)
+	}
+}
+
+// difundir pone la noticia en la cola de novedades; se llama con n.mu tomado
+func (n *NodoPertenencia) difundir(m Miembro) {
+	n.novedades[m.Nombre] = &novedad{m: m}
+}
+
+// enviar manda un mensaje con las novedades menos difundidas
+func (n *NodoPertenencia) enviar(direccion string, m MensajeGossip) {
+	dir, err := net.ResolveUDPAddr("udp", direccion)
+	if err != nil {
+		return
+	}
+	n.mu.Lock()
+	m.Origen = n.propio.Direccion
+	if len(m.Novedades) == 0 {
+		m.Novedades = n.repartirNovedades()
+	}
+	n.mu.Unlock()
+	m.Sellar(n.Relojes)
+	datos, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+	// Un datagrama perdido lo recupera el siguiente sondeo
+	n.conn.WriteToUDP(datos, dir)
+}
+
+// repartirNovedades elige las novedades que menos han viajado y retira las
+// que ya han viajado bastante; se llama con n.mu tomado
+func (n *NodoPertenencia) repartirNovedades() []Miembro {
+	limite := n.Retransmisiones * int(math.Ceil(math.Log2(float64(len(n.miembros)+2))))
+	var cola []*novedad
+	for nombre, nov := range n.novedades {
+		if nov.envios >= limite {
+			delete(n.novedades, nombre)
+			continue
+		}
+		cola = append(cola, nov)
+	}
+	sort.Slice(cola, func(i, j int) bool { return cola[i].envios < cola[j].envios })
+	if len(cola) > maxNovedades {
+		cola = cola[:maxNovedades]
+	}
+	lista := make([]Miembro, len(cola))
+	for i, nov := range cola {
+		nov.envios++
+		lista[i] = nov.m
+	}
+	return lista
+}
+
+func mismosMetadatos(a, b EstadoSede) bool {
+	if a.Nombre != b.Nombre || a.PlazasLibres != b.PlazasLibres || len(a.Especialidades) != len(b.Especialidades) {
+		return false
+	}
+	for i := range a.Especialidades {
+		if a.Especialidades[i] != b.Especialidades[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// nodoGossip arranca en un puerto fijo (para poder volver a arrancarlo en
+// la misma dirección) un miembro con periodos cortos y sin dar a nadie por
+// caído durante la prueba
+func nodoGossip(t *testing.T, puerto int, semillas ...string) *NodoPertenencia {
+	t.Helper()
+	n, err := NuevoNodoPertenencia(fmt.Sprintf("taller%d", puerto), fmt.Sprintf("localhost:%d", puerto), semillas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Periodo, n.Espera, n.Sospecha = 30*time.Millisecond, 10*time.Millisecond, time.Minute
+	n.Iniciar()
+	t.Cleanup(n.Detener)
+	return n
+}
+
+// veVivos dice si n conoce vivos a todos los nombres con al menos esas
+// encarnaciones
+func veVivos(n *NodoPertenencia, encarnaciones map[string]uint64) bool {
+	vistos := map[string]Miembro{}
+	for _, m := range n.Miembros() {
+		vistos[m.Nombre] = m
+	}
+	for nombre, enc := range encarnaciones {
+		m, ok := vistos[nombre]
+		if !ok || m.Estado != MiembroVivo || m.Encarnacion < enc {
+			return false
+		}
+	}
+	return true
+}
+
+// TestReingresoGossip vuelve a arrancar un nodo antes de que los demás lo
+// den por caído y cuando las novedades sobre ellos ya no viajan: la semilla
+// lo reconoce por su nueva encarnación y le manda la lista completa, sin
+// esperar a la sincronización periódica, que aquí está desactivada
+func TestReingresoGossip(t *testing.T) {
+	semilla := "localhost:9381"
+	nodos := []*NodoPertenencia{nodoGossip(t, 9381), nodoGossip(t, 9382, semilla), nodoGossip(t, 9383, semilla)}
+	for _, n := range nodos {
+		n.mu.Lock()
+		n.SincronizarCada = 0
+		n.mu.Unlock()
+	}
+	todos := map[string]uint64{"taller9381": 0, "taller9382": 0, "taller9383": 0}
+	esperar(t, 5*time.Second, "los tres nodos se conocen", func() bool {
+		for _, n := range nodos {
+			if !veVivos(n, todos) {
+				return false
+			}
+		}
+		return true
+	})
+	// Las novedades ya han viajado lo bastante y nadie las reenvía
+	for _, n := range nodos {
+		n.mu.Lock()
+		n.novedades = map[string]*novedad{}
+		n.mu.Unlock()
+	}
+
+	anterior := nodos[2].Miembros()
+	nodos[2].Detener()
+	time.Sleep(5 * time.Millisecond)
+	nodos[2] = nodoGossip(t, 9383, semilla)
+	nodos[2].mu.Lock()
+	nodos[2].SincronizarCada = 0
+	enc := nodos[2].propio.Encarnacion
+	nodos[2].mu.Unlock()
+	for _, m := range anterior {
+		if m.Nombre == "taller9383" && m.Encarnacion >= enc {
+			t.Fatalf("la nueva encarnación %d no supera a la anterior %d", enc, m.Encarnacion)
+		}
+	}
+
+	todos["taller9383"] = enc
+	esperar(t, 5*time.Second, "todos ven vivo al nodo que vuelve y él a todos", func() bool {
+		for _, n := range nodos {
+			if !veVivos(n, todos) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// TestSemillasSinRespuesta comprueba que los pings a una semilla que no
+// responde no se acumulan esperando respuesta
+func TestSemillasSinRespuesta(t *testing.T) {
+	n := nodoGossip(t, 9384, "localhost:9389")
+	time.Sleep(20 * n.Periodo)
+	n.Detener()
+	esperar(t, time.Second, "no quedan pings sin respuesta", func() bool {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		return len(n.esperas) == 0
+	})
+}
+
+// TestPertenenciaGossip arranca cinco nodos que solo conocen al primero y
+// comprueba que todos acaban conociéndose con sus metadatos, que un cambio
+// de metadatos llega a todos, que una red que pierde datagramas no tumba a
+// nadie, que se detecta la caída de un nodo y que este vuelve al arrancar
+func TestPertenenciaGossip(t *testing.T) {
+	const total, puertoBase = 5, 9651
+	plazas := make([]int, total)
+	var mu sync.Mutex
+	nodos := make([]*NodoPertenencia, total)
+	semilla := fmt.Sprintf("localhost:%d", puertoBase)
+	arrancar := func(i int) {
+		nombre := fmt.Sprintf("taller%d", i)
+		n, err := NuevoNodoPertenencia(nombre, fmt.Sprintf("localhost:%d", puertoBase+i), []string{semilla})
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.Periodo, n.Espera, n.Sospecha = 100*time.Millisecond, 30*time.Millisecond, time.Second
+		n.Metadatos = func() EstadoSede {
+			mu.Lock()
+			defer mu.Unlock()
+			return EstadoSede{Nombre: nombre, PlazasLibres: plazas[i], Especialidades: []string{"mecánica"}}
+		}
+		nodos[i] = n
+		n.Iniciar()
+		t.Cleanup(n.Detener)
+	}
+	for i := range nodos {
+		plazas[i] = i
+		arrancar(i)
+	}
+
+	// ven comprueba que todos los nodos de vivos ven a los de estados con
+	// ese estado y, si los hay, con los metadatos indicados
+	ven := func(vivos []int, estados map[int]string, metadatos map[int]int) func() bool {
+		return func() bool {
+			for _, i := range vivos {
+				vistos := map[string]Miembro{}
+				for _, m := range nodos[i].Miembros() {
+					vistos[m.Nombre] = m
+				}
+				for j, estado := range estados {
+					m, ok := vistos[fmt.Sprintf("taller%d", j)]
+					if !ok || m.Estado != estado {
+						return false
+					}
+					if p, ok := metadatos[j]; ok && m.Metadatos.PlazasLibres != p {
+						return false
+					}
+				}
+			}
+			return true
+		}
+	}
+	todos := []int{0, 1, 2, 3, 4}
+	vivos := map[int]string{}
+	metadatos := map[int]int{}
+	for _, i := range todos {
+		vivos[i] = MiembroVivo
+		metadatos[i] = i
+	}
+	esperar(t, 10*time.Second, "los nodos se descubren a partir de una sola semilla", ven(todos, vivos, metadatos))
+
+	mu.Lock()
+	plazas[2] = 42
+	mu.Unlock()
+	metadatos[2] = 42
+	esperar(t, 10*time.Second, "el cambio de plazas libres de taller2 llega a todos", ven(todos, vivos, metadatos))
+
+	// Perdiendo un 10 % de los datagramas durante 2 s nadie se da por caído
+	for _, n := range nodos {
+		n.mu.Lock()
+		n.Perdida = 0.1
+		n.mu.Unlock()
+	}
+	limite := time.Now().Add(2 * time.Second)
+	for time.Now().Before(limite) {
+		for _, n := range nodos {
+			for _, m := range n.Miembros() {
+				if m.Estado == MiembroCaido {
+					t.Fatalf("con pérdidas, %s da por caído a %s", n.propio.Nombre, m.Nombre)
+				}
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	for _, n := range nodos {
+		n.mu.Lock()
+		n.Perdida = 0
+		n.mu.Unlock()
+	}
+
+	nodos[4].Detener()
+	esperar(t, 10*time.Second, "los demás dan por caído a taller4", ven(todos[:4], map[int]string{4: MiembroCaido}, nil))
+
+	arrancar(4)
+	esperar(t, 10*time.Second, "taller4 vuelve a arrancar y todos lo ven vivo", ven(todos, vivos, nil))
+}
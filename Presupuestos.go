@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Estados de un presupuesto
+const (
+	PresupuestoBorrador  = "borrador"
+	PresupuestoEnviado   = "enviado"
+	PresupuestoAceptado  = "aceptado"
+	PresupuestoRechazado = "rechazado"
+)
+
+// Presupuesto es una versión del precio de la reparación de una incidencia.
+// Las líneas y los importes son como los de una factura, en céntimos. Cada
+// revisión después de enviarlo es una versión nueva; las anteriores se
+// guardan tal como quedaron.
+type Presupuesto struct {
+	Version    int            `json:"version"`
+	Estado     string         `json:"estado"`
+	Fecha      string         `json:"fecha,omitempty"`      // última vez que se preparó
+	Enviado    string         `json:"enviado,omitempty"`    // cuándo se envió al cliente
+	Respuesta  string         `json:"respuesta,omitempty"`  // cuándo lo aceptó o lo rechazó
+	Motivo     string         `json:"motivo,omitempty"`     // de la revisión
+	Comentario string         `json:"comentario,omitempty"` // del cliente al responder
+	Lineas     []LineaFactura `json:"lineas"`
+	Descuento  float64        `json:"descuento,omitempty"` // sobre el total de las líneas, en tanto por ciento
+	// Importes en céntimos; los calcula calcular
+	Subtotal      int64 `json:"subtotal"`
+	ImporteDto    int64 `json:"importeDescuento"`
+	BaseImponible int64 `json:"baseImponible"`
+	IVA           int64 `json:"iva"`
+	Total         int64 `json:"total"`
+}
+
+// calcular comprueba las líneas y rellena los importes igual que en una
+// factura
+func (p *Presupuesto) calcular() error {
+	if len(p.Lineas) == 0 {
+		return errors.New("el presupuesto no tiene líneas")
+	}
+	f := Factura{Lineas: p.Lineas, Descuento: p.Descuento}
+	if err := f.Comprobar(); err != nil {
+		return err
+	}
+	f.Calcular()
+	p.Subtotal, p.ImporteDto, p.BaseImponible, p.IVA, p.Total = f.Subtotal, f.ImporteDto, f.BaseImponible, f.IVA, f.Total
+	return nil
+}
+
+// Pendiente indica si el presupuesto espera la respuesta del cliente
+func (p *Presupuesto) Pendiente() bool {
+	return p.Estado == PresupuestoBorrador || p.Estado == PresupuestoEnviado
+}
+
+// Presupuesto devuelve la última versión del presupuesto de la incidencia
+// (nil si no tiene)
+func (i *Incidencia) Presupuesto() *Presupuesto {
+	if len(i.Presupuestos) == 0 {
+		return nil
+	}
+	return &i.Presupuestos[len(i.Presupuestos)-1]
+}
+
+// PresupuestoVigente devuelve la última versión aceptada (nil si el cliente
+// no ha aceptado ninguna). Si rechaza una revisión sigue valiendo la anterior.
+func (i *Incidencia) PresupuestoVigente() *Presupuesto {
+	for k := len(i.Presupuestos) - 1; k >= 0; k-- {
+		if i.Presupuestos[k].Estado == PresupuestoAceptado {
+			return &i.Presupuestos[k]
+		}
+	}
+	return nil
+}
+
+// comprobarPresupuesto impide empezar una reparación sin un presupuesto
+// aceptado, y empezarla o terminarla con una revisión sin responder
+func comprobarPresupuesto(inc *Incidencia, estado string) error {
+	if p := inc.Presupuesto(); p != nil && p.Pendiente() {
+		return fmt.Errorf("la versión %d del presupuesto está %s: falta la respuesta del cliente", p.Version, p.Estado)
+	}
+	if estado == "en proceso" && inc.PresupuestoVigente() == nil {
+		return errors.New("el cliente no ha aceptado ningún presupuesto")
+	}
+	return nil
+}
+
+// presupuestar aplica OpPresupuestar: cambia el borrador del presupuesto o,
+// si ya se envió, prepara una versión nueva
+func (t *Taller) presupuestar(op Operacion) error {
+	if op.Presupuesto == nil {
+		return errors.New("falta el presupuesto")
+	}
+	_, v := t.BuscarVehiculo(op.Matricula)
+	if v == nil || v.GetIncidencia() == nil {
+		return errors.New("vehículo no encontrado o sin incidencia")
+	}
+	inc := v.GetIncidencia()
+	if inc.Estado == "cerrada" {
+		return errors.New("la incidencia está cerrada")
+	}
+	p := Presupuesto{Lineas: append([]LineaFactura(nil), op.Presupuesto.Lineas...),
+		Descuento: op.Presupuesto.Descuento, Motivo: op.Presupuesto.Motivo,
+		Estado: PresupuestoBorrador, Fecha: op.Fecha, Version: 1}
+	if err := p.calcular(); err != nil {
+		return err
+	}
+	ultimo := inc.Presupuesto()
+	switch {
+	case ultimo != nil && ultimo.Estado == PresupuestoBorrador:
+		p.Version = ultimo.Version
+		*ultimo = p
+	case ultimo != nil:
+		p.Version = ultimo.Version + 1
+		inc.Presupuestos = append(inc.Presupuestos, p)
+	default:
+		inc.Presupuestos = append(inc.Presupuestos, p)
+	}
+	return nil
+}
+
+// enviarPresupuesto aplica OpEnviarPresupuesto: el borrador pasa a enviado
+func (t *Taller) enviarPresupuesto(op Operacion) error {
+	_, v := t.BuscarVehiculo(op.Matricula)
+	if v == nil || v.GetIncidencia() == nil {
+		return errors.New("vehículo no encontrado o sin incidencia")
+	}
+	p := v.GetIncidencia().Presupuesto()
+	if p == nil || p.Estado != PresupuestoBorrador {
+		return errors.New("no hay ningún borrador de presupuesto")
+	}
+	p.Estado, p.Enviado = PresupuestoEnviado, op.Fecha
+	return nil
+}
+
+// responderPresupuesto aplica OpResponderPresupuesto: el cliente acepta o
+// rechaza (op.Estado) la última versión, enviada o en el mostrador, con un
+// comentario (op.Descripcion)
+func (t *Taller) responderPresupuesto(op Operacion) error {
+	if op.Estado != PresupuestoAceptado && op.Estado != PresupuestoRechazado {
+		return fmt.Errorf("respuesta no válida: %q", op.Estado)
+	}
+	_, v := t.BuscarVehiculo(op.Matricula)
+	if v == nil || v.GetIncidencia() == nil {
+		return errors.New("vehículo no encontrado o sin incidencia")
+	}
+	p := v.GetIncidencia().Presupuesto()
+	if p == nil || !p.Pendiente() {
+		return errors.New("no hay ningún presupuesto pendiente de respuesta")
+	}
+	p.Estado, p.Respuesta, p.Comentario = op.Estado, op.Fecha, op.Descripcion
+	return nil
+}
+
+// Texto devuelve el presupuesto en texto plano, con las líneas y los
+// totales como en la factura
+func (p *Presupuesto) Texto() string {
+	var b strings.Builder
+	if err := plantillaPresupuestoTexto.Execute(&b, p); err != nil {
+		return "error al preparar el presupuesto: " + err.Error()
+	}
+	return b.String()
+}
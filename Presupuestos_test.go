@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// presupuestoDePrueba es una hora de mano de obra de mecánica, para las
+// pruebas que necesitan un presupuesto aceptado antes de empezar
+func presupuestoDePrueba() *Presupuesto {
+	return &Presupuesto{Lineas: []LineaFactura{{Tipo: LineaManoObra, Concepto: "Mano de obra mecánica",
+		Cantidad: 1, Precio: TarifasHora["mecánica"]}}}
+}
+
+// repararPrueba son las operaciones que llevan la incidencia de un vehículo
+// de abierta a cerrada: un presupuesto aceptado, la reparación y el cierre
+func repararPrueba(matricula string) []Operacion {
+	return []Operacion{
+		{Tipo: OpPresupuestar, Matricula: matricula, Presupuesto: presupuestoDePrueba()},
+		{Tipo: OpResponderPresupuesto, Matricula: matricula, Estado: PresupuestoAceptado},
+		{Tipo: OpEstadoIncidencia, Matricula: matricula, Estado: "en proceso"},
+		{Tipo: OpEstadoIncidencia, Matricula: matricula, Estado: "cerrada"},
+	}
+}
+
+// TestPresupuestos prepara el presupuesto de una reparación y comprueba
+// que no se empieza sin uno aceptado, que tras enviarlo las revisiones son
+// versiones nuevas, que un rechazo obliga a revisarlo, que una revisión a
+// mitad de la reparación debe aceptarse antes de cerrar
+func TestPresupuestos(t *testing.T) {
+	var tl Taller
+	ops := []Operacion{
+		{Tipo: OpCrearMecanico, IDMecanico: 1, Nombre: "Laura", Especialidad: "mecánica"},
+		{Tipo: OpCrearCliente, IDCliente: 1, Nombre: "Ana"},
+		{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "1111AAA", Marca: "Seat", Modelo: "Ibiza"},
+		{Tipo: OpCrearIncidencia, Matricula: "1111AAA", IDIncidencia: 1, TipoIncidencia: "mecánica", Prioridad: "media"},
+	}
+	for _, op := range ops {
+		if err := tl.Aplicar(op); err != nil {
+			t.Fatalf("%s: %v", op.Tipo, err)
+		}
+	}
+	_, v := tl.BuscarVehiculo("1111AAA")
+	inc := v.GetIncidencia()
+	empezar := Operacion{Tipo: OpEstadoIncidencia, Matricula: "1111AAA", Estado: "en proceso"}
+	if err := tl.Aplicar(empezar); err == nil {
+		t.Fatal("la reparación ha empezado sin presupuesto")
+	}
+	manoObra := func(horas float64) LineaFactura {
+		return LineaFactura{Tipo: LineaManoObra, Concepto: "Mano de obra mecánica", Cantidad: horas, Precio: 4500}
+	}
+	embrague := LineaFactura{Tipo: LineaPieza, Concepto: "Kit de embrague", Cantidad: 1, Precio: 18000}
+	presupuestar := func(motivo string, lineas ...LineaFactura) error {
+		return tl.Aplicar(Operacion{Tipo: OpPresupuestar, Matricula: "1111AAA", Fecha: "2026-03-02T09:00:00.000Z",
+			Presupuesto: &Presupuesto{Lineas: lineas, Motivo: motivo}})
+	}
+	if err := presupuestar("", manoObra(3)); err != nil {
+		t.Fatal(err)
+	}
+	// Mientras es un borrador se cambia sin crear versiones
+	if err := presupuestar("", manoObra(4), embrague); err != nil {
+		t.Fatal(err)
+	}
+	if len(inc.Presupuestos) != 1 || inc.Presupuesto().Total != 43560 {
+		t.Fatalf("borrador inesperado: %d versiones, total %s", len(inc.Presupuestos), Euros(inc.Presupuesto().Total))
+	}
+	if err := tl.Aplicar(empezar); err == nil {
+		t.Fatal("la reparación ha empezado con el presupuesto en borrador")
+	}
+	if err := tl.Aplicar(Operacion{Tipo: OpEnviarPresupuesto, Matricula: "1111AAA"}); err != nil {
+		t.Fatal(err)
+	}
+	tl.Aplicar(Operacion{Tipo: OpResponderPresupuesto, Matricula: "1111AAA", Estado: PresupuestoRechazado, Descripcion: "muy caro"})
+	if err := tl.Aplicar(empezar); err == nil {
+		t.Fatal("la reparación ha empezado con el presupuesto rechazado")
+	}
+
+	if err := presupuestar("embrague reconstruido", manoObra(4), LineaFactura{Tipo: LineaPieza,
+		Concepto: "Kit de embrague", Cantidad: 1, Precio: 18000, Descuento: 25}); err != nil {
+		t.Fatal(err)
+	}
+	// El cliente acepta la versión 2 en el mostrador, sin que se le envíe
+	if err := tl.Aplicar(Operacion{Tipo: OpResponderPresupuesto, Matricula: "1111AAA", Estado: PresupuestoAceptado}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tl.Aplicar(empezar); err != nil {
+		t.Fatal(err)
+	}
+
+	// A mitad de la reparación aparece otra avería: versión 3
+	if err := presupuestar("el volante motor también está dañado", manoObra(5),
+		LineaFactura{Tipo: LineaPieza, Concepto: "Kit de embrague", Cantidad: 1, Precio: 18000, Descuento: 25},
+		LineaFactura{Tipo: LineaPieza, Concepto: "Volante motor", Cantidad: 1, Precio: 25000}); err != nil {
+		t.Fatal(err)
+	}
+	tl.Aplicar(Operacion{Tipo: OpEnviarPresupuesto, Matricula: "1111AAA"})
+	cerrar := Operacion{Tipo: OpEstadoIncidencia, Matricula: "1111AAA", Estado: "cerrada"}
+	if err := tl.Aplicar(cerrar); err == nil {
+		t.Fatal("la reparación se ha cerrado con una revisión sin responder")
+	}
+	if inc.PresupuestoVigente().Version != 2 {
+		t.Fatal("mientras se revisa debería seguir vigente la versión 2")
+	}
+	if err := tl.Aplicar(Operacion{Tipo: OpResponderPresupuesto, Matricula: "1111AAA", Estado: PresupuestoAceptado}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tl.Aplicar(cerrar); err != nil {
+		t.Fatal(err)
+	}
+	if err := tl.Aplicar(Operacion{Tipo: OpResponderPresupuesto, Matricula: "1111AAA", Estado: PresupuestoRechazado}); err == nil {
+		t.Fatal("se ha respondido dos veces al mismo presupuesto")
+	}
+	estados := []string{}
+	for _, p := range inc.Presupuestos {
+		estados = append(estados, fmt.Sprintf("v%d %s %s", p.Version, p.Estado, Euros(p.Total)))
+	}
+	if len(inc.Presupuestos) != 3 || inc.PresupuestoVigente().Version != 3 {
+		t.Fatalf("versiones inesperadas: %v", estados)
+	}
+
+	if !strings.Contains(inc.PresupuestoVigente().Texto(), "Volante motor") {
+		t.Fatalf("el presupuesto vigente en texto no lleva la nueva pieza:\n%s", inc.PresupuestoVigente().Texto())
+	}
+}
+
+// TestEstadosIncidencia comprueba que solo se admiten los estados conocidos
+// y los cambios entre ellos: un estado mal escrito no se salta el
+// presupuesto, y una incidencia no se cierra sin haberse empezado ni se
+// reabre una vez cerrada
+func TestEstadosIncidencia(t *testing.T) {
+	var tl Taller
+	for _, op := range []Operacion{
+		{Tipo: OpCrearCliente, IDCliente: 1, Nombre: "Ana"},
+		{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "1111AAA"},
+		{Tipo: OpCrearIncidencia, Matricula: "1111AAA", IDIncidencia: 1},
+	} {
+		if err := tl.Aplicar(op); err != nil {
+			t.Fatalf("%s: %v", op.Tipo, err)
+		}
+	}
+	_, v := tl.BuscarVehiculo("1111AAA")
+	inc := v.GetIncidencia()
+	pasos := []struct {
+		estado string
+		valido bool
+	}{
+		{"En proceso", false},
+		{"reparando", false},
+		{"", false},
+		{"cerrada", false},    // sin empezar
+		{"en proceso", false}, // sin presupuesto aceptado
+		{"abierta", false},
+	}
+	for _, p := range pasos {
+		err := tl.Aplicar(Operacion{Tipo: OpEstadoIncidencia, Matricula: "1111AAA", Estado: p.estado})
+		if (err == nil) != p.valido {
+			t.Fatalf("%s → %q: %v", inc.Estado, p.estado, err)
+		}
+		if inc.Estado != "abierta" {
+			t.Fatalf("un cambio rechazado ha dejado la incidencia %q", inc.Estado)
+		}
+	}
+	for _, op := range []Operacion{
+		{Tipo: OpPresupuestar, Matricula: "1111AAA", Presupuesto: presupuestoDePrueba()},
+		{Tipo: OpResponderPresupuesto, Matricula: "1111AAA", Estado: PresupuestoAceptado},
+	} {
+		if err := tl.Aplicar(op); err != nil {
+			t.Fatalf("%s: %v", op.Tipo, err)
+		}
+	}
+	pasos = []struct {
+		estado string
+		valido bool
+	}{
+		{"en proceso", true},
+		{"en proceso", false},
+		{"abierta", true}, // vuelve a la cola
+		{"en proceso", true},
+		{"cerrada", true},
+		{"abierta", false},
+		{"en proceso", false},
+		{"cerrada", false},
+	}
+	for _, p := range pasos {
+		antes := inc.Estado
+		err := tl.Aplicar(Operacion{Tipo: OpEstadoIncidencia, Matricula: "1111AAA", Estado: p.estado})
+		if (err == nil) != p.valido {
+			t.Fatalf("%s → %q: %v", antes, p.estado, err)
+		}
+	}
+	if inc.Estado != "cerrada" {
+		t.Fatalf("la incidencia ha acabado %q", inc.Estado)
+	}
+}
+
+// TestPresupuestoComoFactura comprueba que un presupuesto y una factura con
+// las mismas líneas y el mismo descuento imprimen igual sus importes
+func TestPresupuestoComoFactura(t *testing.T) {
+	lineas := []LineaFactura{
+		{Tipo: LineaManoObra, Concepto: "Mano de obra mecánica", Cantidad: 1.5, Precio: TarifasHora["mecánica"]},
+		{Tipo: LineaPieza, Concepto: "Pastillas de freno", Cantidad: 2, Precio: 3995, Descuento: 10},
+	}
+	p := &Presupuesto{Version: 1, Estado: PresupuestoBorrador, Lineas: lineas, Descuento: 5}
+	if err := p.calcular(); err != nil {
+		t.Fatal(err)
+	}
+	f := &Factura{Numero: "2026-0001", Lineas: lineas, Descuento: 5}
+	f.Calcular()
+	_, importes, _ := strings.Cut(p.Texto(), "\n")
+	if !strings.Contains(importes, "Suma") || !strings.HasSuffix(f.Texto(), importes) {
+		t.Fatalf("los importes del presupuesto no se imprimen como en la factura:\n%s\n%s", p.Texto(), f.Texto())
+	}
+}
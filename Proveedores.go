@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Estados de un pedido a proveedor
+const (
+	PedidoBorrador  = "borrador" // lo prepara el taller solo; aún se puede completar
+	PedidoEnviado   = "enviado"
+	PedidoRecibido  = "recibido"
+	PedidoCancelado = "cancelado"
+)
+
+// Proveedor es una empresa a la que el taller compra repuestos
+type Proveedor struct {
+	IDProveedor int    `json:"idProveedor"`
+	Nombre      string `json:"nombre"`
+	Telefono    string `json:"telefono,omitempty"`
+	Email       string `json:"email,omitempty"`
+}
+
+// LineaPedido son las unidades que se piden de un repuesto, a su coste
+type LineaPedido struct {
+	Referencia string `json:"referencia"`
+	Cantidad   int    `json:"cantidad"`
+	Coste      int64  `json:"coste"` // por unidad, en céntimos
+}
+
+// Pedido es un pedido de repuestos a un proveedor. Incidencias son las que
+// esperan piezas de este pedido; al recibirlo quedan las que lo esperaban.
+type Pedido struct {
+	IDPedido    int           `json:"idPedido"`
+	IDProveedor int           `json:"idProveedor"`
+	Estado      string        `json:"estado"`
+	Fecha       string        `json:"fecha"`
+	Recibido    string        `json:"recibido,omitempty"` // fecha de recepción
+	Lineas      []LineaPedido `json:"lineas"`
+	Incidencias []int         `json:"incidencias,omitempty"`
+}
+
+// Abierto indica si el pedido aún no ha llegado ni se ha cancelado
+func (p *Pedido) Abierto() bool {
+	return p.Estado == PedidoBorrador || p.Estado == PedidoEnviado
+}
+
+// Total devuelve el coste del pedido en céntimos
+func (p *Pedido) Total() int64 {
+	var total int64
+	for _, l := range p.Lineas {
+		total += int64(l.Cantidad) * l.Coste
+	}
+	return total
+}
+
+// Texto devuelve el pedido listo para mandarlo al proveedor
+func (p *Pedido) Texto(t *Taller) string {
+	var b strings.Builder
+	nombre := fmt.Sprintf("proveedor %d", p.IDProveedor)
+	if pr, _ := t.BuscarProveedor(p.IDProveedor); pr != nil {
+		nombre = pr.Nombre
+	}
+	fmt.Fprintf(&b, "Pedido %d a %s (%s, %s)\n", p.IDPedido, nombre, p.Estado, p.Fecha)
+	for _, l := range p.Lineas {
+		descripcion := ""
+		if r, _ := t.BuscarRepuesto(l.Referencia); r != nil {
+			descripcion = r.Descripcion
+		}
+		fmt.Fprintf(&b, "  %-10s %-30s %4d × %s\n", l.Referencia, descripcion, l.Cantidad, Euros(l.Coste))
+	}
+	fmt.Fprintf(&b, "  Total: %s", Euros(p.Total()))
+	return b.String()
+}
+
+// BuscarProveedor devuelve el proveedor con ese ID y su posición (-1 si no existe)
+func (t *Taller) BuscarProveedor(id int) (*Proveedor, int) {
+	for i, p := range t.Proveedores {
+		if p.IDProveedor == id {
+			return p, i
+		}
+	}
+	return nil, -1
+}
+
+// BuscarPedido devuelve el pedido con ese ID (nil si no existe)
+func (t *Taller) BuscarPedido(id int) *Pedido {
+	for _, p := range t.Pedidos {
+		if p.IDPedido == id {
+			return p
+		}
+	}
+	return nil
+}
+
+// PedidosEsperados devuelve los pedidos abiertos de los que espera piezas
+// la incidencia
+func (t *Taller) PedidosEsperados(inc *Incidencia) []*Pedido {
+	var out []*Pedido
+	for _, p := range t.Pedidos {
+		if !p.Abierto() {
+			continue
+		}
+		for _, id := range p.Incidencias {
+			if id == inc.IDIncidencia && len(PiezasQueFaltan(inc)) > 0 {
+				out = append(out, p)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// enCamino devuelve las unidades de la pieza en pedidos abiertos
+func (t *Taller) enCamino(ref string) int {
+	n := 0
+	for _, p := range t.Pedidos {
+		if !p.Abierto() {
+			continue
+		}
+		for _, l := range p.Lineas {
+			if l.Referencia == ref {
+				n += l.Cantidad
+			}
+		}
+	}
+	return n
+}
+
+// revisarPedidos prepara o completa un pedido en borrador para cada pieza
+// con proveedor que, contando lo que ya está pedido y lo que esperan las
+// incidencias, queda por debajo de su punto de pedido. Después enlaza cada
+// pedido abierto con las incidencias que esperan alguna de sus piezas.
+func (t *Taller) revisarPedidos(fecha string) {
+	pendientes := map[string]int{}
+	esperando := map[string][]int{}
+	t.incidencias(func(_ *Vehiculo, inc *Incidencia) {
+		for _, p := range PiezasQueFaltan(inc) {
+			pendientes[p.Referencia] += p.Cantidad - p.Apartadas
+			esperando[p.Referencia] = append(esperando[p.Referencia], inc.IDIncidencia)
+		}
+	})
+	for _, r := range t.Repuestos {
+		if pr, _ := t.BuscarProveedor(r.IDProveedor); pr == nil {
+			continue
+		}
+		previsto := t.Disponible(r.Referencia) + t.enCamino(r.Referencia) - pendientes[r.Referencia]
+		falta := max(r.Minimo, 0) - previsto
+		if falta <= 0 {
+			continue
+		}
+		t.borradorDe(r.IDProveedor, fecha).sumar(r, max(falta, r.Lote))
+	}
+	for _, p := range t.Pedidos {
+		if !p.Abierto() {
+			continue
+		}
+		p.Incidencias = nil
+		for _, l := range p.Lineas {
+			for _, id := range esperando[l.Referencia] {
+				if !contieneID(p.Incidencias, id) {
+					p.Incidencias = append(p.Incidencias, id)
+				}
+			}
+		}
+		sort.Ints(p.Incidencias)
+	}
+}
+
+// borradorDe devuelve el pedido en borrador del proveedor, y lo crea si no
+// tiene. Los IDs de pedido son correlativos.
+func (t *Taller) borradorDe(idProveedor int, fecha string) *Pedido {
+	id := 1
+	for _, p := range t.Pedidos {
+		if p.IDProveedor == idProveedor && p.Estado == PedidoBorrador {
+			return p
+		}
+		if p.IDPedido >= id {
+			id = p.IDPedido + 1
+		}
+	}
+	p := &Pedido{IDPedido: id, IDProveedor: idProveedor, Estado: PedidoBorrador, Fecha: fecha}
+	t.Pedidos = append(t.Pedidos, p)
+	return p
+}
+
+func (p *Pedido) sumar(r *Repuesto, cantidad int) {
+	for i := range p.Lineas {
+		if p.Lineas[i].Referencia == r.Referencia {
+			p.Lineas[i].Cantidad += cantidad
+			return
+		}
+	}
+	p.Lineas = append(p.Lineas, LineaPedido{Referencia: r.Referencia, Cantidad: cantidad, Coste: r.Coste})
+}
+
+// recibirPedido aplica OpRecibirPedido: las unidades entran en el almacén y
+// se apartan para las incidencias que las esperaban
+func (t *Taller) recibirPedido(op Operacion) error {
+	p := t.BuscarPedido(op.IDPedido)
+	if p == nil {
+		return errors.New("pedido no encontrado")
+	}
+	if !p.Abierto() {
+		return fmt.Errorf("el pedido está %s", p.Estado)
+	}
+	t.revisarPedidos(op.Fecha) // deja en el pedido las incidencias que lo esperaban
+	for _, l := range p.Lineas {
+		if r, _ := t.BuscarRepuesto(l.Referencia); r != nil {
+			r.Stock += l.Cantidad
+		}
+	}
+	p.Estado, p.Recibido = PedidoRecibido, op.Fecha
+	t.repartirRepuestos()
+	t.revisarPedidos(op.Fecha)
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// TestPedidos reserva más pastillas de las que hay y comprueba que se
+// prepara un pedido en borrador al proveedor enlazado con las incidencias
+// que esperan, que una nueva reserva completa el borrador y, una vez
+// enviado, abre otro; y que al recibirlo las incidencias pueden empezar
+func TestPedidos(t *testing.T) {
+	var tl Taller
+	fecha := "2026-05-04T09:00:00.000Z"
+	ops := []Operacion{
+		{Tipo: OpCrearProveedor, Proveedor: &Proveedor{IDProveedor: 1, Nombre: "Recambios Sur", Email: "pedidos@sur.es"}},
+		{Tipo: OpCrearRepuesto, Repuesto: &Repuesto{Referencia: "FR-01", Descripcion: "Pastillas de freno",
+			Coste: 2000, Precio: 3995, Stock: 4, Minimo: 2, Lote: 6, IDProveedor: 1}},
+		{Tipo: OpCrearRepuesto, Repuesto: &Repuesto{Referencia: "AC-05", Descripcion: "Aceite 5W30", Coste: 600, Precio: 1200, Stock: 1}},
+		{Tipo: OpCrearCliente, IDCliente: 1, Nombre: "Ana"},
+		{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "1111AAA", Marca: "Seat", Modelo: "Ibiza"},
+		{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "2222BBB", Marca: "Seat", Modelo: "León"},
+		{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "3333CCC", Marca: "Seat", Modelo: "Arona"},
+		{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "4444DDD", Marca: "Seat", Modelo: "Ateca"},
+		{Tipo: OpCrearIncidencia, Matricula: "1111AAA", IDIncidencia: 1},
+		{Tipo: OpCrearIncidencia, Matricula: "2222BBB", IDIncidencia: 2},
+		{Tipo: OpCrearIncidencia, Matricula: "3333CCC", IDIncidencia: 3},
+		{Tipo: OpCrearIncidencia, Matricula: "4444DDD", IDIncidencia: 4},
+		{Tipo: OpPresupuestar, Matricula: "2222BBB", Presupuesto: presupuestoDePrueba()},
+		{Tipo: OpPresupuestar, Matricula: "3333CCC", Presupuesto: presupuestoDePrueba()},
+		{Tipo: OpResponderPresupuesto, Matricula: "2222BBB", Estado: PresupuestoAceptado},
+		{Tipo: OpResponderPresupuesto, Matricula: "3333CCC", Estado: PresupuestoAceptado},
+		// Quedan 2: aún no se llega al punto de pedido
+		{Tipo: OpReservarRepuesto, Matricula: "1111AAA", Referencia: "FR-01", Cantidad: 2},
+		// El aceite no tiene proveedor: nunca se pide
+		{Tipo: OpReservarRepuesto, Matricula: "1111AAA", Referencia: "AC-05", Cantidad: 3},
+	}
+	for _, op := range ops {
+		op.Fecha = fecha
+		if err := tl.Aplicar(op); err != nil {
+			t.Fatalf("%s: %v", op.Tipo, err)
+		}
+	}
+	if len(tl.Pedidos) != 0 {
+		t.Fatalf("se han preparado pedidos sin bajar del punto de pedido: %d", len(tl.Pedidos))
+	}
+	// La incidencia 2 necesita 5 y solo quedan 2: hay que pedir 3 más 2 para
+	// volver al punto de pedido, pero el lote mínimo es de 6
+	tl.Aplicar(Operacion{Tipo: OpReservarRepuesto, Matricula: "2222BBB", Referencia: "FR-01", Cantidad: 5, Fecha: fecha})
+	if len(tl.Pedidos) != 1 {
+		t.Fatalf("se esperaba un pedido en borrador y hay %d", len(tl.Pedidos))
+	}
+	p := tl.Pedidos[0]
+	if p.Estado != PedidoBorrador || p.IDProveedor != 1 || len(p.Lineas) != 1 || p.Lineas[0].Cantidad != 6 || fmt.Sprint(p.Incidencias) != "[2]" {
+		t.Fatalf("pedido inesperado: %+v", *p)
+	}
+	// Otra reserva: faltan 3 + 4 y el borrador solo cubre 6, así que se le
+	// añade otro lote
+	tl.Aplicar(Operacion{Tipo: OpReservarRepuesto, Matricula: "3333CCC", Referencia: "FR-01", Cantidad: 4, Fecha: fecha})
+	if len(tl.Pedidos) != 1 || p.Lineas[0].Cantidad != 12 || fmt.Sprint(p.Incidencias) != "[2 3]" {
+		t.Fatalf("el borrador no se ha completado: %+v", *p)
+	}
+	_, v3 := tl.BuscarVehiculo("3333CCC")
+	if esperados := tl.PedidosEsperados(v3.GetIncidencia()); len(esperados) != 1 || esperados[0] != p {
+		t.Fatal("la incidencia 3 no está enlazada con el pedido")
+	}
+	if err := tl.Aplicar(Operacion{Tipo: OpEnviarPedido, IDPedido: 1, Fecha: fecha}); err != nil {
+		t.Fatal(err)
+	}
+	// Con el pedido enviado, si hace falta más se abre otro borrador
+	tl.Aplicar(Operacion{Tipo: OpReservarRepuesto, Matricula: "4444DDD", Referencia: "FR-01", Cantidad: 8, Fecha: fecha})
+	if len(tl.Pedidos) != 2 || tl.Pedidos[1].Estado != PedidoBorrador || tl.Pedidos[1].IDPedido != 2 {
+		t.Fatalf("no se ha abierto un segundo borrador: %d pedidos", len(tl.Pedidos))
+	}
+
+	if err := tl.Aplicar(Operacion{Tipo: OpEstadoIncidencia, Matricula: "3333CCC", Estado: "en proceso"}); err == nil {
+		t.Fatal("la incidencia 3 ha empezado sin sus piezas")
+	}
+	if err := tl.Aplicar(Operacion{Tipo: OpRecibirPedido, IDPedido: 1, Fecha: "2026-05-06T12:00:00.000Z"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tl.Aplicar(Operacion{Tipo: OpRecibirPedido, IDPedido: 1}); err == nil {
+		t.Fatal("se ha recibido dos veces el mismo pedido")
+	}
+	for _, mat := range []string{"2222BBB", "3333CCC"} {
+		if err := tl.Aplicar(Operacion{Tipo: OpEstadoIncidencia, Matricula: mat, Estado: "en proceso"}); err != nil {
+			t.Fatalf("%s tras recibir el pedido: %v", mat, err)
+		}
+	}
+	if len(tl.PedidosEsperados(v3.GetIncidencia())) != 0 {
+		t.Fatal("la incidencia 3 sigue esperando piezas")
+	}
+	if q := tl.BuscarPedido(1); fmt.Sprint(q.Incidencias) != "[2 3 4]" || q.Recibido == "" {
+		t.Fatalf("el pedido recibido no recuerda qué incidencias lo esperaban: %+v", *q)
+	}
+
+	if q := tl.BuscarPedido(2); q.Estado != PedidoBorrador || fmt.Sprint(q.Incidencias) != "[4]" {
+		t.Fatalf("el segundo pedido no espera a la incidencia 4: %+v", *q)
+	}
+	if err := tl.Aplicar(Operacion{Tipo: OpEliminarProveedor, IDProveedor: 1}); err == nil {
+		t.Fatal("se ha eliminado un proveedor con pedidos abiertos")
+	}
+	if err := tl.Aplicar(Operacion{Tipo: OpCancelarPedido, IDPedido: 2}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,956 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Estados de un nodo Raft
+const (
+	RaftSeguidor  = "seguidor"
+	RaftCandidato = "candidato"
+	RaftLider     = "líder"
+)
+
+// Tiempos del protocolo
+const (
+	raftLatido         = 100 * time.Millisecond
+	raftEleccionMin    = 300 * time.Millisecond
+	raftEleccionMax    = 600 * time.Millisecond
+	raftTimeoutRPC     = 200 * time.Millisecond
+	raftEsperaProponer = 2 * time.Second
+)
+
+// ErrNoLider se devuelve al proponer una operación en un nodo que no es líder
+var ErrNoLider = errors.New("este nodo no es el líder")
+
+// EntradaRaft es una operación del taller en el log replicado. Las entradas
+// con Op.Tipo vacío son entradas nulas que el líder añade al ser elegido.
+type EntradaRaft struct {
+	Indice  int
+	Termino int
+	Op      Operacion
+}
+
+// NodoRaft es un nodo de un clúster Raft cuya máquina de estados es el Taller:
+// cada entrada confirmada se aplica con Taller.Aplicar en el mismo orden en
+// todos los nodos. El log se compacta con una instantánea del taller cada
+// UmbralInstantanea entradas aplicadas.
+type NodoRaft struct {
+	UmbralInstantanea int
+
+	// Máquina de estados; se llaman con el cerrojo del taller tomado
+	Aplicar  func(op Operacion) error
+	Exportar func() Instantanea
+	Importar func(ins Instantanea)
+	// Relojes lógicos con los que se marcan los RPC (nil = sin marcas)
+	Relojes *Relojes
+
+	mu          sync.Mutex
+	cerrojo     *sync.Mutex
+	id          int
+	pares       []string // direcciones de todos los nodos, indexadas por id
+	red         *RedRaft // filtro de particiones (nil = red real)
+	persist     *PersistenciaRaft
+	clientes    map[int]*rpc.Client
+	oyente      net.Listener
+	conexiones  []net.Conn
+	muerto      bool
+	fallo       error // por qué se detuvo el nodo solo (nil = no se ha detenido)
+	parar       chan struct{}
+	estado      string
+	liderActual int
+
+	// Estado persistente
+	termino int
+	votadoA int
+	log     []EntradaRaft // log[0] es el centinela con el último índice compactado
+
+	// Estado volátil
+	commit         int
+	aplicado       int
+	siguiente      []int
+	coincidente    []int
+	ultimoContacto time.Time
+	timeout        time.Duration
+	esperas        map[int]chan resultadoRaft
+}
+
+type resultadoRaft struct {
+	termino int
+	err     error
+}
+
+// NuevoNodoRaft crea el nodo id del clúster formado por pares sobre el taller t
+// protegido por cerrojo, recuperando lo que hubiera en persist
+func NuevoNodoRaft(id int, pares []string, persist *PersistenciaRaft, t *Taller, cerrojo *sync.Mutex) *NodoRaft {
+	return &NodoRaft{
+		UmbralInstantanea: 100,
+		Aplicar:           t.Aplicar,
+		Exportar:          t.Exportar,
+		Importar:          t.Importar,
+		cerrojo:           cerrojo,
+		id:                id,
+		pares:             pares,
+		persist:           persist,
+		clientes:          map[int]*rpc.Client{},
+		parar:             make(chan struct{}),
+		estado:            RaftSeguidor,
+		liderActual:       -1,
+		votadoA:           -1,
+		log:               []EntradaRaft{{}},
+		esperas:           map[int]chan resultadoRaft{},
+	}
+}
+
+// Iniciar recupera el estado persistido, abre el servidor RPC y arranca los
+// temporizadores de elección y latido
+func (rf *NodoRaft) Iniciar() error {
+	rf.mu.Lock()
+	if err := rf.recuperar(); err != nil {
+		rf.mu.Unlock()
+		return err
+	}
+	rf.ultimoContacto = time.Now()
+	rf.timeout = timeoutEleccion()
+	rf.mu.Unlock()
+
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Raft", &ServicioRaft{rf}); err != nil {
+		return err
+	}
+	oyente, err := net.Listen("tcp", rf.pares[rf.id])
+	if err != nil {
+		return err
+	}
+	rf.oyente = oyente
+	go func() {
+		for {
+			conn, err := oyente.Accept()
+			if err != nil {
+				return
+			}
+			rf.mu.Lock()
+			rf.conexiones = append(rf.conexiones, conn)
+			rf.mu.Unlock()
+			go srv.ServeConn(conn)
+		}
+	}()
+	go rf.temporizador()
+	return nil
+}
+
+// Detener simula la caída del nodo: cierra el servidor y las conexiones y deja
+// de participar en el protocolo. Lo persistido se conserva.
+func (rf *NodoRaft) Detener() {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.detener()
+}
+
+// detener hace lo mismo que Detener; se llama con rf.mu tomado
+func (rf *NodoRaft) detener() {
+	if rf.muerto {
+		return
+	}
+	rf.muerto = true
+	close(rf.parar)
+	if rf.oyente != nil {
+		rf.oyente.Close()
+	}
+	for _, c := range rf.conexiones {
+		c.Close()
+	}
+	for _, c := range rf.clientes {
+		c.Close()
+	}
+	for i, ch := range rf.esperas {
+		ch <- resultadoRaft{err: ErrNoLider}
+		delete(rf.esperas, i)
+	}
+}
+
+// Proponer añade la operación al log replicado y espera a que se confirme y se
+// aplique. Solo el líder acepta operaciones.
+func (rf *NodoRaft) Proponer(op Operacion) error {
+	rf.mu.Lock()
+	if rf.muerto || rf.estado != RaftLider {
+		rf.mu.Unlock()
+		return ErrNoLider
+	}
+	e := EntradaRaft{Indice: rf.ultimoIndice() + 1, Termino: rf.termino, Op: op}
+	rf.log = append(rf.log, e)
+	if err := rf.guardar(nil); err != nil {
+		rf.mu.Unlock()
+		return err
+	}
+	ch := make(chan resultadoRaft, 1)
+	rf.esperas[e.Indice] = ch
+	rf.mu.Unlock()
+
+	rf.difundir()
+
+	select {
+	case r := <-ch:
+		if r.termino != e.Termino {
+			return errors.New("la operación se perdió al cambiar de líder")
+		}
+		return r.err
+	case <-time.After(raftEsperaProponer):
+		rf.mu.Lock()
+		delete(rf.esperas, e.Indice)
+		rf.mu.Unlock()
+		return errors.New("la operación no se confirmó a tiempo")
+	}
+}
+
+// Estado devuelve el estado, el término y el líder conocido del nodo
+func (rf *NodoRaft) Estado() (estado string, termino, lider int) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.estado, rf.termino, rf.liderActual
+}
+
+// Fallo devuelve el error por el que el nodo se detuvo solo (nil si no)
+func (rf *NodoRaft) Fallo() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.fallo
+}
+
+// Indices devuelve el último índice del log, el índice de commit y el aplicado
+func (rf *NodoRaft) Indices() (ultimo, commit, aplicado int) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.ultimoIndice(), rf.commit, rf.aplicado
+}
+
+// LOG
+
+func (rf *NodoRaft) base() int          { return rf.log[0].Indice }
+func (rf *NodoRaft) ultimoIndice() int  { return rf.log[len(rf.log)-1].Indice }
+func (rf *NodoRaft) ultimoTermino() int { return rf.log[len(rf.log)-1].Termino }
+func (rf *NodoRaft) entrada(i int) EntradaRaft {
+	return rf.log[i-rf.base()]
+}
+
+// logActualizado indica si un log que acaba en (termino, indice) está al menos
+// tan actualizado como el propio
+func (rf *NodoRaft) logActualizado(termino, indice int) bool {
+	if termino != rf.ultimoTermino() {
+		return termino > rf.ultimoTermino()
+	}
+	return indice >= rf.ultimoIndice()
+}
+
+// pasarASeguidor devuelve el error de guardar el término nuevo; en ese
+// caso el nodo ya se ha detenido
+func (rf *NodoRaft) pasarASeguidor(termino int) error {
+	if termino > rf.termino {
+		rf.termino = termino
+		rf.votadoA = -1
+		if err := rf.guardar(nil); err != nil {
+			return err
+		}
+	}
+	rf.estado = RaftSeguidor
+	return nil
+}
+
+// aplicarConfirmadas aplica en orden las entradas confirmadas pendientes y
+// compacta el log si ha crecido demasiado
+func (rf *NodoRaft) aplicarConfirmadas() {
+	for rf.aplicado < rf.commit && !rf.muerto {
+		rf.aplicado++
+		e := rf.entrada(rf.aplicado)
+		var err error
+		if e.Op.Tipo != "" {
+			rf.cerrojo.Lock()
+			err = rf.Aplicar(e.Op)
+			rf.cerrojo.Unlock()
+		}
+		if ch, ok := rf.esperas[e.Indice]; ok {
+			ch <- resultadoRaft{termino: e.Termino, err: err}
+			delete(rf.esperas, e.Indice)
+		}
+	}
+	if rf.aplicado-rf.base() > rf.UmbralInstantanea && !rf.muerto {
+		rf.compactar()
+	}
+}
+
+// compactar sustituye las entradas aplicadas por una instantánea del taller
+func (rf *NodoRaft) compactar() {
+	rf.cerrojo.Lock()
+	ins := rf.Exportar()
+	rf.cerrojo.Unlock()
+	centinela := EntradaRaft{Indice: rf.aplicado, Termino: rf.entrada(rf.aplicado).Termino}
+	resto := rf.log[rf.aplicado-rf.base()+1:]
+	rf.log = append([]EntradaRaft{centinela}, resto...)
+	rf.guardar(&instantaneaRaft{Indice: centinela.Indice, Termino: centinela.Termino, Estado: ins})
+}
+
+// ELECCIÓN
+
+func timeoutEleccion() time.Duration {
+	return raftEleccionMin + time.Duration(rand.Int63n(int64(raftEleccionMax-raftEleccionMin)))
+}
+
+func (rf *NodoRaft) temporizador() {
+	tick := time.NewTicker(20 * time.Millisecond)
+	defer tick.Stop()
+	ultimoLatido := time.Now()
+	for {
+		select {
+		case <-rf.parar:
+			return
+		case <-tick.C:
+		}
+		rf.mu.Lock()
+		esLider := rf.estado == RaftLider
+		vencido := !esLider && time.Since(rf.ultimoContacto) > rf.timeout
+		rf.mu.Unlock()
+		if esLider && time.Since(ultimoLatido) >= raftLatido {
+			ultimoLatido = time.Now()
+			rf.difundir()
+		}
+		if vencido {
+			rf.iniciarEleccion()
+		}
+	}
+}
+
+func (rf *NodoRaft) iniciarEleccion() {
+	rf.mu.Lock()
+	rf.estado = RaftCandidato
+	rf.termino++
+	rf.votadoA = rf.id
+	rf.liderActual = -1
+	if rf.guardar(nil) != nil {
+		rf.mu.Unlock()
+		return
+	}
+	rf.ultimoContacto = time.Now()
+	rf.timeout = timeoutEleccion()
+	args := ArgsVoto{Termino: rf.termino, Candidato: rf.id,
+		UltimoIndice: rf.ultimoIndice(), UltimoTermino: rf.ultimoTermino()}
+	rf.mu.Unlock()
+
+	votos := 1
+	for p := range rf.pares {
+		if p == rf.id {
+			continue
+		}
+		go func(p int, args ArgsVoto) {
+			var resp RespVoto
+			if err := rf.llamar(p, "PedirVoto", &args, &resp); err != nil {
+				return
+			}
+			rf.mu.Lock()
+			defer rf.mu.Unlock()
+			if resp.Termino > rf.termino {
+				rf.pasarASeguidor(resp.Termino)
+				return
+			}
+			if !resp.Concedido || rf.estado != RaftCandidato || rf.termino != args.Termino {
+				return
+			}
+			votos++
+			if votos > len(rf.pares)/2 {
+				rf.convertirEnLider()
+			}
+		}(p, args)
+	}
+}
+
+// convertirEnLider se llama con rf.mu tomado
+func (rf *NodoRaft) convertirEnLider() {
+	rf.estado = RaftLider
+	rf.liderActual = rf.id
+	rf.siguiente = make([]int, len(rf.pares))
+	rf.coincidente = make([]int, len(rf.pares))
+	for p := range rf.pares {
+		rf.siguiente[p] = rf.ultimoIndice() + 1
+	}
+	// Entrada nula para poder confirmar lo que quedó de términos anteriores
+	rf.log = append(rf.log, EntradaRaft{Indice: rf.ultimoIndice() + 1, Termino: rf.termino})
+	if rf.guardar(nil) != nil {
+		return
+	}
+	go rf.difundir()
+}
+
+// REPLICACIÓN
+
+// difundir envía a cada seguidor las entradas que le faltan (o un latido)
+func (rf *NodoRaft) difundir() {
+	for p := range rf.pares {
+		if p != rf.id {
+			go rf.replicarA(p)
+		}
+	}
+}
+
+func (rf *NodoRaft) replicarA(p int) {
+	rf.mu.Lock()
+	if rf.estado != RaftLider || rf.muerto {
+		rf.mu.Unlock()
+		return
+	}
+	if rf.siguiente[p] <= rf.base() {
+		rf.mu.Unlock()
+		rf.enviarInstantanea(p)
+		return
+	}
+	prev := rf.siguiente[p] - 1
+	args := ArgsAnexar{
+		Termino:        rf.termino,
+		Lider:          rf.id,
+		PrevIndice:     prev,
+		PrevTermino:    rf.entrada(prev).Termino,
+		Entradas:       append([]EntradaRaft(nil), rf.log[prev-rf.base()+1:]...),
+		CommitDelLider: rf.commit,
+	}
+	rf.mu.Unlock()
+
+	var resp RespAnexar
+	if err := rf.llamar(p, "AnexarEntradas", &args, &resp); err != nil {
+		return
+	}
+
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if resp.Termino > rf.termino {
+		rf.pasarASeguidor(resp.Termino)
+		return
+	}
+	if rf.estado != RaftLider || rf.termino != args.Termino {
+		return
+	}
+	if resp.Exito {
+		if m := args.PrevIndice + len(args.Entradas); m > rf.coincidente[p] {
+			rf.coincidente[p] = m
+			rf.siguiente[p] = m + 1
+		}
+		rf.avanzarCommit()
+		return
+	}
+	if resp.Conflicto > 0 {
+		rf.siguiente[p] = resp.Conflicto
+	} else if rf.siguiente[p] > 1 {
+		rf.siguiente[p]--
+	}
+}
+
+// avanzarCommit confirma la entrada más alta del término actual replicada en
+// la mayoría; se llama con rf.mu tomado
+func (rf *NodoRaft) avanzarCommit() {
+	for n := rf.ultimoIndice(); n > rf.commit && n > rf.base(); n-- {
+		if rf.entrada(n).Termino != rf.termino {
+			break
+		}
+		replicas := 1
+		for p := range rf.pares {
+			if p != rf.id && rf.coincidente[p] >= n {
+				replicas++
+			}
+		}
+		if replicas > len(rf.pares)/2 {
+			rf.commit = n
+			rf.aplicarConfirmadas()
+			return
+		}
+	}
+}
+
+func (rf *NodoRaft) enviarInstantanea(p int) {
+	rf.mu.Lock()
+	ins, _ := rf.persist.LeerInstantanea()
+	if ins == nil || rf.estado != RaftLider {
+		rf.mu.Unlock()
+		return
+	}
+	args := ArgsInstantanea{Termino: rf.termino, Lider: rf.id, Instantanea: *ins}
+	rf.mu.Unlock()
+
+	var resp RespInstantanea
+	if err := rf.llamar(p, "InstalarInstantanea", &args, &resp); err != nil {
+		return
+	}
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if resp.Termino > rf.termino {
+		rf.pasarASeguidor(resp.Termino)
+		return
+	}
+	if rf.estado == RaftLider && rf.termino == args.Termino && ins.Indice > rf.coincidente[p] {
+		rf.coincidente[p] = ins.Indice
+		rf.siguiente[p] = ins.Indice + 1
+	}
+}
+
+// RPC
+
+// ArgsVoto son los argumentos de PedirVoto
+type ArgsVoto struct {
+	Termino       int
+	Candidato     int
+	UltimoIndice  int
+	UltimoTermino int
+	Sello
+}
+
+// RespVoto es la respuesta de PedirVoto
+type RespVoto struct {
+	Termino   int
+	Concedido bool
+	Sello
+}
+
+// ArgsAnexar son los argumentos de AnexarEntradas (vacío = latido)
+type ArgsAnexar struct {
+	Termino        int
+	Lider          int
+	PrevIndice     int
+	PrevTermino    int
+	Entradas       []EntradaRaft
+	CommitDelLider int
+	Sello
+}
+
+// RespAnexar es la respuesta de AnexarEntradas. Si falla, Conflicto indica el
+// índice desde el que el líder debe reintentar.
+type RespAnexar struct {
+	Termino   int
+	Exito     bool
+	Conflicto int
+	Sello
+}
+
+// ArgsInstantanea son los argumentos de InstalarInstantanea
+type ArgsInstantanea struct {
+	Termino     int
+	Lider       int
+	Instantanea instantaneaRaft
+	Sello
+}
+
+// RespInstantanea es la respuesta de InstalarInstantanea
+type RespInstantanea struct {
+	Termino int
+	Sello
+}
+
+// mensajeRaft es cualquier argumento o respuesta de los RPC, todos con Sello
+type mensajeRaft interface {
+	Sellar(r *Relojes)
+	Recibido(r *Relojes)
+}
+
+// ServicioRaft expone los RPC del nodo para net/rpc
+type ServicioRaft struct {
+	rf *NodoRaft
+}
+
+var errNodoCaido = errors.New("nodo caído")
+
+// PedirVoto concede el voto si el candidato está al día y no se ha votado a otro
+func (s *ServicioRaft) PedirVoto(args *ArgsVoto, resp *RespVoto) error {
+	rf := s.rf
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.muerto {
+		return errNodoCaido
+	}
+	args.Recibido(rf.Relojes)
+	defer resp.Sellar(rf.Relojes)
+	if args.Termino > rf.termino {
+		if err := rf.pasarASeguidor(args.Termino); err != nil {
+			return err
+		}
+	}
+	resp.Termino = rf.termino
+	if args.Termino < rf.termino {
+		return nil
+	}
+	if (rf.votadoA == -1 || rf.votadoA == args.Candidato) && rf.logActualizado(args.UltimoTermino, args.UltimoIndice) {
+		rf.votadoA = args.Candidato
+		// Un voto que no llega al disco no se concede: al reiniciar se
+		// podría votar a otro en el mismo término
+		if err := rf.guardar(nil); err != nil {
+			return err
+		}
+		rf.ultimoContacto = time.Now()
+		resp.Concedido = true
+	}
+	return nil
+}
+
+// AnexarEntradas añade las entradas del líder si el log coincide en PrevIndice
+func (s *ServicioRaft) AnexarEntradas(args *ArgsAnexar, resp *RespAnexar) error {
+	rf := s.rf
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.muerto {
+		return errNodoCaido
+	}
+	args.Recibido(rf.Relojes)
+	defer resp.Sellar(rf.Relojes)
+	resp.Termino = rf.termino
+	if args.Termino < rf.termino {
+		return nil
+	}
+	if err := rf.pasarASeguidor(args.Termino); err != nil {
+		return err
+	}
+	resp.Termino = rf.termino
+	rf.liderActual = args.Lider
+	rf.ultimoContacto = time.Now()
+
+	// Lo que ya está en la instantánea no hace falta comprobarlo
+	entradas := args.Entradas
+	prev, prevTermino := args.PrevIndice, args.PrevTermino
+	if prev < rf.base() {
+		for len(entradas) > 0 && entradas[0].Indice <= rf.base() {
+			entradas = entradas[1:]
+		}
+		prev, prevTermino = rf.base(), rf.log[0].Termino
+	}
+	if prev > rf.ultimoIndice() {
+		resp.Conflicto = rf.ultimoIndice() + 1
+		return nil
+	}
+	if t := rf.entrada(prev).Termino; t != prevTermino {
+		// Retroceder hasta el principio del término en conflicto
+		i := prev
+		for i > rf.base()+1 && rf.entrada(i-1).Termino == t {
+			i--
+		}
+		resp.Conflicto = i
+		return nil
+	}
+
+	cambiado := false
+	for k, e := range entradas {
+		if e.Indice <= rf.ultimoIndice() {
+			if rf.entrada(e.Indice).Termino == e.Termino {
+				continue
+			}
+			rf.log = rf.log[:e.Indice-rf.base()]
+		}
+		rf.log = append(rf.log, entradas[k:]...)
+		cambiado = true
+		break
+	}
+	// Sin guardar las entradas no se responde: el líder las daría por
+	// replicadas aquí y podría confirmarlas sin mayoría
+	if cambiado {
+		if err := rf.guardar(nil); err != nil {
+			return err
+		}
+	}
+
+	if args.CommitDelLider > rf.commit {
+		ultimoNuevo := prev + len(entradas)
+		rf.commit = args.CommitDelLider
+		if ultimoNuevo < rf.commit {
+			rf.commit = ultimoNuevo
+		}
+		rf.aplicarConfirmadas()
+	}
+	resp.Exito = true
+	return nil
+}
+
+// InstalarInstantanea sustituye el estado del seguidor por la instantánea del
+// líder cuando este ya no conserva las entradas que le faltan
+func (s *ServicioRaft) InstalarInstantanea(args *ArgsInstantanea, resp *RespInstantanea) error {
+	rf := s.rf
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.muerto {
+		return errNodoCaido
+	}
+	args.Recibido(rf.Relojes)
+	defer resp.Sellar(rf.Relojes)
+	resp.Termino = rf.termino
+	if args.Termino < rf.termino {
+		return nil
+	}
+	if err := rf.pasarASeguidor(args.Termino); err != nil {
+		return err
+	}
+	resp.Termino = rf.termino
+	rf.liderActual = args.Lider
+	rf.ultimoContacto = time.Now()
+
+	ins := args.Instantanea
+	if ins.Indice <= rf.aplicado {
+		return nil
+	}
+	centinela := EntradaRaft{Indice: ins.Indice, Termino: ins.Termino}
+	if ins.Indice < rf.ultimoIndice() && rf.entrada(ins.Indice).Termino == ins.Termino {
+		rf.log = append([]EntradaRaft{centinela}, rf.log[ins.Indice-rf.base()+1:]...)
+	} else {
+		rf.log = []EntradaRaft{centinela}
+	}
+	rf.cerrojo.Lock()
+	rf.Importar(ins.Estado)
+	rf.cerrojo.Unlock()
+	rf.commit, rf.aplicado = ins.Indice, ins.Indice
+	return rf.guardar(&ins)
+}
+
+// llamar hace un RPC al nodo p con un tiempo máximo de espera
+func (rf *NodoRaft) llamar(p int, metodo string, args, resp mensajeRaft) error {
+	if rf.red != nil && !rf.red.Conectados(rf.id, p) {
+		return errors.New("nodo inaccesible (partición)")
+	}
+	rf.mu.Lock()
+	if rf.muerto {
+		rf.mu.Unlock()
+		return errNodoCaido
+	}
+	cliente := rf.clientes[p]
+	rf.mu.Unlock()
+	if cliente == nil {
+		conn, err := net.DialTimeout("tcp", rf.pares[p], raftTimeoutRPC)
+		if err != nil {
+			return err
+		}
+		cliente = rpc.NewClient(conn)
+		rf.mu.Lock()
+		if viejo := rf.clientes[p]; viejo != nil {
+			cliente.Close()
+			cliente = viejo
+		} else {
+			rf.clientes[p] = cliente
+		}
+		rf.mu.Unlock()
+	}
+
+	args.Sellar(rf.Relojes)
+	llamada := cliente.Go("Raft."+metodo, args, resp, make(chan *rpc.Call, 1))
+	select {
+	case c := <-llamada.Done:
+		if c.Error == nil {
+			resp.Recibido(rf.Relojes)
+		}
+		if c.Error == rpc.ErrShutdown || errors.Is(c.Error, net.ErrClosed) {
+			rf.mu.Lock()
+			if rf.clientes[p] == cliente {
+				delete(rf.clientes, p)
+			}
+			rf.mu.Unlock()
+		}
+		return c.Error
+	case <-time.After(raftTimeoutRPC):
+		return errors.New("tiempo de espera agotado")
+	}
+}
+
+// PERSISTENCIA
+
+// instantaneaRaft es el estado del taller tras aplicar la entrada Indice
+type instantaneaRaft struct {
+	Indice  int
+	Termino int
+	Estado  Instantanea
+}
+
+type estadoRaft struct {
+	Termino int           `json:"termino"`
+	VotadoA int           `json:"votadoA"`
+	Log     []EntradaRaft `json:"log"`
+}
+
+// PersistenciaRaft guarda el estado persistente de un nodo y su última
+// instantánea. Con dir vacío se guarda en memoria (útil para simular caídas
+// en un mismo proceso); si no, en ficheros dentro de dir.
+type PersistenciaRaft struct {
+	mu          sync.Mutex
+	dir         string
+	estado      []byte
+	instantanea []byte
+}
+
+// NuevaPersistenciaRaft crea una persistencia en dir (vacío = en memoria)
+func NuevaPersistenciaRaft(dir string) (*PersistenciaRaft, error) {
+	p := &PersistenciaRaft{dir: dir}
+	if dir == "" {
+		return p, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	var err error
+	if p.estado, err = leerSiExiste(filepath.Join(dir, "raft.estado")); err != nil {
+		return nil, err
+	}
+	if p.instantanea, err = leerSiExiste(filepath.Join(dir, "raft.instantanea")); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Guardar sustituye el estado y, si no es nil, la instantánea
+func (p *PersistenciaRaft) Guardar(estado, instantanea []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.dir != "" {
+		if instantanea != nil {
+			if err := escribirAtomico(filepath.Join(p.dir, "raft.instantanea"), instantanea); err != nil {
+				return err
+			}
+		}
+		if err := escribirAtomico(filepath.Join(p.dir, "raft.estado"), estado); err != nil {
+			return err
+		}
+	}
+	p.estado = estado
+	if instantanea != nil {
+		p.instantanea = instantanea
+	}
+	return nil
+}
+
+// LeerInstantanea devuelve la última instantánea guardada (nil si no hay)
+func (p *PersistenciaRaft) LeerInstantanea() (*instantaneaRaft, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.instantanea == nil {
+		return nil, nil
+	}
+	var ins instantaneaRaft
+	if err := json.Unmarshal(p.instantanea, &ins); err != nil {
+		return nil, err
+	}
+	return &ins, nil
+}
+
+func (p *PersistenciaRaft) leerEstado() []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.estado
+}
+
+// guardar persiste término, voto y log (y la instantánea si se indica); se
+// llama con rf.mu tomado. Si no lo consigue, el nodo se detiene: seguir
+// participando con un estado que no sobreviviría a un reinicio podría
+// romper un voto dado o perder entradas que el líder cree replicadas.
+func (rf *NodoRaft) guardar(ins *instantaneaRaft) error {
+	estado, err := json.Marshal(estadoRaft{Termino: rf.termino, VotadoA: rf.votadoA, Log: rf.log})
+	var datosIns []byte
+	if err == nil && ins != nil {
+		datosIns, err = json.Marshal(ins)
+	}
+	if err == nil {
+		err = rf.persist.Guardar(estado, datosIns)
+	}
+	if err != nil {
+		rf.fallo = fmt.Errorf("no se pudo guardar el estado de Raft: %w", err)
+		rf.detener()
+		return rf.fallo
+	}
+	return nil
+}
+
+// recuperar carga lo persistido; se llama con rf.mu tomado
+func (rf *NodoRaft) recuperar() error {
+	ins, err := rf.persist.LeerInstantanea()
+	if err != nil {
+		return err
+	}
+	if ins != nil {
+		rf.cerrojo.Lock()
+		rf.Importar(ins.Estado)
+		rf.cerrojo.Unlock()
+		rf.commit, rf.aplicado = ins.Indice, ins.Indice
+	}
+	if datos := rf.persist.leerEstado(); datos != nil {
+		var e estadoRaft
+		if err := json.Unmarshal(datos, &e); err != nil {
+			return err
+		}
+		rf.termino, rf.votadoA, rf.log = e.Termino, e.VotadoA, e.Log
+	}
+	if ins != nil && rf.base() < ins.Indice {
+		rf.log = []EntradaRaft{{Indice: ins.Indice, Termino: ins.Termino}}
+	}
+	return nil
+}
+
+func leerSiExiste(ruta string) ([]byte, error) {
+	datos, err := os.ReadFile(ruta)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return datos, err
+}
+
+func escribirAtomico(ruta string, datos []byte) error {
+	tmp := ruta + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(datos); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ruta)
+}
+
+// RED
+
+// RedRaft simula particiones de red entre nodos de un mismo proceso: dos
+// nodos solo se comunican si están en el mismo grupo
+type RedRaft struct {
+	mu    sync.Mutex
+	grupo map[int]int
+}
+
+// NuevaRedRaft crea una red sin particiones
+func NuevaRedRaft() *RedRaft {
+	return &RedRaft{grupo: map[int]int{}}
+}
+
+// Conectados indica si a y b pueden comunicarse
+func (r *RedRaft) Conectados(a, b int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.grupo[a] == r.grupo[b]
+}
+
+// Particionar separa los nodos en los grupos indicados; los nodos que no
+// aparecen quedan juntos en un grupo aparte
+func (r *RedRaft) Particionar(grupos ...[]int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.grupo = map[int]int{}
+	for g, nodos := range grupos {
+		for _, n := range nodos {
+			r.grupo[n] = g + 1
+		}
+	}
+}
+
+// Sanar elimina todas las particiones
+func (r *RedRaft) Sanar() {
+	r.Particionar()
+}
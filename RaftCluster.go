@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// ClusterRaft levanta un clúster Raft completo dentro del proceso, con cada
+// nodo escuchando en localhost y su propio Taller. Permite matar y reiniciar
+// nodos (conservando lo persistido) y particionar la red entre ellos.
+type ClusterRaft struct {
+	Red *RedRaft
+
+	direcciones   []string
+	nodos         []*NodoRaft
+	talleres      []*Taller
+	cerrojos      []*sync.Mutex
+	persistencias []*PersistenciaRaft
+}
+
+// NuevoClusterRaft arranca n nodos en localhost a partir de puertoBase
+func NuevoClusterRaft(n, puertoBase int) (*ClusterRaft, error) {
+	c := &ClusterRaft{Red: NuevaRedRaft()}
+	for i := 0; i < n; i++ {
+		c.direcciones = append(c.direcciones, fmt.Sprintf("localhost:%d", puertoBase+i))
+		p, _ := NuevaPersistenciaRaft("")
+		c.persistencias = append(c.persistencias, p)
+	}
+	c.nodos = make([]*NodoRaft, n)
+	c.talleres = make([]*Taller, n)
+	c.cerrojos = make([]*sync.Mutex, n)
+	for i := 0; i < n; i++ {
+		if err := c.Arrancar(i); err != nil {
+			c.Detener()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Arrancar (re)inicia el nodo i con un taller vacío que se reconstruye a
+// partir de su instantánea y de lo que le envíe el líder
+func (c *ClusterRaft) Arrancar(i int) error {
+	c.talleres[i] = &Taller{}
+	c.cerrojos[i] = &sync.Mutex{}
+	nodo := NuevoNodoRaft(i, c.direcciones, c.persistencias[i], c.talleres[i], c.cerrojos[i])
+	nodo.UmbralInstantanea = 20
+	nodo.red = c.Red
+	c.nodos[i] = nodo
+	return nodo.Iniciar()
+}
+
+// Matar detiene el nodo i como si se hubiera caído
+func (c *ClusterRaft) Matar(i int) {
+	if c.nodos[i] != nil {
+		c.nodos[i].Detener()
+	}
+}
+
+// Reiniciar mata el nodo i y lo vuelve a arrancar
+func (c *ClusterRaft) Reiniciar(i int) error {
+	c.Matar(i)
+	return c.Arrancar(i)
+}
+
+// Particionar separa los nodos en los grupos indicados
+func (c *ClusterRaft) Particionar(grupos ...[]int) { c.Red.Particionar(grupos...) }
+
+// Sanar reconecta todos los nodos
+func (c *ClusterRaft) Sanar() { c.Red.Sanar() }
+
+// Detener para todos los nodos
+func (c *ClusterRaft) Detener() {
+	for i := range c.nodos {
+		c.Matar(i)
+	}
+}
+
+// Lider devuelve el líder de mayor término entre los nodos vivos de entre
+// los indicados (todos si no se indica ninguno), o -1 si no hay
+func (c *ClusterRaft) Lider(entre ...int) int {
+	if len(entre) == 0 {
+		for i := range c.nodos {
+			entre = append(entre, i)
+		}
+	}
+	lider, mejor := -1, -1
+	for _, i := range entre {
+		if c.nodos[i].muertoSeguro() {
+			continue
+		}
+		estado, termino, _ := c.nodos[i].Estado()
+		if estado == RaftLider && termino > mejor {
+			lider, mejor = i, termino
+		}
+	}
+	return lider
+}
+
+// EsperarLider espera hasta que haya líder entre los nodos indicados
+func (c *ClusterRaft) EsperarLider(espera time.Duration, entre ...int) (int, error) {
+	limite := time.Now().Add(espera)
+	for time.Now().Before(limite) {
+		if l := c.Lider(entre...); l != -1 {
+			return l, nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return -1, errors.New("no se eligió líder a tiempo")
+}
+
+// Proponer envía la operación al líder actual, reintentando si cambia
+func (c *ClusterRaft) Proponer(op Operacion, entre ...int) error {
+	var err error
+	for intento := 0; intento < 10; intento++ {
+		l, errLider := c.EsperarLider(3*time.Second, entre...)
+		if errLider != nil {
+			return errLider
+		}
+		if err = c.nodos[l].Proponer(op); err == nil || !errors.Is(err, ErrNoLider) {
+			return err
+		}
+	}
+	return err
+}
+
+// EsperarConvergencia espera a que todos los nodos vivos indicados tengan el
+// mismo estado del taller
+func (c *ClusterRaft) EsperarConvergencia(espera time.Duration, entre ...int) error {
+	if len(entre) == 0 {
+		for i := range c.nodos {
+			if !c.nodos[i].muertoSeguro() {
+				entre = append(entre, i)
+			}
+		}
+	}
+	limite := time.Now().Add(espera)
+	for time.Now().Before(limite) {
+		var ref Instantanea
+		iguales := true
+		for k, i := range entre {
+			c.cerrojos[i].Lock()
+			ins := c.talleres[i].Exportar()
+			c.cerrojos[i].Unlock()
+			if k == 0 {
+				ref = ins
+			} else if !reflect.DeepEqual(ref, ins) {
+				iguales = false
+				break
+			}
+		}
+		if iguales {
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return errors.New("los nodos no convergen")
+}
+
+// Taller devuelve el taller del nodo i
+func (c *ClusterRaft) Taller(i int) *Taller { return c.talleres[i] }
+
+func (rf *NodoRaft) muertoSeguro() bool {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.muerto
+}
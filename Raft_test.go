@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// romperPersistencia hace que las siguientes escrituras de p fallen, como
+// un disco lleno o desmontado
+func romperPersistencia(t *testing.T, p *PersistenciaRaft) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dir = filepath.Join(t.TempDir(), "no-existe")
+}
+
+// TestRaftFalloPersistencia comprueba que un nodo que no puede guardar su
+// estado deja de responder en vez de aceptar entradas que olvidaría al
+// reiniciar: un seguidor se detiene y el resto sigue confirmando con
+// mayoría; un líder rechaza la operación y se detiene
+func TestRaftFalloPersistencia(t *testing.T) {
+	c, err := NuevoClusterRaft(3, 9301)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Detener()
+	if err := c.Proponer(Operacion{Tipo: OpCrearCliente, IDCliente: 1, Nombre: "Ana"}); err != nil {
+		t.Fatal(err)
+	}
+	lider := c.Lider()
+	seguidor := (lider + 1) % 3
+	romperPersistencia(t, c.persistencias[seguidor])
+	if err := c.Proponer(Operacion{Tipo: OpCrearCliente, IDCliente: 2, Nombre: "Luis"}); err != nil {
+		t.Fatal(err)
+	}
+	esperar(t, 5*time.Second, "el seguidor sin disco se detiene", func() bool {
+		return c.nodos[seguidor].muertoSeguro() && c.nodos[seguidor].Fallo() != nil
+	})
+	if err := c.EsperarConvergencia(3*time.Second, lider, (lider+2)%3); err != nil {
+		t.Fatal(err)
+	}
+
+	lider = c.Lider()
+	romperPersistencia(t, c.persistencias[lider])
+	if err := c.nodos[lider].Proponer(Operacion{Tipo: OpCrearCliente, IDCliente: 3, Nombre: "Eva"}); err == nil {
+		t.Fatal("el líder acepta una operación que no ha podido guardar")
+	}
+	if !c.nodos[lider].muertoSeguro() || c.nodos[lider].Fallo() == nil {
+		t.Fatal("el líder sigue activo sin poder guardar su log")
+	}
+}
+
+// tieneCliente dice si el taller del nodo i tiene el cliente con ese ID
+func tieneCliente(c *ClusterRaft, i, id int) bool {
+	c.cerrojos[i].Lock()
+	defer c.cerrojos[i].Unlock()
+	cli, _ := c.talleres[i].BuscarCliente(id)
+	return cli != nil
+}
+
+// TestRaftCaidaYReinicio replica 30 clientes, mata al líder, comprueba que
+// se elige otro que sigue confirmando y que el antiguo líder, al volver a
+// arrancar, se pone al día desde su instantánea y el nuevo líder
+func TestRaftCaidaYReinicio(t *testing.T) {
+	c, err := NuevoClusterRaft(3, 9311)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Detener()
+	if err := c.Proponer(Operacion{Tipo: OpCrearMecanico, IDMecanico: 1, Nombre: "Laura", Especialidad: "mecánica"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 30; i++ {
+		if err := c.Proponer(Operacion{Tipo: OpCrearCliente, IDCliente: i, Nombre: fmt.Sprint("cliente", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.EsperarConvergencia(3 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if !tieneCliente(c, i, 30) {
+			t.Fatalf("el nodo %d no tiene los 30 clientes", i)
+		}
+	}
+
+	viejo := c.Lider()
+	c.Matar(viejo)
+	nuevo, err := c.EsperarLider(3 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nuevo == viejo {
+		t.Fatal("el líder muerto sigue siendo líder")
+	}
+	if err := c.Proponer(Operacion{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "1234ABC"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Reiniciar(viejo); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.EsperarConvergencia(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	c.cerrojos[viejo].Lock()
+	_, v := c.talleres[viejo].BuscarVehiculo("1234ABC")
+	c.cerrojos[viejo].Unlock()
+	if v == nil || !tieneCliente(c, viejo, 30) {
+		t.Fatal("el nodo reiniciado no recupera lo confirmado antes ni durante su caída")
+	}
+}
+
+// TestRaftParticion aísla al líder en minoría: no puede confirmar, la
+// mayoría elige otro y sigue confirmando, y al sanar la partición todos
+// convergen sin la operación de la minoría
+func TestRaftParticion(t *testing.T) {
+	for k, n := range []int{3, 5} {
+		t.Run(fmt.Sprintf("%d nodos", n), func(t *testing.T) {
+			c, err := NuevoClusterRaft(n, 9321+5*k)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Detener()
+			for i := 1; i <= 3; i++ {
+				if err := c.Proponer(Operacion{Tipo: OpCrearCliente, IDCliente: i, Nombre: fmt.Sprint("cliente", i)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := c.EsperarConvergencia(3 * time.Second); err != nil {
+				t.Fatal(err)
+			}
+
+			aislado := c.Lider()
+			var mayoria []int
+			for i := 0; i < n; i++ {
+				if i != aislado {
+					mayoria = append(mayoria, i)
+				}
+			}
+			c.Particionar([]int{aislado}, mayoria)
+			if err := c.nodos[aislado].Proponer(Operacion{Tipo: OpCrearCliente, IDCliente: 99}); err == nil {
+				t.Fatal("un líder en minoría confirmó una operación")
+			}
+			if _, err := c.EsperarLider(3*time.Second, mayoria...); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Proponer(Operacion{Tipo: OpEliminarCliente, IDCliente: 2}, mayoria...); err != nil {
+				t.Fatal(err)
+			}
+
+			c.Sanar()
+			if err := c.EsperarConvergencia(5 * time.Second); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < n; i++ {
+				if tieneCliente(c, i, 99) {
+					t.Errorf("el nodo %d aplicó la operación de la minoría", i)
+				}
+				if tieneCliente(c, i, 2) {
+					t.Errorf("el nodo %d no aplicó la operación de la mayoría", i)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,759 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CRDT
+
+// ORSet es un conjunto "observed-remove": cada alta lleva una etiqueta única
+// y una baja retira solo las etiquetas que ha visto, así que un alta
+// concurrente con una baja gana. Las etiquetas retiradas se conservan para
+// que fusionar no resucite elementos.
+type ORSet struct {
+	Altas map[string]map[string]bool `json:"altas,omitempty"` // elemento -> etiquetas de sus altas
+	Bajas map[string]bool            `json:"bajas,omitempty"` // etiquetas retiradas
+}
+
+// Agregar da de alta el elemento con una etiqueta que no se haya usado nunca
+func (s *ORSet) Agregar(elemento, etiqueta string) {
+	if s.Altas == nil {
+		s.Altas = map[string]map[string]bool{}
+	}
+	if s.Altas[elemento] == nil {
+		s.Altas[elemento] = map[string]bool{}
+	}
+	s.Altas[elemento][etiqueta] = true
+}
+
+// Quitar retira las altas del elemento vistas hasta ahora
+func (s *ORSet) Quitar(elemento string) {
+	for etiqueta := range s.Altas[elemento] {
+		if s.Bajas == nil {
+			s.Bajas = map[string]bool{}
+		}
+		s.Bajas[etiqueta] = true
+	}
+}
+
+// Contiene indica si al elemento le queda alguna alta sin retirar
+func (s *ORSet) Contiene(elemento string) bool {
+	for etiqueta := range s.Altas[elemento] {
+		if !s.Bajas[etiqueta] {
+			return true
+		}
+	}
+	return false
+}
+
+// Elementos devuelve, ordenados, los elementos que contiene el conjunto
+func (s *ORSet) Elementos() []string {
+	var out []string
+	for elemento := range s.Altas {
+		if s.Contiene(elemento) {
+			out = append(out, elemento)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Retirados devuelve, ordenados, los elementos que se dieron de alta alguna
+// vez y ya no están
+func (s *ORSet) Retirados() []string {
+	var out []string
+	for elemento := range s.Altas {
+		if !s.Contiene(elemento) {
+			out = append(out, elemento)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Fusionar une las altas y las bajas de otro conjunto
+func (s *ORSet) Fusionar(o ORSet) {
+	for elemento, etiquetas := range o.Altas {
+		for etiqueta := range etiquetas {
+			s.Agregar(elemento, etiqueta)
+		}
+	}
+	for etiqueta := range o.Bajas {
+		if s.Bajas == nil {
+			s.Bajas = map[string]bool{}
+		}
+		s.Bajas[etiqueta] = true
+	}
+}
+
+// MarcaLWW ordena las escrituras de un registro: gana la de mayor tiempo y,
+// a igual tiempo, la de la réplica de nombre mayor
+type MarcaLWW struct {
+	Tiempo  int64  `json:"t"` // milisegundos de la hora sincronizada
+	Replica string `json:"r"`
+}
+
+// Posterior indica si m gana a o
+func (m MarcaLWW) Posterior(o MarcaLWW) bool {
+	return m.Tiempo > o.Tiempo || m.Tiempo == o.Tiempo && m.Replica > o.Replica
+}
+
+// RegistroLWW es un registro "last-writer-wins": de dos escrituras
+// concurrentes se queda la de marca posterior
+type RegistroLWW struct {
+	Valor string   `json:"v"`
+	Marca MarcaLWW `json:"m"`
+}
+
+// Fusionar se queda con la escritura posterior
+func (r *RegistroLWW) Fusionar(o RegistroLWW) {
+	if o.Marca.Posterior(r.Marca) {
+		*r = o
+	}
+}
+
+// ValorMV es un valor de un RegistroMV con el vector de versiones de la
+// escritura que lo puso
+type ValorMV struct {
+	Valor   string            `json:"v"`
+	Version map[string]uint64 `json:"version"`
+}
+
+// RegistroMV es un registro multivalor: las escrituras concurrentes se
+// conservan todas hasta que una posterior las sustituye, para que nadie
+// pierda un cambio sin saberlo
+type RegistroMV struct {
+	Valores []ValorMV `json:"valores,omitempty"`
+}
+
+// Fijar sustituye todos los valores vistos por uno nuevo de la réplica
+func (r *RegistroMV) Fijar(valor, replica string) {
+	version := map[string]uint64{}
+	for _, v := range r.Valores {
+		for rep, n := range v.Version {
+			if n > version[rep] {
+				version[rep] = n
+			}
+		}
+	}
+	version[replica]++
+	r.Valores = []ValorMV{{Valor: valor, Version: version}}
+}
+
+// Fusionar conserva los valores de ambos registros que ninguna otra
+// escritura ha sustituido
+func (r *RegistroMV) Fusionar(o RegistroMV) {
+	todos := append(append([]ValorMV{}, r.Valores...), o.Valores...)
+	var quedan []ValorMV
+	vistas := map[string]bool{}
+	for i, v := range todos {
+		clave := claveVersion(v.Version)
+		if vistas[clave] {
+			continue // la misma escritura llega por los dos lados
+		}
+		sustituido := false
+		for j, w := range todos {
+			if i != j && dominaVersion(w.Version, v.Version) {
+				sustituido = true
+				break
+			}
+		}
+		if !sustituido {
+			vistas[clave] = true
+			quedan = append(quedan, v)
+		}
+	}
+	sort.Slice(quedan, func(i, j int) bool { return claveVersion(quedan[i].Version) < claveVersion(quedan[j].Version) })
+	r.Valores = quedan
+}
+
+// Lista devuelve los valores distintos del registro, ordenados
+func (r *RegistroMV) Lista() []string {
+	var out []string
+	vistos := map[string]bool{}
+	for _, v := range r.Valores {
+		if !vistos[v.Valor] {
+			vistos[v.Valor] = true
+			out = append(out, v.Valor)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// dominaVersion indica si a ha visto todo lo que b y algo más
+func dominaVersion(a, b map[string]uint64) bool {
+	mayor := false
+	for rep, n := range b {
+		if a[rep] < n {
+			return false
+		}
+	}
+	for rep, n := range a {
+		if n > b[rep] {
+			mayor = true
+		}
+	}
+	return mayor
+}
+
+func claveVersion(v map[string]uint64) string {
+	var partes []string
+	for rep, n := range v {
+		partes = append(partes, fmt.Sprintf("%s=%d", rep, n))
+	}
+	sort.Strings(partes)
+	return strings.Join(partes, ",")
+}
+
+// ESTADO DE LA RECEPCIÓN
+
+// EstadoRecepcion son los clientes, vehículos e incidencias de una
+// recepción como CRDT. Dos réplicas editadas por separado se fusionan en
+// cualquier orden y las veces que haga falta con el mismo resultado.
+type EstadoRecepcion struct {
+	Clientes    ORSet `json:"clientes"`    // IDs de cliente
+	Vehiculos   ORSet `json:"vehiculos"`   // matrículas
+	Incidencias ORSet `json:"incidencias"` // IDs de incidencia
+	// Campos guarda un registro por dato, con claves como "cliente/7/telefono",
+	// "vehiculo/1234ABC/cliente" o "incidencia/9/vehiculo"
+	Campos map[string]RegistroLWW `json:"campos,omitempty"`
+	// Estados guarda el estado de cada incidencia por su ID
+	Estados map[string]RegistroMV `json:"estados,omitempty"`
+}
+
+// Fusionar incorpora los cambios de otro estado
+func (e *EstadoRecepcion) Fusionar(o *EstadoRecepcion) {
+	e.Clientes.Fusionar(o.Clientes)
+	e.Vehiculos.Fusionar(o.Vehiculos)
+	e.Incidencias.Fusionar(o.Incidencias)
+	for clave, r := range o.Campos {
+		if e.Campos == nil {
+			e.Campos = map[string]RegistroLWW{}
+		}
+		actual, ok := e.Campos[clave]
+		if !ok {
+			e.Campos[clave] = r
+			continue
+		}
+		actual.Fusionar(r)
+		e.Campos[clave] = actual
+	}
+	for clave, r := range o.Estados {
+		if e.Estados == nil {
+			e.Estados = map[string]RegistroMV{}
+		}
+		actual := e.Estados[clave]
+		actual.Fusionar(r)
+		e.Estados[clave] = actual
+	}
+}
+
+// Copia devuelve una copia independiente del estado
+func (e *EstadoRecepcion) Copia() *EstadoRecepcion {
+	datos, _ := json.Marshal(e)
+	var c EstadoRecepcion
+	json.Unmarshal(datos, &c)
+	return &c
+}
+
+func (e *EstadoRecepcion) campo(entidad, id, nombre string) string {
+	return e.Campos[entidad+"/"+id+"/"+nombre].Valor
+}
+
+// ordenEstados decide qué estado se muestra cuando hay varios concurrentes:
+// el más avanzado
+var ordenEstados = map[string]int{"abierta": 1, "en proceso": 2, "cerrada": 3}
+
+// VistaRecepcion es el estado de la recepción tal como lo vería el taller,
+// con los conflictos que se han resuelto por el camino
+type VistaRecepcion struct {
+	Clientes   []ClienteDatos
+	Conflictos []string
+}
+
+// Vista materializa el estado. Un vehículo cuyo cliente se ha dado de baja
+// no se muestra; si un vehículo acaba con varias incidencias (se abrieron
+// a la vez en dos recepciones) se queda la de menor ID; si una incidencia
+// tiene estados concurrentes se muestra el más avanzado.
+func (e *EstadoRecepcion) Vista() VistaRecepcion {
+	var vista VistaRecepcion
+	incidencias := map[string][]string{} // matrícula -> IDs de incidencia
+	for _, id := range e.Incidencias.Elementos() {
+		mat := e.campo("incidencia", id, "vehiculo")
+		incidencias[mat] = append(incidencias[mat], id)
+	}
+	vehiculos := map[string][]string{} // ID de cliente -> matrículas
+	for _, mat := range e.Vehiculos.Elementos() {
+		cliente := e.campo("vehiculo", mat, "cliente")
+		if !e.Clientes.Contiene(cliente) {
+			vista.Conflictos = append(vista.Conflictos,
+				fmt.Sprintf("el vehículo %s no se muestra: su cliente %s se dio de baja", mat, cliente))
+			continue
+		}
+		vehiculos[cliente] = append(vehiculos[cliente], mat)
+	}
+	ids := e.Clientes.Elementos()
+	sort.Slice(ids, func(i, j int) bool { return atoi(ids[i]) < atoi(ids[j]) })
+	for _, id := range ids {
+		cd := ClienteDatos{IDCliente: atoi(id), Nombre: e.campo("cliente", id, "nombre"),
+			Telefono: e.campo("cliente", id, "telefono"), Email: e.campo("cliente", id, "email")}
+		for _, mat := range vehiculos[id] {
+			vd := VehiculoDatos{Matricula: mat, Marca: e.campo("vehiculo", mat, "marca"),
+				Modelo: e.campo("vehiculo", mat, "modelo")}
+			if lista := incidencias[mat]; len(lista) > 0 {
+				sort.Slice(lista, func(i, j int) bool { return atoi(lista[i]) < atoi(lista[j]) })
+				if len(lista) > 1 {
+					vista.Conflictos = append(vista.Conflictos, fmt.Sprintf("el vehículo %s tiene %d incidencias abiertas a la vez (%s); se toma la %s",
+						mat, len(lista), strings.Join(lista, ", "), lista[0]))
+				}
+				inc := lista[0]
+				estados := e.Estados[inc]
+				valores := estados.Lista()
+				sort.SliceStable(valores, func(i, j int) bool { return ordenEstados[valores[i]] > ordenEstados[valores[j]] })
+				estado := "abierta"
+				if len(valores) > 0 {
+					estado = valores[0]
+				}
+				if len(valores) > 1 {
+					vista.Conflictos = append(vista.Conflictos, fmt.Sprintf("la incidencia %s tiene estados concurrentes (%s); se toma %q",
+						inc, strings.Join(valores, ", "), estado))
+				}
+				vd.Incidencia = &IncidenciaDatos{IDIncidencia: atoi(inc), Tipo: e.campo("incidencia", inc, "tipo"),
+					Prioridad: e.campo("incidencia", inc, "prioridad"), Descripcion: e.campo("incidencia", inc, "descripcion"),
+					Estado: estado}
+			}
+			cd.Vehiculos = append(cd.Vehiculos, vd)
+		}
+		vista.Clientes = append(vista.Clientes, cd)
+	}
+	return vista
+}
+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+// RECEPCIÓN
+
+// Recepcion es la réplica de una recepción que registra clientes, vehículos
+// e incidencias aunque no tenga conexión con el taller. Cada cambio se
+// guarda en disco; al recuperar la conexión se sincroniza con otras
+// recepciones y se vuelca al taller.
+type Recepcion struct {
+	// Reloj del que se toman las marcas de las escrituras (nil = hora del sistema)
+	Reloj *RelojFisico
+	// Relojes lógicos con los que se marcan los mensajes (nil = sin marcas)
+	Relojes *Relojes
+
+	mu       sync.Mutex
+	replica  string
+	contador uint64 // altas hechas por esta réplica, para sus etiquetas
+	ultimo   int64  // mayor marca de tiempo vista
+	estado   *EstadoRecepcion
+	ruta     string // fichero en el que se guarda ("" = solo en memoria)
+	oyente   net.Listener
+}
+
+// datosRecepcion es lo que la recepción guarda en disco
+type datosRecepcion struct {
+	Replica  string           `json:"replica"`
+	Contador uint64           `json:"contador"`
+	Ultimo   int64            `json:"ultimo"`
+	Estado   *EstadoRecepcion `json:"estado"`
+}
+
+// NuevaRecepcion abre la réplica indicada y recupera de ruta (si existe) lo
+// que tenía guardado
+func NuevaRecepcion(replica, ruta string) (*Recepcion, error) {
+	r := &Recepcion{replica: replica, estado: &EstadoRecepcion{}, ruta: ruta}
+	if ruta == "" {
+		return r, nil
+	}
+	datos, err := os.ReadFile(ruta)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var d datosRecepcion
+	if err := json.Unmarshal(datos, &d); err != nil {
+		return nil, fmt.Errorf("%s: %v", ruta, err)
+	}
+	if d.Replica != replica {
+		return nil, fmt.Errorf("%s es de la recepción %q, no de %q", ruta, d.Replica, replica)
+	}
+	r.contador, r.ultimo = d.Contador, d.Ultimo
+	if d.Estado != nil {
+		r.estado = d.Estado
+	}
+	return r, nil
+}
+
+// AltaCliente registra un cliente
+func (r *Recepcion) AltaCliente(id int, nombre, telefono, email string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	clave := strconv.Itoa(id)
+	r.estado.Clientes.Agregar(clave, r.etiqueta())
+	r.fijar("cliente/"+clave+"/nombre", nombre)
+	r.fijar("cliente/"+clave+"/telefono", telefono)
+	r.fijar("cliente/"+clave+"/email", email)
+	return r.guardar()
+}
+
+// CambiarCliente cambia el nombre, el teléfono o el email de un cliente
+func (r *Recepcion) CambiarCliente(id int, campo, valor string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	clave := strconv.Itoa(id)
+	if !r.estado.Clientes.Contiene(clave) {
+		return errors.New("cliente no encontrado")
+	}
+	switch campo {
+	case "nombre", "telefono", "email":
+	default:
+		return fmt.Errorf("campo desconocido: %q", campo)
+	}
+	r.fijar("cliente/"+clave+"/"+campo, valor)
+	return r.guardar()
+}
+
+// BajaCliente da de baja un cliente; sus vehículos dejan de verse
+func (r *Recepcion) BajaCliente(id int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	clave := strconv.Itoa(id)
+	if !r.estado.Clientes.Contiene(clave) {
+		return errors.New("cliente no encontrado")
+	}
+	r.estado.Clientes.Quitar(clave)
+	return r.guardar()
+}
+
+// AltaVehiculo registra un vehículo de un cliente. Si otra recepción
+// registra la misma matrícula, las dos altas son el mismo vehículo.
+func (r *Recepcion) AltaVehiculo(idCliente int, matricula, marca, modelo string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cliente := strconv.Itoa(idCliente)
+	if !r.estado.Clientes.Contiene(cliente) {
+		return errors.New("cliente no encontrado")
+	}
+	if matricula == "" {
+		return errors.New("falta la matrícula")
+	}
+	r.estado.Vehiculos.Agregar(matricula, r.etiqueta())
+	r.fijar("vehiculo/"+matricula+"/cliente", cliente)
+	r.fijar("vehiculo/"+matricula+"/marca", marca)
+	r.fijar("vehiculo/"+matricula+"/modelo", modelo)
+	return r.guardar()
+}
+
+// BajaVehiculo da de baja un vehículo
+func (r *Recepcion) BajaVehiculo(matricula string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.estado.Vehiculos.Contiene(matricula) {
+		return errors.New("vehículo no encontrado")
+	}
+	r.estado.Vehiculos.Quitar(matricula)
+	return r.guardar()
+}
+
+// AltaIncidencia abre una incidencia de un vehículo
+func (r *Recepcion) AltaIncidencia(id int, matricula, tipo, prioridad, descripcion string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.estado.Vehiculos.Contiene(matricula) {
+		return errors.New("vehículo no encontrado")
+	}
+	clave := strconv.Itoa(id)
+	r.estado.Incidencias.Agregar(clave, r.etiqueta())
+	r.fijar("incidencia/"+clave+"/vehiculo", matricula)
+	r.fijar("incidencia/"+clave+"/tipo", tipo)
+	r.fijar("incidencia/"+clave+"/prioridad", prioridad)
+	r.fijar("incidencia/"+clave+"/descripcion", descripcion)
+	r.fijarEstado(clave, "abierta")
+	return r.guardar()
+}
+
+// CambiarEstado cambia el estado de una incidencia
+func (r *Recepcion) CambiarEstado(id int, estado string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	clave := strconv.Itoa(id)
+	if !r.estado.Incidencias.Contiene(clave) {
+		return errors.New("incidencia no encontrada")
+	}
+	r.fijarEstado(clave, estado)
+	return r.guardar()
+}
+
+// Vista devuelve el estado materializado de la recepción
+func (r *Recepcion) Vista() VistaRecepcion {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.estado.Vista()
+}
+
+// EstadoCRDT devuelve una copia del estado de la réplica
+func (r *Recepcion) EstadoCRDT() *EstadoRecepcion {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.estado.Copia()
+}
+
+// Fusionar incorpora el estado de otra recepción
+func (r *Recepcion) Fusionar(o *EstadoRecepcion) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.estado.Fusionar(o.Copia())
+	// Las escrituras siguientes deben ganar a todas las que ya se han visto
+	for _, campo := range r.estado.Campos {
+		if campo.Marca.Tiempo > r.ultimo {
+			r.ultimo = campo.Marca.Tiempo
+		}
+	}
+	return r.guardar()
+}
+
+// Estado resume la recepción para mostrarla por consola
+func (r *Recepcion) Estado() string {
+	vista := r.Vista()
+	vehiculos, incidencias := 0, 0
+	for _, c := range vista.Clientes {
+		vehiculos += len(c.Vehiculos)
+		for _, v := range c.Vehiculos {
+			if v.Incidencia != nil {
+				incidencias++
+			}
+		}
+	}
+	return fmt.Sprintf("Recepción %s | Clientes:%d | Vehículos:%d | Incidencias:%d | Conflictos:%d",
+		r.replica, len(vista.Clientes), vehiculos, incidencias, len(vista.Conflictos))
+}
+
+// etiqueta da una etiqueta nueva para un alta; se llama con r.mu tomado
+func (r *Recepcion) etiqueta() string {
+	r.contador++
+	return fmt.Sprintf("%s:%d", r.replica, r.contador)
+}
+
+// fijar escribe un campo con una marca posterior a todas las vistas, aunque
+// el reloj haya retrocedido; se llama con r.mu tomado
+func (r *Recepcion) fijar(clave, valor string) {
+	t := r.Reloj.Ahora().UnixMilli()
+	if t <= r.ultimo {
+		t = r.ultimo + 1
+	}
+	r.ultimo = t
+	if r.estado.Campos == nil {
+		r.estado.Campos = map[string]RegistroLWW{}
+	}
+	r.estado.Campos[clave] = RegistroLWW{Valor: valor, Marca: MarcaLWW{Tiempo: t, Replica: r.replica}}
+}
+
+// fijarEstado escribe el estado de una incidencia; se llama con r.mu tomado
+func (r *Recepcion) fijarEstado(id, estado string) {
+	if r.estado.Estados == nil {
+		r.estado.Estados = map[string]RegistroMV{}
+	}
+	reg := r.estado.Estados[id]
+	reg.Fijar(estado, r.replica)
+	r.estado.Estados[id] = reg
+}
+
+// guardar deja el estado en disco; se llama con r.mu tomado
+func (r *Recepcion) guardar() error {
+	if r.ruta == "" {
+		return nil
+	}
+	datos, err := json.Marshal(datosRecepcion{Replica: r.replica, Contador: r.contador, Ultimo: r.ultimo, Estado: r.estado})
+	if err != nil {
+		return err
+	}
+	return escribirAtomico(r.ruta, datos)
+}
+
+// SINCRONIZACIÓN
+
+// MensajeRecepcion lleva el estado completo de una recepción a otra
+type MensajeRecepcion struct {
+	Estado *EstadoRecepcion `json:"estado,omitempty"`
+	Error  string           `json:"error,omitempty"`
+	Sello
+}
+
+// Escuchar atiende a las recepciones que se sincronizan con esta
+func (r *Recepcion) Escuchar(direccion string) error {
+	oyente, err := net.Listen("tcp", direccion)
+	if err != nil {
+		return err
+	}
+	r.oyente = oyente
+	go func() {
+		for {
+			conn, err := oyente.Accept()
+			if err != nil {
+				return
+			}
+			go r.atender(conn)
+		}
+	}()
+	return nil
+}
+
+// Detener deja de atender a otras recepciones
+func (r *Recepcion) Detener() {
+	if r.oyente != nil {
+		r.oyente.Close()
+	}
+}
+
+func (r *Recepcion) atender(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	var pet MensajeRecepcion
+	if err := json.NewDecoder(conn).Decode(&pet); err != nil {
+		return
+	}
+	pet.Recibido(r.Relojes)
+	var resp MensajeRecepcion
+	if pet.Estado == nil {
+		resp.Error = "falta el estado"
+	} else if err := r.Fusionar(pet.Estado); err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp.Estado = r.EstadoCRDT()
+	}
+	resp.Sellar(r.Relojes)
+	json.NewEncoder(conn).Encode(resp)
+}
+
+// Sincronizar intercambia el estado con la recepción de la dirección
+// indicada; al terminar las dos tienen lo mismo
+func (r *Recepcion) Sincronizar(direccion string) error {
+	pet := MensajeRecepcion{Estado: r.EstadoCRDT()}
+	pet.Sellar(r.Relojes)
+	conn, err := net.DialTimeout("tcp", direccion, 2*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := json.NewEncoder(conn).Encode(pet); err != nil {
+		return err
+	}
+	var resp MensajeRecepcion
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return err
+	}
+	resp.Recibido(r.Relojes)
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	return r.Fusionar(resp.Estado)
+}
+
+// Volcar lleva al taller lo que ha registrado la recepción: crea o
+// actualiza los clientes, vehículos e incidencias que ve y elimina los que
+// se dieron de baja. Devuelve cuántas operaciones ha ejecutado.
+func (r *Recepcion) Volcar(t *Taller, cerrojo *sync.Mutex, ejecutar func(Operacion) error) (int, error) {
+	vista := r.Vista()
+	retirados := r.EstadoCRDT()
+
+	var altas, bajas []Operacion
+	cerrojo.Lock()
+	for _, cd := range vista.Clientes {
+		c, _ := t.BuscarCliente(cd.IDCliente)
+		switch {
+		case c == nil:
+			altas = append(altas, Operacion{Tipo: OpCrearCliente, IDCliente: cd.IDCliente,
+				Nombre: cd.Nombre, Telefono: cd.Telefono, Email: cd.Email})
+		case c.Nombre != cd.Nombre || c.Telefono != cd.Telefono || c.Email != cd.Email:
+			altas = append(altas, Operacion{Tipo: OpModificarCliente, IDCliente: cd.IDCliente,
+				Nombre: cd.Nombre, Telefono: cd.Telefono, Email: cd.Email})
+		}
+		for _, vd := range cd.Vehiculos {
+			_, v := t.BuscarVehiculo(vd.Matricula)
+			switch {
+			case v == nil:
+				altas = append(altas, Operacion{Tipo: OpCrearVehiculo, IDCliente: cd.IDCliente,
+					Matricula: vd.Matricula, Marca: vd.Marca, Modelo: vd.Modelo})
+			case v.Marca != vd.Marca || v.Modelo != vd.Modelo:
+				altas = append(altas, Operacion{Tipo: OpModificarVehiculo, Matricula: vd.Matricula, Marca: vd.Marca,
+					Modelo: vd.Modelo, FechaEntrada: v.FechaEntrada, FechaSalida: v.FechaSalida})
+			}
+			id := vd.Incidencia
+			if id == nil {
+				continue
+			}
+			var inc *Incidencia
+			if v != nil {
+				inc = v.GetIncidencia()
+			}
+			if inc == nil {
+				altas = append(altas, Operacion{Tipo: OpCrearIncidencia, Matricula: vd.Matricula, IDIncidencia: id.IDIncidencia,
+					TipoIncidencia: id.Tipo, Prioridad: id.Prioridad, Descripcion: id.Descripcion})
+				if id.Estado != "abierta" {
+					altas = append(altas, Operacion{Tipo: OpEstadoIncidencia, Matricula: vd.Matricula, Estado: id.Estado})
+				}
+				continue
+			}
+			if inc.IDIncidencia != id.IDIncidencia {
+				continue // el taller ya trabaja en otra incidencia de ese vehículo
+			}
+			if inc.Tipo != id.Tipo || inc.Prioridad != id.Prioridad || inc.Descripcion != id.Descripcion {
+				altas = append(altas, Operacion{Tipo: OpModificarIncidencia, Matricula: vd.Matricula,
+					TipoIncidencia: id.Tipo, Prioridad: id.Prioridad, Descripcion: id.Descripcion})
+			}
+			if inc.Estado != id.Estado {
+				altas = append(altas, Operacion{Tipo: OpEstadoIncidencia, Matricula: vd.Matricula, Estado: id.Estado})
+			}
+		}
+	}
+	for _, mat := range retirados.Vehiculos.Retirados() {
+		if _, v := t.BuscarVehiculo(mat); v != nil {
+			bajas = append(bajas, Operacion{Tipo: OpEliminarVehiculo, Matricula: mat})
+		}
+	}
+	for _, id := range retirados.Clientes.Retirados() {
+		if c, _ := t.BuscarCliente(atoi(id)); c != nil {
+			bajas = append(bajas, Operacion{Tipo: OpEliminarCliente, IDCliente: c.IDCliente})
+		}
+	}
+	cerrojo.Unlock()
+
+	hechas := 0
+	var fallos []string
+	for _, op := range append(altas, bajas...) {
+		if err := ejecutar(op); err != nil {
+			fallos = append(fallos, fmt.Sprintf("%s %s%s: %v", op.Tipo, op.Matricula, idTexto(op.IDCliente), err))
+			continue
+		}
+		hechas++
+	}
+	if len(fallos) > 0 {
+		return hechas, fmt.Errorf("%d operaciones fallaron: %s", len(fallos), strings.Join(fallos, "; "))
+	}
+	return hechas, nil
+}
+
+func idTexto(id int) string {
+	if id == 0 {
+		return ""
+	}
+	return strconv.Itoa(id)
+}
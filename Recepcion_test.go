@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// canonico serializa un CRDT para compararlo: los mapas salen ordenados
+func canonico(x interface{}) string {
+	datos, _ := json.Marshal(x)
+	return string(datos)
+}
+
+// tipoCRDT describe un tipo para las pruebas de propiedades: cómo crear una
+// réplica vacía, hacer en ella un cambio al azar y fusionar otra en ella.
+// Las réplicas son punteros, así que se copian pasando por JSON.
+type tipoCRDT struct {
+	nombre   string
+	nuevo    func() interface{}
+	cambiar  func(azar *rand.Rand, x interface{}, replica int)
+	fusionar func(a, b interface{}) // incorpora b en a
+}
+
+func (tc tipoCRDT) copia(x interface{}) interface{} {
+	c := tc.nuevo()
+	datos, _ := json.Marshal(x)
+	json.Unmarshal(datos, c)
+	return c
+}
+
+// fusion devuelve la fusión de a y b sin tocar ninguno de los dos
+func (tc tipoCRDT) fusion(a, b interface{}) interface{} {
+	c := tc.copia(a)
+	tc.fusionar(c, tc.copia(b))
+	return c
+}
+
+// tiposCRDT son los CRDT de la recepción. Los cambios se hacen sobre pocos
+// elementos para que las réplicas choquen a menudo.
+func tiposCRDT() []tipoCRDT {
+	elementos := []string{"1", "2", "3"}
+	estados := []string{"abierta", "en proceso", "cerrada"}
+	etiquetas := 0
+	tiempos := map[int]int64{} // última marca de cada réplica del LWW
+	return []tipoCRDT{
+		{
+			nombre: "OR-set",
+			nuevo:  func() interface{} { return &ORSet{} },
+			cambiar: func(azar *rand.Rand, x interface{}, replica int) {
+				s, e := x.(*ORSet), elementos[azar.Intn(len(elementos))]
+				if azar.Intn(3) == 0 {
+					s.Quitar(e)
+					return
+				}
+				etiquetas++
+				s.Agregar(e, fmt.Sprintf("r%d:%d", replica, etiquetas))
+			},
+			fusionar: func(a, b interface{}) { a.(*ORSet).Fusionar(*b.(*ORSet)) },
+		},
+		{
+			nombre: "registro LWW",
+			nuevo:  func() interface{} { return &RegistroLWW{} },
+			cambiar: func(azar *rand.Rand, x interface{}, replica int) {
+				// Como Recepcion.fijar, una réplica nunca repite marca; entre
+				// réplicas los tiempos se cruzan y hay empates
+				r := x.(*RegistroLWW)
+				t := max(tiempos[replica], r.Marca.Tiempo) + 1 + int64(azar.Intn(3))
+				tiempos[replica] = t
+				r.Valor, r.Marca = fmt.Sprintf("v%d", azar.Intn(5)), MarcaLWW{Tiempo: t, Replica: fmt.Sprintf("r%d", replica)}
+			},
+			fusionar: func(a, b interface{}) { a.(*RegistroLWW).Fusionar(*b.(*RegistroLWW)) },
+		},
+		{
+			nombre: "registro multivalor",
+			nuevo:  func() interface{} { return &RegistroMV{} },
+			cambiar: func(azar *rand.Rand, x interface{}, replica int) {
+				x.(*RegistroMV).Fijar(estados[azar.Intn(len(estados))], fmt.Sprintf("r%d", replica))
+			},
+			fusionar: func(a, b interface{}) { a.(*RegistroMV).Fusionar(*b.(*RegistroMV)) },
+		},
+		{
+			nombre: "estado de la recepción",
+			nuevo:  func() interface{} { return &EstadoRecepcion{} },
+			cambiar: func(azar *rand.Rand, x interface{}, replica int) {
+				e, id, rep := x.(*EstadoRecepcion), elementos[azar.Intn(len(elementos))], fmt.Sprintf("r%d", replica)
+				switch azar.Intn(4) {
+				case 0:
+					etiquetas++
+					e.Clientes.Agregar(id, fmt.Sprintf("%s:%d", rep, etiquetas))
+				case 1:
+					e.Clientes.Quitar(id)
+				case 2:
+					if e.Campos == nil {
+						e.Campos = map[string]RegistroLWW{}
+					}
+					r := e.Campos["cliente/"+id+"/telefono"]
+					t := max(tiempos[replica], r.Marca.Tiempo) + 1 + int64(azar.Intn(3))
+					tiempos[replica] = t
+					e.Campos["cliente/"+id+"/telefono"] = RegistroLWW{Valor: fmt.Sprintf("6%08d", azar.Intn(1e8)), Marca: MarcaLWW{Tiempo: t, Replica: rep}}
+				default:
+					if e.Estados == nil {
+						e.Estados = map[string]RegistroMV{}
+					}
+					r := e.Estados[id]
+					r.Fijar(estados[azar.Intn(len(estados))], rep)
+					e.Estados[id] = r
+				}
+			},
+			fusionar: func(a, b interface{}) { a.(*EstadoRecepcion).Fusionar(b.(*EstadoRecepcion)) },
+		},
+	}
+}
+
+// TestPropiedadesCRDT hace cambios al azar en tres réplicas de cada CRDT,
+// fusionándolas entre sí de vez en cuando, y comprueba sobre los estados
+// por los que pasan que la fusión es conmutativa, asociativa e idempotente,
+// y que todas las réplicas convergen sea cual sea el orden en que reciben
+// a las demás. Las semillas son fijas para poder repetir un fallo.
+func TestPropiedadesCRDT(t *testing.T) {
+	for _, tc := range tiposCRDT() {
+		t.Run(tc.nombre, func(t *testing.T) {
+			for semilla := int64(1); semilla <= 10; semilla++ {
+				azar := rand.New(rand.NewSource(semilla))
+				replicas := []interface{}{tc.nuevo(), tc.nuevo(), tc.nuevo()}
+				var muestras []interface{}
+				for paso := 0; paso < 150; paso++ {
+					i := azar.Intn(len(replicas))
+					if azar.Intn(4) == 0 {
+						tc.fusionar(replicas[i], tc.copia(replicas[azar.Intn(len(replicas))]))
+					} else {
+						tc.cambiar(azar, replicas[i], i)
+					}
+					if paso%5 == 0 {
+						muestras = append(muestras, tc.copia(replicas[i]))
+					}
+				}
+
+				for k := 0; k < 100; k++ {
+					a := muestras[azar.Intn(len(muestras))]
+					b := muestras[azar.Intn(len(muestras))]
+					c := muestras[azar.Intn(len(muestras))]
+					ab := canonico(tc.fusion(a, b))
+					if ab != canonico(tc.fusion(b, a)) {
+						t.Fatalf("semilla %d: la fusión no es conmutativa:\n%s\n%s", semilla, canonico(a), canonico(b))
+					}
+					if canonico(tc.fusion(tc.fusion(a, b), c)) != canonico(tc.fusion(a, tc.fusion(b, c))) {
+						t.Fatalf("semilla %d: la fusión no es asociativa", semilla)
+					}
+					if canonico(tc.fusion(a, a)) != canonico(a) || canonico(tc.fusion(tc.fusion(a, b), b)) != ab {
+						t.Fatalf("semilla %d: la fusión no es idempotente", semilla)
+					}
+				}
+
+				// Cada réplica recibe a las demás en un orden al azar, cada
+				// una quizá varias veces
+				var final string
+				for i := range replicas {
+					e := tc.copia(replicas[i])
+					for ronda := 0; ronda < 1+azar.Intn(2); ronda++ {
+						for _, j := range azar.Perm(len(replicas)) {
+							tc.fusionar(e, tc.copia(replicas[j]))
+						}
+					}
+					if i == 0 {
+						final = canonico(e)
+					} else if canonico(e) != final {
+						t.Fatalf("semilla %d: las réplicas no convergen al fusionarse en distinto orden", semilla)
+					}
+				}
+			}
+		})
+	}
+}
+
+// recepcionesEnConflicto registra un cliente en el norte, lo copia al sur
+// y, sin conexión, las dos cambian el teléfono y el estado de la
+// incidencia, el norte da de baja el vehículo y el sur lo vuelve a
+// registrar, y cada una da de alta un cliente. Al final se sincronizan.
+func recepcionesEnConflicto(t *testing.T) (norte, sur *Recepcion) {
+	t.Helper()
+	norte, _ = NuevaRecepcion("norte", "")
+	sur, _ = NuevaRecepcion("sur", "")
+	norte.AltaCliente(1, "Ana", "600000001", "ana@correo.es")
+	norte.AltaVehiculo(1, "1234ABC", "Seat", "Ibiza")
+	norte.AltaIncidencia(10, "1234ABC", "mecánica", "alta", "frenos")
+	sur.Fusionar(norte.EstadoCRDT())
+	norte.CambiarCliente(1, "telefono", "600000002")
+	time.Sleep(2 * time.Millisecond)
+	sur.CambiarCliente(1, "telefono", "600000003")
+	norte.CambiarEstado(10, "en proceso")
+	sur.CambiarEstado(10, "cerrada")
+	norte.BajaVehiculo("1234ABC")
+	sur.AltaVehiculo(1, "1234ABC", "Seat", "León")
+	norte.AltaCliente(2, "Luis", "600000004", "")
+	sur.AltaCliente(3, "Eva", "600000005", "")
+	if err := norte.Fusionar(sur.EstadoCRDT()); err != nil {
+		t.Fatal(err)
+	}
+	if err := sur.Fusionar(norte.EstadoCRDT()); err != nil {
+		t.Fatal(err)
+	}
+	return norte, sur
+}
+
+// TestRecepcionConflictos recorre los conflictos típicos de dos recepciones
+// sin conexión: gana el último teléfono, el alta concurrente con una baja,
+// y los estados concurrentes se conservan hasta que otro los resuelve
+func TestRecepcionConflictos(t *testing.T) {
+	norte, sur := recepcionesEnConflicto(t)
+	vn, vs := norte.Vista(), sur.Vista()
+	if canonico(vn) != canonico(vs) {
+		t.Fatal("las dos recepciones no ven lo mismo tras sincronizarse")
+	}
+	if len(vn.Clientes) != 3 {
+		t.Fatalf("se esperaban 3 clientes y hay %d", len(vn.Clientes))
+	}
+	ana := vn.Clientes[0]
+	if ana.Telefono != "600000003" {
+		t.Errorf("el teléfono debería ser el último escrito, 600000003, y es %s", ana.Telefono)
+	}
+	if len(ana.Vehiculos) != 1 || ana.Vehiculos[0].Modelo != "León" {
+		t.Fatal("el vehículo dado de baja y registrado a la vez debería seguir, con el modelo nuevo")
+	}
+	estados := norte.EstadoCRDT().Estados["10"]
+	if lista := estados.Lista(); len(lista) != 2 || ana.Vehiculos[0].Incidencia.Estado != "cerrada" || len(vn.Conflictos) != 1 {
+		t.Errorf("se esperaban los dos estados concurrentes y ver \"cerrada\"; hay %v y %v", lista, vn.Conflictos)
+	}
+	norte.CambiarEstado(10, "en proceso")
+	sur.Fusionar(norte.EstadoCRDT())
+	if v := sur.Vista(); len(v.Conflictos) != 0 || v.Clientes[0].Vehiculos[0].Incidencia.Estado != "en proceso" {
+		t.Error("un estado escrito después de ver el conflicto debería resolverlo")
+	}
+}
+
+// TestRecepcionVolcado reinicia una recepción, la sincroniza por red con
+// otra y la vuelca a un taller, dos veces
+func TestRecepcionVolcado(t *testing.T) {
+	norte, _ := recepcionesEnConflicto(t)
+	// El taller no cierra una incidencia que no se ha empezado
+	norte.CambiarEstado(10, "en proceso")
+	ruta := filepath.Join(t.TempDir(), "este.json")
+	este, err := NuevaRecepcion("este", ruta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	este.AltaCliente(4, "Marta", "600000006", "")
+	este.AltaVehiculo(4, "5678DEF", "Renault", "Clio")
+	este, err = NuevaRecepcion("este", ruta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(este.Vista().Clientes) != 1 {
+		t.Fatal("la recepción no recupera lo guardado al reiniciarse")
+	}
+	direccion := "localhost:9661"
+	if err := este.Escuchar(direccion); err != nil {
+		t.Fatal(err)
+	}
+	defer este.Detener()
+	if err := norte.Sincronizar(direccion); err != nil {
+		t.Fatal(err)
+	}
+	if canonico(norte.Vista()) != canonico(este.Vista()) || len(este.Vista().Clientes) != 4 {
+		t.Fatal("las recepciones no ven lo mismo tras sincronizarse por red")
+	}
+
+	var tl Taller
+	var cerrojo sync.Mutex
+	aplicar := func(op Operacion) error {
+		cerrojo.Lock()
+		defer cerrojo.Unlock()
+		return tl.Aplicar(op)
+	}
+	// El taller ya tenía el vehículo 1234ABC con el presupuesto aceptado,
+	// sin el cual la recepción no puede poner la incidencia en proceso
+	for _, op := range []Operacion{
+		{Tipo: OpCrearCliente, IDCliente: 1, Nombre: "Ana"},
+		{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "1234ABC"},
+		{Tipo: OpCrearIncidencia, Matricula: "1234ABC", IDIncidencia: 10, TipoIncidencia: "mecánica"},
+		{Tipo: OpPresupuestar, Matricula: "1234ABC", Presupuesto: presupuestoDePrueba()},
+		{Tipo: OpResponderPresupuesto, Matricula: "1234ABC", Estado: PresupuestoAceptado},
+		{Tipo: OpCrearCliente, IDCliente: 3, Nombre: "Eva", Telefono: "000"},
+		{Tipo: OpCrearCliente, IDCliente: 4, Nombre: "Marta"},
+		{Tipo: OpCrearVehiculo, IDCliente: 4, Matricula: "9999ZZZ"},
+	} {
+		if err := aplicar(op); err != nil {
+			t.Fatalf("%s: %v", op.Tipo, err)
+		}
+	}
+	este.BajaVehiculo("5678DEF")
+	este.AltaVehiculo(4, "9999ZZZ", "Ford", "Focus")
+	este.BajaVehiculo("9999ZZZ")
+	if _, err := este.Volcar(&tl, &cerrojo, aplicar); err != nil {
+		t.Fatal(err)
+	}
+	if err := tl.ComprobarConsistencia(); err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := tl.BuscarCliente(3); c == nil || c.Telefono != "600000005" {
+		t.Error("el volcado no actualiza el teléfono del cliente 3")
+	}
+	if _, v := tl.BuscarVehiculo("1234ABC"); v == nil || v.GetIncidencia() == nil || v.GetIncidencia().Estado != "en proceso" {
+		t.Error("el volcado no deja el vehículo 1234ABC con su incidencia en proceso")
+	}
+	if _, v := tl.BuscarVehiculo("9999ZZZ"); v != nil {
+		t.Error("el volcado no elimina el vehículo dado de baja")
+	}
+	if len(tl.ClientesTaller) != 4 {
+		t.Errorf("el taller debería tener 4 clientes y tiene %d", len(tl.ClientesTaller))
+	}
+	if hechas, err := este.Volcar(&tl, &cerrojo, aplicar); err != nil || hechas != 0 {
+		t.Errorf("volcar dos veces debería no hacer nada y hace %d operaciones (%v)", hechas, err)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Ficheros del registro dentro del directorio de datos
+const (
+	ficheroWAL        = "taller.wal"
+	ficheroCheckpoint = "taller.ckpt"
+)
+
+// IntervaloCheckpoint es el número de operaciones entre dos checkpoints
+const IntervaloCheckpoint = 50
+
+// maxEntradaWAL acota el tamaño de una entrada para no confiar en una
+// longitud corrupta
+const maxEntradaWAL = 1 << 20
+
+// RegistroWAL es un registro de escritura anticipada delante del Taller: cada
+// operación se escribe y se sincroniza en disco antes de aplicarse, y cada
+// IntervaloCheckpoint operaciones se guarda una instantánea completa.
+//
+// Cada entrada del fichero tiene la forma [longitud uint32][crc32 uint32][JSON].
+// Una entrada incompleta o con CRC incorrecto marca el final del registro.
+type RegistroWAL struct {
+	mu              sync.Mutex
+	dir             string
+	f               archivoWAL
+	seq             uint64 // número de secuencia de la última operación registrada
+	desdeCheckpoint int    // operaciones registradas desde el último checkpoint
+}
+
+// archivoWAL es lo que el registro usa de su fichero (las pruebas lo
+// sustituyen por uno que falla)
+type archivoWAL interface {
+	io.WriteSeeker
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+// entradaWAL es una operación numerada tal y como se guarda en el registro
+type entradaWAL struct {
+	Seq uint64    `json:"seq"`
+	Op  Operacion `json:"op"`
+}
+
+// checkpointWAL es la instantánea del taller tras aplicar la operación Seq
+type checkpointWAL struct {
+	Seq    uint64      `json:"seq"`
+	Estado Instantanea `json:"estado"`
+}
+
+// AbrirRegistro recupera el estado guardado en dir sobre t (último checkpoint
+// más las operaciones posteriores del registro) y deja el registro listo para
+// seguir escribiendo. La cola dañada por una caída a mitad de escritura se descarta.
+func AbrirRegistro(dir string, t *Taller) (*RegistroWAL, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	r := &RegistroWAL{dir: dir}
+
+	ck, err := leerCheckpoint(filepath.Join(dir, ficheroCheckpoint))
+	if err != nil {
+		return nil, err
+	}
+	if ck != nil {
+		t.Importar(ck.Estado)
+		r.seq = ck.Seq
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, ficheroWAL), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	entradas, valido, err := leerEntradas(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	for _, e := range entradas {
+		if e.Seq <= r.seq {
+			continue // ya incluida en el checkpoint
+		}
+		// Una operación que falló al ejecutarse vuelve a fallar igual aquí
+		t.Aplicar(e.Op)
+		r.seq = e.Seq
+		r.desdeCheckpoint++
+	}
+
+	// Descartar la cola incompleta para que las nuevas entradas queden detrás
+	// de la última válida
+	if err := f.Truncate(valido); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(valido, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	r.f = f
+	return r, nil
+}
+
+// Ejecutar registra la operación, la sincroniza en disco y después la aplica
+func (r *RegistroWAL) Ejecutar(t *Taller, op Operacion) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.escribir(entradaWAL{Seq: r.seq + 1, Op: op}); err != nil {
+		return err
+	}
+	r.seq++
+	r.desdeCheckpoint++
+	errAplicar := t.Aplicar(op)
+
+	if r.desdeCheckpoint >= IntervaloCheckpoint {
+		if err := r.checkpoint(t); err != nil {
+			return err
+		}
+	}
+	return errAplicar
+}
+
+// Checkpoint guarda una instantánea del taller y vacía el registro
+func (r *RegistroWAL) Checkpoint(t *Taller) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.checkpoint(t)
+}
+
+// Cerrar hace un último checkpoint y cierra el fichero del registro
+func (r *RegistroWAL) Cerrar(t *Taller) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.checkpoint(t)
+	if errClose := r.f.Close(); err == nil {
+		err = errClose
+	}
+	return err
+}
+
+func (r *RegistroWAL) escribir(e entradaWAL) error {
+	datos, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 8+len(datos))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(datos)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(datos))
+	copy(buf[8:], datos)
+	// Si la escritura o la sincronización fallan se quita lo que haya llegado
+	// a escribirse, para que la siguiente entrada no quede detrás de una a
+	// medias (y se pierda al recuperar) ni se recupere una que no se aplicó
+	inicio, err := r.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err = r.f.Write(buf); err == nil {
+		err = r.f.Sync()
+	}
+	if err != nil {
+		if errT := r.f.Truncate(inicio); errT != nil {
+			return fmt.Errorf("%v (y no se pudo deshacer: %v)", err, errT)
+		}
+		if _, errS := r.f.Seek(inicio, io.SeekStart); errS != nil {
+			return fmt.Errorf("%v (y no se pudo deshacer: %v)", err, errS)
+		}
+	}
+	return err
+}
+
+// checkpoint escribe la instantánea en un fichero temporal y lo renombra, de
+// modo que en disco siempre hay un checkpoint completo. Las entradas que quedan
+// en el registro tras una caída entre el renombrado y el vaciado tienen un Seq
+// ya cubierto por el checkpoint y se ignoran al recuperar.
+func (r *RegistroWAL) checkpoint(t *Taller) error {
+	datos, err := json.Marshal(checkpointWAL{Seq: r.seq, Estado: t.Exportar()})
+	if err != nil {
+		return err
+	}
+	ruta := filepath.Join(r.dir, ficheroCheckpoint)
+	tmp := ruta + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(datos); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, ruta); err != nil {
+		return err
+	}
+	sincronizarDirectorio(r.dir)
+
+	if err := r.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := r.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r.desdeCheckpoint = 0
+	return r.f.Sync()
+}
+
+// leerEntradas devuelve las entradas válidas del registro y la posición en la
+// que termina la última de ellas
+func leerEntradas(f *os.File) ([]entradaWAL, int64, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	lector := bufio.NewReader(f)
+	var entradas []entradaWAL
+	var valido int64
+	cab := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(lector, cab); err != nil {
+			break // fin del fichero o cabecera cortada
+		}
+		n := binary.BigEndian.Uint32(cab[0:4])
+		if n > maxEntradaWAL {
+			break
+		}
+		datos := make([]byte, n)
+		if _, err := io.ReadFull(lector, datos); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(datos) != binary.BigEndian.Uint32(cab[4:8]) {
+			break
+		}
+		var e entradaWAL
+		if err := json.Unmarshal(datos, &e); err != nil {
+			break
+		}
+		entradas = append(entradas, e)
+		valido += int64(8 + n)
+	}
+	return entradas, valido, nil
+}
+
+func leerCheckpoint(ruta string) (*checkpointWAL, error) {
+	datos, err := os.ReadFile(ruta)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ck checkpointWAL
+	if err := json.Unmarshal(datos, &ck); err != nil {
+		return nil, err
+	}
+	return &ck, nil
+}
+
+func sincronizarDirectorio(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
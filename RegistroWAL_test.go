@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// opsRegistro es una secuencia de operaciones variada para el registro,
+// incluida alguna que falla al aplicarse
+func opsRegistro() []Operacion {
+	ops := []Operacion{
+		{Tipo: OpCrearMecanico, IDMecanico: 1, Nombre: "Laura", Especialidad: "mecánica", Activo: true},
+		{Tipo: OpCrearMecanico, IDMecanico: 2, Nombre: "Pedro", Especialidad: "eléctrica", Activo: true},
+	}
+	for i := 1; i <= 6; i++ {
+		mat := fmt.Sprintf("%04dAAA", i)
+		ops = append(ops,
+			Operacion{Tipo: OpCrearCliente, IDCliente: i, Nombre: fmt.Sprintf("cliente%d", i), Telefono: "600000000"},
+			Operacion{Tipo: OpCrearVehiculo, IDCliente: i, Matricula: mat, Marca: "Seat", Modelo: "Ibiza"},
+			Operacion{Tipo: OpCrearIncidencia, Matricula: mat, IDIncidencia: 10 + i, TipoIncidencia: "mecánica", Prioridad: "alta"},
+			Operacion{Tipo: OpAsignarPlaza, Matricula: mat, IDMecanico: 1 + i%2, IDPlaza: i})
+	}
+	return append(ops,
+		Operacion{Tipo: OpCrearCliente, IDCliente: 1, Nombre: "repetido"}, // falla: el ID ya existe
+		Operacion{Tipo: OpModificarCliente, IDCliente: 2, Nombre: "Ana", Telefono: "611111111"},
+		Operacion{Tipo: OpEstadoIncidencia, Matricula: "0003AAA", Estado: "cerrada"},   // falla: no se ha empezado
+		Operacion{Tipo: OpEstadoIncidencia, Matricula: "0003AAA", Estado: "reparando"}, // falla: estado desconocido
+		Operacion{Tipo: OpEliminarVehiculo, Matricula: "0004AAA"},
+		Operacion{Tipo: OpEliminarCliente, IDCliente: 5})
+}
+
+func estadoJSON(t *testing.T, taller *Taller) string {
+	t.Helper()
+	datos, err := json.Marshal(taller.Exportar())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(datos)
+}
+
+// TestRegistroCortado corta el registro en posiciones al azar, como si el
+// proceso hubiera caído a mitad de una escritura, y comprueba que al
+// recuperarlo el taller queda igual que tras aplicar un prefijo de las
+// operaciones: todas las que se escribieron enteras y ninguna más. Después
+// el registro recuperado debe seguir admitiendo operaciones.
+func TestRegistroCortado(t *testing.T) {
+	ops := opsRegistro()
+	if len(ops) >= IntervaloCheckpoint {
+		t.Fatal("las operaciones de la prueba deben caber en el registro sin checkpoint")
+	}
+	dir := t.TempDir()
+	var original Taller
+	r, err := AbrirRegistro(dir, &original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// prefijos[k] es el estado tras aplicar las k primeras operaciones y
+	// finales[k] la posición del registro en la que acaba la k-ésima
+	var referencia Taller
+	prefijos := []string{estadoJSON(t, &referencia)}
+	finales := []int64{0}
+	for _, op := range ops {
+		r.Ejecutar(&original, op)
+		referencia.Aplicar(op)
+		prefijos = append(prefijos, estadoJSON(t, &referencia))
+		fin, err := r.f.Seek(0, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		finales = append(finales, fin)
+	}
+	r.f.Close()
+	completo, err := os.ReadFile(filepath.Join(dir, ficheroWAL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	azar := rand.New(rand.NewSource(1))
+	cortes := []int{0, len(completo)}
+	for _, fin := range finales {
+		cortes = append(cortes, int(fin), max(int(fin)-1, 0), min(int(fin)+1, len(completo)))
+	}
+	for i := 0; i < 300; i++ {
+		cortes = append(cortes, azar.Intn(len(completo)+1))
+	}
+	for _, corte := range cortes {
+		enteras := 0
+		for enteras < len(ops) && finales[enteras+1] <= int64(corte) {
+			enteras++
+		}
+		dirCorte := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dirCorte, ficheroWAL), completo[:corte], 0644); err != nil {
+			t.Fatal(err)
+		}
+		var recuperado Taller
+		r, err := AbrirRegistro(dirCorte, &recuperado)
+		if err != nil {
+			t.Fatalf("corte en %d: %v", corte, err)
+		}
+		if estadoJSON(t, &recuperado) != prefijos[enteras] {
+			t.Fatalf("corte en %d: el taller no coincide con las %d primeras operaciones", corte, enteras)
+		}
+		if err := recuperado.ComprobarConsistencia(); err != nil {
+			t.Fatalf("corte en %d: %v", corte, err)
+		}
+
+		// La cola rota se descarta: una operación nueva queda detrás de la
+		// última entera y sobrevive a otra recuperación
+		nueva := Operacion{Tipo: OpCrearCliente, IDCliente: 99, Nombre: "nuevo"}
+		if err := r.Ejecutar(&recuperado, nueva); err != nil {
+			t.Fatalf("corte en %d: %v", corte, err)
+		}
+		esperado := estadoJSON(t, &recuperado)
+		r.f.Close()
+		var otraVez Taller
+		r, err = AbrirRegistro(dirCorte, &otraVez)
+		if err != nil {
+			t.Fatalf("corte en %d, segunda recuperación: %v", corte, err)
+		}
+		r.f.Close()
+		if estadoJSON(t, &otraVez) != esperado {
+			t.Fatalf("corte en %d: se pierde la operación escrita tras recuperar", corte)
+		}
+	}
+}
+
+// TestRegistroCheckpointCortado corta el registro que queda detrás de un
+// checkpoint: lo recuperado es el checkpoint más un prefijo de la cola
+func TestRegistroCheckpointCortado(t *testing.T) {
+	dir := t.TempDir()
+	var original, referencia Taller
+	r, err := AbrirRegistro(dir, &original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= IntervaloCheckpoint+5; i++ {
+		op := Operacion{Tipo: OpCrearCliente, IDCliente: i, Nombre: fmt.Sprintf("cliente%d", i)}
+		r.Ejecutar(&original, op)
+		referencia.Aplicar(op)
+	}
+	r.f.Close()
+	completo, err := os.ReadFile(filepath.Join(dir, ficheroWAL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Tras el checkpoint quedan 5 entradas en el registro; se quita media
+	if err := os.WriteFile(filepath.Join(dir, ficheroWAL), completo[:len(completo)-10], 0644); err != nil {
+		t.Fatal(err)
+	}
+	var recuperado Taller
+	if _, err := AbrirRegistro(dir, &recuperado); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(recuperado.ClientesTaller); n != IntervaloCheckpoint+4 {
+		t.Fatalf("se recuperan %d clientes en vez de %d", n, IntervaloCheckpoint+4)
+	}
+}
+
+// archivoQueFalla escribe solo los primeros corte bytes de la siguiente
+// entrada y falla, o la escribe entera y falla al sincronizar
+type archivoQueFalla struct {
+	*os.File
+	corte      int
+	fallarSync bool
+}
+
+func (a *archivoQueFalla) Write(p []byte) (int, error) {
+	if a.corte > 0 && a.corte < len(p) {
+		n, _ := a.File.Write(p[:a.corte])
+		a.corte = 0
+		return n, errors.New("disco lleno")
+	}
+	return a.File.Write(p)
+}
+
+func (a *archivoQueFalla) Sync() error {
+	if a.fallarSync {
+		a.fallarSync = false
+		return errors.New("error de E/S")
+	}
+	return a.File.Sync()
+}
+
+// TestRegistroEscrituraFallida hace fallar una escritura a medias y una
+// sincronización: ninguna de las dos operaciones se aplica, la siguiente
+// queda bien registrada y al recuperar se obtiene lo mismo que en memoria
+func TestRegistroEscrituraFallida(t *testing.T) {
+	dir := t.TempDir()
+	var original Taller
+	r, err := AbrirRegistro(dir, &original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fichero := &archivoQueFalla{File: r.f.(*os.File)}
+	r.f = fichero
+	ejecutar := func(id int) error {
+		return r.Ejecutar(&original, Operacion{Tipo: OpCrearCliente, IDCliente: id, Nombre: fmt.Sprintf("cliente%d", id)})
+	}
+	if err := ejecutar(1); err != nil {
+		t.Fatal(err)
+	}
+	fichero.corte = 5
+	if err := ejecutar(2); err == nil {
+		t.Fatal("la escritura a medias no da error")
+	}
+	fichero.fallarSync = true
+	if err := ejecutar(3); err == nil {
+		t.Fatal("el fallo al sincronizar no da error")
+	}
+	if err := ejecutar(4); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(original.ClientesTaller); n != 2 {
+		t.Fatalf("se han aplicado %d clientes en vez de 2", n)
+	}
+	fichero.Close()
+
+	var recuperado Taller
+	if _, err := AbrirRegistro(dir, &recuperado); err != nil {
+		t.Fatal(err)
+	}
+	if a, b := estadoJSON(t, &original), estadoJSON(t, &recuperado); a != b {
+		t.Fatalf("se recupera un estado distinto del aplicado:\n%s\n%s", b, a)
+	}
+}
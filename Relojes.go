@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MarcaLogica es la marca lógica de un evento: el reloj de Lamport y el reloj
+// vectorial del nodo en el que ocurrió
+type MarcaLogica struct {
+	Nodo    string            `json:"nodo"`
+	Lamport uint64            `json:"lamport"`
+	Vector  map[string]uint64 `json:"vector"`
+}
+
+// Relojes mantiene los relojes lógicos de un nodo. Todos los métodos admiten
+// un receptor nil (nodo sin relojes), en cuyo caso no hacen nada.
+type Relojes struct {
+	mu      sync.Mutex
+	nodo    string
+	lamport uint64
+	vector  map[string]uint64
+}
+
+// NuevosRelojes crea los relojes del nodo indicado, a cero
+func NuevosRelojes(nodo string) *Relojes {
+	return &Relojes{nodo: nodo, vector: map[string]uint64{}}
+}
+
+// Evento avanza los relojes por un evento local (incluido enviar un mensaje)
+// y devuelve la marca resultante
+func (r *Relojes) Evento() *MarcaLogica {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lamport++
+	r.vector[r.nodo]++
+	return r.marca()
+}
+
+// Recibir incorpora la marca de un mensaje recibido: Lamport pasa a
+// max(propio, recibido)+1 y el vector toma el máximo componente a componente
+func (r *Relojes) Recibir(m *MarcaLogica) {
+	if r == nil || m == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if m.Lamport > r.lamport {
+		r.lamport = m.Lamport
+	}
+	r.lamport++
+	for nodo, v := range m.Vector {
+		if v > r.vector[nodo] {
+			r.vector[nodo] = v
+		}
+	}
+	r.vector[r.nodo]++
+}
+
+// Actual devuelve la marca actual sin avanzar los relojes
+func (r *Relojes) Actual() *MarcaLogica {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.marca()
+}
+
+// marca copia el estado de los relojes; se llama con r.mu tomado
+func (r *Relojes) marca() *MarcaLogica {
+	v := make(map[string]uint64, len(r.vector))
+	for nodo, x := range r.vector {
+		v[nodo] = x
+	}
+	return &MarcaLogica{Nodo: r.nodo, Lamport: r.lamport, Vector: v}
+}
+
+// reanudar lleva los relojes al menos hasta m, para seguir tras un reinicio
+// desde el último evento guardado
+func (r *Relojes) reanudar(m MarcaLogica) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if m.Lamport > r.lamport {
+		r.lamport = m.Lamport
+	}
+	for nodo, v := range m.Vector {
+		if v > r.vector[nodo] {
+			r.vector[nodo] = v
+		}
+	}
+}
+
+// Sello lleva la marca lógica del emisor en los mensajes entre nodos. Se
+// incrusta en cada tipo de mensaje; quien envía llama a Sellar y quien recibe
+// a Recibido.
+type Sello struct {
+	Reloj *MarcaLogica `json:"reloj,omitempty"`
+}
+
+// Sellar marca el mensaje con un nuevo evento de envío
+func (s *Sello) Sellar(r *Relojes) { s.Reloj = r.Evento() }
+
+// Recibido incorpora la marca del mensaje a los relojes del receptor
+func (s *Sello) Recibido(r *Relojes) { r.Recibir(s.Reloj) }
+
+// AntesDe indica si el evento a ocurrió causalmente antes que b
+func AntesDe(a, b MarcaLogica) bool {
+	menor := false
+	for nodo, x := range a.Vector {
+		if x > b.Vector[nodo] {
+			return false
+		}
+		if x < b.Vector[nodo] {
+			menor = true
+		}
+	}
+	for nodo, y := range b.Vector {
+		if _, ok := a.Vector[nodo]; !ok && y > 0 {
+			menor = true
+		}
+	}
+	return menor
+}
+
+// Concurrentes indica si ninguno de los dos eventos precede al otro
+func Concurrentes(a, b MarcaLogica) bool {
+	return !AntesDe(a, b) && !AntesDe(b, a)
+}
+
+// String muestra la marca como "L=7 {A:3 B:4}"
+func (m MarcaLogica) String() string {
+	nodos := make([]string, 0, len(m.Vector))
+	for nodo := range m.Vector {
+		nodos = append(nodos, nodo)
+	}
+	sort.Strings(nodos)
+	partes := make([]string, len(nodos))
+	for i, nodo := range nodos {
+		partes[i] = fmt.Sprintf("%s:%d", nodo, m.Vector[nodo])
+	}
+	return fmt.Sprintf("L=%d {%s}", m.Lamport, strings.Join(partes, " "))
+}
+
+// HISTORIAL DE EVENTOS
+
+// EventoTaller es una operación aplicada en un nodo junto con su marca y las
+// entidades que modifica
+type EventoTaller struct {
+	Reloj     MarcaLogica `json:"reloj"`
+	Entidades []string    `json:"entidades"`
+	Op        Operacion   `json:"op"`
+}
+
+// Historial guarda los eventos de un nodo, una línea JSON por evento
+type Historial struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// AbrirHistorial abre (o crea) el historial en la ruta indicada y adelanta
+// los relojes r hasta el último evento guardado en él
+func AbrirHistorial(ruta string, r *Relojes) (*Historial, error) {
+	eventos, err := LeerHistorial(ruta)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, e := range eventos {
+		r.reanudar(e.Reloj)
+	}
+	f, err := os.OpenFile(ruta, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Historial{f: f}, nil
+}
+
+// Registrar añade un evento al historial; no hace nada si h o m son nil
+func (h *Historial) Registrar(m *MarcaLogica, op Operacion) error {
+	if h == nil || m == nil {
+		return nil
+	}
+	datos, err := json.Marshal(EventoTaller{Reloj: *m, Entidades: entidadesDe(op), Op: op})
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err = h.f.Write(append(datos, '\n'))
+	return err
+}
+
+// Cerrar cierra el fichero del historial
+func (h *Historial) Cerrar() error {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.f.Close()
+}
+
+// LeerHistorial devuelve los eventos guardados en un historial. Una última
+// línea incompleta (caída a mitad de escritura) se ignora.
+func LeerHistorial(ruta string) ([]EventoTaller, error) {
+	f, err := os.Open(ruta)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var eventos []EventoTaller
+	var errLinea error
+	lector := bufio.NewScanner(f)
+	lector.Buffer(make([]byte, 64*1024), 1<<20)
+	for lector.Scan() {
+		if errLinea != nil {
+			return nil, errLinea
+		}
+		var e EventoTaller
+		if err := json.Unmarshal(lector.Bytes(), &e); err != nil {
+			errLinea = fmt.Errorf("%s: %v", ruta, err)
+			continue
+		}
+		eventos = append(eventos, e)
+	}
+	return eventos, lector.Err()
+}
+
+// entidadesDe devuelve las entidades que modifica una operación, para
+// detectar ediciones concurrentes sobre la misma entidad
+func entidadesDe(op Operacion) []string {
+	cliente := fmt.Sprintf("cliente:%d", op.IDCliente)
+	vehiculo := "vehiculo:" + op.Matricula
+	incidencia := "incidencia:" + op.Matricula
+	mecanico := fmt.Sprintf("mecanico:%d", op.IDMecanico)
+	switch op.Tipo {
+	case OpCrearCliente, OpModificarCliente, OpEliminarCliente:
+		// Eliminar un cliente libera sus plazas
+		return []string{cliente}
+	case OpCrearVehiculo, OpRecibirVehiculo, OpConfirmarEntrada:
+		return []string{cliente, vehiculo, incidencia}
+	case OpModificarVehiculo, OpEliminarVehiculo, OpPrepararSalida, OpConfirmarSalida, OpAbortarSalida:
+		return []string{vehiculo}
+	case OpCrearIncidencia, OpModificarIncidencia, OpEliminarIncidencia, OpEstadoIncidencia,
+		OpPresupuestar, OpEnviarPresupuesto, OpResponderPresupuesto:
+		return []string{incidencia}
+	case OpCrearMecanico, OpModificarMecanico, OpEliminarMecanico, OpEstadoMecanico,
+		OpMecanicoInaccesible, OpMecanicoAccesible:
+		// Los cambios de mecánicos recalculan todas las plazas
+		return []string{mecanico, "plazas"}
+	case OpImportarCliente:
+		if op.Cliente == nil {
+			return nil
+		}
+		entidades := []string{fmt.Sprintf("cliente:%d", op.Cliente.IDCliente)}
+		for _, v := range op.Cliente.Vehiculos {
+			entidades = append(entidades, "vehiculo:"+v.Matricula, "incidencia:"+v.Matricula)
+		}
+		return entidades
+	case OpAsignarPlaza:
+		return []string{fmt.Sprintf("plaza:%d", op.IDPlaza), vehiculo}
+	case OpReservarPlaza, OpCancelarReserva:
+		return []string{"plazas"}
+	case OpCrearRepuesto, OpModificarRepuesto:
+		if op.Repuesto == nil {
+			return nil
+		}
+		return []string{"repuesto:" + op.Repuesto.Referencia, "pedidos"}
+	case OpEliminarRepuesto, OpEntradaRepuesto:
+		// Las entradas reparten unidades entre las incidencias que esperan
+		return []string{"repuesto:" + op.Referencia, "repuestos", "pedidos"}
+	case OpReservarRepuesto, OpLiberarRepuesto:
+		return []string{incidencia, "repuesto:" + op.Referencia, "repuestos", "pedidos"}
+	case OpCrearProveedor, OpModificarProveedor:
+		if op.Proveedor == nil {
+			return nil
+		}
+		return []string{fmt.Sprintf("proveedor:%d", op.Proveedor.IDProveedor)}
+	case OpEliminarProveedor:
+		return []string{fmt.Sprintf("proveedor:%d", op.IDProveedor), "pedidos"}
+	case OpEnviarPedido, OpCancelarPedido:
+		return []string{fmt.Sprintf("pedido:%d", op.IDPedido)}
+	case OpRecibirPedido:
+		return []string{fmt.Sprintf("pedido:%d", op.IDPedido), "repuestos", "pedidos"}
+	case OpIniciarTrabajo:
+		// Un mecánico solo puede estar fichado en una incidencia
+		return []string{incidencia, mecanico}
+	case OpTerminarTrabajo:
+		return []string{mecanico}
+	case OpPedirCita:
+		// Las citas de una franja compiten por sus plazas
+		if op.Cita == nil {
+			return nil
+		}
+		return []string{"vehiculo:" + op.Cita.Matricula, "citas:" + op.Cita.Dia}
+	case OpCancelarCita:
+		return []string{fmt.Sprintf("cita:%d", op.IDCita)}
+	case OpLlegadaCita:
+		return []string{fmt.Sprintf("cita:%d", op.IDCita), "plazas"}
+	case OpHorarioMecanico, OpAusenciaMecanico, OpQuitarAusencia:
+		return []string{mecanico}
+	case OpEmitirFactura:
+		// La numeración es común a todas las facturas del año
+		return []string{incidencia, "facturas"}
+	case OpRegistrarPago:
+		// Dos cobros a la vez de la misma factura pueden pasarse del total
+		if op.Pago == nil {
+			return nil
+		}
+		return []string{"factura:" + op.Pago.Factura}
+	}
+	return nil
+}
+
+// FusionarHistoriales combina los historiales de varios nodos en un orden
+// compatible con la causalidad (por reloj de Lamport y, a igualdad, por nodo)
+// y devuelve los pares de eventos concurrentes que modifican la misma entidad
+// desde nodos distintos
+func FusionarHistoriales(rutas []string) ([]EventoTaller, [][2]EventoTaller, error) {
+	var todos []EventoTaller
+	for _, ruta := range rutas {
+		eventos, err := LeerHistorial(ruta)
+		if err != nil {
+			return nil, nil, err
+		}
+		todos = append(todos, eventos...)
+	}
+	sort.SliceStable(todos, func(i, j int) bool {
+		if todos[i].Reloj.Lamport != todos[j].Reloj.Lamport {
+			return todos[i].Reloj.Lamport < todos[j].Reloj.Lamport
+		}
+		return todos[i].Reloj.Nodo < todos[j].Reloj.Nodo
+	})
+
+	porEntidad := map[string][]int{}
+	for i, e := range todos {
+		for _, ent := range e.Entidades {
+			porEntidad[ent] = append(porEntidad[ent], i)
+		}
+	}
+	var conflictos [][2]EventoTaller
+	vistos := map[[2]int]bool{}
+	for _, indices := range porEntidad {
+		for a := 0; a < len(indices); a++ {
+			for b := a + 1; b < len(indices); b++ {
+				i, j := indices[a], indices[b]
+				ei, ej := todos[i], todos[j]
+				if ei.Reloj.Nodo == ej.Reloj.Nodo || vistos[[2]int{i, j}] {
+					continue
+				}
+				if Concurrentes(ei.Reloj, ej.Reloj) {
+					vistos[[2]int{i, j}] = true
+					conflictos = append(conflictos, [2]EventoTaller{ei, ej})
+				}
+			}
+		}
+	}
+	return todos, conflictos, nil
+}
+
+// mostrarHistorialFusionado imprime la historia combinada y los conflictos
+func mostrarHistorialFusionado(rutas []string) error {
+	eventos, conflictos, err := FusionarHistoriales(rutas)
+	if err != nil {
+		return err
+	}
+	fmt.Println("===== HISTORIA COMBINADA =====")
+	for _, e := range eventos {
+		fmt.Printf("- [%s] %s | %s %v\n", e.Reloj.Nodo, e.Reloj, e.Op.Tipo, e.Entidades)
+	}
+	if len(conflictos) == 0 {
+		fmt.Println("Sin ediciones concurrentes en conflicto.")
+		return nil
+	}
+	fmt.Printf("===== %d EDICIONES CONCURRENTES EN CONFLICTO =====\n", len(conflictos))
+	for _, c := range conflictos {
+		fmt.Printf("- %s en %s (%s) || %s en %s (%s)\n",
+			c[0].Op.Tipo, c[0].Reloj.Nodo, c[0].Reloj, c[1].Op.Tipo, c[1].Reloj.Nodo, c[1].Reloj)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestRelojesMensajes sigue un mensaje de A a B con C al margen: el envío
+// precede a la recepción en los dos relojes y C es concurrente con ambos
+func TestRelojesMensajes(t *testing.T) {
+	a, b, c := NuevosRelojes("A"), NuevosRelojes("B"), NuevosRelojes("C")
+	local := *a.Evento()
+	var m MensajeGossip
+	m.Sellar(a)
+	envio := *m.Reloj
+	b.Evento()
+	b.Evento()
+	b.Evento()
+	m.Recibido(b)
+	recepcion := *b.Actual()
+	suelto := *c.Evento()
+
+	if envio.Lamport <= local.Lamport || recepcion.Lamport <= envio.Lamport {
+		t.Errorf("Lamport no crece con la causalidad: %s, %s, %s", local, envio, recepcion)
+	}
+	if recepcion.Lamport != 4 || recepcion.Vector["A"] != 2 || recepcion.Vector["B"] != 4 {
+		t.Errorf("B debería quedar en L=4 {A:2 B:4} y queda en %s", recepcion)
+	}
+	if !AntesDe(local, envio) || !AntesDe(envio, recepcion) || !AntesDe(local, recepcion) {
+		t.Error("el envío y lo anterior a él deberían preceder a la recepción")
+	}
+	if AntesDe(recepcion, envio) || AntesDe(local, local) {
+		t.Error("AntesDe no debería cumplirse al revés ni con el mismo evento")
+	}
+	if !Concurrentes(suelto, envio) || !Concurrentes(suelto, recepcion) {
+		t.Error("un evento de C sin mensajes debería ser concurrente con los de A y B")
+	}
+
+	// Un nodo sin relojes no marca ni se rompe
+	var nada *Relojes
+	m.Sellar(nada)
+	m.Recibido(nada)
+	if m.Reloj != nil || nada.Actual() != nil {
+		t.Error("sin relojes no debería haber marca")
+	}
+}
+
+// TestFusionarHistoriales escribe los historiales de dos nodos que editan el
+// mismo cliente a la vez y después tras un mensaje: solo las ediciones
+// concurrentes son conflicto, la historia combinada respeta la causalidad y
+// un nodo que reinicia sigue desde su último evento
+func TestFusionarHistoriales(t *testing.T) {
+	dir := t.TempDir()
+	rutas := []string{filepath.Join(dir, "a.log"), filepath.Join(dir, "b.log")}
+	ra, rb := NuevosRelojes("A"), NuevosRelojes("B")
+	ha, err := AbrirHistorial(rutas[0], ra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hb, err := AbrirHistorial(rutas[1], rb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registrar := func(h *Historial, r *Relojes, op Operacion) {
+		if err := h.Registrar(r.Evento(), op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	registrar(ha, ra, Operacion{Tipo: OpModificarCliente, IDCliente: 1, Telefono: "600000001"})
+	registrar(hb, rb, Operacion{Tipo: OpModificarCliente, IDCliente: 1, Telefono: "600000002"})
+	registrar(hb, rb, Operacion{Tipo: OpCrearCliente, IDCliente: 2})
+	var m MensajeGossip
+	m.Sellar(ra)
+	m.Recibido(rb)
+	registrar(hb, rb, Operacion{Tipo: OpModificarCliente, IDCliente: 1, Telefono: "600000003"})
+	ha.Cerrar()
+	hb.Cerrar()
+
+	eventos, conflictos, err := FusionarHistoriales(rutas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(eventos) != 4 {
+		t.Fatalf("se esperaban 4 eventos y hay %d", len(eventos))
+	}
+	for i := range eventos {
+		for j := i + 1; j < len(eventos); j++ {
+			if AntesDe(eventos[j].Reloj, eventos[i].Reloj) {
+				t.Errorf("%s va después de %s, que depende de él", eventos[j].Reloj, eventos[i].Reloj)
+			}
+		}
+	}
+	if len(conflictos) != 1 || conflictos[0][0].Op.Telefono == conflictos[0][1].Op.Telefono ||
+		conflictos[0][0].Op.Telefono == "600000003" || conflictos[0][1].Op.Telefono == "600000003" {
+		t.Errorf("solo las dos primeras ediciones del cliente 1 deberían ser conflicto: %+v", conflictos)
+	}
+
+	// Una última línea cortada por una caída se ignora y los relojes siguen
+	// desde el último evento completo
+	f, err := os.OpenFile(rutas[1], os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"reloj":{"nodo":"B","lamp`)
+	f.Close()
+	otra := NuevosRelojes("B")
+	h, err := AbrirHistorial(rutas[1], otra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Cerrar()
+	if antes, despues := rb.Actual(), otra.Actual(); antes.String() != despues.String() {
+		t.Errorf("tras reiniciar los relojes de B están en %s en vez de %s", despues, antes)
+	}
+}
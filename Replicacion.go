@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Roles de un nodo replicado
+const (
+	RolPrimario = "primario"
+	RolRespaldo = "respaldo"
+)
+
+// Tipos de mensaje entre primario y respaldo
+const (
+	msgEstado = "estado" // instantánea completa, se envía al (re)conectar
+	msgOp     = "op"     // una operación ya aplicada en el primario
+	msgLatido = "latido" // el primario sigue vivo
+)
+
+// MensajeReplica es lo que el primario envía al respaldo, un JSON por línea
+type MensajeReplica struct {
+	Tipo   string       `json:"tipo"`
+	Seq    uint64       `json:"seq"`
+	Op     *Operacion   `json:"op,omitempty"`
+	Estado *Instantanea `json:"estado,omitempty"`
+	Sello
+}
+
+// NodoReplica implementa la replicación primario-respaldo del taller. El
+// primario envía cada operación aplicada al respaldo en orden; el respaldo las
+// aplica, solo admite consultas y se promociona a primario si deja de recibir
+// latidos durante Expiracion.
+type NodoReplica struct {
+	Latido     time.Duration // cada cuánto envía latidos el primario
+	Expiracion time.Duration // silencio tras el que el respaldo se promociona
+
+	// Cómo actúa el nodo sobre su taller; se llaman con el cerrojo tomado
+	Aplicar  func(op Operacion) error
+	Exportar func() Instantanea
+	Importar func(ins Instantanea)
+	// AlPromocionar se llama (si no es nil) cuando el respaldo pasa a primario
+	AlPromocionar func()
+	// Relojes lógicos con los que se marcan los mensajes (nil = sin marcas)
+	Relojes *Relojes
+
+	cerrojo *sync.Mutex // cerrojo del taller, compartido con quien lo modifica
+
+	mu           sync.Mutex
+	rol          string
+	escucha      string // dirección en la que escucha el respaldo
+	respaldo     string // dirección del respaldo (solo en el primario)
+	conn         net.Conn
+	codif        *json.Encoder
+	seq          uint64 // número de la última operación aplicada
+	ultimoLatido time.Time
+	oyente       net.Listener
+	parar        chan struct{}
+}
+
+// NuevoNodoReplica crea un nodo sobre el taller t protegido por cerrojo. En
+// un primario, respaldo es la dirección del respaldo; en un respaldo, escucha
+// es la dirección en la que espera al primario.
+func NuevoNodoReplica(rol, escucha, respaldo string, t *Taller, cerrojo *sync.Mutex) *NodoReplica {
+	return &NodoReplica{
+		Latido:     500 * time.Millisecond,
+		Expiracion: 2 * time.Second,
+		Aplicar:    t.Aplicar,
+		Exportar:   t.Exportar,
+		Importar:   t.Importar,
+		cerrojo:    cerrojo,
+		rol:        rol,
+		escucha:    escucha,
+		respaldo:   respaldo,
+		parar:      make(chan struct{}),
+	}
+}
+
+// Iniciar arranca las tareas de fondo del nodo según su rol
+func (n *NodoReplica) Iniciar() error {
+	if n.Rol() == RolRespaldo {
+		oyente, err := net.Listen("tcp", n.escucha)
+		if err != nil {
+			return err
+		}
+		n.mu.Lock()
+		n.oyente = oyente
+		n.mu.Unlock()
+		go n.aceptarPrimario(oyente)
+		go n.vigilarPrimario()
+		return nil
+	}
+	go n.bucleLatidos()
+	return nil
+}
+
+// Detener para las tareas de fondo y cierra las conexiones
+func (n *NodoReplica) Detener() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	select {
+	case <-n.parar:
+		return
+	default:
+	}
+	close(n.parar)
+	if n.oyente != nil {
+		n.oyente.Close()
+	}
+	if n.conn != nil {
+		n.conn.Close()
+		n.conn = nil
+	}
+}
+
+// Rol devuelve el rol actual del nodo
+func (n *NodoReplica) Rol() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.rol
+}
+
+// Seq devuelve el número de la última operación aplicada
+func (n *NodoReplica) Seq() uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.seq
+}
+
+// Ejecutar aplica la operación en el primario y la envía al respaldo. En un
+// respaldo devuelve error: solo admite consultas.
+func (n *NodoReplica) Ejecutar(op Operacion) error {
+	n.cerrojo.Lock()
+	defer n.cerrojo.Unlock()
+	if n.Rol() != RolPrimario {
+		return errors.New("nodo de respaldo: solo se permiten consultas")
+	}
+	if err := n.Aplicar(op); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.seq++
+	if n.conn != nil {
+		// Si el envío falla se descarta la conexión; al reconectar se manda
+		// el estado completo, así que no se pierde ninguna operación
+		n.enviar(MensajeReplica{Tipo: msgOp, Seq: n.seq, Op: &op})
+	}
+	return nil
+}
+
+// Estado resume el rol y la posición del nodo para mostrarlo por consola
+func (n *NodoReplica) Estado() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	conectado := "sin conexión"
+	if n.conn != nil {
+		conectado = "conectado con " + n.conn.RemoteAddr().String()
+	}
+	return fmt.Sprintf("Rol:%s | Última operación:%d | %s", n.rol, n.seq, conectado)
+}
+
+// PRIMARIO
+
+func (n *NodoReplica) bucleLatidos() {
+	tick := time.NewTicker(n.Latido)
+	defer tick.Stop()
+	for {
+		n.mu.Lock()
+		sinRespaldo := n.respaldo == ""
+		conectado := n.conn != nil
+		if conectado {
+			n.enviar(MensajeReplica{Tipo: msgLatido, Seq: n.seq})
+		}
+		n.mu.Unlock()
+		if !sinRespaldo && !conectado {
+			n.conectarRespaldo()
+		}
+		select {
+		case <-n.parar:
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// conectarRespaldo abre la conexión con el respaldo y le envía el estado
+// completo. Se toma el cerrojo del taller para que ninguna operación quede
+// entre la instantánea y las siguientes.
+func (n *NodoReplica) conectarRespaldo() {
+	conn, err := net.DialTimeout("tcp", n.respaldo, n.Expiracion)
+	if err != nil {
+		return
+	}
+	n.cerrojo.Lock()
+	defer n.cerrojo.Unlock()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.conn = conn
+	n.codif = json.NewEncoder(conn)
+	ins := n.Exportar()
+	n.enviar(MensajeReplica{Tipo: msgEstado, Seq: n.seq, Estado: &ins})
+}
+
+// enviar manda un mensaje al respaldo; se llama con n.mu tomado
+func (n *NodoReplica) enviar(m MensajeReplica) {
+	m.Sellar(n.Relojes)
+	n.conn.SetWriteDeadline(time.Now().Add(n.Expiracion))
+	if err := n.codif.Encode(m); err != nil {
+		n.conn.Close()
+		n.conn = nil
+	}
+}
+
+// RESPALDO
+
+func (n *NodoReplica) aceptarPrimario(oyente net.Listener) {
+	for {
+		conn, err := oyente.Accept()
+		if err != nil {
+			return // oyente cerrado: detenido o promocionado
+		}
+		n.mu.Lock()
+		if n.conn != nil {
+			n.conn.Close()
+		}
+		n.conn = conn
+		n.mu.Unlock()
+		go n.recibirDePrimario(conn)
+	}
+}
+
+func (n *NodoReplica) recibirDePrimario(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		n.mu.Lock()
+		if n.conn == conn {
+			n.conn = nil
+		}
+		n.mu.Unlock()
+	}()
+	decod := json.NewDecoder(conn)
+	for {
+		var m MensajeReplica
+		if err := decod.Decode(&m); err != nil {
+			return
+		}
+		if !n.procesar(m) {
+			// Hueco en la secuencia: se corta para que el primario
+			// reconecte y mande el estado completo
+			return
+		}
+	}
+}
+
+// procesar aplica un mensaje del primario; devuelve false si hay un hueco
+func (n *NodoReplica) procesar(m MensajeReplica) bool {
+	n.cerrojo.Lock()
+	defer n.cerrojo.Unlock()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.rol != RolRespaldo {
+		return false
+	}
+	n.ultimoLatido = time.Now()
+	m.Recibido(n.Relojes)
+	switch m.Tipo {
+	case msgEstado:
+		n.Importar(*m.Estado)
+		n.seq = m.Seq
+	case msgOp:
+		if m.Seq <= n.seq {
+			return true // repetida
+		}
+		if m.Seq != n.seq+1 {
+			return false
+		}
+		// El primario ya la validó; un error aquí es el mismo que obtuvo él
+		n.Aplicar(*m.Op)
+		n.seq = m.Seq
+	}
+	return true
+}
+
+// vigilarPrimario promociona el respaldo si el primario, tras haber estado
+// en contacto, deja de enviar mensajes durante Expiracion
+func (n *NodoReplica) vigilarPrimario() {
+	tick := time.NewTicker(n.Latido)
+	defer tick.Stop()
+	for {
+		select {
+		case <-n.parar:
+			return
+		case <-tick.C:
+		}
+		n.mu.Lock()
+		caido := !n.ultimoLatido.IsZero() && time.Since(n.ultimoLatido) > n.Expiracion
+		if caido && n.rol == RolRespaldo {
+			n.rol = RolPrimario
+			n.respaldo = ""
+			n.oyente.Close()
+			if n.conn != nil {
+				n.conn.Close()
+				n.conn = nil
+			}
+			alPromocionar := n.AlPromocionar
+			n.mu.Unlock()
+			if alPromocionar != nil {
+				alPromocionar()
+			}
+			go n.bucleLatidos()
+			return
+		}
+		n.mu.Unlock()
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// esperar repite cond hasta que se cumple o pasa el plazo
+func esperar(t *testing.T, plazo time.Duration, que string, cond func() bool) {
+	t.Helper()
+	limite := time.Now().Add(plazo)
+	for !cond() {
+		if time.Now().After(limite) {
+			t.Fatalf("tras %v no se cumple: %s", plazo, que)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// nodoPrueba es un taller con su cerrojo y el nodo que lo replica
+type nodoPrueba struct {
+	taller  Taller
+	cerrojo sync.Mutex
+	nodo    *NodoReplica
+}
+
+func (p *nodoPrueba) estado(t *testing.T) string {
+	p.cerrojo.Lock()
+	defer p.cerrojo.Unlock()
+	return estadoJSON(t, &p.taller)
+}
+
+// parReplicado arranca en el mismo proceso un respaldo en un puerto libre
+// y un primario que replica hacia él
+func parReplicado(t *testing.T) (primario, respaldo *nodoPrueba) {
+	t.Helper()
+	primario, respaldo = &nodoPrueba{}, &nodoPrueba{}
+	respaldo.nodo = NuevoNodoReplica(RolRespaldo, "127.0.0.1:0", "", &respaldo.taller, &respaldo.cerrojo)
+	respaldo.nodo.Latido, respaldo.nodo.Expiracion = 20*time.Millisecond, 300*time.Millisecond
+	if err := respaldo.nodo.Iniciar(); err != nil {
+		t.Fatal(err)
+	}
+	dir := respaldo.nodo.oyente.Addr().String()
+	primario.nodo = NuevoNodoReplica(RolPrimario, "", dir, &primario.taller, &primario.cerrojo)
+	primario.nodo.Latido, primario.nodo.Expiracion = 20*time.Millisecond, 300*time.Millisecond
+	t.Cleanup(func() {
+		primario.nodo.Detener()
+		respaldo.nodo.Detener()
+	})
+	return primario, respaldo
+}
+
+// convergen espera a que el respaldo alcance al primario y compara ambos
+// talleres
+func convergen(t *testing.T, primario, respaldo *nodoPrueba) {
+	t.Helper()
+	esperar(t, 5*time.Second, "el respaldo alcanza al primario", func() bool {
+		return respaldo.nodo.Seq() == primario.nodo.Seq()
+	})
+	if primario.estado(t) != respaldo.estado(t) {
+		t.Fatal("primario y respaldo tienen la misma secuencia y distinto taller")
+	}
+}
+
+// TestReplicaConverge aplica operaciones antes de que el primario conecte
+// (llegan con la instantánea), después (llegan una a una) y tras cortar la
+// conexión (el primario reconecta y vuelve a mandar el estado); el
+// respaldo debe quedar igual que el primario y rechazar modificaciones
+func TestReplicaConverge(t *testing.T) {
+	primario, respaldo := parReplicado(t)
+	ops := opsRegistro()
+	tercio := len(ops) / 3
+	for _, op := range ops[:tercio] {
+		primario.nodo.Ejecutar(op)
+	}
+	if err := primario.nodo.Iniciar(); err != nil {
+		t.Fatal(err)
+	}
+	convergen(t, primario, respaldo)
+
+	for _, op := range ops[tercio : 2*tercio] {
+		primario.nodo.Ejecutar(op)
+	}
+	convergen(t, primario, respaldo)
+
+	primario.nodo.mu.Lock()
+	if primario.nodo.conn != nil {
+		primario.nodo.conn.Close()
+	}
+	primario.nodo.mu.Unlock()
+	for _, op := range ops[2*tercio:] {
+		primario.nodo.Ejecutar(op)
+	}
+	convergen(t, primario, respaldo)
+
+	if err := respaldo.nodo.Ejecutar(Operacion{Tipo: OpCrearCliente, IDCliente: 50, Nombre: "x"}); err == nil {
+		t.Fatal("el respaldo acepta modificaciones")
+	}
+}
+
+// TestReplicaPromocion para el primario y comprueba que el respaldo se
+// promociona con todo lo replicado y admite operaciones nuevas
+func TestReplicaPromocion(t *testing.T) {
+	primario, respaldo := parReplicado(t)
+	promocionado := make(chan struct{})
+	respaldo.nodo.AlPromocionar = func() { close(promocionado) }
+	if err := primario.nodo.Iniciar(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 10; i++ {
+		primario.nodo.Ejecutar(Operacion{Tipo: OpCrearCliente, IDCliente: i, Nombre: fmt.Sprintf("cliente%d", i)})
+	}
+	convergen(t, primario, respaldo)
+	antes := respaldo.estado(t)
+
+	primario.nodo.Detener()
+	select {
+	case <-promocionado:
+	case <-time.After(5 * time.Second):
+		t.Fatal("el respaldo no se promociona al callar el primario")
+	}
+	if respaldo.nodo.Rol() != RolPrimario || respaldo.estado(t) != antes {
+		t.Fatal("el respaldo promocionado no conserva lo replicado")
+	}
+	if err := respaldo.nodo.Ejecutar(Operacion{Tipo: OpCrearCliente, IDCliente: 11, Nombre: "nuevo"}); err != nil {
+		t.Fatal(err)
+	}
+}
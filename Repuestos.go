@@ -0,0 +1,278 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Repuesto es una pieza del catálogo del taller. Los importes van en céntimos.
+type Repuesto struct {
+	Referencia  string       `json:"referencia"` // identificador único de la pieza
+	Descripcion string       `json:"descripcion"`
+	Compatibles []Compatible `json:"compatibles,omitempty"` // vacío = vale para cualquier vehículo
+	Coste       int64        `json:"coste"`                 // lo que le cuesta al taller
+	Precio      int64        `json:"precio"`                // lo que paga el cliente
+	Stock       int          `json:"stock"`                 // unidades en el almacén, apartadas o no
+	Minimo      int          `json:"minimo,omitempty"`      // punto de pedido: por debajo se avisa y se pide
+	IDProveedor int          `json:"idProveedor,omitempty"` // a quién se pide (0 = a nadie)
+	Lote        int          `json:"lote,omitempty"`        // unidades mínimas de cada pedido
+}
+
+// Compatible es una marca y, si no está vacío, un modelo concreto en el que
+// se puede montar una pieza
+type Compatible struct {
+	Marca  string `json:"marca"`
+	Modelo string `json:"modelo,omitempty"`
+}
+
+// PiezaIncidencia es una pieza reservada para una incidencia. Apartadas son
+// las unidades del almacén que ya tiene guardadas; si son menos que Cantidad,
+// la incidencia espera a que se repongan.
+type PiezaIncidencia struct {
+	Referencia string `json:"referencia"`
+	Cantidad   int    `json:"cantidad"`
+	Apartadas  int    `json:"apartadas"`
+	Consumida  bool   `json:"consumida,omitempty"` // se gastó al cerrar la incidencia
+}
+
+// EsCompatible indica si la pieza se puede montar en ese vehículo
+func (r *Repuesto) EsCompatible(marca, modelo string) bool {
+	if len(r.Compatibles) == 0 {
+		return true
+	}
+	for _, c := range r.Compatibles {
+		if strings.EqualFold(c.Marca, marca) && (c.Modelo == "" || strings.EqualFold(c.Modelo, modelo)) {
+			return true
+		}
+	}
+	return false
+}
+
+// LeerCompatibles interpreta una lista como "Seat/Ibiza,Seat/León,Renault"
+func LeerCompatibles(texto string) []Compatible {
+	var out []Compatible
+	for _, parte := range strings.Split(texto, ",") {
+		marca, modelo, _ := strings.Cut(strings.TrimSpace(parte), "/")
+		if marca != "" {
+			out = append(out, Compatible{Marca: marca, Modelo: modelo})
+		}
+	}
+	return out
+}
+
+func (c Compatible) String() string {
+	if c.Modelo == "" {
+		return c.Marca
+	}
+	return c.Marca + "/" + c.Modelo
+}
+
+// BuscarRepuesto devuelve la pieza con esa referencia y su posición (-1 si no existe)
+func (t *Taller) BuscarRepuesto(ref string) (*Repuesto, int) {
+	for i, r := range t.Repuestos {
+		if r.Referencia == ref {
+			return r, i
+		}
+	}
+	return nil, -1
+}
+
+// incidencias recorre las incidencias del taller en el orden de los clientes
+// y sus vehículos, que es el mismo en todas las réplicas
+func (t *Taller) incidencias(f func(v *Vehiculo, inc *Incidencia)) {
+	for _, c := range t.ClientesTaller {
+		for _, v := range c.Vehiculos {
+			if inc := v.GetIncidencia(); inc != nil {
+				f(v, inc)
+			}
+		}
+	}
+}
+
+// Apartadas devuelve cuántas unidades de la pieza están guardadas para
+// incidencias que aún no la han gastado
+func (t *Taller) Apartadas(ref string) int {
+	n := 0
+	t.incidencias(func(_ *Vehiculo, inc *Incidencia) {
+		for _, p := range inc.Piezas {
+			if p.Referencia == ref && !p.Consumida {
+				n += p.Apartadas
+			}
+		}
+	})
+	return n
+}
+
+// Disponible devuelve las unidades de la pieza que no están apartadas
+func (t *Taller) Disponible(ref string) int {
+	r, _ := t.BuscarRepuesto(ref)
+	if r == nil {
+		return 0
+	}
+	return r.Stock - t.Apartadas(ref)
+}
+
+// PiezasQueFaltan devuelve las piezas de la incidencia que esperan unidades
+func PiezasQueFaltan(inc *Incidencia) []PiezaIncidencia {
+	var faltan []PiezaIncidencia
+	for _, p := range inc.Piezas {
+		if !p.Consumida && p.Apartadas < p.Cantidad {
+			faltan = append(faltan, p)
+		}
+	}
+	return faltan
+}
+
+func errorFaltan(faltan []PiezaIncidencia) error {
+	var partes []string
+	for _, p := range faltan {
+		partes = append(partes, fmt.Sprintf("%s (%d de %d)", p.Referencia, p.Cantidad-p.Apartadas, p.Cantidad))
+	}
+	return fmt.Errorf("faltan repuestos: %s", strings.Join(partes, ", "))
+}
+
+// reservarRepuesto aplica OpReservarRepuesto: aparta para la incidencia del
+// vehículo las unidades que haya libres; el resto queda pendiente
+func (t *Taller) reservarRepuesto(op Operacion) error {
+	_, v := t.BuscarVehiculo(op.Matricula)
+	if v == nil || v.GetIncidencia() == nil {
+		return errors.New("vehículo no encontrado o sin incidencia")
+	}
+	inc := v.GetIncidencia()
+	if inc.Estado == "cerrada" {
+		return errors.New("la incidencia ya está cerrada")
+	}
+	r, _ := t.BuscarRepuesto(op.Referencia)
+	if r == nil {
+		return errors.New("repuesto no encontrado")
+	}
+	if !r.EsCompatible(v.Marca, v.Modelo) {
+		return fmt.Errorf("el repuesto %s no es compatible con %s %s", r.Referencia, v.Marca, v.Modelo)
+	}
+	if op.Cantidad <= 0 {
+		return errors.New("la cantidad debe ser positiva")
+	}
+	libres := t.Disponible(r.Referencia)
+	i := -1
+	for j, p := range inc.Piezas {
+		if p.Referencia == r.Referencia && !p.Consumida {
+			i = j
+		}
+	}
+	if i == -1 {
+		inc.Piezas = append(inc.Piezas, PiezaIncidencia{Referencia: r.Referencia})
+		i = len(inc.Piezas) - 1
+	}
+	p := &inc.Piezas[i]
+	p.Cantidad += op.Cantidad
+	p.Apartadas += min(op.Cantidad, max(libres, 0))
+	t.revisarPedidos(op.Fecha)
+	return nil
+}
+
+// liberarRepuesto aplica OpLiberarRepuesto: quita la pieza de la incidencia
+// y reparte sus unidades entre las que esperan
+func (t *Taller) liberarRepuesto(op Operacion) error {
+	_, v := t.BuscarVehiculo(op.Matricula)
+	if v == nil || v.GetIncidencia() == nil {
+		return errors.New("vehículo no encontrado o sin incidencia")
+	}
+	inc := v.GetIncidencia()
+	for i, p := range inc.Piezas {
+		if p.Referencia == op.Referencia && !p.Consumida {
+			inc.Piezas = append(inc.Piezas[:i], inc.Piezas[i+1:]...)
+			t.repartirRepuestos()
+			t.revisarPedidos(op.Fecha)
+			return nil
+		}
+	}
+	return errors.New("la incidencia no tiene reservado ese repuesto")
+}
+
+// repartirRepuestos aparta las unidades libres para las piezas pendientes,
+// por orden de incidencia. Se llama cuando entran unidades o se liberan.
+func (t *Taller) repartirRepuestos() {
+	libres := map[string]int{}
+	for _, r := range t.Repuestos {
+		libres[r.Referencia] = t.Disponible(r.Referencia)
+	}
+	t.incidencias(func(_ *Vehiculo, inc *Incidencia) {
+		for i := range inc.Piezas {
+			p := &inc.Piezas[i]
+			if p.Consumida || p.Apartadas >= p.Cantidad || libres[p.Referencia] <= 0 {
+				continue
+			}
+			n := min(p.Cantidad-p.Apartadas, libres[p.Referencia])
+			p.Apartadas += n
+			libres[p.Referencia] -= n
+		}
+	})
+}
+
+// consumirPiezas saca del almacén las piezas apartadas de una incidencia que
+// se cierra
+func (t *Taller) consumirPiezas(inc *Incidencia) {
+	for i := range inc.Piezas {
+		p := &inc.Piezas[i]
+		if p.Consumida {
+			continue
+		}
+		if r, _ := t.BuscarRepuesto(p.Referencia); r != nil {
+			r.Stock -= p.Apartadas
+		}
+		p.Consumida = true
+	}
+}
+
+// AvisoExistencias es una pieza que hay que reponer
+type AvisoExistencias struct {
+	Referencia  string
+	Descripcion string
+	Stock       int // unidades en el almacén
+	Disponible  int // sin apartar
+	Pendientes  int // reservadas que esperan unidades
+}
+
+// AvisosExistencias devuelve las piezas agotadas, las que tienen reservas
+// esperando y las que están por debajo de su mínimo
+func (t *Taller) AvisosExistencias() []AvisoExistencias {
+	pendientes := map[string]int{}
+	t.incidencias(func(_ *Vehiculo, inc *Incidencia) {
+		for _, p := range PiezasQueFaltan(inc) {
+			pendientes[p.Referencia] += p.Cantidad - p.Apartadas
+		}
+	})
+	var avisos []AvisoExistencias
+	for _, r := range t.Repuestos {
+		d := t.Disponible(r.Referencia)
+		if d <= 0 || d < r.Minimo || pendientes[r.Referencia] > 0 {
+			avisos = append(avisos, AvisoExistencias{Referencia: r.Referencia, Descripcion: r.Descripcion,
+				Stock: r.Stock, Disponible: d, Pendientes: pendientes[r.Referencia]})
+		}
+	}
+	return avisos
+}
+
+func (a AvisoExistencias) String() string {
+	s := fmt.Sprintf("%s (%s): %d en almacén, %d libres", a.Referencia, a.Descripcion, a.Stock, a.Disponible)
+	if a.Pendientes > 0 {
+		s += fmt.Sprintf(", faltan %d para incidencias en espera", a.Pendientes)
+	}
+	return s
+}
+
+// lineasPiezas prepara las líneas de factura de las piezas que gastó una
+// incidencia, al precio del catálogo
+func (t *Taller) lineasPiezas(inc *Incidencia) []LineaFactura {
+	var lineas []LineaFactura
+	for _, p := range inc.Piezas {
+		r, _ := t.BuscarRepuesto(p.Referencia)
+		if !p.Consumida || p.Apartadas == 0 || r == nil {
+			continue
+		}
+		lineas = append(lineas, LineaFactura{Tipo: LineaPieza, Concepto: r.Descripcion, IDRepuesto: r.Referencia,
+			Cantidad: float64(p.Apartadas), Precio: r.Precio})
+	}
+	return lineas
+}
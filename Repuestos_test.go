@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+)
+
+// TestRepuestos reserva piezas para dos incidencias con menos existencias
+// de las necesarias y comprueba que la que espera no puede pasar a "en
+// proceso" hasta que se reponen, que al cerrar se gastan, que al eliminar
+// un vehículo sus piezas pasan a otra incidencia
+func TestRepuestos(t *testing.T) {
+	var tl Taller
+	ops := []Operacion{
+		{Tipo: OpCrearRepuesto, Repuesto: &Repuesto{Referencia: "FR-01", Descripcion: "Pastillas de freno",
+			Compatibles: LeerCompatibles("Seat/Ibiza, Seat/León"), Coste: 2000, Precio: 3995, Stock: 3, Minimo: 2}},
+		{Tipo: OpCrearRepuesto, Repuesto: &Repuesto{Referencia: "AC-05", Descripcion: "Aceite 5W30", Coste: 600, Precio: 1200, Stock: 10}},
+		{Tipo: OpCrearCliente, IDCliente: 1, Nombre: "Ana"},
+		{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "1111AAA", Marca: "Seat", Modelo: "Ibiza"},
+		{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "2222BBB", Marca: "seat", Modelo: "león"},
+		{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "3333CCC", Marca: "Renault", Modelo: "Clio"},
+		{Tipo: OpCrearIncidencia, Matricula: "1111AAA", IDIncidencia: 1, TipoIncidencia: "mecánica"},
+		{Tipo: OpCrearIncidencia, Matricula: "2222BBB", IDIncidencia: 2, TipoIncidencia: "mecánica"},
+		{Tipo: OpCrearIncidencia, Matricula: "3333CCC", IDIncidencia: 3, TipoIncidencia: "mecánica"},
+		{Tipo: OpPresupuestar, Matricula: "1111AAA", Presupuesto: presupuestoDePrueba()},
+		{Tipo: OpPresupuestar, Matricula: "2222BBB", Presupuesto: presupuestoDePrueba()},
+		{Tipo: OpResponderPresupuesto, Matricula: "1111AAA", Estado: PresupuestoAceptado},
+		{Tipo: OpResponderPresupuesto, Matricula: "2222BBB", Estado: PresupuestoAceptado},
+		{Tipo: OpReservarRepuesto, Matricula: "1111AAA", Referencia: "FR-01", Cantidad: 2},
+		{Tipo: OpReservarRepuesto, Matricula: "1111AAA", Referencia: "AC-05", Cantidad: 4},
+		{Tipo: OpReservarRepuesto, Matricula: "2222BBB", Referencia: "FR-01", Cantidad: 3},
+		{Tipo: OpReservarRepuesto, Matricula: "3333CCC", Referencia: "AC-05", Cantidad: 5},
+	}
+	for _, op := range ops {
+		if err := tl.Aplicar(op); err != nil {
+			t.Fatalf("%s: %v", op.Tipo, err)
+		}
+	}
+	if err := tl.Aplicar(Operacion{Tipo: OpReservarRepuesto, Matricula: "3333CCC", Referencia: "FR-01", Cantidad: 1}); err == nil {
+		t.Fatal("se han reservado pastillas de Seat para un Renault")
+	}
+	if tl.Disponible("FR-01") != 0 || len(tl.AvisosExistencias()) != 1 {
+		t.Fatalf("existencias inesperadas: %d libres, avisos %v", tl.Disponible("FR-01"), tl.AvisosExistencias())
+	}
+	if err := tl.Aplicar(Operacion{Tipo: OpEstadoIncidencia, Matricula: "2222BBB", Estado: "en proceso"}); err == nil {
+		t.Fatal("la incidencia 2 ha pasado a en proceso sin sus piezas")
+	}
+	if err := tl.Aplicar(Operacion{Tipo: OpEstadoIncidencia, Matricula: "1111AAA", Estado: "en proceso"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Llega una unidad: la incidencia 2 sigue esperando la otra
+	tl.Aplicar(Operacion{Tipo: OpEntradaRepuesto, Referencia: "FR-01", Cantidad: 1})
+	if err := tl.Aplicar(Operacion{Tipo: OpEstadoIncidencia, Matricula: "2222BBB", Estado: "en proceso"}); err == nil {
+		t.Fatal("la incidencia 2 ha empezado con una pieza de menos")
+	}
+	// Al cerrar la 1 se gastan sus piezas
+	if err := tl.Aplicar(Operacion{Tipo: OpEstadoIncidencia, Matricula: "1111AAA", Estado: "cerrada"}); err != nil {
+		t.Fatal(err)
+	}
+	fr, _ := tl.BuscarRepuesto("FR-01")
+	ac, _ := tl.BuscarRepuesto("AC-05")
+	if fr.Stock != 2 || ac.Stock != 6 || tl.Disponible("AC-05") != 1 {
+		t.Fatalf("tras cerrar quedan %d pastillas y %d de aceite (%d libres)", fr.Stock, ac.Stock, tl.Disponible("AC-05"))
+	}
+	_, v := tl.BuscarVehiculo("1111AAA")
+	lineas := tl.lineasPiezas(v.GetIncidencia())
+	if len(lineas) != 2 || lineas[0].IDRepuesto != "FR-01" || lineas[0].Cantidad != 2 || lineas[0].Precio != 3995 {
+		t.Fatalf("líneas de factura inesperadas: %+v", lineas)
+	}
+
+	// La incidencia 3 se queda sin vehículo: su aceite pasa a estar libre
+	if err := tl.Aplicar(Operacion{Tipo: OpEliminarVehiculo, Matricula: "3333CCC"}); err != nil {
+		t.Fatal(err)
+	}
+	if tl.Disponible("AC-05") != 6 {
+		t.Fatalf("tras eliminar el vehículo hay %d de aceite libres", tl.Disponible("AC-05"))
+	}
+	if err := tl.Aplicar(Operacion{Tipo: OpEliminarRepuesto, Referencia: "FR-01"}); err == nil {
+		t.Fatal("se ha eliminado un repuesto reservado")
+	}
+	tl.Aplicar(Operacion{Tipo: OpEntradaRepuesto, Referencia: "FR-01", Cantidad: 1})
+	if err := tl.Aplicar(Operacion{Tipo: OpEstadoIncidencia, Matricula: "2222BBB", Estado: "en proceso"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tl.ComprobarConsistencia(); err != nil {
+		t.Fatal(err)
+	}
+}
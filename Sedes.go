@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Sede es un taller de la red de la empresa
+type Sede struct {
+	Nombre    string  `json:"nombre"`
+	Direccion string  `json:"direccion"` // host:puerto en el que atiende a las demás sedes
+	X         float64 `json:"x"`         // posición para calcular distancias (km)
+	Y         float64 `json:"y"`
+	Canal     string  `json:"canal,omitempty"` // host:puerto de los canales de la instantánea global
+}
+
+// EstadoSede resume la disponibilidad de una sede
+type EstadoSede struct {
+	Nombre         string   `json:"nombre"`
+	PlazasLibres   int      `json:"plazasLibres"`
+	Especialidades []string `json:"especialidades"` // de los mecánicos activos
+}
+
+// Tipos de petición entre sedes
+const (
+	pedirEstadoSede   = "estado"
+	prepararTx        = "preparar"          // fase 1 de una transferencia
+	decidirTx         = "decidir"           // fase 2 de una transferencia
+	consultarDecision = "consultarDecision" // un participante en duda pregunta al coordinador
+)
+
+// PeticionSede es lo que una sede envía a otra (una por conexión)
+type PeticionSede struct {
+	Tipo      string     `json:"tipo"`
+	Tx        string     `json:"tx,omitempty"`
+	Origen    string     `json:"origen,omitempty"`    // sede coordinadora de la transacción
+	Decision  string     `json:"decision,omitempty"`  // confirmada o abortada
+	Recepcion *Operacion `json:"recepcion,omitempty"` // vehículo que se transfiere
+	Sello
+}
+
+// RespuestaSede es la respuesta a una PeticionSede
+type RespuestaSede struct {
+	Estado   *EstadoSede `json:"estado,omitempty"`
+	Voto     bool        `json:"voto,omitempty"`
+	Decision string      `json:"decision,omitempty"`
+	Error    string      `json:"error,omitempty"`
+	Sello
+}
+
+// RedSedes conecta este taller con las demás sedes de la empresa
+type RedSedes struct {
+	Propia Sede
+	Otras  []Sede
+	// Relojes lógicos con los que se marcan las peticiones (nil = sin marcas)
+	Relojes *Relojes
+
+	taller   *Taller
+	cerrojo  *sync.Mutex           // para leer el taller
+	ejecutar func(Operacion) error // para modificarlo
+	oyente   net.Listener
+
+	mu              sync.Mutex
+	fallarEn        string // fase de una transferencia en la que simular una caída
+	caida           bool   // caída simulada: no se atiende nada hasta Recuperar
+	transacciones   *RegistroTransacciones
+	coordinadas     map[string]*registroTx
+	participaciones map[string]*registroTx
+	resolviendo     bool
+}
+
+// CargarSedes lee la lista de sedes de un fichero JSON, separa la propia y
+// abre su registro de transacciones en dir
+func CargarSedes(ruta, propia, dir string, t *Taller, cerrojo *sync.Mutex, ejecutar func(Operacion) error) (*RedSedes, error) {
+	datos, err := os.ReadFile(ruta)
+	if err != nil {
+		return nil, err
+	}
+	var sedes []Sede
+	if err := json.Unmarshal(datos, &sedes); err != nil {
+		return nil, err
+	}
+	return NuevaRedSedes(sedes, propia, dir, t, cerrojo, ejecutar)
+}
+
+// NuevaRedSedes crea la red a partir de la lista de sedes, separando la propia
+func NuevaRedSedes(sedes []Sede, propia, dir string, t *Taller, cerrojo *sync.Mutex, ejecutar func(Operacion) error) (*RedSedes, error) {
+	r := &RedSedes{taller: t, cerrojo: cerrojo, ejecutar: ejecutar}
+	encontrada := false
+	for _, s := range sedes {
+		if s.Nombre == propia {
+			r.Propia = s
+			encontrada = true
+		} else {
+			r.Otras = append(r.Otras, s)
+		}
+	}
+	if !encontrada {
+		return nil, fmt.Errorf("la sede %q no está en la lista", propia)
+	}
+	if err := r.abrirTransacciones(dir); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Escuchar atiende las peticiones de las demás sedes
+func (r *RedSedes) Escuchar() error {
+	oyente, err := net.Listen("tcp", r.Propia.Direccion)
+	if err != nil {
+		return err
+	}
+	r.oyente = oyente
+	go func() {
+		for {
+			conn, err := oyente.Accept()
+			if err != nil {
+				return
+			}
+			go r.atender(conn)
+		}
+	}()
+	return nil
+}
+
+// Detener deja de atender peticiones y cierra el registro de transacciones
+func (r *RedSedes) Detener() {
+	if r.oyente != nil {
+		r.oyente.Close()
+	}
+	r.transacciones.Cerrar()
+}
+
+func (r *RedSedes) atender(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	var pet PeticionSede
+	if err := json.NewDecoder(conn).Decode(&pet); err != nil {
+		return
+	}
+	if r.Caida() {
+		return
+	}
+	pet.Recibido(r.Relojes)
+	var resp RespuestaSede
+	switch pet.Tipo {
+	case pedirEstadoSede:
+		e := r.EstadoLocal()
+		resp.Estado = &e
+	case prepararTx:
+		resp = r.prepararDestino(pet)
+	case decidirTx:
+		if err := r.aplicarDecision(pet.Tx, pet.Decision); err != nil {
+			resp.Error = err.Error()
+		}
+	case consultarDecision:
+		resp.Decision = r.decisionDe(pet.Tx)
+	default:
+		resp.Error = "petición desconocida"
+	}
+	// Una caída simulada durante la petición deja al otro sin respuesta
+	if r.Caida() {
+		return
+	}
+	resp.Sellar(r.Relojes)
+	json.NewEncoder(conn).Encode(resp)
+}
+
+// EstadoLocal devuelve las plazas libres y especialidades activas de esta sede
+func (r *RedSedes) EstadoLocal() EstadoSede {
+	r.cerrojo.Lock()
+	defer r.cerrojo.Unlock()
+	return estadoDeTaller(r.Propia.Nombre, r.taller)
+}
+
+// estadoDeTaller resume las plazas libres y las especialidades disponibles
+// de un taller; se llama con su cerrojo tomado
+func estadoDeTaller(nombre string, t *Taller) EstadoSede {
+	_, libres := t.EstadoTaller()
+	e := EstadoSede{Nombre: nombre, PlazasLibres: libres}
+	vistas := map[string]bool{}
+	for _, m := range t.ListarMecanicosDisponibles(relojFisico.Fecha()) {
+		if !vistas[m.Especialidad] {
+			vistas[m.Especialidad] = true
+			e.Especialidades = append(e.Especialidades, m.Especialidad)
+		}
+	}
+	return e
+}
+
+// ConsultarEstado pide su estado a otra sede
+func (r *RedSedes) ConsultarEstado(s Sede) (EstadoSede, error) {
+	resp, err := r.llamar(s.Direccion, PeticionSede{Tipo: pedirEstadoSede})
+	if err != nil {
+		return EstadoSede{}, err
+	}
+	if resp.Estado == nil {
+		return EstadoSede{}, errors.New("respuesta sin estado")
+	}
+	return *resp.Estado, nil
+}
+
+// Distancia devuelve la distancia en km entre esta sede y s
+func (r *RedSedes) Distancia(s Sede) float64 {
+	return math.Hypot(s.X-r.Propia.X, s.Y-r.Propia.Y)
+}
+
+// BuscarCercana devuelve la sede más cercana (incluida la propia) que tenga
+// plazas libres, si conPlaza, y un mecánico activo de la especialidad, si no
+// está vacía. Las sedes que no responden se ignoran.
+func (r *RedSedes) BuscarCercana(especialidad string, conPlaza bool) (Sede, EstadoSede, error) {
+	var mejor Sede
+	var mejorEstado EstadoSede
+	dist := math.Inf(1)
+	candidatas := append([]Sede{r.Propia}, r.Otras...)
+	for _, s := range candidatas {
+		var e EstadoSede
+		if s.Nombre == r.Propia.Nombre {
+			e = r.EstadoLocal()
+		} else {
+			var err error
+			if e, err = r.ConsultarEstado(s); err != nil {
+				continue
+			}
+		}
+		if conPlaza && e.PlazasLibres == 0 {
+			continue
+		}
+		if especialidad != "" && !contiene(e.Especialidades, especialidad) {
+			continue
+		}
+		if d := r.Distancia(s); d < dist {
+			mejor, mejorEstado, dist = s, e, d
+		}
+	}
+	if math.IsInf(dist, 1) {
+		return Sede{}, EstadoSede{}, errors.New("ninguna sede cumple los requisitos")
+	}
+	return mejor, mejorEstado, nil
+}
+
+// buscarSede devuelve la sede con ese nombre (nil si no es de la red)
+func (r *RedSedes) buscarSede(nombre string) *Sede {
+	for i := range r.Otras {
+		if r.Otras[i].Nombre == nombre {
+			return &r.Otras[i]
+		}
+	}
+	return nil
+}
+
+// operacionRecepcion describe el vehículo, su cliente y su incidencia como
+// una OpRecibirVehiculo para darlo de alta en otro taller. La incidencia
+// viaja entera (historial, piezas, sesiones y presupuestos) salvo sus
+// mecánicos, que son de esta sede.
+func operacionRecepcion(t *Taller, matricula string) (Operacion, error) {
+	c, v := t.BuscarVehiculo(matricula)
+	if v == nil {
+		return Operacion{}, errors.New("vehículo no encontrado")
+	}
+	op := Operacion{
+		Tipo:         OpRecibirVehiculo,
+		IDCliente:    c.IDCliente,
+		Nombre:       c.Nombre,
+		Telefono:     c.Telefono,
+		Email:        c.Email,
+		Matricula:    v.Matricula,
+		Marca:        v.Marca,
+		Modelo:       v.Modelo,
+		FechaEntrada: v.FechaEntrada,
+		FechaSalida:  v.FechaSalida,
+	}
+	if inc := v.GetIncidencia(); inc != nil {
+		op.IDIncidencia = inc.IDIncidencia
+		op.TipoIncidencia = inc.Tipo
+		op.Prioridad = inc.Prioridad
+		op.Descripcion = inc.Descripcion
+		op.Estado = inc.Estado
+	}
+	vd := datosVehiculo(v)
+	vd.Saliendo = ""
+	if vd.Incidencia != nil {
+		vd.Incidencia.Mecanicos = nil
+	}
+	op.Cliente = &ClienteDatos{IDCliente: c.IDCliente, Nombre: c.Nombre, Telefono: c.Telefono, Email: c.Email,
+		Vehiculos: []VehiculoDatos{vd}}
+	return op, nil
+}
+
+// llamar envía una petición a la sede que atiende en direccion y espera su
+// respuesta
+func (r *RedSedes) llamar(direccion string, pet PeticionSede) (RespuestaSede, error) {
+	var resp RespuestaSede
+	pet.Sellar(r.Relojes)
+	conn, err := net.DialTimeout("tcp", direccion, 2*time.Second)
+	if err != nil {
+		return resp, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := json.NewEncoder(conn).Encode(pet); err != nil {
+		return resp, err
+	}
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return resp, err
+	}
+	resp.Recibido(r.Relojes)
+	return resp, nil
+}
+
+func contiene(lista []string, s string) bool {
+	for _, x := range lista {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
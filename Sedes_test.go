@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// TestRecepcionIncidenciaCompleta transfiere un vehículo en plena
+// reparación y comprueba que la incidencia llega entera al destino, sin los
+// mecánicos del origen, con la sesión abierta cortada y las piezas apartadas
+// del almacén del destino
+func TestRecepcionIncidenciaCompleta(t *testing.T) {
+	var origen, destino Taller
+	for _, op := range []Operacion{
+		{Tipo: OpCrearMecanico, IDMecanico: 1, Nombre: "Laura", Especialidad: "mecánica"},
+		{Tipo: OpCrearRepuesto, Repuesto: &Repuesto{Referencia: "FR-01", Descripcion: "Pastillas de freno", Coste: 20, Precio: 35, Stock: 5}},
+		{Tipo: OpCrearCliente, IDCliente: 1, Nombre: "Ana", Email: "ana@ejemplo.es"},
+		{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "1234ABC", Marca: "Seat", Modelo: "Ibiza"},
+		{Tipo: OpCrearIncidencia, Matricula: "1234ABC", IDIncidencia: 7, TipoIncidencia: "mecánica", Fecha: "2026-03-02T08:00:00.000Z"},
+		{Tipo: OpAsignarPlaza, Matricula: "1234ABC", IDMecanico: 1, IDPlaza: 1},
+		{Tipo: OpPresupuestar, Matricula: "1234ABC", Presupuesto: presupuestoDePrueba(), Fecha: "2026-03-02T08:30:00.000Z"},
+		{Tipo: OpResponderPresupuesto, Matricula: "1234ABC", Estado: PresupuestoAceptado},
+		{Tipo: OpReservarRepuesto, Matricula: "1234ABC", Referencia: "FR-01", Cantidad: 2},
+		{Tipo: OpEstadoIncidencia, Matricula: "1234ABC", Estado: "en proceso", Fecha: "2026-03-02T09:00:00.000Z"},
+		{Tipo: OpIniciarTrabajo, Matricula: "1234ABC", IDMecanico: 1, Fecha: "2026-03-02T09:00:00.000Z"},
+	} {
+		if err := origen.Aplicar(op); err != nil {
+			t.Fatalf("%s: %v", op.Tipo, err)
+		}
+	}
+	// En el destino el mecánico 1 es otra persona y solo hay una pieza
+	destino.Aplicar(Operacion{Tipo: OpCrearMecanico, IDMecanico: 1, Nombre: "Pedro", Especialidad: "eléctrica"})
+	destino.Aplicar(Operacion{Tipo: OpCrearRepuesto, Repuesto: &Repuesto{Referencia: "FR-01", Descripcion: "Pastillas de freno", Coste: 20, Precio: 35, Stock: 1}})
+
+	op, err := operacionRecepcion(&origen, "1234ABC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// La operación pasa por la red y por el registro de transacciones
+	datos, _ := json.Marshal(op)
+	op = Operacion{}
+	json.Unmarshal(datos, &op)
+	op.Fecha = "2026-03-02T10:00:00.000Z"
+	if err := destino.Aplicar(op); err != nil {
+		t.Fatal(err)
+	}
+
+	_, antes := origen.BuscarVehiculo("1234ABC")
+	_, v := destino.BuscarVehiculo("1234ABC")
+	if v == nil || v.GetIncidencia() == nil {
+		t.Fatal("el vehículo llega sin incidencia")
+	}
+	llegada, salida := v.GetIncidencia(), antes.GetIncidencia()
+	if llegada.IDIncidencia != 7 || llegada.Estado != "en proceso" || len(llegada.Cambios) != len(salida.Cambios) {
+		t.Fatalf("historial: llega %d %q %+v", llegada.IDIncidencia, llegada.Estado, llegada.Cambios)
+	}
+	if len(llegada.Presupuestos) != 1 || llegada.Presupuestos[0].Estado != PresupuestoAceptado {
+		t.Fatalf("presupuestos: %+v", llegada.Presupuestos)
+	}
+	if len(llegada.GetMecanicos()) != 0 {
+		t.Fatal("la incidencia llega con un mecánico del destino que no ha trabajado en ella")
+	}
+	if len(llegada.Sesiones) != 1 || llegada.Sesiones[0].Fin != op.Fecha {
+		t.Fatalf("sesiones: %+v", llegada.Sesiones)
+	}
+	if len(llegada.Piezas) != 1 || llegada.Piezas[0].Cantidad != 2 || llegada.Piezas[0].Apartadas != 1 {
+		t.Fatalf("piezas: %+v", llegada.Piezas)
+	}
+	if err := destino.ComprobarConsistencia(); err != nil {
+		t.Fatal(err)
+	}
+}
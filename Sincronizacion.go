@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Algoritmos de sincronización de relojes físicos
+const (
+	SincCristian = "cristian" // se pide la hora a un servidor y se descuenta media ida y vuelta
+	SincBerkeley = "berkeley" // un coordinador promedia las horas de todos y reparte los ajustes
+)
+
+// FormatoFecha es el formato de las horas que el taller apunta por sí mismo
+// (entradas, salidas y cambios de estado de las incidencias)
+const FormatoFecha = "2006-01-02T15:04:05.000Z07:00"
+
+// RelojFisico es el reloj de pared de un nodo: la hora del sistema más un
+// desfase simulado (para probar con máquinas desajustadas) más la corrección
+// que calcula la sincronización. Admite un receptor nil (hora del sistema).
+type RelojFisico struct {
+	mu         sync.Mutex
+	desfase    time.Duration
+	correccion time.Duration
+}
+
+// NuevoRelojFisico crea un reloj que se adelanta desfase respecto al sistema
+func NuevoRelojFisico(desfase time.Duration) *RelojFisico {
+	return &RelojFisico{desfase: desfase}
+}
+
+// Ahora devuelve la hora corregida del nodo
+func (r *RelojFisico) Ahora() time.Time {
+	if r == nil {
+		return time.Now()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return time.Now().Add(r.desfase + r.correccion)
+}
+
+// Fecha devuelve la hora corregida con FormatoFecha
+func (r *RelojFisico) Fecha() string { return r.Ahora().UTC().Format(FormatoFecha) }
+
+// Ajustar suma d a la corrección del reloj. El ajuste es de golpe: una hora
+// apuntada justo después puede ser anterior a otra apuntada justo antes.
+func (r *RelojFisico) Ajustar(d time.Duration) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.correccion += d
+}
+
+// Correccion devuelve el ajuste acumulado desde que arrancó el nodo
+func (r *RelojFisico) Correccion() time.Duration {
+	if r == nil {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.correccion
+}
+
+// Tipos de mensaje de la sincronización
+const (
+	horaPedir   = "hora"   // ¿qué hora tienes? Se responde con la hora actual
+	horaAjustar = "ajuste" // suma Ajuste a tu reloj (Berkeley); se responde con la hora ya ajustada
+)
+
+// MensajeHora es una petición o respuesta de la sincronización; cada petición
+// va en su propia conexión y se responde en ella
+type MensajeHora struct {
+	Tipo   string        `json:"tipo"`
+	Hora   int64         `json:"hora,omitempty"` // nanosegundos Unix
+	Ajuste time.Duration `json:"ajuste,omitempty"`
+	Sello
+}
+
+// NodoHora sincroniza el RelojFisico de un nodo con los de los demás. Atiende
+// las peticiones de hora y de ajuste que le llegan y, con Iniciar, se
+// sincroniza cada Periodo con Cristian (contra un servidor) o Berkeley
+// (como coordinador de un grupo).
+type NodoHora struct {
+	Reloj      *RelojFisico
+	Periodo    time.Duration
+	Espera     time.Duration // plazo de cada petición
+	Muestras   int           // peticiones por medida; se queda con la de menor ida y vuelta
+	Tolerancia time.Duration // Berkeley: relojes más alejados de la mediana no entran en la media
+	// Relojes lógicos con los que se marcan los mensajes (nil = sin marcas)
+	Relojes *Relojes
+
+	direccion string
+	oyente    net.Listener
+	parar     chan struct{}
+
+	mu     sync.Mutex
+	ultima string // resultado de la última sincronización
+}
+
+// NuevoNodoHora crea el nodo que atiende en direccion ("" = no atiende
+// peticiones, solo se sincroniza con otros) y corrige reloj
+func NuevoNodoHora(direccion string, reloj *RelojFisico) *NodoHora {
+	return &NodoHora{
+		Reloj:      reloj,
+		Periodo:    30 * time.Second,
+		Espera:     time.Second,
+		Muestras:   5,
+		Tolerancia: 10 * time.Second,
+		direccion:  direccion,
+		parar:      make(chan struct{}),
+	}
+}
+
+// Escuchar atiende las peticiones de hora y de ajuste de los demás nodos
+func (n *NodoHora) Escuchar() error {
+	if n.direccion == "" {
+		return nil
+	}
+	oyente, err := net.Listen("tcp", n.direccion)
+	if err != nil {
+		return err
+	}
+	n.oyente = oyente
+	go func() {
+		for {
+			conn, err := oyente.Accept()
+			if err != nil {
+				return
+			}
+			go n.atender(conn)
+		}
+	}()
+	return nil
+}
+
+// Iniciar se sincroniza ahora y después cada Periodo: con Cristian contra
+// objetivos[0] o con Berkeley coordinando a todos los objetivos
+func (n *NodoHora) Iniciar(algoritmo string, objetivos []string) error {
+	if algoritmo != SincCristian && algoritmo != SincBerkeley {
+		return fmt.Errorf("algoritmo de sincronización desconocido: %q", algoritmo)
+	}
+	if len(objetivos) == 0 || objetivos[0] == "" {
+		return errors.New("falta el servidor de hora o los nodos que sincronizar")
+	}
+	go func() {
+		tick := time.NewTicker(n.Periodo)
+		defer tick.Stop()
+		for {
+			var err error
+			if algoritmo == SincCristian {
+				_, err = n.Cristian(objetivos[0])
+			} else {
+				_, err = n.Berkeley(objetivos)
+			}
+			if err != nil {
+				n.anotar(fmt.Sprintf("%s fallida: %v", algoritmo, err))
+			}
+			select {
+			case <-n.parar:
+				return
+			case <-tick.C:
+			}
+		}
+	}()
+	return nil
+}
+
+// Detener deja de atender peticiones y de sincronizarse
+func (n *NodoHora) Detener() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	select {
+	case <-n.parar:
+		return
+	default:
+	}
+	close(n.parar)
+	if n.oyente != nil {
+		n.oyente.Close()
+	}
+}
+
+// Estado resume el reloj y la última sincronización para mostrarlo por consola
+func (n *NodoHora) Estado() string {
+	n.mu.Lock()
+	ultima := n.ultima
+	n.mu.Unlock()
+	if ultima == "" {
+		ultima = "sin sincronizar todavía"
+	}
+	return fmt.Sprintf("Hora:%s | Corrección:%v | %s", n.Reloj.Fecha(), n.Reloj.Correccion(), ultima)
+}
+
+func (n *NodoHora) anotar(s string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.ultima = s
+}
+
+func (n *NodoHora) atender(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(n.Espera))
+	var m MensajeHora
+	if err := json.NewDecoder(conn).Decode(&m); err != nil {
+		return
+	}
+	m.Recibido(n.Relojes)
+	if m.Tipo == horaAjustar {
+		n.Reloj.Ajustar(m.Ajuste)
+		n.anotar(fmt.Sprintf("berkeley: ajuste de %v recibido del coordinador", m.Ajuste))
+	}
+	resp := MensajeHora{Tipo: m.Tipo, Hora: n.Reloj.Ahora().UnixNano()}
+	resp.Sellar(n.Relojes)
+	json.NewEncoder(conn).Encode(resp)
+}
+
+// pedir envía un mensaje a otro nodo y devuelve su respuesta
+func (n *NodoHora) pedir(direccion string, m MensajeHora) (MensajeHora, error) {
+	var resp MensajeHora
+	conn, err := net.DialTimeout("tcp", direccion, n.Espera)
+	if err != nil {
+		return resp, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(n.Espera))
+	m.Sellar(n.Relojes)
+	if err := json.NewEncoder(conn).Encode(m); err != nil {
+		return resp, err
+	}
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return resp, err
+	}
+	resp.Recibido(n.Relojes)
+	return resp, nil
+}
+
+// medir estima cuánto va adelantado el reloj de otro nodo respecto al propio
+// con el método de Cristian: su hora más media ida y vuelta, menos la propia
+// al recibirla. Se queda con la muestra de menor ida y vuelta, la más fiable.
+func (n *NodoHora) medir(direccion string) (desfase, idaYVuelta time.Duration, err error) {
+	muestras := n.Muestras
+	if muestras < 1 {
+		muestras = 1
+	}
+	validas := 0
+	for i := 0; i < muestras; i++ {
+		inicio := time.Now()
+		resp, errPedir := n.pedir(direccion, MensajeHora{Tipo: horaPedir})
+		rtt := time.Since(inicio)
+		if errPedir != nil {
+			err = errPedir
+			continue
+		}
+		local := n.Reloj.Ahora()
+		if validas == 0 || rtt < idaYVuelta {
+			desfase = time.Unix(0, resp.Hora).Add(rtt / 2).Sub(local)
+			idaYVuelta = rtt
+		}
+		validas++
+	}
+	if validas == 0 {
+		return 0, 0, err
+	}
+	return desfase, idaYVuelta, nil
+}
+
+// Cristian ajusta el reloj propio a la hora del servidor y devuelve el ajuste
+func (n *NodoHora) Cristian(servidor string) (time.Duration, error) {
+	desfase, rtt, err := n.medir(servidor)
+	if err != nil {
+		return 0, err
+	}
+	n.Reloj.Ajustar(desfase)
+	n.anotar(fmt.Sprintf("cristian con %s: ajuste de %v (ida y vuelta %v)", servidor, desfase, rtt))
+	return desfase, nil
+}
+
+// Berkeley actúa como coordinador: mide el desfase de cada nodo de pares,
+// promedia los que no se alejan de la mediana más de Tolerancia (incluido el
+// propio, que es 0) y envía a cada nodo lo que le falta para llegar a la
+// media, también a los descartados. Devuelve el ajuste aplicado a cada nodo
+// ("" = el coordinador). Los nodos que no responden se quedan sin ajustar.
+func (n *NodoHora) Berkeley(pares []string) (map[string]time.Duration, error) {
+	desfases := map[string]time.Duration{"": 0}
+	for _, dir := range pares {
+		if dir == n.direccion {
+			continue
+		}
+		if d, _, err := n.medir(dir); err == nil {
+			desfases[dir] = d
+		}
+	}
+	if len(desfases) == 1 {
+		return nil, errors.New("ningún nodo ha respondido")
+	}
+
+	var orden []time.Duration
+	for _, d := range desfases {
+		orden = append(orden, d)
+	}
+	sort.Slice(orden, func(i, j int) bool { return orden[i] < orden[j] })
+	mediana := orden[len(orden)/2]
+	var suma time.Duration
+	var cuenta int
+	for _, d := range orden {
+		if diferencia := d - mediana; diferencia <= n.Tolerancia && diferencia >= -n.Tolerancia {
+			suma += d
+			cuenta++
+		}
+	}
+	media := suma / time.Duration(cuenta)
+
+	ajustes := map[string]time.Duration{}
+	var fallidos []string
+	for dir, d := range desfases {
+		if dir == "" {
+			continue
+		}
+		if _, err := n.pedir(dir, MensajeHora{Tipo: horaAjustar, Ajuste: media - d}); err != nil {
+			fallidos = append(fallidos, dir)
+			continue
+		}
+		ajustes[dir] = media - d
+	}
+	n.Reloj.Ajustar(media)
+	ajustes[""] = media
+	resumen := fmt.Sprintf("berkeley como coordinador: %d nodos en la media, ajuste propio de %v", cuenta, media)
+	if len(fallidos) > 0 {
+		sort.Strings(fallidos)
+		resumen += ", sin ajustar " + strings.Join(fallidos, ",")
+	}
+	n.anotar(resumen)
+	return ajustes, nil
+}
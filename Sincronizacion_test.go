@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// margenHora es lo que se admite entre dos relojes sincronizados en la
+// misma máquina
+const margenHora = 25 * time.Millisecond
+
+// nodoHoraPrueba arranca un nodo cuyo reloj va desfase por delante del
+// sistema
+func nodoHoraPrueba(t *testing.T, puerto int, desfase time.Duration) *NodoHora {
+	t.Helper()
+	n := NuevoNodoHora(fmt.Sprintf("localhost:%d", puerto), NuevoRelojFisico(desfase))
+	n.Tolerancia = 5 * time.Second
+	if err := n.Escuchar(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(n.Detener)
+	return n
+}
+
+// cerca dice si d está a menos de margenHora de esperado
+func cerca(d, esperado time.Duration) bool {
+	return d-esperado <= margenHora && esperado-d <= margenHora
+}
+
+// TestCristianDesfase sincroniza con un servidor a la hora del sistema un
+// cliente adelantado 3 s y otro atrasado 2 s: cada uno mide su desfase y se
+// corrige justo eso
+func TestCristianDesfase(t *testing.T) {
+	servidor := nodoHoraPrueba(t, 9621, 0)
+	for k, desfase := range []time.Duration{3 * time.Second, -2 * time.Second} {
+		cliente := nodoHoraPrueba(t, 9622+k, desfase)
+		ajuste, err := cliente.Cristian(servidor.direccion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cerca(ajuste, -desfase) || !cerca(cliente.Reloj.Correccion(), -desfase) {
+			t.Errorf("desfase %v: ajuste de %v y corrección de %v", desfase, ajuste, cliente.Reloj.Correccion())
+		}
+		if d := cliente.Reloj.Ahora().Sub(servidor.Reloj.Ahora()); !cerca(d, 0) {
+			t.Errorf("desfase %v: tras sincronizar el cliente sigue a %v del servidor", desfase, d)
+		}
+	}
+}
+
+// TestBerkeleyAjustes coordina cuatro nodos desajustados, uno de ellos
+// tanto que no entra en la media: la media de 0, 2 s y -1 s queda 1/3 s
+// por delante del coordinador y cada nodo, también el descartado, recibe lo
+// que le falta para llegar a ella
+func TestBerkeleyAjustes(t *testing.T) {
+	desfases := []time.Duration{0, 2 * time.Second, -time.Second, 40 * time.Second}
+	var nodos []*NodoHora
+	var pares []string
+	for i, d := range desfases {
+		n := nodoHoraPrueba(t, 9631+i, d)
+		nodos = append(nodos, n)
+		pares = append(pares, n.direccion)
+	}
+	ajustes, err := nodos[0].Berkeley(pares)
+	if err != nil {
+		t.Fatal(err)
+	}
+	media := time.Second / 3
+	for i, n := range nodos {
+		clave := pares[i]
+		if i == 0 {
+			clave = ""
+		}
+		if esperado := media - desfases[i]; !cerca(ajustes[clave], esperado) || !cerca(n.Reloj.Correccion(), esperado) {
+			t.Errorf("nodo %d (desfase %v): ajuste de %v y corrección de %v en vez de %v",
+				i, desfases[i], ajustes[clave], n.Reloj.Correccion(), esperado)
+		}
+		if d := n.Reloj.Ahora().Sub(nodos[0].Reloj.Ahora()); !cerca(d, 0) {
+			t.Errorf("nodo %d: tras sincronizar sigue a %v del coordinador", i, d)
+		}
+	}
+}
@@ -1,16 +1,34 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
 	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 // Taller representa el sistema general del taller
 type Taller struct {
-	MaxPlazas       int         // número máximo de plazas del taller (2 por mecánico)
-	ClientesTaller  []*Cliente  // lista de clientes registrados
-	MecanicosTaller []*Mecanico // lista de mecánicos disponibles
-	PlazasTaller    []*Plaza    // lista de plazas del taller
+	MaxPlazas       int             // número máximo de plazas del taller (2 por mecánico)
+	ClientesTaller  []*Cliente      // lista de clientes registrados
+	MecanicosTaller []*Mecanico     // lista de mecánicos disponibles
+	PlazasTaller    []*Plaza        // lista de plazas del taller
+	Facturas        []*Factura      // facturas emitidas, en orden de emisión
+	Repuestos       []*Repuesto     // catálogo de piezas con sus existencias
+	Proveedores     []*Proveedor    // empresas a las que se piden repuestos
+	Pedidos         []*Pedido       // pedidos de repuestos a proveedores
+	Citas           []*Cita         // citas pedidas, con las ya atendidas o canceladas
+	Pagos           []*Pago         // cobros y devoluciones de las facturas, en orden
+	Sesiones        []SesionTrabajo // ratos de trabajo de los mecánicos, aunque el vehículo ya no esté
+
+	eventos []Evento // eventos de la última operación aplicada (ver Eventos)
 }
 
 // Plaza representa una plaza física dentro del taller
@@ -19,6 +37,7 @@ type Plaza struct {
 	ocupada  bool      // true si la plaza está ocupada
 	cliente  *Cliente  // cliente asociado a la plaza (si hay vehículo)
 	mecanico *Mecanico // mecánico asignado a esa plaza
+	reserva  string    // transacción que tiene reservada la plaza ("" = sin reserva)
 }
 
 // Cliente representa a un cliente del taller
@@ -38,16 +57,41 @@ type Vehiculo struct {
 	FechaEntrada string      // fecha de entrada al taller
 	FechaSalida  string      // fecha estimada o real de salida
 	incidencia   *Incidencia // incidencia actual asociada al vehículo
+	saliendo     string      // transacción que lo está transfiriendo a otra sede ("" = ninguna)
 }
 
 // Incidencia representa un trabajo o avería a reparar
 type Incidencia struct {
-	IDIncidencia int         // identificador único de la incidencia
-	mecanicos    []*Mecanico // lista de mecánicos asignados a la incidencia
-	Tipo         string      // tipo de incidencia: "mecánica", "eléctrica" o "carrocería"
-	Prioridad    string      // nivel de prioridad: "baja", "media" o "alta"
-	Descripcion  string      // descripción breve del problema
-	Estado       string      // estado actual: "abierta", "en proceso" o "cerrada"
+	IDIncidencia int               // identificador único de la incidencia
+	mecanicos    []*Mecanico       // lista de mecánicos asignados a la incidencia
+	Tipo         string            // tipo de incidencia: "mecánica", "eléctrica" o "carrocería"
+	Prioridad    string            // nivel de prioridad: "baja", "media" o "alta"
+	Descripcion  string            // descripción breve del problema
+	Estado       string            // estado actual: "abierta", "en proceso" o "cerrada"
+	Cambios      []CambioEstado    // estados por los que ha pasado, con la hora sincronizada
+	Piezas       []PiezaIncidencia // repuestos reservados para la reparación
+	Sesiones     []SesionTrabajo   // ratos que ha trabajado cada mecánico
+	Presupuestos []Presupuesto     // versiones del presupuesto, la última al final
+}
+
+// EstadosIncidencia son los estados de una incidencia, en el orden en que
+// los recorre
+var EstadosIncidencia = []string{"abierta", "en proceso", "cerrada"}
+
+// siguientesEstados son los cambios que admite OpEstadoIncidencia desde cada
+// estado: se empieza la reparación, se devuelve a la cola o se termina. Solo
+// se cierra lo que se ha reparado, así que una incidencia abierta no pasa a
+// cerrada sin empezarse (si no se va a reparar, se elimina); una cerrada ya
+// no cambia.
+var siguientesEstados = map[string][]string{
+	"abierta":    {"en proceso"},
+	"en proceso": {"abierta", "cerrada"},
+}
+
+// CambioEstado es una transición de una incidencia y cuándo ocurrió
+type CambioEstado struct {
+	Estado string `json:"estado"`
+	Fecha  string `json:"fecha,omitempty"` // hora sincronizada entre nodos ("" = desconocida)
 }
 
 // Mecanico representa a un trabajador del taller
@@ -57,11 +101,21 @@ type Mecanico struct {
 	Especialidad     string // área de especialidad: "mecánica", "eléctrica" o "carrocería"
 	AniosExperiencia int    // años de experiencia en el taller
 	Activo           bool   // true = activo, false = de baja
+	Inaccesible      bool   // su terminal ha dejado de enviar latidos
+
+	// Jornada semanal (sin turnos trabaja a cualquier hora) y vacaciones,
+	// bajas y días libres; ver Turnos.go
+	Turnos    []Turno    `json:",omitempty"`
+	Ausencias []Ausencia `json:",omitempty"`
 }
 
 // MÉTODOS
 
 func (t *Taller) InicializarPlazas() {
+	// Las plazas se crean de nuevo, libres: se avisa de las que no lo estaban
+	for _, p := range t.PlazasTaller {
+		t.anotarLibre(p)
+	}
 	t.MaxPlazas = 2 * len(t.MecanicosTaller)
 	t.PlazasTaller = make([]*Plaza, t.MaxPlazas)
 	for i := 0; i < t.MaxPlazas; i++ {
@@ -71,7 +125,7 @@ func (t *Taller) InicializarPlazas() {
 
 func (t *Taller) EstadoTaller() (ocupadas, libres int) {
 	for _, p := range t.PlazasTaller {
-		if p.ocupada {
+		if !p.EstaLibre() {
 			ocupadas++
 		}
 	}
@@ -90,28 +144,179 @@ func (t *Taller) BuscarVehiculo(matricula string) (*Cliente, *Vehiculo) {
 	return nil, nil
 }
 
-func (t *Taller) ListarMecanicosDisponibles() []*Mecanico {
+func (t *Taller) BuscarCliente(id int) (*Cliente, int) {
+	for idx, c := range t.ClientesTaller {
+		if c.IDCliente == id {
+			return c, idx
+		}
+	}
+	return nil, -1
+}
+
+func (t *Taller) BuscarMecanico(id int) (*Mecanico, int) {
+	for idx, m := range t.MecanicosTaller {
+		if m.IDMecanico == id {
+			return m, idx
+		}
+	}
+	return nil, -1
+}
+
+func (t *Taller) BuscarPlaza(id int) *Plaza {
+	for _, p := range t.PlazasTaller {
+		if p.IDPlaza == id {
+			return p
+		}
+	}
+	return nil
+}
+
+func (t *Taller) LiberarPlazasDeCliente(c *Cliente) {
+	for _, p := range t.PlazasTaller {
+		if p.ocupada && p.cliente == c {
+			t.LiberarPlaza(p)
+		}
+	}
+}
+
+func (t *Taller) LiberarPlazasDeMecanico(m *Mecanico) {
+	for _, p := range t.PlazasTaller {
+		if p.ocupada && p.mecanico == m {
+			t.LiberarPlaza(p)
+		}
+	}
+}
+
+// RetirarMecanicoInaccesible devuelve a la cola las incidencias en proceso
+// del mecánico y pasa sus plazas a otro disponible, preferentemente de la
+// misma especialidad y con menos plazas; si no hay ninguno, las libera
+func (t *Taller) RetirarMecanicoInaccesible(m *Mecanico, fecha string) {
+	for _, c := range t.ClientesTaller {
+		for _, v := range c.Vehiculos {
+			inc := v.GetIncidencia()
+			if inc == nil {
+				continue
+			}
+			for _, x := range inc.GetMecanicos() {
+				if x == m {
+					inc.QuitarMecanico(m)
+					if inc.GetEstado() == "en proceso" {
+						t.CambiarEstadoIncidencia(inc, "abierta", fecha)
+					}
+					break
+				}
+			}
+		}
+	}
+	for _, p := range t.PlazasTaller {
+		if p.mecanico != m {
+			continue
+		}
+		sustituto := t.sustitutoDe(m, fecha)
+		switch {
+		case sustituto != nil:
+			p.mecanico = sustituto
+		case p.ocupada:
+			t.LiberarPlaza(p)
+		case p.reserva == "":
+			p.mecanico = nil
+		}
+	}
+}
+
+// sustitutoDe elige el mecánico disponible en esa fecha que hereda una
+// plaza de m
+func (t *Taller) sustitutoDe(m *Mecanico, fecha string) *Mecanico {
+	carga := map[*Mecanico]int{}
+	for _, p := range t.PlazasTaller {
+		if p.mecanico != nil {
+			carga[p.mecanico]++
+		}
+	}
+	var mejor *Mecanico
+	for _, x := range t.ListarMecanicosDisponibles(fecha) {
+		if mejor == nil {
+			mejor = x
+			continue
+		}
+		mismaX, mismaMejor := x.Especialidad == m.Especialidad, mejor.Especialidad == m.Especialidad
+		if mismaX && !mismaMejor || mismaX == mismaMejor && carga[x] < carga[mejor] {
+			mejor = x
+		}
+	}
+	return mejor
+}
+
+// ListarMecanicosDisponibles devuelve los mecánicos disponibles y de turno
+// en esa fecha (ver DisponibleEn)
+func (t *Taller) ListarMecanicosDisponibles(fecha string) []*Mecanico {
 	var out []*Mecanico
 	for _, m := range t.MecanicosTaller {
-		if m.Activo {
+		if m.DisponibleEn(fecha) {
 			out = append(out, m)
 		}
 	}
 	return out
 }
 
+// OcuparPlaza ocupa la plaza y anota el evento
+func (t *Taller) OcuparPlaza(p *Plaza, c *Cliente, m *Mecanico) {
+	p.Ocupar(c, m)
+	e := Evento{Tema: TemaPlazaOcupada, IDPlaza: p.IDPlaza}
+	if c != nil {
+		e.IDCliente = c.IDCliente
+	}
+	if m != nil {
+		e.IDMecanico = m.IDMecanico
+	}
+	t.anotar(e)
+}
+
+// LiberarPlaza libera la plaza y, si no estaba libre, anota el evento
+func (t *Taller) LiberarPlaza(p *Plaza) {
+	t.anotarLibre(p)
+	p.Liberar()
+}
+
+func (t *Taller) anotarLibre(p *Plaza) {
+	if !p.EstaLibre() {
+		e := Evento{Tema: TemaPlazaLibre, IDPlaza: p.IDPlaza}
+		if p.cliente != nil {
+			e.IDCliente = p.cliente.IDCliente
+		}
+		t.anotar(e)
+	}
+}
+
+// CambiarEstadoIncidencia cambia el estado de la incidencia, lo apunta en
+// su historial y anota los eventos
+func (t *Taller) CambiarEstadoIncidencia(i *Incidencia, estado, fecha string) {
+	i.CambiarEstado(estado, fecha)
+	t.anotar(Evento{Tema: TemaEstadoIncidencia, IDIncidencia: i.IDIncidencia, Estado: estado})
+	if estado == "cerrada" {
+		t.anotar(Evento{Tema: TemaIncidenciaCerrada, IDIncidencia: i.IDIncidencia, Estado: estado})
+	}
+}
+
 // --- Plaza
 func (p *Plaza) Ocupar(c *Cliente, m *Mecanico) {
 	p.ocupada = true
 	p.cliente = c
 	p.mecanico = m
+	p.reserva = ""
 }
 func (p *Plaza) Liberar() {
 	p.ocupada = false
 	p.cliente = nil
 	p.mecanico = nil
+	p.reserva = ""
+}
+func (p *Plaza) Reservar(tx string, m *Mecanico) {
+	p.reserva = tx
+	p.mecanico = m
 }
-func (p *Plaza) EstaLibre() bool { return !p.ocupada }
+func (p *Plaza) GetReserva() string { return p.reserva }
+func (p *Plaza) EstaLibre() bool    { return !p.ocupada && p.reserva == "" }
 func (p *Plaza) GetCliente() *Cliente {
 	return p.cliente
 }
@@ -122,58 +327,228 @@ func (p *Plaza) GetMecanico() *Mecanico {
 // --- Vehiculo
 func (v *Vehiculo) SetIncidencia(i *Incidencia) { v.incidencia = i }
 func (v *Vehiculo) GetIncidencia() *Incidencia  { return v.incidencia }
+func (v *Vehiculo) SetSaliendo(tx string)       { v.saliendo = tx }
+func (v *Vehiculo) GetSaliendo() string         { return v.saliendo }
 
 // --- Incidencia
 func (i *Incidencia) AsignarMecanico(m *Mecanico) {
 	i.mecanicos = append(i.mecanicos, m)
 }
+func (i *Incidencia) QuitarMecanico(m *Mecanico) {
+	for k, x := range i.mecanicos {
+		if x == m {
+			i.mecanicos = append(i.mecanicos[:k], i.mecanicos[k+1:]...)
+			return
+		}
+	}
+}
 func (i *Incidencia) GetMecanicos() []*Mecanico { return i.mecanicos }
-func (i *Incidencia) SetEstado(estado string)   { i.Estado = estado }
 func (i *Incidencia) GetEstado() string         { return i.Estado }
 func (i *Incidencia) EsAltaPrioridad() bool     { return i.Prioridad == "alta" }
+func (i *Incidencia) SetEstado(estado string)   { i.Estado = estado }
+func (i *Incidencia) CambiarEstado(estado, fecha string) {
+	i.SetEstado(estado)
+	i.Cambios = append(i.Cambios, CambioEstado{Estado: estado, Fecha: fecha})
+}
 
 // --- Mecanico
 func (m *Mecanico) CambiarEstado(activo bool) { m.Activo = activo }
-func (m *Mecanico) Disponible() bool          { return m.Activo }
+func (m *Mecanico) Disponible() bool          { return m.Activo && !m.Inaccesible }
 
 // VARIABLES GLOBALES
 var app Taller
-var nextIncID int = 1
+var registro *RegistroWAL          // registro de escritura anticipada (nil = sin persistencia)
+var replica *NodoReplica           // replicación primario-respaldo (nil = nodo único)
+var nodoRaft *NodoRaft             // nodo del clúster Raft (nil = sin Raft)
+var red *RedSedes                  // red de sedes de la empresa (nil = taller aislado)
+var relojes *Relojes               // relojes lógicos de este nodo
+var historial *Historial           // eventos aplicados en este nodo con su marca lógica
+var exclusion ExclusionMutua       // exclusión mutua entre procesos al asignar plazas (nil = sin ella)
+var eleccion *NodoEleccion         // elección de coordinador entre talleres (nil = sin ella)
+var nodoCL *NodoCL                 // canales de la instantánea global entre sedes (nil = sin ellos)
+var vigilante *VigilanteTerminales // detector de caídas de los terminales de los mecánicos (nil = sin él)
+var relojFisico *RelojFisico       // hora de pared del nodo, corregida por la sincronización
+var nodoHora *NodoHora             // sincronización de relojes físicos (nil = sin ella)
+var generadorIDs *GeneradorIDs     // identificadores de las entidades nuevas creadas en este nodo
+var enrutador *EnrutadorFragmentos // reparto de los clientes entre fragmentos (nil = clientes locales)
+var fragmento *ServidorFragmento   // este nodo guarda un fragmento de los clientes (nil = no)
+var gossip *NodoPertenencia        // pertenencia al clúster de talleres por gossip (nil = sin ella)
+var recepcion *Recepcion           // recepción que registra sin conexión con el taller (nil = sin ella)
+var bus *BusEventos                // eventos del taller para los suscriptores del proceso
+var sse *ServidorEventos           // emisión de los eventos por HTTP (nil = sin ella)
+var avisos *Avisos                 // avisos a los clientes por correo y SMS (nil = sin ellos)
+var directorioDatos string         // directorio de -datos, donde se guardan las instantáneas globales
+var mutexTaller sync.Mutex         // protege app frente a las operaciones que llegan por red
+
+// eventosPropios guarda, por operación que este nodo está ejecutando, los
+// eventos que produjo al aplicarse aquí; se protege con mutexTaller
+var eventosPropios = map[string][]Evento{}
 
 // HELPERS
 
+// copiaTaller devuelve una copia del taller tomada con mutexTaller. Los
+// menús consultan sobre ella para no leer app mientras la réplica, Raft o
+// los servidores de red le aplican operaciones; tras ejecutar una operación
+// hay que pedir otra copia para ver su efecto.
+func copiaTaller() *Taller {
+	mutexTaller.Lock()
+	defer mutexTaller.Unlock()
+	var t Taller
+	t.Importar(app.Exportar())
+	return &t
+}
+
+// findClienteByID busca el cliente en el taller o, con fragmentos, en el
+// fragmento que lo guarda (en ese caso devuelve una copia e índice 0)
 func findClienteByID(id int) (*Cliente, int) {
-	for idx, c := range app.ClientesTaller {
-		if c.IDCliente == id {
-			return c, idx
+	if enrutador != nil {
+		cd, err := enrutador.BuscarCliente(id)
+		if err != nil {
+			fmt.Println("Aviso: no se pudo consultar el fragmento:", err)
+		}
+		if cd == nil {
+			return nil, -1
 		}
+		return copiaTaller().clienteDeDatos(*cd), 0
 	}
-	return nil, -1
+	return copiaTaller().BuscarCliente(id)
 }
 
-func findMecanicoByID(id int) (*Mecanico, int) {
-	for idx, m := range app.MecanicosTaller {
-		if m.IDMecanico == id {
-			return m, idx
+// findVehiculoByMatricula busca el vehículo y su dueño como findClienteByID
+func findVehiculoByMatricula(matricula string) (*Cliente, *Vehiculo) {
+	if enrutador != nil {
+		cd, err := enrutador.BuscarVehiculo(matricula)
+		if err != nil {
+			fmt.Println("Aviso: no se pudo consultar el fragmento:", err)
+		}
+		if cd == nil {
+			return nil, nil
+		}
+		c := copiaTaller().clienteDeDatos(*cd)
+		for _, v := range c.Vehiculos {
+			if v.Matricula == matricula {
+				return c, v
+			}
 		}
+		return nil, nil
 	}
-	return nil, -1
+	return copiaTaller().BuscarVehiculo(matricula)
 }
 
-func liberarPlazasDeCliente(c *Cliente) {
-	for _, p := range app.PlazasTaller {
-		if p.ocupada && p.cliente == c {
-			p.Liberar()
+// listaClientes devuelve los clientes del taller o, con fragmentos, copias
+// de los de todos los fragmentos
+func listaClientes() []*Cliente {
+	if enrutador != nil {
+		datos, err := enrutador.Clientes()
+		if err != nil {
+			fmt.Println("Aviso: no se pudo consultar algún fragmento:", err)
 		}
+		t := copiaTaller()
+		clientes := make([]*Cliente, len(datos))
+		for i, cd := range datos {
+			clientes[i] = t.clienteDeDatos(cd)
+		}
+		return clientes
 	}
+	return copiaTaller().ClientesTaller
 }
 
-func liberarPlazasDeMecanico(m *Mecanico) {
-	for _, p := range app.PlazasTaller {
-		if p.ocupada && p.mecanico == m {
-			p.Liberar()
+func findMecanicoByID(id int) (*Mecanico, int) {
+	return copiaTaller().BuscarMecanico(id)
+}
+
+// ejecutar aplica una operación sobre el taller global. Si el nodo está
+// replicado, pasa por la réplica (que la rechaza en un respaldo) o por el
+// log de Raft (que solo la acepta en el líder).
+//
+// Cada operación que se aplica es un evento de este nodo: se marca con sus
+// relojes lógicos y con la hora sincronizada antes de propagarla y se guarda
+// en el historial.
+func ejecutar(op Operacion) error {
+	marca := relojes.Evento()
+	if op.Fecha == "" {
+		op.Fecha = relojFisico.Fecha()
+	}
+	// Los eventos de la operación los publica solo este nodo, y solo si se
+	// ejecuta: las demás réplicas, y este nodo al reconstruir su estado, la
+	// aplican sin publicar nada
+	clave := claveOperacion(op)
+	mutexTaller.Lock()
+	eventosPropios[clave] = nil
+	mutexTaller.Unlock()
+	var err error
+	switch {
+	case enrutador != nil && enrutador.Reparte(op):
+		err = enrutador.Ejecutar(op)
+	case nodoRaft != nil:
+		err = nodoRaft.Proponer(op)
+	case replica != nil:
+		err = replica.Ejecutar(op)
+	default:
+		mutexTaller.Lock()
+		err = aplicarLocal(op)
+		mutexTaller.Unlock()
+	}
+	mutexTaller.Lock()
+	if err == nil {
+		publicarEventos(bus, op.Fecha, eventosPropios[clave])
+	}
+	delete(eventosPropios, clave)
+	mutexTaller.Unlock()
+	if err == nil {
+		if errH := historial.Registrar(marca, op); errH != nil {
+			fmt.Println("Aviso: no se pudo guardar el evento en el historial:", errH)
+		}
+	}
+	return err
+}
+
+// aplicarLocal aplica la operación pasando por el registro de escritura
+// anticipada si está abierto; se llama con mutexTaller tomado
+func aplicarLocal(op Operacion) error {
+	var err error
+	if registro != nil {
+		err = registro.Ejecutar(&app, op)
+	} else {
+		err = app.Aplicar(op)
+	}
+	if err == nil && len(eventosPropios) > 0 {
+		clave := claveOperacion(op)
+		if _, propia := eventosPropios[clave]; propia {
+			eventosPropios[clave] = app.Eventos()
 		}
 	}
+	return err
+}
+
+// claveOperacion identifica una operación al volver a este nodo tras pasar
+// por Raft o la réplica
+func claveOperacion(op Operacion) string {
+	datos, _ := json.Marshal(op)
+	return string(datos)
+}
+
+// importarLocal sustituye el estado por el recibido del primario y lo deja
+// guardado en un checkpoint; se llama con mutexTaller tomado
+func importarLocal(ins Instantanea) {
+	app.Importar(ins)
+	if registro != nil {
+		registro.Checkpoint(&app)
+	}
+}
+
+// versionReplicada es la posición del taller local en el estado replicado:
+// la última entrada de Raft aplicada o la última operación de la réplica (0
+// en un nodo único, que no tiene a quién esperar)
+func versionReplicada() uint64 {
+	switch {
+	case nodoRaft != nil:
+		_, _, aplicado := nodoRaft.Indices()
+		return uint64(aplicado)
+	case replica != nil:
+		return replica.Seq()
+	}
+	return 0
 }
 
 // MENÚS
@@ -254,6 +629,10 @@ func menuIncidencias() {
 		fmt.Println("3. Modificar incidencia")
 		fmt.Println("4. Eliminar incidencia")
 		fmt.Println("5. Cambiar estado de incidencia")
+		fmt.Println("6. Preparar o revisar presupuesto")
+		fmt.Println("7. Enviar presupuesto al cliente")
+		fmt.Println("8. Respuesta del cliente al presupuesto")
+		fmt.Println("9. Ver versiones del presupuesto")
 		fmt.Println("0. Volver")
 		fmt.Print("Opción: ")
 		fmt.Scanln(&op)
@@ -269,6 +648,12 @@ func menuIncidencias() {
 			eliminarIncidencia()
 		case 5:
 			cambiarEstadoIncidencia()
+		case 6:
+			prepararPresupuesto()
+		case 7, 8:
+			responderPresupuesto(op == 8)
+		case 9:
+			verPresupuestos()
 		case 0:
 			return
 		default:
@@ -287,6 +672,14 @@ func menuMecanicos() {
 		fmt.Println("3. Modificar mecánico")
 		fmt.Println("4. Eliminar mecánico")
 		fmt.Println("5. Dar de alta/baja a un mecánico")
+		fmt.Println("6. Empezar a trabajar en una incidencia")
+		fmt.Println("7. Terminar el trabajo en curso")
+		fmt.Println("8. Horas por mecánico y día")
+		fmt.Println("9. Productividad")
+		fmt.Println("10. Definir horario semanal")
+		fmt.Println("11. Añadir vacaciones, baja o día libre")
+		fmt.Println("12. Quitar una ausencia")
+		fmt.Println("13. Cuadrante semanal")
 		fmt.Println("0. Volver")
 		fmt.Print("Opción: ")
 		fmt.Scanln(&op)
@@ -302,6 +695,18 @@ func menuMecanicos() {
 			eliminarMecanico()
 		case 5:
 			cambiarEstadoMecanico()
+		case 6, 7:
+			ficharMecanico(op == 6)
+		case 8:
+			listarJornadas()
+		case 9:
+			listarProductividad()
+		case 10:
+			definirHorario()
+		case 11, 12:
+			cambiarAusencia(op == 11)
+		case 13:
+			verCuadrante()
 		case 0:
 			return
 		default:
@@ -310,6 +715,132 @@ func menuMecanicos() {
 	}
 }
 
+// FICHAJES
+func ficharMecanico(empezar bool) {
+	var id int
+	fmt.Print("ID mecánico: ")
+	fmt.Scanln(&id)
+	op := Operacion{Tipo: OpTerminarTrabajo, IDMecanico: id}
+	if empezar {
+		op.Tipo = OpIniciarTrabajo
+		fmt.Print("Matrícula del vehículo: ")
+		fmt.Scanln(&op.Matricula)
+	}
+	if err := ejecutar(op); err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	if empezar {
+		fmt.Println("Sesión de trabajo iniciada.")
+	} else {
+		fmt.Println("Sesión de trabajo terminada.")
+	}
+}
+
+func listarJornadas() {
+	var desde, hasta string
+	fmt.Print("Desde (AAAA-MM-DD, vacío = sin límite): ")
+	fmt.Scanln(&desde)
+	fmt.Print("Hasta (AAAA-MM-DD, vacío = sin límite): ")
+	fmt.Scanln(&hasta)
+	jornadas := copiaTaller().Jornadas(desde, hasta, time.Now())
+	if len(jornadas) == 0 {
+		fmt.Println("No hay horas fichadas.")
+	}
+	for _, j := range jornadas {
+		fmt.Printf("- %s | Mecánico:%d %s | %s | Incidencias:%v\n", j.Dia, j.IDMecanico, j.Nombre, formatoHoras(j.Horas), j.Incidencias)
+	}
+}
+
+func listarProductividad() {
+	for _, p := range copiaTaller().Productividad(time.Now()) {
+		fmt.Printf("- ID:%d | %s | Fichadas:%s | Facturadas:%s | Rendimiento:%.0f%% | Incidencias:%d\n",
+			p.IDMecanico, p.Nombre, formatoHoras(p.Fichadas), formatoHoras(p.Facturadas), p.Rendimiento()*100, p.Incidencias)
+	}
+}
+
+// TURNOS
+func definirHorario() {
+	var id int
+	fmt.Print("ID mecánico: ")
+	fmt.Scanln(&id)
+	m, _ := findMecanicoByID(id)
+	if m == nil {
+		fmt.Println("Mecánico no encontrado.")
+		return
+	}
+	fmt.Println("Horario de cada día (HH:MM-HH:MM, vacío = libra):")
+	var partes []string
+	for i := 1; i <= 7; i++ {
+		letra := letrasDias[i%7]
+		var horas string
+		if tu := m.TurnoEl(time.Weekday(i % 7)); tu != nil {
+			fmt.Printf("%s [%s-%s]: ", letra, tu.Inicio, tu.Fin)
+		} else {
+			fmt.Printf("%s: ", letra)
+		}
+		fmt.Scanln(&horas)
+		if horas != "" {
+			partes = append(partes, letra+" "+horas)
+		}
+	}
+	turnos, err := LeerTurnos(strings.Join(partes, ","))
+	if err == nil {
+		err = ejecutar(Operacion{Tipo: OpHorarioMecanico, IDMecanico: id, Turnos: turnos})
+	}
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	fmt.Println("Horario guardado.")
+}
+
+func cambiarAusencia(anadir bool) {
+	var id int
+	var a Ausencia
+	fmt.Print("ID mecánico: ")
+	fmt.Scanln(&id)
+	fmt.Print("Tipo (vacaciones/baja/libre): ")
+	fmt.Scanln(&a.Tipo)
+	fmt.Print("Desde (AAAA-MM-DD): ")
+	fmt.Scanln(&a.Desde)
+	op := Operacion{Tipo: OpQuitarAusencia, IDMecanico: id, Ausencia: &a}
+	if anadir {
+		op.Tipo = OpAusenciaMecanico
+		fmt.Print("Hasta (AAAA-MM-DD, vacío = un solo día): ")
+		fmt.Scanln(&a.Hasta)
+		if a.Hasta == "" {
+			a.Hasta = a.Desde
+		}
+		fmt.Print("Motivo: ")
+		fmt.Scanln(&a.Motivo)
+	}
+	if err := ejecutar(op); err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	fmt.Println("Ausencias actualizadas.")
+}
+
+func verCuadrante() {
+	var dia string
+	fmt.Print("Un día de la semana (AAAA-MM-DD, vacío = esta semana): ")
+	fmt.Scanln(&dia)
+	if dia == "" {
+		dia = time.Now().In(ZonaTaller).Format("2006-01-02")
+	}
+	filas, dias, err := copiaTaller().Cuadrante(dia)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	if len(filas) == 0 {
+		fmt.Println("No hay mecánicos.")
+		return
+	}
+	fmt.Print(TextoCuadrante(filas, dias))
+}
+
 // CLIENTES
 func crearCliente() {
 	var id int
@@ -327,20 +858,29 @@ func crearCliente() {
 	fmt.Print("Email: ")
 	fmt.Scanln(&email)
 
-	c := &Cliente{IDCliente: id, Nombre: nombre, Telefono: telefono, Email: email}
-	app.ClientesTaller = append(app.ClientesTaller, c)
+	op := Operacion{Tipo: OpCrearCliente, IDCliente: id, Nombre: nombre, Telefono: telefono, Email: email}
+	if err := ejecutar(op); err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
 	fmt.Println("Cliente creado.")
 }
 
 func listarClientes() {
-	if len(app.ClientesTaller) == 0 {
+	clientes := listaClientes()
+	if len(clientes) == 0 {
 		fmt.Println("No hay clientes.")
 		return
 	}
+	t := copiaTaller()
 	fmt.Println("Listado de clientes:")
-	for _, c := range app.ClientesTaller {
-		fmt.Printf("- ID:%d | %s | Tel:%s | Email:%s | Vehículos:%d\n",
-			c.IDCliente, c.Nombre, c.Telefono, c.Email, len(c.Vehiculos))
+	for _, c := range clientes {
+		deuda := ""
+		if saldo := t.SaldoCliente(c.IDCliente); saldo > 0 {
+			deuda = " | DEBE " + Euros(saldo)
+		}
+		fmt.Printf("- ID:%d | %s | Tel:%s | Email:%s | Vehículos:%d%s\n",
+			c.IDCliente, c.Nombre, c.Telefono, c.Email, len(c.Vehiculos), deuda)
 	}
 }
 
@@ -360,7 +900,11 @@ func modificarCliente() {
 	fmt.Scanln(&tel)
 	fmt.Print("Nuevo email: ")
 	fmt.Scanln(&email)
-	c.Nombre, c.Telefono, c.Email = nombre, tel, email
+	op := Operacion{Tipo: OpModificarCliente, IDCliente: c.IDCliente, Nombre: nombre, Telefono: tel, Email: email}
+	if err := ejecutar(op); err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
 	fmt.Println("Cliente modificado.")
 }
 
@@ -368,15 +912,16 @@ func eliminarCliente() {
 	var id int
 	fmt.Print("ID cliente a eliminar: ")
 	fmt.Scanln(&id)
-	c, idx := findClienteByID(id)
+	c, _ := findClienteByID(id)
 	if c == nil {
 		fmt.Println("Cliente no encontrado.")
 		return
 	}
-	// Liberar plazas ocupadas por este cliente (si las hubiera)
-	liberarPlazasDeCliente(c)
-	// Eliminar del slice
-	app.ClientesTaller = append(app.ClientesTaller[:idx], app.ClientesTaller[idx+1:]...)
+	// Al aplicarse se liberan las plazas ocupadas por este cliente (si las hubiera)
+	if err := ejecutar(Operacion{Tipo: OpEliminarCliente, IDCliente: c.IDCliente}); err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
 	fmt.Println("Cliente eliminado (y plazas liberadas si correspondía).")
 }
 
@@ -393,7 +938,7 @@ func crearVehiculo() {
 	var mat, marca, modelo, fIn, fOut string
 	fmt.Print("Matrícula: ")
 	fmt.Scanln(&mat)
-	if _, v := app.BuscarVehiculo(mat); v != nil {
+	if _, v := findVehiculoByMatricula(mat); v != nil {
 		fmt.Println("Ya existe un vehículo con esa matrícula.")
 		return
 	}
@@ -406,20 +951,27 @@ func crearVehiculo() {
 	fmt.Print("Fecha de salida: ")
 	fmt.Scanln(&fOut)
 
-	v := &Vehiculo{Matricula: mat, Marca: marca, Modelo: modelo, FechaEntrada: fIn, FechaSalida: fOut}
-	c.Vehiculos = append(c.Vehiculos, v)
+	op := Operacion{Tipo: OpCrearVehiculo, IDCliente: c.IDCliente, Matricula: mat, Marca: marca,
+		Modelo: modelo, FechaEntrada: fIn, FechaSalida: fOut}
+	if err := ejecutar(op); err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
 	fmt.Println("Vehículo creado y asignado al cliente.")
 }
 
 func listarVehiculos() {
 	encontrados := 0
-	for _, c := range app.ClientesTaller {
+	for _, c := range listaClientes() {
 		for _, v := range c.Vehiculos {
 			encontrados++
 			estadoInc := "sin incidencia"
 			if v.GetIncidencia() != nil {
 				estadoInc = "incidencia " + v.GetIncidencia().Estado
 			}
+			if v.GetSaliendo() != "" {
+				estadoInc += " | en transferencia a otra sede"
+			}
 			fmt.Printf("- [%s] %s %s | Cliente:%s | %s\n",
 				v.Matricula, v.Marca, v.Modelo, c.Nombre, estadoInc)
 		}
@@ -433,7 +985,7 @@ func modificarVehiculo() {
 	var mat string
 	fmt.Print("Matrícula del vehículo a modificar: ")
 	fmt.Scanln(&mat)
-	c, v := app.BuscarVehiculo(mat)
+	c, v := findVehiculoByMatricula(mat)
 	if v == nil {
 		fmt.Println("Vehículo no encontrado.")
 		return
@@ -447,7 +999,12 @@ func modificarVehiculo() {
 	fmt.Scanln(&fIn)
 	fmt.Print("Nueva fecha de salida: ")
 	fmt.Scanln(&fOut)
-	v.Marca, v.Modelo, v.FechaEntrada, v.FechaSalida = marca, modelo, fIn, fOut
+	op := Operacion{Tipo: OpModificarVehiculo, Matricula: v.Matricula, Marca: marca, Modelo: modelo,
+		FechaEntrada: fIn, FechaSalida: fOut}
+	if err := ejecutar(op); err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
 	fmt.Printf("Vehículo %s del cliente %s modificado.\n", v.Matricula, c.Nombre)
 }
 
@@ -455,23 +1012,27 @@ func eliminarVehiculo() {
 	var mat string
 	fmt.Print("Matrícula del vehículo a eliminar: ")
 	fmt.Scanln(&mat)
-	c, v := app.BuscarVehiculo(mat)
+	_, v := findVehiculoByMatricula(mat)
 	if v == nil {
 		fmt.Println("Vehículo no encontrado.")
 		return
 	}
-	// Si tuviera incidencia, la "eliminamos" (nil)
-	v.SetIncidencia(nil)
-	// Eliminar del slice del cliente
-	pos := -1
-	for i, vv := range c.Vehiculos {
-		if vv == v {
-			pos = i
-			break
+	// Antes de que salga, se avisa si su última factura no está pagada
+	t := copiaTaller()
+	if f := t.FacturaPendienteDe(v.Matricula); f != nil {
+		var seguir string
+		fmt.Printf("Atención: la factura %s está sin pagar (faltan %s). ¿Sale igualmente? (s/n): ",
+			f.Numero, Euros(t.Pendiente(f)))
+		fmt.Scanln(&seguir)
+		if !strings.EqualFold(seguir, "s") {
+			fmt.Println("El vehículo no sale.")
+			return
 		}
 	}
-	if pos != -1 {
-		c.Vehiculos = append(c.Vehiculos[:pos], c.Vehiculos[pos+1:]...)
+	// Si tuviera incidencia, se elimina junto con el vehículo
+	if err := ejecutar(Operacion{Tipo: OpEliminarVehiculo, Matricula: v.Matricula}); err != nil {
+		fmt.Println("Error:", err)
+		return
 	}
 	fmt.Println("Vehículo eliminado.")
 }
@@ -481,7 +1042,7 @@ func registrarIncidenciaVehiculo() {
 	var mat string
 	fmt.Print("Matrícula del vehículo: ")
 	fmt.Scanln(&mat)
-	c, v := app.BuscarVehiculo(mat)
+	c, v := findVehiculoByMatricula(mat)
 	if v == nil {
 		fmt.Println("Vehículo no encontrado.")
 		return
@@ -499,25 +1060,33 @@ func registrarIncidenciaVehiculo() {
 	fmt.Print("Descripción (una palabra o sin espacios): ")
 	fmt.Scanln(&desc)
 
-	inc := &Incidencia{
-		IDIncidencia: nextIncID,
-		Tipo:         tipo,
-		Prioridad:    prio,
-		Descripcion:  desc,
-		Estado:       "abierta",
+	id, err := generadorIDs.Siguiente()
+	if err != nil {
+		fmt.Println("No se pudo generar el identificador de la incidencia:", err)
+		return
+	}
+	op := Operacion{
+		Tipo:           OpCrearIncidencia,
+		Matricula:      v.Matricula,
+		IDIncidencia:   id,
+		TipoIncidencia: tipo,
+		Prioridad:      prio,
+		Descripcion:    desc,
+	}
+	if err := ejecutar(op); err != nil {
+		fmt.Println("Error:", err)
+		return
 	}
-	nextIncID++
-	v.SetIncidencia(inc)
 
 	fmt.Printf("Incidencia registrada al vehículo %s del cliente %s (ID=%d).\n",
-		v.Matricula, c.Nombre, inc.IDIncidencia)
+		v.Matricula, c.Nombre, op.IDIncidencia)
 }
 
 func consultarIncidenciaVehiculo() {
 	var mat string
 	fmt.Print("Matrícula del vehículo: ")
 	fmt.Scanln(&mat)
-	_, v := app.BuscarVehiculo(mat)
+	_, v := findVehiculoByMatricula(mat)
 	if v == nil {
 		fmt.Println("Vehículo no encontrado.")
 		return
@@ -529,16 +1098,50 @@ func consultarIncidenciaVehiculo() {
 	}
 	fmt.Printf("Incidencia ID:%d | Tipo:%s | Prioridad:%s | Estado:%s | Desc:%s | Mecánicos:%d\n",
 		inc.IDIncidencia, inc.Tipo, inc.Prioridad, inc.Estado, inc.Descripcion, len(inc.GetMecanicos()))
+	fmt.Printf("Entrada del vehículo: %s | Salida: %s\n", v.FechaEntrada, v.FechaSalida)
+	for _, cambio := range inc.Cambios {
+		fmt.Printf("  %s → %s\n", cambio.Fecha, cambio.Estado)
+	}
+	for _, sesion := range inc.Sesiones {
+		fin := sesion.Fin
+		if sesion.Abierta() {
+			fin = "en curso"
+		}
+		fmt.Printf("  Mecánico %d trabajando: %s → %s\n", sesion.IDMecanico, sesion.Inicio, fin)
+	}
+	horas := HorasIncidencia(inc, time.Now())
+	ids := make([]int, 0, len(horas))
+	for id := range horas {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		fmt.Printf("  Total del mecánico %d: %s\n", id, formatoHoras(horas[id]))
+	}
 }
 
 func listarIncidencias() {
+	t := copiaTaller()
 	total := 0
-	for _, c := range app.ClientesTaller {
+	for _, c := range listaClientes() {
 		for _, v := range c.Vehiculos {
 			if inc := v.GetIncidencia(); inc != nil {
 				total++
 				fmt.Printf("- Vehículo [%s] de %s | IncID:%d | Tipo:%s | Prio:%s | Estado:%s\n",
 					v.Matricula, c.Nombre, inc.IDIncidencia, inc.Tipo, inc.Prioridad, inc.Estado)
+				for _, p := range inc.Piezas {
+					fmt.Printf("    · Repuesto %s: %d reservadas, %d apartadas", p.Referencia, p.Cantidad, p.Apartadas)
+					if p.Consumida {
+						fmt.Print(" (gastadas)")
+					}
+					fmt.Println()
+				}
+				for _, p := range t.PedidosEsperados(inc) {
+					fmt.Printf("    · Esperando piezas del pedido %d (%s)\n", p.IDPedido, p.Estado)
+				}
+				if p := inc.Presupuesto(); p != nil {
+					fmt.Printf("    · Presupuesto versión %d: %s (%s)\n", p.Version, Euros(p.Total), p.Estado)
+				}
 			}
 		}
 	}
@@ -551,12 +1154,11 @@ func modificarIncidencia() {
 	var mat string
 	fmt.Print("Matrícula del vehículo con incidencia: ")
 	fmt.Scanln(&mat)
-	_, v := app.BuscarVehiculo(mat)
+	_, v := findVehiculoByMatricula(mat)
 	if v == nil || v.GetIncidencia() == nil {
 		fmt.Println("Vehículo no encontrado o sin incidencia.")
 		return
 	}
-	inc := v.GetIncidencia()
 	var tipo, prio, desc string
 	fmt.Print("Nuevo tipo (mecánica/eléctrica/carrocería): ")
 	fmt.Scanln(&tipo)
@@ -564,7 +1166,12 @@ func modificarIncidencia() {
 	fmt.Scanln(&prio)
 	fmt.Print("Nueva descripción (una palabra): ")
 	fmt.Scanln(&desc)
-	inc.Tipo, inc.Prioridad, inc.Descripcion = tipo, prio, desc
+	op := Operacion{Tipo: OpModificarIncidencia, Matricula: v.Matricula, TipoIncidencia: tipo,
+		Prioridad: prio, Descripcion: desc}
+	if err := ejecutar(op); err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
 	fmt.Println("Incidencia modificada.")
 }
 
@@ -572,135 +1179,1257 @@ func eliminarIncidencia() {
 	var mat string
 	fmt.Print("Matrícula del vehículo con incidencia a eliminar: ")
 	fmt.Scanln(&mat)
-	_, v := app.BuscarVehiculo(mat)
+	_, v := findVehiculoByMatricula(mat)
 	if v == nil || v.GetIncidencia() == nil {
 		fmt.Println("Vehículo no encontrado o sin incidencia.")
 		return
 	}
-	v.SetIncidencia(nil)
+	if err := ejecutar(Operacion{Tipo: OpEliminarIncidencia, Matricula: v.Matricula}); err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
 	fmt.Println("Incidencia eliminada del vehículo.")
 }
 
+// elegirEstado muestra los estados numerados y devuelve el elegido ("" si la
+// opción no es válida). Se elige por número porque "en proceso" lleva un
+// espacio y Scanln solo leería "en".
+func elegirEstado(estados []string) string {
+	fmt.Println("Nuevo estado:")
+	for i, e := range estados {
+		fmt.Printf("%d) %s\n", i+1, e)
+	}
+	var n int
+	fmt.Print("Elija una opción: ")
+	fmt.Scanln(&n)
+	if n < 1 || n > len(estados) {
+		return ""
+	}
+	return estados[n-1]
+}
+
 func cambiarEstadoIncidencia() {
-	var mat, nuevo string
+	var mat string
 	fmt.Print("Matrícula del vehículo: ")
 	fmt.Scanln(&mat)
-	_, v := app.BuscarVehiculo(mat)
+	_, v := findVehiculoByMatricula(mat)
 	if v == nil || v.GetIncidencia() == nil {
 		fmt.Println("Vehículo no encontrado o sin incidencia.")
 		return
 	}
-	fmt.Print("Nuevo estado (abierta/en proceso/cerrada): ")
-	fmt.Scanln(&nuevo)
-	v.GetIncidencia().SetEstado(nuevo)
-	fmt.Println("Estado actualizado.")
-}
-
-// MECÁNICOS
-func crearMecanico() {
-	var id int
-	var nombre, esp string
-	var anios int
-	fmt.Print("ID mecánico: ")
-	fmt.Scanln(&id)
-	if _, idx := findMecanicoByID(id); idx != -1 {
-		fmt.Println("Ya existe un mecánico con ese ID.")
+	estado := v.GetIncidencia().GetEstado()
+	siguientes := siguientesEstados[estado]
+	if len(siguientes) == 0 {
+		fmt.Printf("La incidencia está %s y ya no cambia de estado.\n", estado)
 		return
 	}
-	fmt.Print("Nombre: ")
-	fmt.Scanln(&nombre)
-	fmt.Print("Especialidad (mecánica/eléctrica/carrocería): ")
-	fmt.Scanln(&esp)
-	fmt.Print("Años de experiencia: ")
-	fmt.Scanln(&anios)
-
-	m := &Mecanico{IDMecanico: id, Nombre: nombre, Especialidad: esp, AniosExperiencia: anios, Activo: true}
-	app.MecanicosTaller = append(app.MecanicosTaller, m)
-	app.InicializarPlazas()
-	fmt.Println("Mecánico creado y plazas recalculadas.")
-}
-
-func listarMecanicos() {
-	if len(app.MecanicosTaller) == 0 {
-		fmt.Println("No hay mecánicos.")
+	fmt.Printf("La incidencia está %s.\n", estado)
+	nuevo := elegirEstado(siguientes)
+	if nuevo == "" {
+		fmt.Println("Opción no válida.")
 		return
 	}
-	for _, m := range app.MecanicosTaller {
-		status := "baja"
-		if m.Activo {
-			status = "activo"
-		}
-		fmt.Printf("- ID:%d | %s | %s | %d años | %s\n",
-			m.IDMecanico, m.Nombre, m.Especialidad, m.AniosExperiencia, status)
+	if err := ejecutar(Operacion{Tipo: OpEstadoIncidencia, Matricula: v.Matricula, Estado: nuevo}); err != nil {
+		fmt.Println("Error:", err)
+		return
 	}
+	fmt.Println("Estado actualizado.")
 }
 
-func modificarMecanico() {
-	var id int
-	fmt.Print("ID del mecánico a modificar: ")
-	fmt.Scanln(&id)
-	m, _ := findMecanicoByID(id)
-	if m == nil {
-		fmt.Println("No existe ese mecánico.")
+// PRESUPUESTOS
+func prepararPresupuesto() {
+	var mat string
+	fmt.Print("Matrícula del vehículo: ")
+	fmt.Scanln(&mat)
+	t := copiaTaller()
+	_, v := t.BuscarVehiculo(mat)
+	if v == nil || v.GetIncidencia() == nil {
+		fmt.Println("Vehículo no encontrado o sin incidencia.")
 		return
 	}
-	var nombre, esp string
-	var anios int
+	inc := v.GetIncidencia()
+	p := Presupuesto{}
+	if ultimo := inc.Presupuesto(); ultimo != nil && !ultimo.Pendiente() {
+		fmt.Print("Motivo de la revisión: ")
+		fmt.Scanln(&p.Motivo)
+	}
+	var horas float64
+	fmt.Printf("Horas de mano de obra de %s (%s/h): ", inc.Tipo, Euros(TarifasHora[inc.Tipo]))
+	fmt.Scanln(&horas)
+	if horas > 0 {
+		p.Lineas = append(p.Lineas, LineaFactura{Tipo: LineaManoObra, Concepto: "Mano de obra " + inc.Tipo,
+			Cantidad: horas, Precio: TarifasHora[inc.Tipo]})
+	}
+	// Las piezas reservadas entran al precio del catálogo
+	for _, pieza := range inc.Piezas {
+		if r, _ := t.BuscarRepuesto(pieza.Referencia); r != nil {
+			fmt.Printf("Pieza reservada: %s × %d a %s\n", r.Descripcion, pieza.Cantidad, Euros(r.Precio))
+			p.Lineas = append(p.Lineas, LineaFactura{Tipo: LineaPieza, Concepto: r.Descripcion,
+				IDRepuesto: r.Referencia, Cantidad: float64(pieza.Cantidad), Precio: r.Precio})
+		}
+	}
+	for {
+		var concepto string
+		fmt.Print("Otra pieza (vacío para terminar): ")
+		fmt.Scanln(&concepto)
+		if concepto == "" {
+			break
+		}
+		l := LineaFactura{Tipo: LineaPieza, Concepto: concepto}
+		var precio float64
+		fmt.Print("Unidades: ")
+		fmt.Scanln(&l.Cantidad)
+		fmt.Print("Precio por unidad (€): ")
+		fmt.Scanln(&precio)
+		l.Precio = redondear(precio * 100)
+		p.Lineas = append(p.Lineas, l)
+	}
+	fmt.Print("Descuento sobre el total (%): ")
+	fmt.Scanln(&p.Descuento)
+	if err := ejecutar(Operacion{Tipo: OpPresupuestar, Matricula: mat, Presupuesto: &p}); err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	if _, v := copiaTaller().BuscarVehiculo(mat); v != nil && v.GetIncidencia() != nil {
+		fmt.Print(v.GetIncidencia().Presupuesto().Texto())
+	}
+}
+
+func responderPresupuesto(responder bool) {
+	var mat string
+	fmt.Print("Matrícula del vehículo: ")
+	fmt.Scanln(&mat)
+	op := Operacion{Tipo: OpEnviarPresupuesto, Matricula: mat}
+	if responder {
+		var acepta string
+		op.Tipo = OpResponderPresupuesto
+		fmt.Print("¿Lo acepta el cliente? (s/n): ")
+		fmt.Scanln(&acepta)
+		op.Estado = PresupuestoRechazado
+		if strings.EqualFold(acepta, "s") {
+			op.Estado = PresupuestoAceptado
+		}
+		fmt.Print("Comentario: ")
+		fmt.Scanln(&op.Descripcion)
+	}
+	if err := ejecutar(op); err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	fmt.Println("Presupuesto actualizado.")
+}
+
+func verPresupuestos() {
+	var mat string
+	fmt.Print("Matrícula del vehículo: ")
+	fmt.Scanln(&mat)
+	_, v := findVehiculoByMatricula(mat)
+	if v == nil || v.GetIncidencia() == nil {
+		fmt.Println("Vehículo no encontrado o sin incidencia.")
+		return
+	}
+	if len(v.GetIncidencia().Presupuestos) == 0 {
+		fmt.Println("La incidencia no tiene presupuesto.")
+		return
+	}
+	for _, p := range v.GetIncidencia().Presupuestos {
+		fmt.Println()
+		fmt.Print(p.Texto())
+	}
+}
+
+// MECÁNICOS
+func crearMecanico() {
+	var id int
+	var nombre, esp string
+	var anios int
+	fmt.Print("ID mecánico: ")
+	fmt.Scanln(&id)
+	if _, idx := findMecanicoByID(id); idx != -1 {
+		fmt.Println("Ya existe un mecánico con ese ID.")
+		return
+	}
+	fmt.Print("Nombre: ")
+	fmt.Scanln(&nombre)
+	fmt.Print("Especialidad (mecánica/eléctrica/carrocería): ")
+	fmt.Scanln(&esp)
+	fmt.Print("Años de experiencia: ")
+	fmt.Scanln(&anios)
+
+	op := Operacion{Tipo: OpCrearMecanico, IDMecanico: id, Nombre: nombre, Especialidad: esp, AniosExperiencia: anios}
+	if err := ejecutar(op); err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	fmt.Println("Mecánico creado y plazas recalculadas.")
+}
+
+func listarMecanicos() {
+	t := copiaTaller()
+	if len(t.MecanicosTaller) == 0 {
+		fmt.Println("No hay mecánicos.")
+		return
+	}
+	for _, m := range t.MecanicosTaller {
+		status := "baja"
+		if m.Activo {
+			status = "activo"
+		}
+		if m.Inaccesible {
+			status += " (terminal inaccesible)"
+		}
+		if m.Disponible() && !m.DisponibleEn(relojFisico.Fecha()) {
+			status += " (fuera de turno)"
+		}
+		fmt.Printf("- ID:%d | %s | %s | %d años | %s\n",
+			m.IDMecanico, m.Nombre, m.Especialidad, m.AniosExperiencia, status)
+	}
+}
+
+func modificarMecanico() {
+	var id int
+	fmt.Print("ID del mecánico a modificar: ")
+	fmt.Scanln(&id)
+	m, _ := findMecanicoByID(id)
+	if m == nil {
+		fmt.Println("No existe ese mecánico.")
+		return
+	}
+	var nombre, esp string
+	var anios int
 	fmt.Print("Nuevo nombre: ")
 	fmt.Scanln(&nombre)
 	fmt.Print("Nueva especialidad (mecánica/eléctrica/carrocería): ")
 	fmt.Scanln(&esp)
 	fmt.Print("Nuevos años de experiencia: ")
 	fmt.Scanln(&anios)
-	m.Nombre, m.Especialidad, m.AniosExperiencia = nombre, esp, anios
+	op := Operacion{Tipo: OpModificarMecanico, IDMecanico: m.IDMecanico, Nombre: nombre, Especialidad: esp,
+		AniosExperiencia: anios}
+	if err := ejecutar(op); err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
 	fmt.Println("Mecánico modificado.")
 }
 
-func eliminarMecanico() {
-	var id int
-	fmt.Print("ID del mecánico a eliminar: ")
-	fmt.Scanln(&id)
-	m, idx := findMecanicoByID(id)
-	if m == nil {
-		fmt.Println("No existe ese mecánico.")
+func eliminarMecanico() {
+	var id int
+	fmt.Print("ID del mecánico a eliminar: ")
+	fmt.Scanln(&id)
+	m, _ := findMecanicoByID(id)
+	if m == nil {
+		fmt.Println("No existe ese mecánico.")
+		return
+	}
+	// Al aplicarse se liberan sus plazas y se recalculan (2 por mecánico)
+	if err := ejecutar(Operacion{Tipo: OpEliminarMecanico, IDMecanico: m.IDMecanico}); err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	fmt.Println("Mecánico eliminado, plazas liberadas y recalculadas.")
+}
+
+func cambiarEstadoMecanico() {
+	var id int
+	var op int
+	fmt.Print("ID del mecánico: ")
+	fmt.Scanln(&id)
+	m, _ := findMecanicoByID(id)
+	if m == nil {
+		fmt.Println("No existe ese mecánico.")
+		return
+	}
+	fmt.Print("1=Activar, 2=Dar de baja: ")
+	fmt.Scanln(&op)
+	if op != 1 && op != 2 {
+		fmt.Println("Opción inválida.")
+		return
+	}
+	if err := ejecutar(Operacion{Tipo: OpEstadoMecanico, IDMecanico: m.IDMecanico, Activo: op == 1}); err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	fmt.Println("Estado del mecánico actualizado y plazas recalculadas.")
+}
+
+// Menú: Red de talleres
+func menuSedes() {
+	if red == nil {
+		fmt.Println("Este taller no forma parte de ninguna red (use -sedes y -sede).")
+		return
+	}
+	var op int
+	for {
+		fmt.Println("\n===== RED DE TALLERES =====")
+		fmt.Println("1. Visualizar sedes")
+		fmt.Println("2. Buscar la sede más cercana con plazas libres")
+		fmt.Println("3. Buscar la sede más cercana con un mecánico de una especialidad")
+		fmt.Println("4. Transferir vehículo a otra sede")
+		fmt.Println("5. Tomar instantánea global de la red")
+		fmt.Println("0. Volver")
+		fmt.Print("Opción: ")
+		fmt.Scanln(&op)
+
+		switch op {
+		case 1:
+			listarSedes()
+		case 2:
+			buscarSedeCercana(false)
+		case 3:
+			buscarSedeCercana(true)
+		case 4:
+			transferirVehiculo()
+		case 5:
+			tomarInstantaneaGlobal()
+		case 0:
+			return
+		default:
+			fmt.Println("Opción no válida.")
+		}
+	}
+}
+
+// RED DE TALLERES
+func tomarInstantaneaGlobal() {
+	if nodoCL == nil {
+		fmt.Println("Las sedes no tienen canales para la instantánea global (campo \"canal\" de -sedes).")
+		return
+	}
+	ig, err := nodoCL.TomarInstantanea(10 * time.Second)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	ruta := filepath.Join(directorioDatos, "instantanea-"+ig.ID+".json")
+	if err := GuardarInstantaneaGlobal(ruta, ig); err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	fmt.Println(ig.Resumen())
+	fmt.Println("Guardada en", ruta)
+}
+
+func listarSedes() {
+	e := red.EstadoLocal()
+	fmt.Printf("- %s (esta sede) | Plazas libres:%d | Especialidades:%v\n",
+		e.Nombre, e.PlazasLibres, e.Especialidades)
+	for _, s := range red.Otras {
+		e, err := red.ConsultarEstado(s)
+		if err != nil {
+			fmt.Printf("- %s | %.1f km | sin respuesta\n", s.Nombre, red.Distancia(s))
+			continue
+		}
+		fmt.Printf("- %s | %.1f km | Plazas libres:%d | Especialidades:%v\n",
+			s.Nombre, red.Distancia(s), e.PlazasLibres, e.Especialidades)
+	}
+}
+
+func buscarSedeCercana(porEspecialidad bool) {
+	esp := ""
+	if porEspecialidad {
+		fmt.Print("Especialidad (mecánica/eléctrica/carrocería): ")
+		fmt.Scanln(&esp)
+	}
+	s, e, err := red.BuscarCercana(esp, !porEspecialidad)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	fmt.Printf("Sede más cercana: %s (%.1f km) | Plazas libres:%d | Especialidades:%v\n",
+		s.Nombre, red.Distancia(s), e.PlazasLibres, e.Especialidades)
+}
+
+func transferirVehiculo() {
+	var mat, destino string
+	fmt.Print("Matrícula del vehículo a transferir: ")
+	fmt.Scanln(&mat)
+	fmt.Print("Sede de destino: ")
+	fmt.Scanln(&destino)
+	if err := red.Transferir(mat, destino); err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	fmt.Printf("Vehículo %s transferido a la sede %s.\n", mat, destino)
+}
+
+// Menú: Fragmentos de clientes
+func menuFragmentos() {
+	if enrutador == nil {
+		fmt.Println("Los clientes no están repartidos entre fragmentos (use -fragmentos).")
+		return
+	}
+	var op int
+	for {
+		fmt.Println("\n===== FRAGMENTOS DE CLIENTES =====")
+		fmt.Println("1. Ver reparto de clientes")
+		fmt.Println("2. Buscar el fragmento de un cliente o matrícula")
+		fmt.Println("3. Añadir fragmento")
+		fmt.Println("4. Quitar fragmento")
+		fmt.Println("0. Volver")
+		fmt.Print("Opción: ")
+		fmt.Scanln(&op)
+
+		switch op {
+		case 1:
+			verRepartoFragmentos()
+		case 2:
+			buscarFragmento()
+		case 3, 4:
+			var dir string
+			fmt.Print("Dirección del fragmento: ")
+			fmt.Scanln(&dir)
+			var movidos int
+			var err error
+			if op == 3 {
+				movidos, err = enrutador.AgregarNodo(dir)
+			} else {
+				movidos, err = enrutador.QuitarNodo(dir)
+			}
+			if err != nil {
+				fmt.Println("Error:", err)
+				continue
+			}
+			fmt.Printf("Reparto actualizado: %d clientes movidos.\n", movidos)
+		case 0:
+			return
+		default:
+			fmt.Println("Opción no válida.")
+		}
+	}
+}
+
+// FRAGMENTOS
+func verRepartoFragmentos() {
+	reparto, err := enrutador.Reparto()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	for _, nodo := range enrutador.Nodos() {
+		fmt.Printf("- %s | Clientes:%d\n", nodo, reparto[nodo])
+	}
+}
+
+func buscarFragmento() {
+	var clave string
+	fmt.Print("ID de cliente o matrícula: ")
+	fmt.Scanln(&clave)
+	if id, err := strconv.Atoi(clave); err == nil {
+		fmt.Printf("El cliente %d pertenece al fragmento %s.\n", id, enrutador.NodoDe(id))
+		return
+	}
+	if nodo := enrutador.NodoDeMatricula(clave); nodo != "" {
+		fmt.Printf("El vehículo %s está en el fragmento %s.\n", clave, nodo)
+		return
+	}
+	fmt.Println("Ningún fragmento tiene esa matrícula.")
+}
+
+// Menú: Miembros del clúster
+func listarMiembrosCluster() {
+	if gossip == nil {
+		fmt.Println("Este nodo no forma parte de un clúster (use -gossip).")
+		return
+	}
+	fmt.Println(gossip.Estado())
+	for _, m := range gossip.Miembros() {
+		fmt.Printf("- %s (%s) | Estado:%s | Plazas libres:%d | Especialidades:%s\n",
+			m.Nombre, m.Direccion, m.Estado, m.Metadatos.PlazasLibres, strings.Join(m.Metadatos.Especialidades, ", "))
+	}
+}
+
+// Menú: Recepción sin conexión
+func menuRecepcion() {
+	if recepcion == nil {
+		fmt.Println("Este nodo no lleva una recepción sin conexión (use -recepcion).")
+		return
+	}
+	var op int
+	for {
+		fmt.Println("\n===== RECEPCIÓN SIN CONEXIÓN =====")
+		fmt.Println("1. Registrar cliente")
+		fmt.Println("2. Cambiar un dato de un cliente")
+		fmt.Println("3. Dar de baja un cliente")
+		fmt.Println("4. Registrar vehículo")
+		fmt.Println("5. Dar de baja un vehículo")
+		fmt.Println("6. Abrir incidencia")
+		fmt.Println("7. Cambiar estado de una incidencia")
+		fmt.Println("8. Ver lo registrado en la recepción")
+		fmt.Println("9. Sincronizar con otra recepción")
+		fmt.Println("10. Volcar al taller")
+		fmt.Println("0. Volver")
+		fmt.Print("Opción: ")
+		fmt.Scanln(&op)
+
+		var err error
+		switch op {
+		case 1:
+			err = recepcionAltaCliente()
+		case 2:
+			var id int
+			var campo, valor string
+			fmt.Print("ID cliente: ")
+			fmt.Scanln(&id)
+			fmt.Print("Dato (nombre/telefono/email): ")
+			fmt.Scanln(&campo)
+			fmt.Print("Nuevo valor: ")
+			fmt.Scanln(&valor)
+			err = recepcion.CambiarCliente(id, campo, valor)
+		case 3:
+			var id int
+			fmt.Print("ID cliente: ")
+			fmt.Scanln(&id)
+			err = recepcion.BajaCliente(id)
+		case 4:
+			var id int
+			var mat, marca, modelo string
+			fmt.Print("ID del cliente propietario: ")
+			fmt.Scanln(&id)
+			fmt.Print("Matrícula: ")
+			fmt.Scanln(&mat)
+			fmt.Print("Marca: ")
+			fmt.Scanln(&marca)
+			fmt.Print("Modelo: ")
+			fmt.Scanln(&modelo)
+			err = recepcion.AltaVehiculo(id, mat, marca, modelo)
+		case 5:
+			var mat string
+			fmt.Print("Matrícula: ")
+			fmt.Scanln(&mat)
+			err = recepcion.BajaVehiculo(mat)
+		case 6:
+			err = recepcionAltaIncidencia()
+		case 7:
+			var id int
+			var estado string
+			fmt.Print("ID incidencia: ")
+			fmt.Scanln(&id)
+			if estado = elegirEstado(EstadosIncidencia); estado == "" {
+				fmt.Println("Opción no válida.")
+				continue
+			}
+			err = recepcion.CambiarEstado(id, estado)
+		case 8:
+			verRecepcion()
+			continue
+		case 9:
+			var dir string
+			fmt.Print("Dirección de la otra recepción: ")
+			fmt.Scanln(&dir)
+			err = recepcion.Sincronizar(dir)
+		case 10:
+			if enrutador != nil {
+				fmt.Println("Vuelque la recepción desde un fragmento: el enrutador no guarda clientes.")
+				continue
+			}
+			var hechas int
+			hechas, err = recepcion.Volcar(&app, &mutexTaller, ejecutar)
+			fmt.Printf("%d operaciones ejecutadas en el taller.\n", hechas)
+		case 0:
+			return
+		default:
+			fmt.Println("Opción no válida.")
+			continue
+		}
+		if err != nil {
+			fmt.Println("Error:", err)
+			continue
+		}
+		fmt.Println("Hecho.")
+	}
+}
+
+// RECEPCIÓN
+func recepcionAltaCliente() error {
+	var nombre, telefono, email string
+	fmt.Print("Nombre: ")
+	fmt.Scanln(&nombre)
+	fmt.Print("Teléfono: ")
+	fmt.Scanln(&telefono)
+	fmt.Print("Email: ")
+	fmt.Scanln(&email)
+	// Sin conexión no se puede comprobar qué IDs están libres: se genera uno
+	id, err := generadorIDs.Siguiente()
+	if err != nil {
+		return err
+	}
+	if err := recepcion.AltaCliente(id, nombre, telefono, email); err != nil {
+		return err
+	}
+	fmt.Printf("Cliente registrado con ID=%d.\n", id)
+	return nil
+}
+
+func recepcionAltaIncidencia() error {
+	var mat, tipo, prio, desc string
+	fmt.Print("Matrícula del vehículo: ")
+	fmt.Scanln(&mat)
+	fmt.Print("Tipo (mecánica/eléctrica/carrocería): ")
+	fmt.Scanln(&tipo)
+	fmt.Print("Prioridad (baja/media/alta): ")
+	fmt.Scanln(&prio)
+	fmt.Print("Descripción (una palabra o sin espacios): ")
+	fmt.Scanln(&desc)
+	id, err := generadorIDs.Siguiente()
+	if err != nil {
+		return err
+	}
+	if err := recepcion.AltaIncidencia(id, mat, tipo, prio, desc); err != nil {
+		return err
+	}
+	fmt.Printf("Incidencia abierta con ID=%d.\n", id)
+	return nil
+}
+
+func verRecepcion() {
+	vista := recepcion.Vista()
+	if len(vista.Clientes) == 0 {
+		fmt.Println("La recepción no tiene clientes registrados.")
+	}
+	for _, c := range vista.Clientes {
+		fmt.Printf("- ID:%d | %s | Tel:%s | Email:%s\n", c.IDCliente, c.Nombre, c.Telefono, c.Email)
+		for _, v := range c.Vehiculos {
+			fmt.Printf("    [%s] %s %s", v.Matricula, v.Marca, v.Modelo)
+			if inc := v.Incidencia; inc != nil {
+				fmt.Printf(" | IncID:%d | Tipo:%s | Prio:%s | Estado:%s", inc.IDIncidencia, inc.Tipo, inc.Prioridad, inc.Estado)
+			}
+			fmt.Println()
+		}
+	}
+	for _, c := range vista.Conflictos {
+		fmt.Println("Conflicto:", c)
+	}
+}
+
+// Menú: Eventos del taller
+func seguirEventos() {
+	fmt.Print("Temas separados por comas (vacío = todos; p. ej. incidencia.cerrada,plaza.*): ")
+	var temas string
+	fmt.Scanln(&temas)
+	var lista []string
+	if temas != "" {
+		lista = strings.Split(temas, ",")
+	}
+	sus := bus.Suscribir(lista...)
+	go func() {
+		for e := range sus.C {
+			switch e.Tema {
+			case TemaEstadoIncidencia, TemaIncidenciaCerrada:
+				fmt.Printf("[%s] %s | Incidencia:%d | Estado:%s\n", e.Fecha, e.Tema, e.IDIncidencia, e.Estado)
+			default:
+				fmt.Printf("[%s] %s | Plaza:%d | Cliente:%d | Mecánico:%d\n", e.Fecha, e.Tema, e.IDPlaza, e.IDCliente, e.IDMecanico)
+			}
+		}
+	}()
+	fmt.Println("Mostrando eventos; pulse Intro para volver.")
+	fmt.Scanln()
+	sus.Cancelar()
+}
+
+// Menú: Avisos a clientes
+func verAvisos() {
+	if avisos == nil {
+		fmt.Println("Los avisos a clientes no están activos (use -smtp o -sms-salida).")
+		return
+	}
+	fmt.Println(avisos.Estado())
+	registro := avisos.Registro()
+	if len(registro) == 0 {
+		fmt.Println("Aún no se ha enviado ningún aviso.")
+	}
+	for _, e := range registro {
+		fmt.Printf("- [%s] %s a %s | %s | Intento:%d | %s", e.Fecha, e.Canal, e.Destino, e.Asunto, e.Intento, e.Estado)
+		if e.Error != "" {
+			fmt.Printf(" (%s)", e.Error)
+		}
+		fmt.Println()
+	}
+}
+
+// REPUESTOS
+func menuRepuestos() {
+	var op int
+	for {
+		fmt.Println("\n===== GESTIÓN DE REPUESTOS =====")
+		fmt.Println("1. Crear repuesto")
+		fmt.Println("2. Visualizar repuestos")
+		fmt.Println("3. Modificar repuesto")
+		fmt.Println("4. Eliminar repuesto")
+		fmt.Println("5. Entrada de unidades en el almacén")
+		fmt.Println("6. Reservar repuesto para una incidencia")
+		fmt.Println("7. Liberar repuesto de una incidencia")
+		fmt.Println("8. Avisos de existencias")
+		fmt.Println("0. Volver")
+		fmt.Print("Opción: ")
+		fmt.Scanln(&op)
+
+		switch op {
+		case 1:
+			guardarRepuesto(OpCrearRepuesto)
+		case 2:
+			listarRepuestos()
+		case 3:
+			guardarRepuesto(OpModificarRepuesto)
+		case 4:
+			var ref string
+			fmt.Print("Referencia del repuesto a eliminar: ")
+			fmt.Scanln(&ref)
+			if err := ejecutar(Operacion{Tipo: OpEliminarRepuesto, Referencia: ref}); err != nil {
+				fmt.Println("Error:", err)
+				continue
+			}
+			fmt.Println("Repuesto eliminado.")
+		case 5:
+			var ref string
+			var n int
+			fmt.Print("Referencia: ")
+			fmt.Scanln(&ref)
+			fmt.Print("Unidades recibidas: ")
+			fmt.Scanln(&n)
+			if err := ejecutar(Operacion{Tipo: OpEntradaRepuesto, Referencia: ref, Cantidad: n}); err != nil {
+				fmt.Println("Error:", err)
+				continue
+			}
+			fmt.Printf("Entrada registrada: %d libres.\n", copiaTaller().Disponible(ref))
+		case 6:
+			reservarRepuesto()
+		case 7:
+			var mat, ref string
+			fmt.Print("Matrícula del vehículo: ")
+			fmt.Scanln(&mat)
+			fmt.Print("Referencia: ")
+			fmt.Scanln(&ref)
+			if err := ejecutar(Operacion{Tipo: OpLiberarRepuesto, Matricula: mat, Referencia: ref}); err != nil {
+				fmt.Println("Error:", err)
+				continue
+			}
+			fmt.Println("Repuesto liberado.")
+		case 8:
+			avisos := copiaTaller().AvisosExistencias()
+			if len(avisos) == 0 {
+				fmt.Println("No hay que reponer ningún repuesto.")
+			}
+			for _, a := range avisos {
+				fmt.Println("- Reponer", a)
+			}
+		case 0:
+			return
+		default:
+			fmt.Println("Opción no válida.")
+		}
+	}
+}
+
+func guardarRepuesto(tipo string) {
+	var r Repuesto
+	var compatibles string
+	var coste, precio float64
+	fmt.Print("Referencia: ")
+	fmt.Scanln(&r.Referencia)
+	if actual, _ := copiaTaller().BuscarRepuesto(r.Referencia); tipo == OpModificarRepuesto && actual == nil {
+		fmt.Println("Repuesto no encontrado.")
+		return
+	}
+	fmt.Print("Descripción: ")
+	fmt.Scanln(&r.Descripcion)
+	fmt.Print("Compatible con (Marca/Modelo separados por comas, vacío = todos): ")
+	fmt.Scanln(&compatibles)
+	fmt.Print("Coste (€): ")
+	fmt.Scanln(&coste)
+	fmt.Print("Precio de venta (€): ")
+	fmt.Scanln(&precio)
+	if tipo == OpCrearRepuesto {
+		fmt.Print("Unidades en el almacén: ")
+		fmt.Scanln(&r.Stock)
+	}
+	fmt.Print("Punto de pedido (existencias mínimas): ")
+	fmt.Scanln(&r.Minimo)
+	fmt.Print("ID del proveedor (0 = ninguno): ")
+	fmt.Scanln(&r.IDProveedor)
+	if r.IDProveedor != 0 {
+		fmt.Print("Unidades mínimas por pedido: ")
+		fmt.Scanln(&r.Lote)
+	}
+	r.Compatibles = LeerCompatibles(compatibles)
+	r.Coste, r.Precio = redondear(coste*100), redondear(precio*100)
+	if err := ejecutar(Operacion{Tipo: tipo, Repuesto: &r}); err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	fmt.Println("Repuesto guardado.")
+}
+
+func listarRepuestos() {
+	t := copiaTaller()
+	if len(t.Repuestos) == 0 {
+		fmt.Println("No hay repuestos.")
+		return
+	}
+	for _, r := range t.Repuestos {
+		compatibles := "todos"
+		if len(r.Compatibles) > 0 {
+			compatibles = fmt.Sprint(r.Compatibles)
+		}
+		fmt.Printf("- %s | %s | Coste:%s | Precio:%s | Almacén:%d | Libres:%d | Mínimo:%d | Proveedor:%d | Compatible:%s\n",
+			r.Referencia, r.Descripcion, Euros(r.Coste), Euros(r.Precio), r.Stock, t.Disponible(r.Referencia), r.Minimo, r.IDProveedor, compatibles)
+	}
+}
+
+func reservarRepuesto() {
+	var mat, ref string
+	var n int
+	fmt.Print("Matrícula del vehículo: ")
+	fmt.Scanln(&mat)
+	fmt.Print("Referencia: ")
+	fmt.Scanln(&ref)
+	fmt.Print("Unidades: ")
+	fmt.Scanln(&n)
+	if err := ejecutar(Operacion{Tipo: OpReservarRepuesto, Matricula: mat, Referencia: ref, Cantidad: n}); err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	fmt.Println("Repuesto reservado.")
+	if _, v := copiaTaller().BuscarVehiculo(mat); v != nil && v.GetIncidencia() != nil {
+		if faltan := PiezasQueFaltan(v.GetIncidencia()); len(faltan) > 0 {
+			fmt.Printf("Aviso: %v. La incidencia no podrá pasar a en proceso hasta que se repongan.\n", errorFaltan(faltan))
+		}
+	}
+}
+
+// CITAS
+func menuCitas() {
+	var op int
+	for {
+		fmt.Println("\n===== CITAS =====")
+		fmt.Println("1. Pedir cita")
+		fmt.Println("2. Citas de un día")
+		fmt.Println("3. Próximas citas")
+		fmt.Println("4. Huecos libres de un día")
+		fmt.Println("5. Cancelar cita")
+		fmt.Println("6. Llegada de un vehículo con cita")
+		fmt.Println("0. Volver")
+		fmt.Print("Opción: ")
+		fmt.Scanln(&op)
+
+		switch op {
+		case 1:
+			pedirCita()
+		case 2:
+			var dia string
+			fmt.Print("Día (AAAA-MM-DD): ")
+			fmt.Scanln(&dia)
+			listarCitas(copiaTaller().CitasDelDia(dia))
+		case 3:
+			proximas := copiaTaller().ProximasCitas(time.Now().In(ZonaTaller).Format("2006-01-02"), 7)
+			if len(proximas) == 0 {
+				fmt.Println("No hay citas en los próximos 7 días.")
+			}
+			for i := 0; i < 7; i++ {
+				dia := time.Now().AddDate(0, 0, i).Format("2006-01-02")
+				if len(proximas[dia]) > 0 {
+					fmt.Println(dia + ":")
+					listarCitas(proximas[dia])
+				}
+			}
+		case 4:
+			var dia, esp string
+			fmt.Print("Día (AAAA-MM-DD): ")
+			fmt.Scanln(&dia)
+			fmt.Print("Especialidad (mecánica/eléctrica/carrocería): ")
+			fmt.Scanln(&esp)
+			t := copiaTaller()
+			for _, h := range HorasCita {
+				fmt.Printf("- %s: %d libres\n", h, t.HuecosFranja(dia, h, esp))
+			}
+		case 5, 6:
+			var id int
+			fmt.Print("ID cita: ")
+			fmt.Scanln(&id)
+			operacion := Operacion{Tipo: OpCancelarCita, IDCita: id}
+			if op == 6 {
+				operacion.Tipo = OpLlegadaCita
+				fmt.Print("ID del mecánico (0 = el primero disponible de la especialidad): ")
+				fmt.Scanln(&operacion.IDMecanico)
+				// Si el vehículo no tiene incidencia, se le abre con el motivo de la cita
+				idInc, err := generadorIDs.Siguiente()
+				if err != nil {
+					fmt.Println("Error:", err)
+					continue
+				}
+				operacion.IDIncidencia = idInc
+			}
+			if err := ejecutar(operacion); err != nil {
+				fmt.Println("Error:", err)
+				continue
+			}
+			if c := copiaTaller().BuscarCita(id); c != nil && c.Estado == CitaAtendida {
+				fmt.Printf("Vehículo %s en la plaza #%d.\n", c.Matricula, c.IDPlaza)
+			} else {
+				fmt.Println("Cita cancelada.")
+			}
+		case 0:
+			return
+		default:
+			fmt.Println("Opción no válida.")
+		}
+	}
+}
+
+func pedirCita() {
+	var c Cita
+	fmt.Print("Matrícula del vehículo: ")
+	fmt.Scanln(&c.Matricula)
+	fmt.Print("Día (AAAA-MM-DD): ")
+	fmt.Scanln(&c.Dia)
+	fmt.Printf("Hora (%s): ", strings.Join(HorasCita, ", "))
+	fmt.Scanln(&c.Hora)
+	if inicio, err := time.ParseInLocation("2006-01-02 15:04", c.Dia+" "+c.Hora, ZonaTaller); err == nil && inicio.Before(time.Now()) {
+		fmt.Println("No se pueden pedir citas en el pasado.")
+		return
+	}
+	fmt.Print("Especialidad (mecánica/eléctrica/carrocería): ")
+	fmt.Scanln(&c.Especialidad)
+	fmt.Print("Motivo (una palabra o sin espacios): ")
+	fmt.Scanln(&c.Motivo)
+	id, err := generadorIDs.Siguiente()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	c.IDCita = id
+	if err := ejecutar(Operacion{Tipo: OpPedirCita, Cita: &c}); err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	fmt.Printf("Cita reservada con ID=%d.\n", id)
+}
+
+func listarCitas(citas []*Cita) {
+	if len(citas) == 0 {
+		fmt.Println("No hay citas.")
+	}
+	for _, c := range citas {
+		fmt.Printf("- %s %s | ID:%d | %s | Cliente:%d | %s | %s | %s\n",
+			c.Dia, c.Hora, c.IDCita, c.Matricula, c.IDCliente, c.Especialidad, c.Motivo, c.Estado)
+	}
+}
+
+// PROVEEDORES Y PEDIDOS
+func menuProveedores() {
+	var op int
+	for {
+		fmt.Println("\n===== PROVEEDORES Y PEDIDOS =====")
+		fmt.Println("1. Crear proveedor")
+		fmt.Println("2. Visualizar proveedores")
+		fmt.Println("3. Modificar proveedor")
+		fmt.Println("4. Eliminar proveedor")
+		fmt.Println("5. Visualizar pedidos")
+		fmt.Println("6. Ver pedido")
+		fmt.Println("7. Enviar pedido")
+		fmt.Println("8. Recibir pedido")
+		fmt.Println("9. Cancelar pedido")
+		fmt.Println("0. Volver")
+		fmt.Print("Opción: ")
+		fmt.Scanln(&op)
+
+		switch op {
+		case 1:
+			guardarProveedor(OpCrearProveedor)
+		case 2:
+			t := copiaTaller()
+			if len(t.Proveedores) == 0 {
+				fmt.Println("No hay proveedores.")
+			}
+			for _, pr := range t.Proveedores {
+				fmt.Printf("- ID:%d | %s | Tel:%s | Email:%s\n", pr.IDProveedor, pr.Nombre, pr.Telefono, pr.Email)
+			}
+		case 3:
+			guardarProveedor(OpModificarProveedor)
+		case 4:
+			var id int
+			fmt.Print("ID proveedor a eliminar: ")
+			fmt.Scanln(&id)
+			if err := ejecutar(Operacion{Tipo: OpEliminarProveedor, IDProveedor: id}); err != nil {
+				fmt.Println("Error:", err)
+				continue
+			}
+			fmt.Println("Proveedor eliminado.")
+		case 5:
+			t := copiaTaller()
+			if len(t.Pedidos) == 0 {
+				fmt.Println("No hay pedidos.")
+			}
+			for _, p := range t.Pedidos {
+				fmt.Printf("- Pedido %d | Proveedor:%d | %s | %s | Líneas:%d | Total:%s | Incidencias:%v\n",
+					p.IDPedido, p.IDProveedor, p.Estado, p.Fecha, len(p.Lineas), Euros(p.Total()), p.Incidencias)
+			}
+		case 6, 7, 8, 9:
+			var id int
+			fmt.Print("ID pedido: ")
+			fmt.Scanln(&id)
+			if op == 6 {
+				t := copiaTaller()
+				if p := t.BuscarPedido(id); p != nil {
+					fmt.Println(p.Texto(t))
+				} else {
+					fmt.Println("Pedido no encontrado.")
+				}
+				continue
+			}
+			tipo := map[int]string{7: OpEnviarPedido, 8: OpRecibirPedido, 9: OpCancelarPedido}[op]
+			if err := ejecutar(Operacion{Tipo: tipo, IDPedido: id}); err != nil {
+				fmt.Println("Error:", err)
+				continue
+			}
+			fmt.Println("Pedido actualizado.")
+		case 0:
+			return
+		default:
+			fmt.Println("Opción no válida.")
+		}
+	}
+}
+
+func guardarProveedor(tipo string) {
+	var pr Proveedor
+	fmt.Print("ID proveedor: ")
+	fmt.Scanln(&pr.IDProveedor)
+	fmt.Print("Nombre: ")
+	fmt.Scanln(&pr.Nombre)
+	fmt.Print("Teléfono: ")
+	fmt.Scanln(&pr.Telefono)
+	fmt.Print("Email: ")
+	fmt.Scanln(&pr.Email)
+	if err := ejecutar(Operacion{Tipo: tipo, Proveedor: &pr}); err != nil {
+		fmt.Println("Error:", err)
 		return
 	}
-	// Liberar plazas atendidas por este mecánico
-	liberarPlazasDeMecanico(m)
-	// Eliminar del slice
-	app.MecanicosTaller = append(app.MecanicosTaller[:idx], app.MecanicosTaller[idx+1:]...)
-	// Recalcular plazas por política 2 por mecánico
-	app.InicializarPlazas()
-	fmt.Println("Mecánico eliminado, plazas liberadas y recalculadas.")
+	fmt.Println("Proveedor guardado.")
 }
 
-func cambiarEstadoMecanico() {
-	var id int
+// FACTURACIÓN
+func menuFacturas() {
 	var op int
-	fmt.Print("ID del mecánico: ")
-	fmt.Scanln(&id)
-	m, _ := findMecanicoByID(id)
-	if m == nil {
-		fmt.Println("No existe ese mecánico.")
+	for {
+		fmt.Println("\n===== FACTURACIÓN =====")
+		fmt.Println("1. Facturar incidencia cerrada")
+		fmt.Println("2. Listar facturas")
+		fmt.Println("3. Facturas de un cliente")
+		fmt.Println("4. Ver factura")
+		fmt.Println("5. Guardar factura en HTML")
+		fmt.Println("6. Registrar un pago o una devolución")
+		fmt.Println("7. Extracto de un cliente")
+		fmt.Println("8. Facturas pendientes de cobro")
+		fmt.Println("0. Volver")
+		fmt.Print("Opción: ")
+		fmt.Scanln(&op)
+
+		switch op {
+		case 1:
+			emitirFactura()
+		case 2:
+			listarFacturas(copiaTaller().Facturas)
+		case 3:
+			var id int
+			fmt.Print("ID cliente: ")
+			fmt.Scanln(&id)
+			listarFacturas(copiaTaller().FacturasDeCliente(id))
+		case 4, 5:
+			var numero string
+			fmt.Print("Número de factura (año-número): ")
+			fmt.Scanln(&numero)
+			f := copiaTaller().BuscarFactura(numero)
+			if f == nil {
+				fmt.Println("Factura no encontrada.")
+				continue
+			}
+			if op == 4 {
+				fmt.Println(f.Texto())
+				continue
+			}
+			dir := filepath.Join(directorioDatos, "facturas")
+			ruta := filepath.Join(dir, f.Numero+".html")
+			err := os.MkdirAll(dir, 0755)
+			if err == nil {
+				err = escribirAtomico(ruta, []byte(f.HTML()))
+			}
+			if err != nil {
+				fmt.Println("Error:", err)
+				continue
+			}
+			fmt.Println("Factura guardada en", ruta)
+		case 6:
+			registrarPago()
+		case 7:
+			verExtracto()
+		case 8:
+			var pendientes []*Factura
+			t := copiaTaller()
+			for _, f := range t.Facturas {
+				if t.Pendiente(f) > 0 {
+					pendientes = append(pendientes, f)
+				}
+			}
+			listarFacturas(pendientes)
+		case 0:
+			return
+		default:
+			fmt.Println("Opción no válida.")
+		}
+	}
+}
+
+func emitirFactura() {
+	var mat string
+	fmt.Print("Matrícula del vehículo: ")
+	fmt.Scanln(&mat)
+	t := copiaTaller()
+	_, veh := t.BuscarVehiculo(mat)
+	if veh == nil || veh.GetIncidencia() == nil {
+		fmt.Println("Vehículo no encontrado o sin incidencia.")
 		return
 	}
-	fmt.Print("1=Activar, 2=Dar de baja: ")
-	fmt.Scanln(&op)
-	if op == 1 {
-		m.CambiarEstado(true)
-	} else if op == 2 {
-		m.CambiarEstado(false)
-	} else {
-		fmt.Println("Opción inválida.")
+	inc := veh.GetIncidencia()
+	if inc.Estado != "cerrada" {
+		fmt.Println("Solo se facturan incidencias cerradas.")
 		return
 	}
-	app.InicializarPlazas()
-	fmt.Println("Estado del mecánico actualizado y plazas recalculadas.")
+	if p := inc.PresupuestoVigente(); p != nil {
+		fmt.Printf("Presupuesto aceptado (versión %d): %s\n", p.Version, Euros(p.Total))
+	}
+	// Por omisión se cobran las horas fichadas, redondeadas al cuarto de hora
+	fichadas := HorasIncidencia(inc, time.Now())
+	horas := map[int]float64{}
+	for _, m := range t.mecanicosIncidencia(inc) {
+		horas[m.IDMecanico] = horasFacturables(fichadas[m.IDMecanico])
+		fmt.Printf("Horas de %s (%s, %s/h) [%s]: ", m.Nombre, m.Especialidad,
+			Euros(TarifasHora[m.Especialidad]), cantidadTexto(horas[m.IDMecanico]))
+		var texto string
+		fmt.Scanln(&texto)
+		if h, err := strconv.ParseFloat(strings.Replace(texto, ",", ".", 1), 64); err == nil {
+			horas[m.IDMecanico] = h
+		}
+	}
+	// Las piezas que gastó la incidencia se facturan al precio del catálogo
+	piezas := t.lineasPiezas(inc)
+	for _, l := range piezas {
+		fmt.Printf("Pieza del almacén: %s × %s a %s\n", l.Concepto, cantidadTexto(l.Cantidad), Euros(l.Precio))
+	}
+	lineas := append(t.lineasManoObra(inc, horas), piezas...)
+	for {
+		var concepto string
+		fmt.Print("Otra pieza (vacío para terminar): ")
+		fmt.Scanln(&concepto)
+		if concepto == "" {
+			break
+		}
+		l := LineaFactura{Tipo: LineaPieza, Concepto: concepto}
+		var precio float64
+		fmt.Print("Unidades: ")
+		fmt.Scanln(&l.Cantidad)
+		fmt.Print("Precio por unidad (€): ")
+		fmt.Scanln(&precio)
+		fmt.Print("Descuento de la pieza (%): ")
+		fmt.Scanln(&l.Descuento)
+		l.Precio = redondear(precio * 100)
+		lineas = append(lineas, l)
+	}
+	var descuento float64
+	fmt.Print("Descuento sobre el total (%): ")
+	fmt.Scanln(&descuento)
+	err := ejecutar(Operacion{Tipo: OpEmitirFactura, Matricula: mat,
+		Factura: &Factura{Lineas: lineas, Descuento: descuento}})
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	if f := copiaTaller().FacturaDeIncidencia(inc.IDIncidencia); f != nil {
+		fmt.Println(f.Texto())
+	}
+}
+
+func listarFacturas(facturas []*Factura) {
+	if len(facturas) == 0 {
+		fmt.Println("No hay facturas.")
+		return
+	}
+	t := copiaTaller()
+	for _, f := range facturas {
+		estado := "pagada"
+		if pendiente := t.Pendiente(f); pendiente > 0 {
+			estado = "pendiente " + Euros(pendiente)
+		}
+		fmt.Printf("- %s | %s | Cliente:%d %s | %s | Incidencia:%d | Total:%s | %s\n",
+			f.Numero, f.Fecha, f.IDCliente, f.Cliente, f.Matricula, f.IDIncidencia, Euros(f.Total), estado)
+	}
+}
+
+// PAGOS
+func registrarPago() {
+	var numero, tipo string
+	var importe float64
+	fmt.Print("Número de factura (año-número): ")
+	fmt.Scanln(&numero)
+	t := copiaTaller()
+	f := t.BuscarFactura(numero)
+	if f == nil {
+		fmt.Println("Factura no encontrada.")
+		return
+	}
+	fmt.Printf("Total:%s | Cobrado:%s | Pendiente:%s\n", Euros(f.Total), Euros(t.Cobrado(numero)), Euros(t.Pendiente(f)))
+	fmt.Print("¿Cobro o devolución? (c/d): ")
+	fmt.Scanln(&tipo)
+	p := Pago{Factura: numero}
+	fmt.Print("Forma de pago (efectivo/tarjeta/transferencia): ")
+	fmt.Scanln(&p.Metodo)
+	fmt.Print("Importe (€): ")
+	fmt.Scanln(&importe)
+	fmt.Print("Nota: ")
+	fmt.Scanln(&p.Nota)
+	p.Importe = redondear(importe * 100)
+	if strings.EqualFold(tipo, "d") {
+		p.Importe = -p.Importe
+	}
+	id, err := generadorIDs.Siguiente()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	p.IDPago = id
+	if err := ejecutar(Operacion{Tipo: OpRegistrarPago, Pago: &p}); err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	fmt.Printf("Pago registrado. Quedan %s por cobrar.\n", Euros(copiaTaller().Pendiente(f)))
+}
+
+func verExtracto() {
+	var id int
+	fmt.Print("ID cliente: ")
+	fmt.Scanln(&id)
+	t := copiaTaller()
+	movimientos := t.ExtractoCliente(id)
+	if len(movimientos) == 0 {
+		fmt.Println("El cliente no tiene facturas.")
+		return
+	}
+	fmt.Println(ajustar("Fecha", 12, false) + ajustar("Concepto", 46, false) +
+		ajustar("Cargo", 14, true) + ajustar("Abono", 14, true) + ajustar("Saldo", 14, true))
+	for _, m := range movimientos {
+		fmt.Println(ajustar(m.Fecha, 10, false) + "  " + ajustar(m.Concepto, 46, false) +
+			ajustar(Euros(m.Cargo), 14, true) + ajustar(Euros(m.Abono), 14, true) + ajustar(Euros(m.Saldo), 14, true))
+	}
+	fmt.Printf("Saldo pendiente: %s\n", Euros(t.SaldoCliente(id)))
 }
 
 // PLAZAS / ESTADO TALLER
 func asignarVehiculoAPlaza() {
-	ocupadas, libres := app.EstadoTaller()
+	if enrutador != nil {
+		fmt.Println("Los vehículos están repartidos entre fragmentos: las plazas se asignan en cada taller.")
+		return
+	}
+	t := copiaTaller()
+	ocupadas, libres := t.EstadoTaller()
 	if libres == 0 {
 		fmt.Println("No hay plazas libres: taller lleno.")
 		return
@@ -708,22 +2437,48 @@ func asignarVehiculoAPlaza() {
 	var mat string
 	fmt.Print("Matrícula del vehículo a asignar: ")
 	fmt.Scanln(&mat)
-	cli, veh := app.BuscarVehiculo(mat)
+	_, veh := t.BuscarVehiculo(mat)
 	if veh == nil {
 		fmt.Println("Vehículo no encontrado.")
 		return
 	}
+	if citas := t.CitasPendientesEn(relojFisico.Fecha(), mat); libres <= citas {
+		fmt.Printf("Las %d plazas libres están reservadas para las citas de esta hora.\n", libres)
+		return
+	}
 	var idm int
 	fmt.Print("ID del mecánico para asignar: ")
 	fmt.Scanln(&idm)
-	mec, _ := findMecanicoByID(idm)
-	if mec == nil || !mec.Activo {
-		fmt.Println("Mecánico inexistente o no activo.")
+	mec, _ := t.BuscarMecanico(idm)
+	if mec == nil || !mec.DisponibleEn(relojFisico.Fecha()) {
+		fmt.Println("Mecánico inexistente, no activo, inaccesible o fuera de turno.")
 		return
 	}
-	for _, p := range app.PlazasTaller {
+	// La consulta de la plaza libre y la asignación no pueden intercalarse
+	// con las de otro proceso. La réplica local puede no tener aún la
+	// asignación del titular anterior: se espera a la versión con la que
+	// cedió el acceso y se cede con la que deja la propia.
+	if exclusion != nil {
+		version, err := exclusion.Entrar()
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		defer func() { exclusion.Salir(versionReplicada()) }()
+		if err := EsperarVersion(versionReplicada, version); err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		t = copiaTaller()
+		ocupadas, _ = t.EstadoTaller()
+	}
+	for _, p := range t.PlazasTaller {
 		if p.EstaLibre() {
-			p.Ocupar(cli, mec)
+			op := Operacion{Tipo: OpAsignarPlaza, Matricula: veh.Matricula, IDMecanico: mec.IDMecanico, IDPlaza: p.IDPlaza}
+			if err := ejecutar(op); err != nil {
+				fmt.Println("Error:", err)
+				return
+			}
 			fmt.Printf("Vehículo %s asignado a plaza #%d con mecánico %s. (Ocupadas:%d→%d)\n",
 				veh.Matricula, p.IDPlaza, mec.Nombre, ocupadas, ocupadas+1)
 			return
@@ -733,33 +2488,457 @@ func asignarVehiculoAPlaza() {
 }
 
 func consultarEstadoTaller() {
-	ocupadas, libres := app.EstadoTaller()
-	total := len(app.PlazasTaller)
+	t := copiaTaller()
+	ocupadas, libres := t.EstadoTaller()
+	total := len(t.PlazasTaller)
 	var pct float64 = 0
 	if total > 0 {
 		pct = math.Round((float64(ocupadas)/float64(total))*100.0 + 0.00001)
 	}
 	fmt.Printf("Plazas ocupadas: %d | libres: %d | total: %d | ocupación: %.0f%%\n", ocupadas, libres, total, pct)
-	for _, p := range app.PlazasTaller {
+	for _, p := range t.PlazasTaller {
 		if p.ocupada {
 			fmt.Printf(" - Plaza #%d: OCUPADA | Cliente:%s | Mecánico:%s\n",
 				p.IDPlaza, p.GetCliente().Nombre, p.GetMecanico().Nombre)
+		} else if p.GetReserva() != "" {
+			fmt.Printf(" - Plaza #%d: RESERVADA para un vehículo de otra sede\n", p.IDPlaza)
 		} else {
 			fmt.Printf(" - Plaza #%d: libre\n", p.IDPlaza)
 		}
 	}
 }
 
+// ESTADO DEL NODO
+func consultarEstadoNodo() {
+	switch {
+	case nodoRaft != nil:
+		estado, termino, lider := nodoRaft.Estado()
+		ultimo, commit, aplicado := nodoRaft.Indices()
+		fmt.Printf("Raft | Estado:%s | Término:%d | Líder:%d | Log:%d | Commit:%d | Aplicado:%d\n",
+			estado, termino, lider, ultimo, commit, aplicado)
+		if err := nodoRaft.Fallo(); err != nil {
+			fmt.Println("Raft | Nodo detenido:", err)
+		}
+	case replica != nil:
+		fmt.Println(replica.Estado())
+	default:
+		fmt.Println("Nodo único: la replicación no está activa.")
+	}
+	if exclusion != nil {
+		fmt.Println(exclusion.Metricas())
+	}
+	if eleccion != nil {
+		fmt.Println(eleccion.Estado())
+	}
+	if vigilante != nil {
+		fmt.Println("Terminales | " + vigilante.Estado())
+	}
+	if nodoHora != nil {
+		fmt.Println(nodoHora.Estado())
+	}
+	if gossip != nil {
+		fmt.Println(gossip.Estado())
+	}
+	if recepcion != nil {
+		fmt.Println(recepcion.Estado())
+	}
+	fmt.Println(bus.Estado())
+	if avisos != nil {
+		fmt.Println(avisos.Estado())
+	}
+	if m := relojes.Actual(); m != nil {
+		fmt.Printf("Relojes lógicos de %s | %s\n", m.Nodo, m)
+	}
+}
+
+// nodoEnPares devuelve la dirección del nodo id en la lista de pares
+// separados por comas de -<opcion>-pares
+func nodoEnPares(opcion, pares string, id int) (string, error) {
+	lista := strings.Split(pares, ",")
+	if id < 0 || id >= len(lista) {
+		return "", fmt.Errorf("-%s-id %d no está entre los %d nodos de -%s-pares", opcion, id, len(lista), opcion)
+	}
+	return lista[id], nil
+}
+
 // MAIN
 
 func main() {
-	// Semilla de prueba
-	app.MecanicosTaller = []*Mecanico{
-		{IDMecanico: 1, Nombre: "Laura", Especialidad: "mecánica", AniosExperiencia: 3, Activo: true},
-		{IDMecanico: 2, Nombre: "Pedro", Especialidad: "eléctrica", AniosExperiencia: 5, Activo: true},
+	dirDatos := flag.String("datos", "datos", "directorio del registro y los checkpoints")
+	rol := flag.String("rol", "", "rol en la replicación: primario o respaldo (vacío = nodo único)")
+	escucha := flag.String("escucha", "localhost:9001", "dirección en la que escucha el respaldo")
+	dirRespaldo := flag.String("respaldo", "localhost:9001", "dirección del respaldo (solo primario)")
+	raftID := flag.Int("raft-id", 0, "posición de este nodo en -raft-pares")
+	raftPares := flag.String("raft-pares", "", "direcciones de los nodos Raft separadas por comas")
+	sedes := flag.String("sedes", "", "fichero JSON con las sedes de la red de talleres")
+	sede := flag.String("sede", "", "nombre de esta sede dentro de -sedes")
+	nombreNodo := flag.String("nodo", "", "nombre de este nodo en los relojes lógicos (por defecto, la sede, el par Raft o el rol)")
+	algExclusion := flag.String("exclusion", "", "exclusión mutua al asignar plazas: centralizado, ricart-agrawala o anillo")
+	exclusionID := flag.Int("exclusion-id", 0, "posición de este nodo en -exclusion-pares")
+	exclusionPares := flag.String("exclusion-pares", "", "direcciones de los nodos de exclusión mutua separadas por comas")
+	algEleccion := flag.String("eleccion", "", "elección de coordinador entre talleres: bully o anillo")
+	eleccionID := flag.Int("eleccion-id", 0, "posición de este nodo en -eleccion-pares")
+	eleccionPares := flag.String("eleccion-pares", "", "direcciones de los nodos de la elección separadas por comas")
+	dirVigilante := flag.String("vigilante", "", "dirección UDP en la que recibir los latidos de los terminales de los mecánicos")
+	phiUmbral := flag.Float64("phi-umbral", 8, "sospecha (phi) a partir de la cual un terminal se da por caído")
+	latidoExpiracion := flag.Duration("latido-expiracion", 3*time.Second, "silencio tras el que un terminal se da por caído aunque phi no llegue al umbral")
+	terminalMecanico := flag.Int("terminal-mecanico", 0, "actúa como el terminal del mecánico con este ID, enviando latidos a -vigilante")
+	desfase := flag.Duration("desfase", 0, "desajuste simulado del reloj de este nodo (p. ej. 3s o -1.5s)")
+	horaEscucha := flag.String("hora-escucha", "", "dirección en la que atender las peticiones de hora de los demás nodos")
+	algSinc := flag.String("sincronizacion", "", "sincronización de relojes físicos: cristian o berkeley")
+	horaPares := flag.String("hora-pares", "", "servidor de hora (cristian) o nodos que coordinar (berkeley), separados por comas")
+	idNodo := flag.Int("id-nodo", -1, fmt.Sprintf("número de este nodo (0-%d) en los identificadores; distinto en cada nodo; obligatorio la primera vez en red, después se recuerda en -datos", MaxNodoID))
+	dirFragmento := flag.String("fragmento", "", "dirección en la que este nodo guarda un fragmento de los clientes")
+	listaFragmentos := flag.String("fragmentos", "", "fragmentos entre los que repartir los clientes, separados por comas")
+	dirGossip := flag.String("gossip", "", "dirección UDP con la que este nodo entra en el clúster de talleres por gossip")
+	semillasGossip := flag.String("gossip-semillas", "", "nodos del clúster a los que anunciarse al entrar, separados por comas")
+	conRecepcion := flag.Bool("recepcion", false, "lleva una recepción que registra clientes y vehículos sin conexión con el taller")
+	recepcionEscucha := flag.String("recepcion-escucha", "", "dirección en la que atender la sincronización de otras recepciones")
+	dirEventos := flag.String("eventos", "", "dirección HTTP en la que emitir los eventos del taller con Server-Sent Events (GET /eventos)")
+	servidorSMTP := flag.String("smtp", "", "servidor SMTP (host:puerto) por el que enviar los avisos a los clientes")
+	remitenteSMTP := flag.String("smtp-remitente", "taller@localhost", "remitente de los avisos por correo")
+	usuarioSMTP := flag.String("smtp-usuario", "", "usuario del servidor SMTP (la clave se toma de la variable SMTP_CLAVE)")
+	salidaSMS := flag.String("sms-salida", "", "directorio en el que dejar los avisos por SMS para la pasarela")
+	restaurar := flag.String("restaurar", "", "instantánea global de la que recuperar el estado de este nodo (-nodo o -sede)")
+	fusionar := flag.String("fusionar", "", "historiales de varios nodos separados por comas: los combina en orden causal, marca los conflictos y sale")
+	flag.Parse()
+
+	if *fusionar != "" {
+		if err := mostrarHistorialFusionado(strings.Split(*fusionar, ",")); err != nil {
+			fmt.Println("No se pudieron combinar los historiales:", err)
+		}
+		return
+	}
+
+	if *terminalMecanico > 0 {
+		// Terminal simulado: solo envía latidos hasta que se pulsa Intro
+		terminal := NuevoTerminalMecanico(*terminalMecanico, *dirVigilante)
+		if err := terminal.Iniciar(); err != nil {
+			fmt.Println("No se pudo iniciar el terminal:", err)
+			return
+		}
+		fmt.Printf("Terminal del mecánico %d enviando latidos a %s. Pulse Intro para detenerlo.\n", *terminalMecanico, *dirVigilante)
+		fmt.Scanln()
+		terminal.Detener()
+		return
 	}
+
 	app.ClientesTaller = []*Cliente{}
-	app.InicializarPlazas()
+	directorioDatos = *dirDatos
+
+	// Cada nodo ha de estar en su lista de pares
+	for _, p := range []struct {
+		opcion, pares string
+		id            int
+	}{{"raft", *raftPares, *raftID}, {"eleccion", *eleccionPares, *eleccionID}, {"exclusion", *exclusionPares, *exclusionID}} {
+		if p.pares == "" {
+			continue
+		}
+		if _, err := nodoEnPares(p.opcion, p.pares, p.id); err != nil {
+			fmt.Println("Opciones incorrectas:", err)
+			return
+		}
+	}
+
+	// Relojes lógicos, que siguen desde el último evento del historial
+	if *nombreNodo == "" {
+		switch {
+		case *sede != "":
+			*nombreNodo = *sede
+		case *raftPares != "":
+			*nombreNodo, _ = nodoEnPares("raft", *raftPares, *raftID)
+		case *rol == RolRespaldo:
+			*nombreNodo = *escucha
+		case *rol != "":
+			*nombreNodo = *rol
+		case *dirGossip != "":
+			*nombreNodo = *dirGossip
+		case *eleccionPares != "":
+			*nombreNodo, _ = nodoEnPares("eleccion", *eleccionPares, *eleccionID)
+		case *exclusionPares != "":
+			*nombreNodo, _ = nodoEnPares("exclusion", *exclusionPares, *exclusionID)
+		case *dirFragmento != "":
+			*nombreNodo = *dirFragmento
+		case *recepcionEscucha != "":
+			*nombreNodo = *recepcionEscucha
+		default:
+			*nombreNodo = "local"
+		}
+	}
+	relojes = NuevosRelojes(*nombreNodo)
+	relojFisico = NuevoRelojFisico(*desfase)
+	bus = NuevoBusEventos()
+	bus.Reloj = relojFisico
+	if *dirEventos != "" {
+		sse = NuevoServidorEventos(*dirEventos, bus)
+		if err := sse.Escuchar(); err != nil {
+			fmt.Println("No se pudo emitir los eventos:", err)
+			return
+		}
+	}
+	if *horaEscucha != "" || *algSinc != "" {
+		n := NuevoNodoHora(*horaEscucha, relojFisico)
+		n.Relojes = relojes
+		if err := n.Escuchar(); err != nil {
+			fmt.Println("No se pudo atender la sincronización de relojes:", err)
+			return
+		}
+		if *algSinc != "" {
+			if err := n.Iniciar(*algSinc, strings.Split(*horaPares, ",")); err != nil {
+				fmt.Println("No se pudo iniciar la sincronización de relojes:", err)
+				return
+			}
+		}
+		nodoHora = n
+	}
+	if err := os.MkdirAll(*dirDatos, 0755); err != nil {
+		fmt.Println("No se pudo crear el directorio de datos:", err)
+		return
+	}
+	g, err := NuevoGeneradorIDs(*idNodo, filepath.Join(*dirDatos, "ids.json"))
+	if err != nil {
+		fmt.Println("No se pudo iniciar el generador de identificadores:", err)
+		return
+	}
+	// En red, dos nodos con el mismo número darían identificadores repetidos:
+	// el número se pide en el primer arranque y después se recuerda
+	enRed := *sede != "" || *raftPares != "" || *rol != "" || *algExclusion != "" || *algEleccion != "" ||
+		*dirGossip != "" || *dirFragmento != "" || *listaFragmentos != "" || *conRecepcion || *recepcionEscucha != ""
+	if enRed && !g.Fijo() {
+		fmt.Printf("Este nodo forma parte de una red de talleres: indique con -id-nodo un número (0-%d) distinto en cada nodo.\n", MaxNodoID)
+		return
+	}
+	g.Reloj = relojFisico
+	generadorIDs = g
+	h, err := AbrirHistorial(filepath.Join(*dirDatos, "historial.log"), relojes)
+	if err != nil {
+		fmt.Println("No se pudo abrir el historial de eventos:", err)
+		return
+	}
+	historial = h
+
+	if *raftPares != "" {
+		// En Raft el estado se reconstruye desde el log replicado
+		persist, err := NuevaPersistenciaRaft(filepath.Join(*dirDatos, "raft"))
+		if err != nil {
+			fmt.Println("No se pudo abrir la persistencia de Raft:", err)
+			return
+		}
+		nodoRaft = NuevoNodoRaft(*raftID, strings.Split(*raftPares, ","), persist, &app, &mutexTaller)
+		nodoRaft.Relojes = relojes
+		if err := nodoRaft.Iniciar(); err != nil {
+			fmt.Println("No se pudo iniciar el nodo Raft:", err)
+			return
+		}
+	} else {
+		// Recuperar el estado guardado (checkpoint + cola del registro)
+		r, err := AbrirRegistro(*dirDatos, &app)
+		if err != nil {
+			fmt.Println("No se pudo abrir el registro:", err)
+			return
+		}
+		registro = r
+		if err := app.ComprobarConsistencia(); err != nil {
+			fmt.Println("Aviso: estado recuperado inconsistente:", err)
+		}
+	}
+
+	if *restaurar != "" {
+		// El estado del nodo pasa a ser el de la instantánea global, más las
+		// operaciones que iban hacia él
+		ig, err := CargarInstantaneaGlobal(*restaurar)
+		if err != nil {
+			fmt.Println("No se pudo leer la instantánea global:", err)
+			return
+		}
+		mutexTaller.Lock()
+		err = ig.Restaurar(*nombreNodo, importarLocal, aplicarLocal)
+		mutexTaller.Unlock()
+		if err != nil {
+			fmt.Println("No se pudo restaurar la instantánea global:", err)
+			return
+		}
+		fmt.Println(ig.Resumen())
+	}
+
+	if *rol == RolPrimario || *rol == RolRespaldo {
+		replica = NuevoNodoReplica(*rol, *escucha, *dirRespaldo, &app, &mutexTaller)
+		replica.Aplicar = aplicarLocal
+		replica.Importar = importarLocal
+		replica.Relojes = relojes
+		replica.AlPromocionar = func() {
+			fmt.Println("\n[replicación] El primario no responde: este nodo pasa a primario.")
+		}
+		if err := replica.Iniciar(); err != nil {
+			fmt.Println("No se pudo iniciar la replicación:", err)
+			return
+		}
+	}
+
+	if *sedes != "" {
+		r, err := CargarSedes(*sedes, *sede, *dirDatos, &app, &mutexTaller, ejecutar)
+		if err != nil {
+			fmt.Println("No se pudo cargar la red de sedes:", err)
+			return
+		}
+		r.Relojes = relojes
+		if err := r.Escuchar(); err != nil {
+			fmt.Println("No se pudo atender a las demás sedes:", err)
+			return
+		}
+		// Terminar las transferencias que quedaron a medias
+		if err := r.Recuperar(*dirDatos); err != nil {
+			fmt.Println("No se pudo recuperar el registro de transacciones:", err)
+			return
+		}
+		red = r
+
+		if r.Propia.Canal != "" {
+			pares := map[string]string{r.Propia.Nombre: r.Propia.Canal}
+			for _, s := range r.Otras {
+				if s.Canal != "" {
+					pares[s.Nombre] = s.Canal
+				}
+			}
+			n, err := NuevoNodoCL(r.Propia.Nombre, pares, &app, &mutexTaller)
+			if err != nil {
+				fmt.Println("No se pudieron abrir los canales de la instantánea global:", err)
+				return
+			}
+			n.Aplicar = aplicarLocal
+			n.Relojes = relojes
+			if err := n.Escuchar(); err != nil {
+				fmt.Println("No se pudieron abrir los canales de la instantánea global:", err)
+				return
+			}
+			nodoCL = n
+		}
+	}
+
+	if *algExclusion != "" {
+		e, err := NuevaExclusion(*algExclusion, *exclusionID, strings.Split(*exclusionPares, ","), relojes)
+		if err != nil {
+			fmt.Println("No se pudo iniciar la exclusión mutua:", err)
+			return
+		}
+		exclusion = e
+	}
+
+	if *algEleccion != "" {
+		e, err := NuevoNodoEleccion(*algEleccion, *eleccionID, strings.Split(*eleccionPares, ","))
+		if err != nil {
+			fmt.Println("No se pudo iniciar la elección de coordinador:", err)
+			return
+		}
+		e.Relojes = relojes
+		e.AlCambiarCoordinador = func(c int) {
+			fmt.Printf("\n[elección] Nuevo coordinador: nodo %d\n", c)
+		}
+		if err := e.Iniciar(); err != nil {
+			fmt.Println("No se pudo iniciar la elección de coordinador:", err)
+			return
+		}
+		eleccion = e
+	}
+
+	if *dirFragmento != "" {
+		s := NuevoServidorFragmento(*dirFragmento, &app, &mutexTaller, ejecutar)
+		s.Relojes = relojes
+		if err := s.Escuchar(); err != nil {
+			fmt.Println("No se pudo atender como fragmento:", err)
+			return
+		}
+		fragmento = s
+	}
+
+	if *listaFragmentos != "" {
+		e := NuevoEnrutadorFragmentos(strings.Split(*listaFragmentos, ","), 64)
+		e.Relojes = relojes
+		movidos, err := e.Iniciar()
+		if err != nil {
+			fmt.Println("No se pudo consultar los fragmentos:", err)
+			return
+		}
+		if movidos > 0 {
+			fmt.Printf("[fragmentos] %d clientes llevados a su fragmento.\n", movidos)
+		}
+		enrutador = e
+	}
+
+	if *dirVigilante != "" {
+		v, err := NuevoVigilanteTerminales(*dirVigilante, &app, &mutexTaller, ejecutar)
+		if err != nil {
+			fmt.Println("No se pudo iniciar el vigilante de terminales:", err)
+			return
+		}
+		v.Umbral, v.Expiracion = *phiUmbral, *latidoExpiracion
+		v.Relojes = relojes
+		v.AlCambiar = func(id int, accesible bool) {
+			if accesible {
+				fmt.Printf("\n[terminales] El terminal del mecánico %d vuelve a responder.\n", id)
+			} else {
+				fmt.Printf("\n[terminales] El terminal del mecánico %d no responde: sus incidencias vuelven a la cola.\n", id)
+			}
+		}
+		v.Iniciar()
+		vigilante = v
+	}
+
+	if *dirGossip != "" {
+		n, err := NuevoNodoPertenencia(*nombreNodo, *dirGossip, strings.Split(*semillasGossip, ","))
+		if err != nil {
+			fmt.Println("No se pudo entrar en el clúster:", err)
+			return
+		}
+		n.Relojes = relojes
+		n.Metadatos = func() EstadoSede {
+			mutexTaller.Lock()
+			defer mutexTaller.Unlock()
+			return estadoDeTaller(*nombreNodo, &app)
+		}
+		n.AlCambiar = func(m Miembro) {
+			fmt.Printf("\n[clúster] %s (%s) está %s.\n", m.Nombre, m.Direccion, m.Estado)
+		}
+		n.Iniciar()
+		gossip = n
+	}
+
+	if *conRecepcion || *recepcionEscucha != "" {
+		r, err := NuevaRecepcion(*nombreNodo, filepath.Join(*dirDatos, "recepcion.json"))
+		if err != nil {
+			fmt.Println("No se pudo abrir la recepción:", err)
+			return
+		}
+		r.Reloj, r.Relojes = relojFisico, relojes
+		if *recepcionEscucha != "" {
+			if err := r.Escuchar(*recepcionEscucha); err != nil {
+				fmt.Println("No se pudo atender a otras recepciones:", err)
+				return
+			}
+		}
+		recepcion = r
+	}
+
+	if *servidorSMTP != "" || *salidaSMS != "" {
+		var notificadores []Notificador
+		if *servidorSMTP != "" {
+			notificadores = append(notificadores, &NotificadorSMTP{Servidor: *servidorSMTP, Remitente: *remitenteSMTP,
+				Usuario: *usuarioSMTP, Clave: os.Getenv("SMTP_CLAVE")})
+		}
+		if *salidaSMS != "" {
+			notificadores = append(notificadores, &NotificadorSMS{Directorio: *salidaSMS})
+		}
+		avisos = NuevoAvisos(&app, bus, filepath.Join(*dirDatos, "avisos.log"), notificadores...)
+		avisos.Reloj = relojFisico
+		avisos.Iniciar()
+	}
+
+	// Semilla de prueba (solo si no había nada guardado y el nodo no recibe
+	// el estado de otro)
+	if len(app.MecanicosTaller) == 0 && len(app.ClientesTaller) == 0 && *rol != RolRespaldo && nodoRaft == nil {
+		ejecutar(Operacion{Tipo: OpCrearMecanico, IDMecanico: 1, Nombre: "Laura", Especialidad: "mecánica", AniosExperiencia: 3})
+		ejecutar(Operacion{Tipo: OpCrearMecanico, IDMecanico: 2, Nombre: "Pedro", Especialidad: "eléctrica", AniosExperiencia: 5})
+	}
 
 	var opcion int
 	for {
@@ -770,6 +2949,17 @@ func main() {
 		fmt.Println("4. Gestionar mecánicos")
 		fmt.Println("5. Asignar vehículo a plaza")
 		fmt.Println("6. Consultar estado del taller")
+		fmt.Println("7. Estado del nodo (replicación)")
+		fmt.Println("8. Red de talleres")
+		fmt.Println("9. Fragmentos de clientes")
+		fmt.Println("10. Miembros del clúster")
+		fmt.Println("11. Recepción sin conexión")
+		fmt.Println("12. Seguir los eventos del taller")
+		fmt.Println("13. Avisos a clientes")
+		fmt.Println("14. Facturación")
+		fmt.Println("15. Gestionar repuestos")
+		fmt.Println("16. Proveedores y pedidos")
+		fmt.Println("17. Citas")
 		fmt.Println("0. Salir")
 		fmt.Print("Seleccione una opción: ")
 		fmt.Scanln(&opcion)
@@ -787,7 +2977,74 @@ func main() {
 			asignarVehiculoAPlaza()
 		case 6:
 			consultarEstadoTaller()
+		case 7:
+			consultarEstadoNodo()
+		case 8:
+			menuSedes()
+		case 9:
+			menuFragmentos()
+		case 10:
+			listarMiembrosCluster()
+		case 11:
+			menuRecepcion()
+		case 12:
+			seguirEventos()
+		case 13:
+			verAvisos()
+		case 14:
+			menuFacturas()
+		case 15:
+			menuRepuestos()
+		case 16:
+			menuProveedores()
+		case 17:
+			menuCitas()
 		case 0:
+			if replica != nil {
+				replica.Detener()
+			}
+			if nodoRaft != nil {
+				nodoRaft.Detener()
+			}
+			if red != nil {
+				red.Detener()
+			}
+			if nodoCL != nil {
+				nodoCL.Detener()
+			}
+			if exclusion != nil {
+				exclusion.Detener()
+			}
+			if eleccion != nil {
+				eleccion.Detener()
+			}
+			if vigilante != nil {
+				vigilante.Detener()
+			}
+			if nodoHora != nil {
+				nodoHora.Detener()
+			}
+			if fragmento != nil {
+				fragmento.Detener()
+			}
+			if gossip != nil {
+				gossip.Detener()
+			}
+			if recepcion != nil {
+				recepcion.Detener()
+			}
+			if sse != nil {
+				sse.Detener()
+			}
+			if avisos != nil {
+				avisos.Detener()
+			}
+			if registro != nil {
+				if err := registro.Cerrar(&app); err != nil {
+					fmt.Println("Error al cerrar el registro:", err)
+				}
+			}
+			historial.Cerrar()
 			fmt.Println("Saliendo del programa...")
 			return
 		default:
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LatidoTerminal es el datagrama UDP que envía cada terminal de mecánico para
+// indicar que sigue en marcha
+type LatidoTerminal struct {
+	IDMecanico int    `json:"idMecanico"`
+	Seq        uint64 `json:"seq"`
+	Sello
+}
+
+// DetectorPhi calcula la sospecha de caída de un terminal al estilo "phi
+// accrual": a partir de los intervalos entre latidos recientes estima la
+// probabilidad de que el siguiente latido llegue aún más tarde, y devuelve
+// phi = -log10 de esa probabilidad. phi 1 equivale a un 10 % de que el
+// terminal siga vivo, phi 2 a un 1 %, etc.
+type DetectorPhi struct {
+	Ventana          int           // intervalos que se recuerdan
+	DesviacionMinima time.Duration // evita sospechas inmediatas si los latidos son muy regulares
+
+	intervalos []float64 // en milisegundos, los más antiguos primero
+	ultimo     time.Time
+}
+
+// Latido registra un latido recibido en el instante ahora
+func (d *DetectorPhi) Latido(ahora time.Time) {
+	if !d.ultimo.IsZero() {
+		d.intervalos = append(d.intervalos, float64(ahora.Sub(d.ultimo))/float64(time.Millisecond))
+		if len(d.intervalos) > d.Ventana {
+			d.intervalos = d.intervalos[len(d.intervalos)-d.Ventana:]
+		}
+	}
+	d.ultimo = ahora
+}
+
+// Silencio devuelve el tiempo transcurrido desde el último latido
+func (d *DetectorPhi) Silencio(ahora time.Time) time.Duration { return ahora.Sub(d.ultimo) }
+
+// Phi devuelve la sospecha actual; 0 mientras no haya al menos un intervalo
+func (d *DetectorPhi) Phi(ahora time.Time) float64 {
+	if len(d.intervalos) == 0 {
+		return 0
+	}
+	var media, varianza float64
+	for _, x := range d.intervalos {
+		media += x
+	}
+	media /= float64(len(d.intervalos))
+	for _, x := range d.intervalos {
+		varianza += (x - media) * (x - media)
+	}
+	desviacion := math.Sqrt(varianza / float64(len(d.intervalos)))
+	if minima := float64(d.DesviacionMinima) / float64(time.Millisecond); desviacion < minima {
+		desviacion = minima
+	}
+	transcurrido := float64(d.Silencio(ahora)) / float64(time.Millisecond)
+	// Probabilidad de que un intervalo normal(media, desviacion) supere lo
+	// transcurrido
+	masTarde := 0.5 * math.Erfc((transcurrido-media)/(desviacion*math.Sqrt2))
+	return -math.Log10(masTarde)
+}
+
+// VigilanteTerminales recibe los latidos de los terminales de los mecánicos y
+// marca como inaccesible al mecánico cuyo terminal deja de enviarlos: cuando
+// su phi supera Umbral o lleva más de Expiracion en silencio. Al volver a
+// recibir latidos lo marca de nuevo como accesible. Solo se vigilan los
+// terminales de los que ha llegado algún latido.
+type VigilanteTerminales struct {
+	Umbral           float64       // phi a partir del cual se sospecha del terminal
+	Expiracion       time.Duration // silencio tras el que se sospecha aunque phi no llegue al umbral
+	Comprobacion     time.Duration // cada cuánto se revisan los terminales
+	Ventana          int           // intervalos que recuerda cada detector
+	DesviacionMinima time.Duration
+	// AlCambiar se llama (si no es nil) tras marcar o desmarcar a un mecánico
+	AlCambiar func(idMecanico int, accesible bool)
+	// Relojes lógicos que reciben las marcas de los latidos (nil = sin marcas)
+	Relojes *Relojes
+
+	taller   *Taller
+	cerrojo  *sync.Mutex
+	ejecutar func(op Operacion) error
+	conn     *net.UDPConn
+	parar    chan struct{}
+
+	mu         sync.Mutex
+	terminales map[int]*DetectorPhi
+}
+
+// EstadoTerminal resume lo que el vigilante sabe de un terminal
+type EstadoTerminal struct {
+	IDMecanico int
+	Phi        float64
+	Silencio   time.Duration
+	Sospechoso bool
+}
+
+// NuevoVigilanteTerminales crea un vigilante que escucha latidos en la
+// dirección UDP indicada y marca a los mecánicos del taller t (protegido por
+// cerrojo) mediante ejecutar
+func NuevoVigilanteTerminales(direccion string, t *Taller, cerrojo *sync.Mutex, ejecutar func(op Operacion) error) (*VigilanteTerminales, error) {
+	dir, err := net.ResolveUDPAddr("udp", direccion)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", dir)
+	if err != nil {
+		return nil, err
+	}
+	return &VigilanteTerminales{
+		Umbral:           8,
+		Expiracion:       3 * time.Second,
+		Comprobacion:     200 * time.Millisecond,
+		Ventana:          100,
+		DesviacionMinima: 100 * time.Millisecond,
+		taller:           t,
+		cerrojo:          cerrojo,
+		ejecutar:         ejecutar,
+		conn:             conn,
+		parar:            make(chan struct{}),
+		terminales:       map[int]*DetectorPhi{},
+	}, nil
+}
+
+// Iniciar arranca la recepción de latidos y la revisión periódica
+func (v *VigilanteTerminales) Iniciar() {
+	go v.recibir()
+	go v.vigilar()
+}
+
+// Detener deja de recibir latidos y de revisar los terminales
+func (v *VigilanteTerminales) Detener() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	select {
+	case <-v.parar:
+		return
+	default:
+	}
+	close(v.parar)
+	v.conn.Close()
+}
+
+// Terminales devuelve el estado de los terminales vigilados, por ID
+func (v *VigilanteTerminales) Terminales() []EstadoTerminal {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	ahora := time.Now()
+	var out []EstadoTerminal
+	for id, d := range v.terminales {
+		out = append(out, EstadoTerminal{IDMecanico: id, Phi: d.Phi(ahora), Silencio: d.Silencio(ahora),
+			Sospechoso: v.sospechoso(d, ahora)})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].IDMecanico < out[j].IDMecanico })
+	return out
+}
+
+// Estado resume los terminales para mostrarlo por consola
+func (v *VigilanteTerminales) Estado() string {
+	terminales := v.Terminales()
+	if len(terminales) == 0 {
+		return "Sin latidos de ningún terminal"
+	}
+	partes := make([]string, len(terminales))
+	for i, e := range terminales {
+		estado := "ok"
+		if e.Sospechoso {
+			estado = "caído"
+		}
+		partes[i] = fmt.Sprintf("mecánico %d: phi=%.1f, silencio %v, %s",
+			e.IDMecanico, e.Phi, e.Silencio.Round(time.Millisecond), estado)
+	}
+	return strings.Join(partes, " | ")
+}
+
+// sospechoso se llama con v.mu tomado
+func (v *VigilanteTerminales) sospechoso(d *DetectorPhi, ahora time.Time) bool {
+	return d.Phi(ahora) > v.Umbral || d.Silencio(ahora) > v.Expiracion
+}
+
+func (v *VigilanteTerminales) recibir() {
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := v.conn.ReadFromUDP(buf)
+		if err != nil {
+			return // conexión cerrada: vigilante detenido
+		}
+		var l LatidoTerminal
+		if json.Unmarshal(buf[:n], &l) != nil {
+			continue
+		}
+		l.Recibido(v.Relojes)
+		v.mu.Lock()
+		d := v.terminales[l.IDMecanico]
+		if d == nil {
+			d = &DetectorPhi{Ventana: v.Ventana, DesviacionMinima: v.DesviacionMinima}
+			v.terminales[l.IDMecanico] = d
+		}
+		d.Latido(time.Now())
+		v.mu.Unlock()
+	}
+}
+
+// vigilar compara cada Comprobacion la sospecha de cada terminal con el
+// estado de su mecánico y ejecuta la operación que los iguala. Como se parte
+// del estado del taller, un fallo al ejecutar se reintenta en la siguiente
+// revisión y un reinicio del vigilante no deja mecánicos marcados de más.
+func (v *VigilanteTerminales) vigilar() {
+	tick := time.NewTicker(v.Comprobacion)
+	defer tick.Stop()
+	for {
+		select {
+		case <-v.parar:
+			return
+		case <-tick.C:
+		}
+		ahora := time.Now()
+		sospechas := map[int]bool{}
+		v.mu.Lock()
+		for id, d := range v.terminales {
+			sospechas[id] = v.sospechoso(d, ahora)
+		}
+		v.mu.Unlock()
+
+		var ops []Operacion
+		v.cerrojo.Lock()
+		for id, sospecha := range sospechas {
+			m, _ := v.taller.BuscarMecanico(id)
+			if m == nil || m.Inaccesible == sospecha {
+				continue
+			}
+			tipo := OpMecanicoAccesible
+			if sospecha {
+				tipo = OpMecanicoInaccesible
+			}
+			ops = append(ops, Operacion{Tipo: tipo, IDMecanico: id})
+		}
+		v.cerrojo.Unlock()
+
+		// ejecutar toma el cerrojo del taller por su cuenta
+		sort.Slice(ops, func(i, j int) bool { return ops[i].IDMecanico < ops[j].IDMecanico })
+		for _, op := range ops {
+			if v.ejecutar(op) == nil && v.AlCambiar != nil {
+				v.AlCambiar(op.IDMecanico, op.Tipo == OpMecanicoAccesible)
+			}
+		}
+	}
+}
+
+// TerminalMecanico simula el terminal remoto de un mecánico: envía un latido
+// al vigilante cada Latido hasta que se detiene
+type TerminalMecanico struct {
+	IDMecanico int
+	Latido     time.Duration
+	// Relojes lógicos con los que se marcan los latidos (nil = sin marcas)
+	Relojes *Relojes
+
+	vigilante string
+	parar     chan struct{}
+	mu        sync.Mutex
+}
+
+// NuevoTerminalMecanico crea el terminal del mecánico id que informa al
+// vigilante en la dirección UDP indicada
+func NuevoTerminalMecanico(id int, vigilante string) *TerminalMecanico {
+	return &TerminalMecanico{
+		IDMecanico: id,
+		Latido:     500 * time.Millisecond,
+		vigilante:  vigilante,
+		parar:      make(chan struct{}),
+	}
+}
+
+// Iniciar empieza a enviar latidos
+func (t *TerminalMecanico) Iniciar() error {
+	conn, err := net.Dial("udp", t.vigilante)
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer conn.Close()
+		tick := time.NewTicker(t.Latido)
+		defer tick.Stop()
+		for seq := uint64(1); ; seq++ {
+			l := LatidoTerminal{IDMecanico: t.IDMecanico, Seq: seq}
+			l.Sellar(t.Relojes)
+			if datos, err := json.Marshal(l); err == nil {
+				// Un datagrama perdido es solo un latido que no llega
+				conn.Write(datos)
+			}
+			select {
+			case <-t.parar:
+				return
+			case <-tick.C:
+			}
+		}
+	}()
+	return nil
+}
+
+// Detener deja de enviar latidos, como si el terminal se cayera
+func (t *TerminalMecanico) Detener() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	select {
+	case <-t.parar:
+		return
+	default:
+	}
+	close(t.parar)
+}
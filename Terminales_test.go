@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestTerminalesCaidos monta un taller con tres mecánicos y sus terminales,
+// deja caer los terminales uno a uno y comprueba que las incidencias vuelven
+// a la cola y que las plazas pasan a otro mecánico o se liberan
+func TestTerminalesCaidos(t *testing.T) {
+	tl, cerrojo := &Taller{}, &sync.Mutex{}
+	aplicar := func(op Operacion) error {
+		cerrojo.Lock()
+		defer cerrojo.Unlock()
+		return tl.Aplicar(op)
+	}
+	semilla := []Operacion{
+		{Tipo: OpCrearMecanico, IDMecanico: 1, Nombre: "Laura", Especialidad: "mecánica"},
+		{Tipo: OpCrearMecanico, IDMecanico: 2, Nombre: "Pedro", Especialidad: "eléctrica"},
+		{Tipo: OpCrearMecanico, IDMecanico: 3, Nombre: "Ana", Especialidad: "mecánica"},
+		{Tipo: OpCrearCliente, IDCliente: 1, Nombre: "Marta"},
+		{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "1111AAA"},
+		{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "2222BBB"},
+		{Tipo: OpCrearIncidencia, Matricula: "1111AAA", IDIncidencia: 1, TipoIncidencia: "mecánica", Prioridad: "alta"},
+		{Tipo: OpCrearIncidencia, Matricula: "2222BBB", IDIncidencia: 2, TipoIncidencia: "mecánica", Prioridad: "baja"},
+		{Tipo: OpAsignarPlaza, IDCliente: 1, Matricula: "1111AAA", IDMecanico: 1, IDPlaza: 1},
+		{Tipo: OpAsignarPlaza, IDCliente: 1, Matricula: "2222BBB", IDMecanico: 1, IDPlaza: 2},
+		{Tipo: OpPresupuestar, Matricula: "1111AAA", Presupuesto: presupuestoDePrueba()},
+		{Tipo: OpPresupuestar, Matricula: "2222BBB", Presupuesto: presupuestoDePrueba()},
+		{Tipo: OpResponderPresupuesto, Matricula: "1111AAA", Estado: PresupuestoAceptado},
+		{Tipo: OpResponderPresupuesto, Matricula: "2222BBB", Estado: PresupuestoAceptado},
+		{Tipo: OpEstadoIncidencia, Matricula: "1111AAA", Estado: "en proceso"},
+		{Tipo: OpEstadoIncidencia, Matricula: "2222BBB", Estado: "en proceso"},
+	}
+	for _, op := range semilla {
+		if err := aplicar(op); err != nil {
+			t.Fatalf("%s: %v", op.Tipo, err)
+		}
+	}
+
+	direccion := "localhost:9601"
+	v, err := NuevoVigilanteTerminales(direccion, tl, cerrojo, aplicar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.Umbral, v.Expiracion, v.Comprobacion = 8, time.Second, 50*time.Millisecond
+	v.DesviacionMinima = 20 * time.Millisecond
+	v.Iniciar()
+	defer v.Detener()
+
+	terminales := map[int]*TerminalMecanico{}
+	arrancar := func(id int) error {
+		terminal := NuevoTerminalMecanico(id, direccion)
+		terminal.Latido = 50 * time.Millisecond
+		terminales[id] = terminal
+		return terminal.Iniciar()
+	}
+	for id := 1; id <= 3; id++ {
+		if err := arrancar(id); err != nil {
+			t.Fatal(err)
+		}
+		defer func(id int) { terminales[id].Detener() }(id)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	// plazas devuelve el mecánico de las plazas 1 y 2 (0 = libre)
+	plazas := func() [2]int {
+		cerrojo.Lock()
+		defer cerrojo.Unlock()
+		var out [2]int
+		for i := range out {
+			if p := tl.BuscarPlaza(i + 1); p.GetMecanico() != nil {
+				out[i] = p.GetMecanico().IDMecanico
+			}
+		}
+		return out
+	}
+	esperarPlazas := func(id int, inaccesible bool, esperadas [2]int) error {
+		limite := time.Now().Add(5 * time.Second)
+		for time.Now().Before(limite) {
+			cerrojo.Lock()
+			m, _ := tl.BuscarMecanico(id)
+			listo := m.Inaccesible == inaccesible
+			cerrojo.Unlock()
+			if listo && plazas() == esperadas {
+				return nil
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		return fmt.Errorf("mecánico %d: se esperaban las plazas con %v y hay %v (%s)", id, esperadas, plazas(), v.Estado())
+	}
+
+	// Cae el terminal de Laura: sus plazas pasan a Ana, de su especialidad,
+	// y sus incidencias en proceso vuelven a estar abiertas y sin mecánico
+	terminales[1].Detener()
+	if err := esperarPlazas(1, true, [2]int{3, 3}); err != nil {
+		t.Fatal(err)
+	}
+	cerrojo.Lock()
+	for _, matricula := range []string{"1111AAA", "2222BBB"} {
+		_, veh := tl.BuscarVehiculo(matricula)
+		if inc := veh.GetIncidencia(); inc.GetEstado() != "abierta" || len(inc.GetMecanicos()) != 0 {
+			t.Errorf("la incidencia de %s sigue %q con %d mecánicos", matricula, inc.GetEstado(), len(inc.GetMecanicos()))
+		}
+	}
+	cerrojo.Unlock()
+
+	// Cae el de Ana: las plazas pasan a Pedro, el único disponible
+	terminales[3].Detener()
+	if err := esperarPlazas(3, true, [2]int{2, 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cae el de Pedro: no queda nadie y las plazas se liberan
+	terminales[2].Detener()
+	if err := esperarPlazas(2, true, [2]int{0, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Vuelve el terminal de Laura y queda de nuevo disponible
+	if err := arrancar(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := esperarPlazas(1, false, [2]int{0, 0}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	_ "time/tzdata" // por si la máquina no tiene las zonas instaladas
+)
+
+// ZonaHorariaTaller es la zona horaria en la que se leen los turnos, las
+// citas y las jornadas. Las horas de las operaciones van en UTC; la zona es
+// fija, y no la local de cada máquina, para que todas las réplicas decidan
+// igual quién está de turno y en qué día cae cada hora.
+const ZonaHorariaTaller = "Europe/Madrid"
+
+// ZonaTaller es ZonaHorariaTaller ya cargada
+var ZonaTaller = cargarZona(ZonaHorariaTaller)
+
+// cargarZona carga una zona horaria por su nombre. Con time/tzdata no puede
+// faltar; si el nombre estuviera mal, el nodo no debe arrancar.
+func cargarZona(nombre string) *time.Location {
+	zona, err := time.LoadLocation(nombre)
+	if err != nil {
+		panic(fmt.Sprintf("zona horaria %q: %v", nombre, err))
+	}
+	return zona
+}
+
+// Tipos de ausencia
+const (
+	AusenciaVacaciones = "vacaciones"
+	AusenciaBaja       = "baja" // por enfermedad
+	AusenciaLibre      = "libre"
+)
+
+// Turno es la jornada de un mecánico un día de la semana, de Inicio a Fin
+// ("08:00"-"15:00"). No hay turnos que pasen de medianoche.
+type Turno struct {
+	Dia    time.Weekday `json:"dia"`
+	Inicio string       `json:"inicio"`
+	Fin    string       `json:"fin"`
+}
+
+// Ausencia son unos días, de Desde a Hasta (AAAA-MM-DD, ambos incluidos), en
+// los que el mecánico no trabaja aunque le toque turno
+type Ausencia struct {
+	Tipo   string `json:"tipo"`
+	Desde  string `json:"desde"`
+	Hasta  string `json:"hasta"`
+	Motivo string `json:"motivo,omitempty"`
+}
+
+var letrasDias = []string{"D", "L", "M", "X", "J", "V", "S"}
+
+func (tu Turno) String() string {
+	return fmt.Sprintf("%s %s-%s", letrasDias[tu.Dia], tu.Inicio, tu.Fin)
+}
+
+// LeerTurnos interpreta una lista como "L-V 08:00-15:00, S 09:00-13:00"
+func LeerTurnos(texto string) ([]Turno, error) {
+	var turnos []Turno
+	for _, parte := range strings.Split(texto, ",") {
+		campos := strings.Fields(parte)
+		if len(campos) == 0 {
+			continue
+		}
+		if len(campos) != 2 {
+			return nil, fmt.Errorf("turno no válido: %q", strings.TrimSpace(parte))
+		}
+		inicio, fin, _ := strings.Cut(campos[1], "-")
+		dias, err := leerDias(campos[0])
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range dias {
+			turnos = append(turnos, Turno{Dia: d, Inicio: inicio, Fin: fin})
+		}
+	}
+	return turnos, comprobarTurnos(turnos)
+}
+
+// leerDias interpreta "L", "L-V" o "LMX"
+func leerDias(texto string) ([]time.Weekday, error) {
+	indice := func(letra string) (time.Weekday, error) {
+		for i, l := range letrasDias {
+			if strings.EqualFold(l, letra) {
+				return time.Weekday(i), nil
+			}
+		}
+		return 0, fmt.Errorf("día no válido: %q (use L M X J V S D)", letra)
+	}
+	if desde, hasta, ok := strings.Cut(texto, "-"); ok {
+		a, err := indice(desde)
+		if err != nil {
+			return nil, err
+		}
+		b, err := indice(hasta)
+		if err != nil {
+			return nil, err
+		}
+		// La semana empieza en lunes: L-D incluye el domingo
+		var dias []time.Weekday
+		for d := a; ; d = (d + 1) % 7 {
+			dias = append(dias, d)
+			if d == b {
+				return dias, nil
+			}
+		}
+	}
+	var dias []time.Weekday
+	for _, r := range texto {
+		d, err := indice(string(r))
+		if err != nil {
+			return nil, err
+		}
+		dias = append(dias, d)
+	}
+	return dias, nil
+}
+
+func horaValida(h string) bool {
+	_, err := time.Parse("15:04", h)
+	return err == nil && len(h) == 5
+}
+
+func comprobarTurnos(turnos []Turno) error {
+	for _, tu := range turnos {
+		if tu.Dia < time.Sunday || tu.Dia > time.Saturday {
+			return fmt.Errorf("día de la semana no válido: %d", tu.Dia)
+		}
+		if !horaValida(tu.Inicio) || !horaValida(tu.Fin) || tu.Fin <= tu.Inicio {
+			return fmt.Errorf("horario no válido: %s-%s", tu.Inicio, tu.Fin)
+		}
+	}
+	return nil
+}
+
+func comprobarAusencia(a Ausencia) error {
+	if a.Tipo != AusenciaVacaciones && a.Tipo != AusenciaBaja && a.Tipo != AusenciaLibre {
+		return fmt.Errorf("tipo de ausencia no válido: %q", a.Tipo)
+	}
+	desde, err1 := time.Parse("2006-01-02", a.Desde)
+	hasta, err2 := time.Parse("2006-01-02", a.Hasta)
+	if err1 != nil || err2 != nil || hasta.Before(desde) {
+		return fmt.Errorf("fechas no válidas: %s a %s", a.Desde, a.Hasta)
+	}
+	return nil
+}
+
+// AusenciaEl devuelve la ausencia del mecánico ese día (nil si no falta)
+func (m *Mecanico) AusenciaEl(dia string) *Ausencia {
+	for i, a := range m.Ausencias {
+		if a.Desde <= dia && dia <= a.Hasta {
+			return &m.Ausencias[i]
+		}
+	}
+	return nil
+}
+
+// TurnoEl devuelve el turno del mecánico en ese día de la semana (nil si
+// libra). Sin turnos definidos se considera que trabaja a cualquier hora.
+func (m *Mecanico) TurnoEl(d time.Weekday) *Turno {
+	for i, tu := range m.Turnos {
+		if tu.Dia == d {
+			return &m.Turnos[i]
+		}
+	}
+	return nil
+}
+
+// TrabajaEl indica si al mecánico le toca trabajar ese día (AAAA-MM-DD) a
+// esa hora (HH:MM), según sus turnos y ausencias
+func (m *Mecanico) TrabajaEl(dia, hora string) bool {
+	fecha, err := time.Parse("2006-01-02", dia)
+	if err != nil || m.AusenciaEl(dia) != nil {
+		return false
+	}
+	if len(m.Turnos) == 0 {
+		return true
+	}
+	for _, tu := range m.Turnos {
+		if tu.Dia == fecha.Weekday() && tu.Inicio <= hora && hora < tu.Fin {
+			return true
+		}
+	}
+	return false
+}
+
+// DisponibleEn indica si el mecánico puede atender un vehículo en ese
+// momento (una hora de FormatoFecha): activo, accesible y de turno. Sin
+// hora solo se mira lo primero.
+func (m *Mecanico) DisponibleEn(fecha string) bool {
+	if !m.Disponible() {
+		return false
+	}
+	momento, err := time.Parse(FormatoFecha, fecha)
+	if err != nil {
+		return true
+	}
+	momento = momento.In(ZonaTaller)
+	return m.TrabajaEl(momento.Format("2006-01-02"), momento.Format("15:04"))
+}
+
+// horarioMecanico aplica OpHorarioMecanico: sustituye la jornada semanal
+// del mecánico (una lista vacía quita el horario)
+func (t *Taller) horarioMecanico(op Operacion) error {
+	m, _ := t.BuscarMecanico(op.IDMecanico)
+	if m == nil {
+		return errors.New("no existe ese mecánico")
+	}
+	if err := comprobarTurnos(op.Turnos); err != nil {
+		return err
+	}
+	vistos := map[time.Weekday]bool{}
+	for _, tu := range op.Turnos {
+		if vistos[tu.Dia] {
+			return fmt.Errorf("hay dos turnos el mismo día (%s)", letrasDias[tu.Dia])
+		}
+		vistos[tu.Dia] = true
+	}
+	m.Turnos = append([]Turno(nil), op.Turnos...)
+	sort.Slice(m.Turnos, func(i, j int) bool { return m.Turnos[i].Dia < m.Turnos[j].Dia })
+	return nil
+}
+
+// ausenciaMecanico aplica OpAusenciaMecanico: añade unas vacaciones, una
+// baja o un día libre que no se solape con otra ausencia
+func (t *Taller) ausenciaMecanico(op Operacion) error {
+	m, _ := t.BuscarMecanico(op.IDMecanico)
+	if m == nil {
+		return errors.New("no existe ese mecánico")
+	}
+	if op.Ausencia == nil {
+		return errors.New("falta la ausencia")
+	}
+	a := *op.Ausencia
+	if err := comprobarAusencia(a); err != nil {
+		return err
+	}
+	for _, otra := range m.Ausencias {
+		if otra.Desde <= a.Hasta && a.Desde <= otra.Hasta {
+			return fmt.Errorf("se solapa con %s del %s al %s", otra.Tipo, otra.Desde, otra.Hasta)
+		}
+	}
+	ausencias := append(append([]Ausencia(nil), m.Ausencias...), a)
+	sort.Slice(ausencias, func(i, j int) bool { return ausencias[i].Desde < ausencias[j].Desde })
+	m.Ausencias = ausencias
+	return nil
+}
+
+// quitarAusencia aplica OpQuitarAusencia: anula la ausencia de ese tipo que
+// empieza ese día
+func (t *Taller) quitarAusencia(op Operacion) error {
+	m, _ := t.BuscarMecanico(op.IDMecanico)
+	if m == nil {
+		return errors.New("no existe ese mecánico")
+	}
+	if op.Ausencia == nil {
+		return errors.New("falta la ausencia")
+	}
+	var quedan []Ausencia
+	for _, a := range m.Ausencias {
+		if a.Tipo != op.Ausencia.Tipo || a.Desde != op.Ausencia.Desde {
+			quedan = append(quedan, a)
+		}
+	}
+	if len(quedan) == len(m.Ausencias) {
+		return errors.New("el mecánico no tiene esa ausencia")
+	}
+	m.Ausencias = quedan
+	return nil
+}
+
+// CUADRANTE
+
+// FilaCuadrante es la semana de un mecánico: por cada día, de lunes a
+// domingo, su turno, su ausencia o "libre"
+type FilaCuadrante struct {
+	IDMecanico int
+	Nombre     string
+	Dias       [7]string
+}
+
+// Cuadrante devuelve la semana que empieza el lunes de la fecha indicada
+// (AAAA-MM-DD) para cada mecánico, y los días de esa semana
+func (t *Taller) Cuadrante(fecha string) ([]FilaCuadrante, [7]string, error) {
+	var dias [7]string
+	f, err := time.Parse("2006-01-02", fecha)
+	if err != nil {
+		return nil, dias, fmt.Errorf("fecha no válida: %q", fecha)
+	}
+	lunes := f.AddDate(0, 0, -((int(f.Weekday()) + 6) % 7))
+	for i := range dias {
+		dias[i] = lunes.AddDate(0, 0, i).Format("2006-01-02")
+	}
+	var filas []FilaCuadrante
+	for _, m := range t.MecanicosTaller {
+		fila := FilaCuadrante{IDMecanico: m.IDMecanico, Nombre: m.Nombre}
+		for i, dia := range dias {
+			d := lunes.AddDate(0, 0, i).Weekday()
+			switch a, tu := m.AusenciaEl(dia), m.TurnoEl(d); {
+			case !m.Activo:
+				fila.Dias[i] = "de baja"
+			case a != nil:
+				fila.Dias[i] = a.Tipo
+			case len(m.Turnos) == 0:
+				fila.Dias[i] = "sin horario"
+			case tu == nil:
+				fila.Dias[i] = "libre"
+			default:
+				fila.Dias[i] = tu.Inicio + "-" + tu.Fin
+			}
+		}
+		filas = append(filas, fila)
+	}
+	return filas, dias, nil
+}
+
+// TextoCuadrante devuelve el cuadrante como una tabla de texto
+func TextoCuadrante(filas []FilaCuadrante, dias [7]string) string {
+	var b strings.Builder
+	b.WriteString(ajustar("Mecánico", 16, false))
+	for i, dia := range dias {
+		b.WriteString(ajustar(letrasDias[(i+1)%7]+" "+dia[8:], 13, true))
+	}
+	b.WriteString("\n")
+	for _, f := range filas {
+		b.WriteString(ajustar(fmt.Sprintf("%d %s", f.IDMecanico, f.Nombre), 16, false))
+		for _, celda := range f.Dias {
+			b.WriteString(ajustar(celda, 13, true))
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
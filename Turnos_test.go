@@ -0,0 +1,150 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestZonaTallerFija comprueba que quién está de turno y en qué día caen las
+// horas fichadas no dependen de la zona local de la máquina: dos réplicas en
+// zonas distintas deciden lo mismo
+func TestZonaTallerFija(t *testing.T) {
+	local := time.Local
+	defer func() { time.Local = local }()
+
+	decidir := func() (bool, []JornadaMecanico) {
+		var tl Taller
+		for _, op := range []Operacion{
+			{Tipo: OpCrearMecanico, IDMecanico: 1, Nombre: "Laura", Especialidad: "mecánica"},
+			{Tipo: OpHorarioMecanico, IDMecanico: 1, Turnos: []Turno{{Dia: time.Wednesday, Inicio: "08:00", Fin: "15:00"}}},
+			{Tipo: OpCrearCliente, IDCliente: 1, Nombre: "Ana"},
+			{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "1111AAA"},
+			{Tipo: OpCrearIncidencia, Matricula: "1111AAA", IDIncidencia: 1},
+		} {
+			if err := tl.Aplicar(op); err != nil {
+				t.Fatalf("%s: %v", op.Tipo, err)
+			}
+		}
+		tl.InicializarPlazas()
+		// Las 8:30 del miércoles en el taller, en verano UTC+2
+		disponible := tl.MecanicosTaller[0].DisponibleEn("2026-07-29T06:30:00.000Z")
+		// Una sesión de 23:00 a 01:00 en el taller se reparte entre dos días
+		tl.Sesiones = []SesionTrabajo{{IDMecanico: 1, Inicio: "2026-07-29T21:00:00.000Z", Fin: "2026-07-29T23:00:00.000Z"}}
+		return disponible, tl.Jornadas("", "", time.Now())
+	}
+	for _, zona := range []string{"UTC", "America/New_York", "Asia/Tokyo"} {
+		z, err := time.LoadLocation(zona)
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Local = z
+		disponible, jornadas := decidir()
+		if !disponible {
+			t.Errorf("%s: Laura no está de turno a las 8:30 del taller", zona)
+		}
+		if len(jornadas) != 2 || jornadas[0].Dia != "2026-07-29" || jornadas[1].Dia != "2026-07-30" ||
+			jornadas[0].Horas != 1 || jornadas[1].Horas != 1 {
+			t.Errorf("%s: jornadas %+v", zona, jornadas)
+		}
+	}
+}
+
+// TestTurnos da turnos y ausencias a dos mecánicos y comprueba quién está
+// de turno en cada momento, que las citas solo caben cuando hay mecánicos
+// trabajando, que al llegar se asigna al que está de turno, que no se le
+// asigna una plaza a quien está de vacaciones y el cuadrante de la semana
+func TestTurnos(t *testing.T) {
+	var tl Taller
+	tl.Aplicar(Operacion{Tipo: OpCrearMecanico, IDMecanico: 1, Nombre: "Laura", Especialidad: "mecánica"})
+	tl.Aplicar(Operacion{Tipo: OpCrearMecanico, IDMecanico: 2, Nombre: "Pedro", Especialidad: "mecánica"})
+	manana, err := LeerTurnos("L-V 08:00-15:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarde, err := LeerTurnos("L-J 15:00-20:00, S 09:00-13:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LeerTurnos("L 15:00-08:00"); err == nil {
+		t.Fatal("se ha aceptado un turno que acaba antes de empezar")
+	}
+	ops := []Operacion{
+		{Tipo: OpHorarioMecanico, IDMecanico: 1, Turnos: manana},
+		{Tipo: OpHorarioMecanico, IDMecanico: 2, Turnos: tarde},
+		// El lunes 3 de agosto de 2026 Laura está de vacaciones toda la semana
+		{Tipo: OpAusenciaMecanico, IDMecanico: 1, Ausencia: &Ausencia{Tipo: AusenciaVacaciones, Desde: "2026-08-03", Hasta: "2026-08-09"}},
+		{Tipo: OpAusenciaMecanico, IDMecanico: 2, Ausencia: &Ausencia{Tipo: AusenciaBaja, Desde: "2026-07-29", Hasta: "2026-07-29"}},
+		{Tipo: OpCrearCliente, IDCliente: 1, Nombre: "Ana"},
+		{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "1111AAA"},
+		{Tipo: OpCrearVehiculo, IDCliente: 1, Matricula: "2222BBB"},
+		{Tipo: OpCrearIncidencia, Matricula: "1111AAA", IDIncidencia: 1},
+	}
+	for _, op := range ops {
+		if err := tl.Aplicar(op); err != nil {
+			t.Fatalf("%s: %v", op.Tipo, err)
+		}
+	}
+	if err := tl.Aplicar(Operacion{Tipo: OpAusenciaMecanico, IDMecanico: 2,
+		Ausencia: &Ausencia{Tipo: AusenciaLibre, Desde: "2026-08-05", Hasta: "2026-08-04"}}); err == nil {
+		t.Fatal("se ha aceptado una ausencia que acaba antes de empezar")
+	}
+	en := func(dia, hora string) string {
+		f, _ := time.ParseInLocation("2006-01-02 15:04", dia+" "+hora, ZonaTaller)
+		return f.UTC().Format(FormatoFecha)
+	}
+	laura, _ := tl.BuscarMecanico(1)
+	pedro, _ := tl.BuscarMecanico(2)
+	casos := []struct {
+		m          *Mecanico
+		dia, hora  string
+		disponible bool
+	}{
+		{laura, "2026-07-29", "08:00", true},  // miércoles por la mañana
+		{laura, "2026-07-29", "15:00", false}, // a las 15:00 termina
+		{pedro, "2026-07-29", "16:00", false}, // de baja
+		{pedro, "2026-07-30", "16:00", true},
+		{pedro, "2026-07-31", "16:00", false}, // los viernes no trabaja
+		{pedro, "2026-08-01", "10:00", true},  // sábado
+		{laura, "2026-08-04", "10:00", false}, // vacaciones
+	}
+	for _, c := range casos {
+		if c.m.DisponibleEn(en(c.dia, c.hora)) != c.disponible {
+			t.Fatalf("%s el %s a las %s: se esperaba disponible=%v", c.m.Nombre, c.dia, c.hora, c.disponible)
+		}
+	}
+
+	// Citas: el viernes por la tarde no trabaja nadie; el jueves por la tarde, solo Pedro
+	if err := tl.Aplicar(Operacion{Tipo: OpPedirCita, Cita: &Cita{IDCita: 1, Matricula: "1111AAA", Dia: "2026-07-31",
+		Hora: "17:00", Especialidad: "mecánica"}}); err == nil {
+		t.Fatal("se ha dado cita cuando no trabaja nadie")
+	}
+	if h := tl.HuecosFranja("2026-07-30", "17:00", "mecánica"); h != 2 {
+		t.Fatalf("el jueves a las 17:00 hay %d huecos", h)
+	}
+	if err := tl.Aplicar(Operacion{Tipo: OpPedirCita, Cita: &Cita{IDCita: 1, Matricula: "1111AAA", Dia: "2026-07-30",
+		Hora: "17:00", Especialidad: "mecánica"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tl.Aplicar(Operacion{Tipo: OpLlegadaCita, IDCita: 1, Fecha: en("2026-07-30", "17:05")}); err != nil {
+		t.Fatal(err)
+	}
+	if m := tl.BuscarPlaza(tl.BuscarCita(1).IDPlaza).GetMecanico(); m != pedro {
+		t.Fatalf("la cita de la tarde se ha asignado a %s", m.Nombre)
+	}
+	if err := tl.Aplicar(Operacion{Tipo: OpAsignarPlaza, Matricula: "2222BBB", IDMecanico: 1, IDPlaza: 2, Fecha: en("2026-08-04", "10:00")}); err == nil {
+		t.Fatal("se ha asignado una plaza a una mecánica de vacaciones")
+	}
+
+	filas, dias, err := tl.Cuadrante("2026-08-05")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dias[0] != "2026-08-03" || filas[0].Dias[0] != AusenciaVacaciones || filas[1].Dias[0] != "15:00-20:00" ||
+		filas[1].Dias[4] != "libre" || filas[1].Dias[5] != "09:00-13:00" {
+		t.Fatalf("cuadrante inesperado: %v %v", dias, filas)
+	}
+	if !strings.Contains(TextoCuadrante(filas, dias), AusenciaVacaciones) {
+		t.Fatalf("el cuadrante en texto no muestra las vacaciones:\n%s", TextoCuadrante(filas, dias))
+	}
+}